@@ -0,0 +1,214 @@
+package main
+
+// Access log of every request, kept separate from the diagnostic log, which
+// only mentions requests that failed or did something.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLog writes a line per request to a file, in the Common or Combined
+// Log Format, or as JSON.
+type AccessLog struct {
+	Format string // "common", "combined" or "json"
+
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer // nil for stdout
+}
+
+// OpenAccessLog opens the file for appending, creating it if necessary, or
+// writes to stdout if path is "-".
+func OpenAccessLog(path, format string) (*AccessLog, error) {
+	switch format {
+	case "common", "combined", "json":
+	default:
+		return nil, fmt.Errorf("-access-log-format: unknown format %q", format)
+	}
+	if path == "-" {
+		return &AccessLog{Format: format, w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLog{Format: format, w: f, closer: f}, nil
+}
+
+// Close closes the file. Anything written afterwards, by requests that
+// were still being served, is discarded.
+func (a *AccessLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w = io.Discard
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// AccessRecord is a request, and the response it got. The query string isn't
+// recorded, as it may carry secrets, such as handoff tokens.
+type AccessRecord struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Duration   float64   `json:"duration"` // in seconds
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+func (a *AccessLog) Write(rec *AccessRecord) {
+	var line []byte
+	if a.Format == "json" {
+		line, _ = json.Marshal(rec)
+	} else {
+		line = rec.AppendCLF(nil, a.Format == "combined")
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(line); err != nil {
+		slog.Error("Writing access log", "err", err)
+	}
+}
+
+// AppendCLF appends the record in the Common Log Format, followed by the
+// referer and user agent if combined, as Apache's Combined Log Format.
+func (rec *AccessRecord) AppendCLF(b []byte, combined bool) []byte {
+	b = append(b, clfField(rec.RemoteAddr)...)
+	b = append(b, " - "...)
+	b = append(b, clfField(rec.User)...)
+	b = rec.Time.AppendFormat(append(b, " ["...), "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, rec.Method+" "+rec.Path+" "+rec.Proto)
+	b = strconv.AppendInt(append(b, ' '), int64(rec.Status), 10)
+	if rec.Bytes > 0 {
+		b = strconv.AppendInt(append(b, ' '), rec.Bytes, 10)
+	} else {
+		b = append(b, " -"...)
+	}
+	if combined {
+		for _, s := range []string{rec.Referer, rec.UserAgent} {
+			if s == "" {
+				s = "-"
+			}
+			b = strconv.AppendQuote(append(b, ' '), s)
+		}
+	}
+	return b
+}
+
+// clfField is "-" for empty fields, and escapes spaces in the others, such as
+// users named by certificates, so that each stays one field.
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return url.PathEscape(s)
+}
+
+type accessRecordKey struct{}
+
+// LogAccess writes every request to the current site's access log, if it
+// has one. It must be inside ForwardedHeaders and AssignRequestIDs, to log
+// the client's address and the request's ID.
+func LogAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if site.Load().AccessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &AccessRecord{
+			Time:       time.Now(),
+			RemoteAddr: ClientIP(r),
+			Method:     r.Method,
+			Path:       r.URL.EscapedPath(),
+			Proto:      r.Proto,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			RequestID:  RequestID(r),
+		}
+		// WithUser fills in the user, once the request is authenticated:
+		r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec))
+		aw := &accessWriter{ResponseWriter: w, rec: rec}
+		defer func() {
+			if rec.Status == 0 {
+				rec.Status = http.StatusOK
+			}
+			rec.Duration = time.Since(rec.Time).Seconds()
+			// To the file as it is now, if it was reopened meanwhile:
+			if l := site.Load().AccessLog; l != nil {
+				l.Write(rec)
+			}
+		}()
+		next.ServeHTTP(aw, r)
+	})
+}
+
+// setAccessUser records the user in the request's access log record, if it
+// has one.
+func setAccessUser(r *http.Request, user string) {
+	if rec, ok := r.Context().Value(accessRecordKey{}).(*AccessRecord); ok {
+		rec.User = user
+	}
+}
+
+// accessWriter records the status and size of the response.
+type accessWriter struct {
+	http.ResponseWriter
+	rec *AccessRecord
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	// Informational responses, such as 103 Early Hints, precede the final
+	// one:
+	if w.rec.Status == 0 && code >= 200 {
+		w.rec.Status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.rec.Status == 0 {
+		w.rec.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.rec.Bytes += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack is for WebSockets, whose libraries may not look for Unwrap.
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.rec.Status == 0 {
+		w.rec.Status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,144 @@
+package main
+
+// Automatic certificates from Let's Encrypt, or another ACME CA.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// acmeConfig and acmeIssuer are set if -acme-domain is specified. Unlike
+// most settings, they can't be changed by reloading.
+var (
+	acmeConfig *certmagic.Config
+	acmeIssuer *certmagic.ACMEIssuer
+)
+
+// HaveCert reports whether a certificate is configured, either from -cert,
+// obtained with ACME, or self-signed.
+func HaveCert() bool {
+	return *cert > "" || *acmeDomain > "" || *tlsSelfSigned
+}
+
+// SetupACME starts obtaining and renewing certificates for -acme-domain in
+// the background, storing them in -acme-cache.
+func SetupACME(ctx context.Context) error {
+	if *cert > "" {
+		return errors.New("-acme-domain can't be used with -cert")
+	}
+	logger := zap.New(slogCore{})
+	certmagic.Default.Logger = logger
+
+	var cfg *certmagic.Config
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return cfg, nil
+		},
+		Logger: logger,
+	})
+	cfg = certmagic.New(cache, certmagic.Config{
+		Storage: &certmagic.FileStorage{Path: *acmeCache},
+		Logger:  logger,
+	})
+
+	issuer := certmagic.ACMEIssuer{
+		CA:     *acmeCA,
+		Email:  *acmeEmail,
+		Agreed: true,
+		Logger: logger,
+	}
+	if *acmeDNS > "" {
+		p, err := NewDNSProvider(*acmeDNS)
+		if err != nil {
+			return err
+		}
+		issuer.DNS01Solver = &certmagic.DNS01Solver{
+			DNSManager: certmagic.DNSManager{DNSProvider: p, Logger: logger},
+		}
+	}
+	acmeIssuer = certmagic.NewACMEIssuer(cfg, issuer)
+	cfg.Issuers = []certmagic.Issuer{acmeIssuer}
+
+	if err := cfg.ManageAsync(ctx, splitList(*acmeDomain)); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	acmeConfig = cfg
+	return nil
+}
+
+// GetCertificate returns the certificate of the current site, or the one
+// obtained with ACME for the requested server name.
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if acmeConfig != nil {
+		return acmeConfig.GetCertificate(hello)
+	}
+	return site.Load().Cert, nil
+}
+
+// slogCore is a zapcore.Core that writes to slog, so that certmagic logs in
+// the same format as everything else.
+type slogCore struct {
+	fields []zapcore.Field
+}
+
+func (c slogCore) Enabled(level zapcore.Level) bool {
+	return slog.Default().Enabled(context.Background(), slogLevel(level))
+}
+
+func (c slogCore) With(fields []zapcore.Field) zapcore.Core {
+	return slogCore{append(slices.Clip(c.fields), fields...)}
+}
+
+func (c slogCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c slogCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	keys := make([]string, 0, len(enc.Fields))
+	for k := range enc.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var args []any
+	if e.LoggerName != "" {
+		args = append(args, "logger", e.LoggerName)
+	}
+	for _, k := range keys {
+		args = append(args, k, enc.Fields[k])
+	}
+	slog.Log(context.Background(), slogLevel(e.Level), e.Message, args...)
+	return nil
+}
+
+func (c slogCore) Sync() error { return nil }
+
+func slogLevel(level zapcore.Level) slog.Level {
+	switch {
+	case level >= zapcore.ErrorLevel:
+		return slog.LevelError
+	case level >= zapcore.WarnLevel:
+		return slog.LevelWarn
+	case level >= zapcore.InfoLevel:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
@@ -0,0 +1,83 @@
+package main
+
+// systemd socket activation, using the LISTEN_FDS protocol described in
+// sd_listen_fds(3).
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+var ErrNotActivated = errors.New("no sockets passed by systemd")
+
+// ActivatedListener is a socket passed by systemd, named by the socket
+// unit's FileDescriptorName= setting.
+type ActivatedListener struct {
+	Name string
+	net.Listener
+}
+
+// ActivatedListeners returns the sockets passed by systemd. The environment
+// variables are only read once, and are removed so that child processes
+// don't inherit them.
+var ActivatedListeners = sync.OnceValues(func() ([]ActivatedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, ErrNotActivated
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, ErrNotActivated
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var out []ActivatedListener
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		lsn, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s): %w", fd, name, err)
+		}
+		out = append(out, ActivatedListener{name, lsn})
+	}
+	return out, nil
+})
+
+// ActivatedListenersNamed returns the sockets passed by systemd with the
+// given name, or all of them if name is empty.
+func ActivatedListenersNamed(name string) ([]net.Listener, error) {
+	all, err := ActivatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	var out []net.Listener
+	for _, l := range all {
+		if name == "" || l.Name == name {
+			out = append(out, l.Listener)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: none named %q", ErrNotActivated, name)
+	}
+	return out, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+// Secrets kept in a file encrypted with age (https://age-encryption.org),
+// decrypted into memory when the configuration is loaded.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/BurntSushi/toml"
+)
+
+// LoadAgeSecrets decrypts a TOML file of secrets by name, such as
+//
+//	data = "hunter2"
+//	backup = "correct horse battery staple"
+//
+// encrypted with age to a recipient whose identity is read from identity,
+// a file of age identities, as output by age-keygen, or sealed in the TPM,
+// given as tpm:HANDLE?pcrs=..., as for rule secrets.
+func LoadAgeSecrets(path, identity string) (map[string]string, error) {
+	if identity == "" {
+		return nil, errors.New("age: an identity is required to decrypt secrets")
+	}
+	keys, err := ReadKeyFile(identity)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := age.ParseIdentities(bytes.NewReader(keys))
+	if err != nil {
+		return nil, fmt.Errorf("age: %s: %w", identity, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := age.Decrypt(f, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("age: %s: %w", path, err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("age: %s: %w", path, err)
+	}
+	secrets := make(map[string]string)
+	if err := toml.Unmarshal(b, &secrets); err != nil {
+		// Without quoting the contents, which are secret:
+		return nil, fmt.Errorf("age: %s: not a TOML table of strings", path)
+	}
+	return secrets, nil
+}
+
+// ReadKeyFile reads a file of private keys, or keys sealed in the TPM,
+// given as tpm:HANDLE?pcrs=..., as for rule secrets.
+func ReadKeyFile(path string) ([]byte, error) {
+	if handle, ok := strings.CutPrefix(path, "tpm:"); ok {
+		return tpmSecret(context.Background(), handle, Prompt{})
+	}
+	return os.ReadFile(path)
+}
+
+// ageSecret looks up a secret by name, such as age:data, in the current
+// site's -age-secrets.
+func ageSecret(_ context.Context, name string, _ Prompt) ([]byte, error) {
+	secrets := site.Load().AgeSecrets
+	if secrets == nil {
+		return nil, errors.New("age: -age-secrets is not set")
+	}
+	s, ok := secrets[name]
+	if !ok {
+		return nil, fmt.Errorf("age: no secret %q", name)
+	}
+	return []byte(s), nil
+}
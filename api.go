@@ -0,0 +1,286 @@
+package main
+
+// JSON API for automation and non-browser clients.
+//
+// Endpoints:
+//   GET  /api/v1/prompts                -> list of current prompts
+//   POST /api/v1/prompts/{name}/answer  -> answer the named prompt
+//   POST /api/v1/prompts/{name}/cancel  -> cancel the named prompt
+//   POST /api/v1/prompts/{name}/share   -> submit a share of the answer
+//   GET  /api/v1/wait?timeout=30s       -> list of prompts, once there are any
+//   GET  /api/v1/answer-key             -> public key to encrypt answers to
+//   GET  /api/v1/approvals              -> list of answers awaiting approval
+//   POST /api/v1/approvals/{id}/approve -> approve an answer
+//   POST /api/v1/approvals/{id}/reject  -> reject an answer
+//   GET  /api/openapi.json              -> OpenAPI description of the above
+//
+// Everything beneath /api/v1 is stable: fields and endpoints may be added,
+// but not removed or changed incompatibly. Those of a future /api/v2 that
+// replaced them would be given Deprecation and Sunset headers, as /pass is
+// for clients other than the web page, for a year before being removed.
+//
+// GET / gives the same list of prompts as /api/v1/prompts, to clients that
+// accept application/json rather than text/html, or as text to those that
+// accept text/plain.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prompt is the API representation of an Askpass. Fields that are only
+// meaningful to the server (such as the socket path) are not exposed.
+type Prompt struct {
+	Name         string     `json:"name"`
+	Message      string     `json:"message"`
+	Icon         string     `json:"icon,omitempty"`
+	ID           string     `json:"id,omitempty"`
+	AcceptCached bool       `json:"accept_cached,omitempty"`
+	Echo         bool       `json:"echo,omitempty"`
+	Process      *Process   `json:"process,omitempty"`
+	NotAfter     *time.Time `json:"not_after,omitempty"`
+	Retry        bool       `json:"retry,omitempty"` // the last answer appears to have been rejected
+}
+
+func NewPrompt(name string, ap *Askpass) Prompt {
+	p := Prompt{
+		Name:         name,
+		Message:      ap.Message,
+		Icon:         ap.Icon,
+		ID:           ap.ID,
+		AcceptCached: ap.AcceptCached,
+		Echo:         ap.Echo,
+		Retry:        retries.Retried(name),
+	}
+	if !ap.NotAfter.IsZero() {
+		p.NotAfter = &ap.NotAfter
+	}
+	if ap.Process.PID > 0 {
+		p.Process = &ap.Process
+	}
+	return p
+}
+
+// Key identifies what the prompt is asking about, which stays the same when
+// the requester asks again with a new ask file: the ID, or the message if
+// the requester didn't give one.
+func (p Prompt) Key() string {
+	if p.ID > "" {
+		return p.ID
+	}
+	return p.Message
+}
+
+// Prompts returns the API representation of the askers, sorted by name.
+func (a Askers) Prompts() []Prompt {
+	out := make([]Prompt, 0, len(a))
+	for name, ap := range a {
+		out = append(out, NewPrompt(name, ap))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// AnswerRequest is the body accepted by the answer endpoint.
+type AnswerRequest struct {
+	Answer       string `json:"answer"`
+	AnswerBase64 string `json:"answer_base64,omitempty"` // the answer, base64-encoded instead, if it isn't UTF-8
+	Encrypted    string `json:"encrypted,omitempty"`     // the answer, encrypted to -answer-key instead
+	TOTP         string `json:"totp,omitempty"`          // required if TOTP is enabled
+}
+
+// ShareRequest is the body accepted by the share endpoint.
+type ShareRequest struct {
+	Share string `json:"share"`
+	TOTP  string `json:"totp,omitempty"` // required if TOTP is enabled
+}
+
+func ServeAPIPrompts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		APIError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	WriteJSON(w, http.StatusOK, hub.Askers().Filter(ParsePromptFilter(r.URL.Query())).Prompts())
+}
+
+// maxWait limits how long a client can hold a request open for.
+const maxWait = 5 * time.Minute
+
+// ServeAPIWait waits until at least one prompt matching the query parameters
+// exists, or the timeout expires, then responds with the current matching
+// prompts, which may be empty.
+func ServeAPIWait(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		APIError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	timeout := 30 * time.Second
+	if s := r.FormValue("timeout"); s != "" {
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil || timeout < 0 {
+			APIError(w, r, fmt.Sprintf("Invalid timeout: %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	timeout = min(timeout, maxWait)
+	extendWriteDeadline(r, timeout)
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	filter := ParsePromptFilter(r.URL.Query())
+	// Existing prompts are delivered as EventAdded straight away:
+	events, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+wait:
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok || e.Type == EventAdded && filter.Match(e.Prompt) {
+				break wait
+			}
+		case <-t.C:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+	WriteJSON(w, http.StatusOK, hub.Askers().Filter(filter).Prompts())
+}
+
+// ServeAPICancelAll cancels every current prompt, and responds with the
+// names of those cancelled.
+func ServeAPICancelAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		APIError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !MayAnswer(r) {
+		APIError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// As for ServeAPIPrompt, against CSRF:
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		APIError(w, r, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	cancelled, err := CancelAllPrompts(r)
+	if err != nil {
+		APIError(w, r, err.Error(), StatusCode(err))
+		return
+	}
+	WriteJSON(w, http.StatusOK, struct {
+		Cancelled []string `json:"cancelled"`
+	}{cancelled})
+}
+
+// ServeAPIPrompt handles requests beneath /api/v1/prompts/{name}/.
+func ServeAPIPrompt(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/prompts/")
+	name, action, _ := strings.Cut(rest, "/")
+	if name == "" || (action != "answer" && action != "cancel" && action != "share") ||
+		action == "share" && site.Load().Settings.ShamirThreshold < 2 {
+		APIError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		APIError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !MayAnswer(r) {
+		APIError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// Browsers can't send a cross-site request with this content type
+	// without a CORS preflight, so this protects against CSRF:
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		APIError(w, r, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var err error
+	switch action {
+	case "answer":
+		var req AnswerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			APIError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		answer := req.Answer
+		err = CheckTOTP(r, req.TOTP)
+		switch {
+		case err != nil:
+		case req.Encrypted > "":
+			answer, err = DecryptAPIAnswer(req.Encrypted)
+		case req.AnswerBase64 > "":
+			var b []byte
+			if b, err = base64.StdEncoding.DecodeString(req.AnswerBase64); err != nil {
+				err = fmt.Errorf("%w: answer_base64: %v", ErrInvalidAnswer, err)
+			}
+			answer = string(b)
+		}
+		var pending *PendingAnswer
+		if err == nil {
+			pending, err = SubmitAnswer(r, name, answer)
+		}
+		if pending != nil {
+			WriteJSON(w, http.StatusAccepted, pending)
+			return
+		}
+	case "cancel":
+		err = CancelPrompt(r, name)
+	case "share":
+		var req ShareRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			APIError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var share []byte
+		if err = CheckTOTP(r, req.TOTP); err == nil {
+			share, err = ParseShare(req.Share)
+		}
+		var n int
+		if err == nil {
+			n, err = shareCollector.Submit(r, name, share)
+		}
+		if threshold := site.Load().Settings.ShamirThreshold; err == nil && n < threshold {
+			WriteJSON(w, http.StatusAccepted, struct {
+				Shares    int `json:"shares"`
+				Threshold int `json:"threshold"`
+			}{n, threshold})
+			return
+		}
+	}
+	if err != nil {
+		APIError(w, r, err.Error(), StatusCode(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func WriteJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Writing JSON response", "err", err)
+	}
+}
+
+// APIError is like Error, but the response body is JSON.
+func APIError(w http.ResponseWriter, r *http.Request, error string, code int) {
+	LogError(r, error, code)
+	WriteJSON(w, code, struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id,omitempty"`
+	}{error, RequestID(r)})
+}
@@ -0,0 +1,256 @@
+package main
+
+// Answers that another user must approve before they're given to the
+// requester, so that no one person can answer prompts alone.
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnauthenticated = errors.New("approving answers requires users to log in")
+	ErrSelfApproval    = errors.New("answers must be approved by another user")
+)
+
+// PendingAnswer is an answer awaiting approval.
+type PendingAnswer struct {
+	ID        string    `json:"id"`
+	Prompt    string    `json:"prompt"` // name
+	Message   string    `json:"message"`
+	User      string    `json:"user"` // who submitted it
+	Submitted time.Time `json:"submitted"`
+	Expires   time.Time `json:"expires"`
+
+	answer string
+}
+
+// Approvals holds answers until they're approved.
+type Approvals struct {
+	mu      sync.Mutex
+	pending map[string]*PendingAnswer // by ID
+}
+
+var approvals = &Approvals{pending: make(map[string]*PendingAnswer)}
+
+// SubmitAnswer answers the named prompt on behalf of the request, or with
+// -require-approval, holds the answer until another user approves it.
+func SubmitAnswer(r *http.Request, name, answer string) (*PendingAnswer, error) {
+	if !site.Load().Settings.RequireApproval {
+		return nil, AnswerPrompt(r, name, answer)
+	}
+	return approvals.Submit(r, name, answer)
+}
+
+// prune forgets answers that have expired, or whose prompts have gone.
+// a.mu must be held.
+func (a *Approvals) prune() {
+	now := time.Now()
+	for id, p := range a.pending {
+		if now.After(p.Expires) || hub.Askers().Find(p.Prompt) == nil {
+			delete(a.pending, id)
+		}
+	}
+}
+
+// Submit holds an answer to the named prompt until another user approves
+// it, for up to -approval-timeout.
+func (a *Approvals) Submit(r *http.Request, name, answer string) (p *PendingAnswer, err error) {
+	defer func() { Audit(r, "answer-submitted", name, err) }()
+	if User(r) == "" {
+		return nil, ErrUnauthenticated
+	}
+	ap := hub.Askers().Find(name)
+	if ap == nil {
+		return nil, ErrNotFound
+	}
+	now := time.Now()
+	p = &PendingAnswer{
+		ID:        randomString(),
+		Prompt:    name,
+		Message:   ap.Message,
+		User:      User(r),
+		Submitted: now,
+		Expires:   now.Add(site.Load().Settings.ApprovalTimeout),
+		answer:    answer,
+	}
+	a.mu.Lock()
+	a.prune()
+	a.pending[p.ID] = p
+	a.mu.Unlock()
+	Logger(r).Info("Answer awaiting approval", "prompt", name, "approval", p.ID)
+	return p, nil
+}
+
+// Pending returns the answers awaiting approval, oldest first.
+func (a *Approvals) Pending() []PendingAnswer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune()
+	out := make([]PendingAnswer, 0, len(a.pending))
+	for _, p := range a.pending {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Submitted.Before(out[j].Submitted) })
+	return out
+}
+
+// Approve answers the prompt with a pending answer, on behalf of the
+// request, which must be from a different user to the one who submitted it.
+func (a *Approvals) Approve(r *http.Request, id string) (err error) {
+	a.mu.Lock()
+	a.prune()
+	p, ok := a.pending[id]
+	switch {
+	case !ok:
+		err = ErrNotFound
+	case User(r) == "":
+		err = ErrUnauthenticated
+	case User(r) == p.User:
+		err = ErrSelfApproval
+	default:
+		delete(a.pending, id)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		Audit(r, "approve", "", err)
+		return err
+	}
+	Audit(r, "approve", p.Prompt, nil)
+	Logger(r).Info("Approved answer", "prompt", p.Prompt, "submitted_by", p.User)
+	return AnswerPrompt(r, p.Prompt, p.answer)
+}
+
+// Reject discards a pending answer, on behalf of the request, which may be
+// from the user who submitted it, to withdraw it.
+func (a *Approvals) Reject(r *http.Request, id string) (err error) {
+	a.mu.Lock()
+	a.prune()
+	p, ok := a.pending[id]
+	switch {
+	case !ok:
+		err = ErrNotFound
+	case User(r) == "":
+		err = ErrUnauthenticated
+	default:
+		delete(a.pending, id)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		Audit(r, "reject", "", err)
+		return err
+	}
+	Audit(r, "reject", p.Prompt, nil)
+	Logger(r).Info("Rejected answer", "prompt", p.Prompt, "submitted_by", p.User)
+	return nil
+}
+
+// ServeApprove approves a pending answer from the web UI.
+func ServeApprove(w http.ResponseWriter, r *http.Request) {
+	serveApproval(w, r, approvals.Approve, true)
+}
+
+// ServeReject rejects a pending answer from the web UI.
+func ServeReject(w http.ResponseWriter, r *http.Request) {
+	serveApproval(w, r, approvals.Reject, false)
+}
+
+func serveApproval(w http.ResponseWriter, r *http.Request, action func(*http.Request, string) error, checkTOTP bool) {
+	if !site.Load().Settings.RequireApproval {
+		Error(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !MayAnswer(r) {
+		Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CheckCSRF(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	// Approving is what actually answers:
+	if checkTOTP {
+		if err := CheckTOTP(r, r.FormValue("totp")); err != nil {
+			Error(w, r, err.Error(), StatusCode(err))
+			return
+		}
+	}
+
+	if err := action(r, r.FormValue("id")); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	http.Redirect(w, r, URLPath(r, "/"), http.StatusSeeOther)
+}
+
+// ServeAPIApprovals lists the answers awaiting approval.
+func ServeAPIApprovals(w http.ResponseWriter, r *http.Request) {
+	if !site.Load().Settings.RequireApproval {
+		APIError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		APIError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	WriteJSON(w, http.StatusOK, approvals.Pending())
+}
+
+// ServeAPIApproval handles requests beneath /api/v1/approvals/{id}/.
+func ServeAPIApproval(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/approvals/")
+	id, action, _ := strings.Cut(rest, "/")
+	if !site.Load().Settings.RequireApproval || id == "" || (action != "approve" && action != "reject") {
+		APIError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		APIError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !MayAnswer(r) {
+		APIError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// As for /api/v1/prompts/, against CSRF:
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		APIError(w, r, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req struct {
+		TOTP string `json:"totp,omitempty"` // required to approve if TOTP is enabled
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		APIError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch action {
+	case "approve":
+		if err = CheckTOTP(r, req.TOTP); err == nil {
+			err = approvals.Approve(r, id)
+		}
+	case "reject":
+		err = approvals.Reject(r, id)
+	}
+	if err != nil {
+		APIError(w, r, err.Error(), StatusCode(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
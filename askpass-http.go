@@ -17,64 +17,694 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/caddyserver/certmagic"
+	"github.com/hashicorp/mdns"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/mdlayher/vsock"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
 	"gopkg.in/ini.v1"
 )
 
+const defaultConfig = "/etc/askpass-http/config.toml"
+
 var (
-	listen = flag.String("listen", "[::]:8080", "ADDR:PORT to bind to, or FD:n to use for socket activation")
+	config = flag.String("config", defaultConfig, "TOML file to read settings from. Command line flags take precedence")
+
+	listen = newListFlag("listen", "[::]:8080", "ADDR:PORT to bind to, unix:PATH for a unix domain socket, fd:n to use an inherited socket, sd:name to use sockets passed by systemd with FileDescriptorName=name (sd: for all), vsock:PORT to accept connections from the hypervisor host of a VM, tailscale:PORT to accept connections from the tailnet joined with -tailscale-hostname, or a wss:// URL, with ?proxy=on, to accept connections through a relay. May be repeated. Options may follow, e.g. ?tls=off&auth=tokens")
 	askDir = flag.String("askdir", "/run/systemd/ask-password", "Directory to watch for password prompts")
 	cert   = flag.String("cert", "", "PEM-encoded TLS certificate. If unspecified, uses plain HTTP")
-	key    = flag.String("key", "", "PEM-encoded TLS key. If -cert is specified, -key is required")
+	key    = flag.String("key", CredentialPath("askpass-http.key"), "PEM-encoded TLS key, a PKCS#11 URI such as pkcs11:token=askpass;object=tls, or tpm:HANDLE for a persistent key in the TPM. If -cert is specified, -key is required. Defaults to the askpass-http.key systemd credential, if present")
 	idle   = flag.Duration("idle", 0, "Idle timeout after which server automatically shuts down")
+
+	readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "How long clients may take to send the headers of a request. 0 for no limit")
+	readTimeout       = flag.Duration("read-timeout", time.Minute, "How long clients may take to send a whole request, including its body. 0 for no limit")
+	writeTimeout      = flag.Duration("write-timeout", time.Minute, "How long responses may take to send, besides the time spent waiting by /api/v1/wait and streams of events. 0 for no limit")
+	keepaliveTimeout  = flag.Duration("keepalive-timeout", 2*time.Minute, "How long idle connections are kept open for the next request. 0 for -read-timeout")
+	maxBodySize       = flag.Int64("max-body-size", 1<<20, "Maximum size of request bodies, in bytes. 0 for no limit")
+	maxConnections    = flag.Int("max-connections", 128, "Maximum connections to each listener at once, beyond which new connections wait, except on unix: sockets. 0 for no limit")
+	maxAnswers        = flag.Int("max-answers", 4, "Maximum answers being written to requesters at once, beyond which others wait, for up to 10s. 0 for no limit")
+
+	listenIface    = newListFlag("listen-iface", "", "IFACE:PORT to bind to on a single network interface only, e.g. wg0:8080, using SO_BINDTODEVICE. May be repeated, and take the same options as -listen. If -listen isn't also specified, the default -listen is not used")
+	redirectListen = flag.String("redirect-listen", "", "ADDR:PORT to serve plain HTTP on, redirecting to the first TLS listener, e.g. [::]:80. Accepts the same addresses as -listen")
+	acmeWebroot    = flag.String("acme-webroot", "", "Directory to serve ACME HTTP-01 challenges from on -redirect-listen, as written by certbot --webroot")
+
+	tailscaleHostname    = flag.String("tailscale-hostname", "", "Join the tailnet as this machine name, and listen on it at tailscale:80 instead of the default -listen. Requires a build with -tags tsnet")
+	tailscaleAuthKeyFile = flag.String("tailscale-authkey-file", CredentialPath("askpass-http.tailscale-authkey"), "File containing the Tailscale auth key to join the tailnet with. Defaults to the askpass-http.tailscale-authkey systemd credential, if present")
+	tailscaleStateDir    = flag.String("tailscale-state-dir", "", "Directory to keep the Tailscale node's keys in. If unspecified, the node is ephemeral, and leaves the tailnet once stopped")
+
+	tunnelTokenFile = flag.String("tunnel-token-file", CredentialPath("askpass-http.tunnel-token"), "File containing a bearer token to authenticate to wss:// relays in -listen. Defaults to the askpass-http.tunnel-token systemd credential, if present")
+
+	pkcs11Module  = flag.String("pkcs11-module", "", "PKCS#11 module to load for a pkcs11: -key, unless the URI has a module-path")
+	pkcs11PinFile = flag.String("pkcs11-pin-file", CredentialPath("askpass-http.pkcs11-pin"), "File containing the PIN for a pkcs11: -key, unless the URI has a pin-value or pin-source. Defaults to the askpass-http.pkcs11-pin systemd credential, if present")
+	tpmDevice     = flag.String("tpm-device", "/dev/tpmrm0", "TPM device for a tpm: -key or rule secret")
+
+	tlsSelfSigned    = flag.Bool("tls-selfsigned", false, "If no certificate is given, generate a self-signed one, and log its SHA-256 fingerprint to check on first connection")
+	tlsSelfSignedDir = flag.String("tls-selfsigned-dir", "/etc/askpass-http", "Directory to keep the -tls-selfsigned certificate and key in")
+
+	acmeDomain            = flag.String("acme-domain", "", "Comma-separated domain names to obtain certificates for automatically with ACME, instead of -cert and -key")
+	acmeEmail             = flag.String("acme-email", "", "Email address for the ACME account, to be told about problems with certificates")
+	acmeCA                = flag.String("acme-ca", certmagic.LetsEncryptProductionCA, "ACME directory URL")
+	acmeCache             = flag.String("acme-cache", "/var/lib/askpass-http/acme", "Directory to store ACME accounts and certificates in")
+	acmeDNS               = flag.String("acme-dns", "", "DNS provider for DNS-01 challenges: exec or rfc2136. If unspecified, HTTP-01 or TLS-ALPN-01 challenges are used, which need port 80 or 443 to be reachable from the CA")
+	acmeDNSExec           = flag.String("acme-dns-exec", "", "Command for -acme-dns exec, run with present or cleanup, the record's FQDN, and its value")
+	acmeDNSServer         = flag.String("acme-dns-server", "", "DNS server for -acme-dns rfc2136 to send updates to, e.g. ns1.example.com:53")
+	acmeDNSTSIGKey        = flag.String("acme-dns-tsig-key", "", "Name of the TSIG key to sign RFC 2136 updates with")
+	acmeDNSTSIGAlgorithm  = flag.String("acme-dns-tsig-algorithm", "hmac-sha256", "Algorithm of -acme-dns-tsig-key")
+	acmeDNSTSIGSecretFile = flag.String("acme-dns-tsig-secret-file", "", "File containing the base64-encoded secret of -acme-dns-tsig-key")
+
+	listenQUIC = flag.String("listen-quic", "", "UDP ADDR:PORT to serve HTTP/3 on, e.g. [::]:8443, with the same settings as the first TLS listener. Experimental")
+
+	notifyTitle   = flag.String("notify-title", "{{ .Host }} is {{ if .Reminder }}still {{ end }}waiting for a password", "Go text/template for the title of notifications, with fields .Host, .Message (the prompt's), .URL, .Prompt.Name and .Reminder")
+	notifyMessage = flag.String("notify-message", "{{ .Message }}", "Go text/template for the message of notifications, with the same fields as -notify-title")
+	notifyDedupe  = flag.Duration("notify-dedupe", 5*time.Minute, "Don't notify of a prompt asking the same question as one notified of within this long, such as after a wrong answer")
+	notifyFlags   = newNotifierFlags("webpush", "ntfy", "pushover", "gotify", "telegram", "matrix", "signal", "slack", "discord", "mattermost", "unifiedpush")
+
+	publicURL = flag.String("public-url", "", "URL of the server, for links in notifications, e.g. https://host.example.com/askpass/. If unspecified, uses the first address of the first TCP listener")
+
+	ntfyURL       = flag.String("ntfy-url", "", "URL of an ntfy topic to publish notifications of new prompts to, e.g. https://ntfy.sh/mytopic")
+	ntfyTokenFile = flag.String("ntfy-token-file", CredentialPath("askpass-http.ntfy-token"), "File containing an access token for -ntfy-url. Defaults to the askpass-http.ntfy-token systemd credential, if present")
+	ntfyPriority  = flag.String("ntfy-priority", "high", "Priority of ntfy notifications: 1 to 5, or min, low, default, high, max or urgent")
+
+	pushoverTokenFile = flag.String("pushover-token-file", CredentialPath("askpass-http.pushover-token"), "File containing the Pushover application token for -pushover-user. Defaults to the askpass-http.pushover-token systemd credential, if present")
+	pushoverUser      = flag.String("pushover-user", "", "Pushover user or group key to send notifications of new prompts to")
+	pushoverPriority  = flag.Int("pushover-priority", 1, "Priority of Pushover notifications, from -2 (lowest) to 1 (high)")
+	pushoverRemind    = flag.Duration("pushover-remind", 0, "Notify through Pushover again about prompts still unanswered after this long. 0 disables reminders")
+
+	gotifyURL       = flag.String("gotify-url", "", "URL of a Gotify server to send notifications of new prompts to, e.g. https://gotify.example.com")
+	gotifyTokenFile = flag.String("gotify-token-file", CredentialPath("askpass-http.gotify-token"), "File containing the Gotify application token. Defaults to the askpass-http.gotify-token systemd credential, if present")
+	gotifyPriority  = flag.Int("gotify-priority", 8, "Priority of Gotify notifications, from 0 to 10")
+	gotifyTemplate  = flag.String("gotify-template", "{{ .Message }}\n\n{{ .URL }}", "Go text/template for the message of Gotify notifications, with fields .Title, .Message, .URL, .Prompt.Name and .Reminder")
+
+	telegramTokenFile = flag.String("telegram-token-file", CredentialPath("askpass-http.telegram-token"), "File containing the token of a Telegram bot to send notifications of new prompts with, to -telegram-chats. Defaults to the askpass-http.telegram-token systemd credential, if present")
+	telegramChats     = flag.String("telegram-chats", "", "Comma-separated IDs of Telegram chats to notify, and accept answers from")
+	telegramAnswer    = flag.Bool("telegram-answer", false, "Accept answers to prompts as replies to Telegram notifications")
+
+	matrixHomeserver  = flag.String("matrix-homeserver", "", "URL of the Matrix homeserver to send notifications of new prompts through, e.g. https://matrix.example.com")
+	matrixTokenFile   = flag.String("matrix-token-file", CredentialPath("askpass-http.matrix-token"), "File containing the access token of the Matrix user to send notifications as. Defaults to the askpass-http.matrix-token systemd credential, if present")
+	matrixRoom        = flag.String("matrix-room", "", "ID or alias of the Matrix room to send notifications to, e.g. #ops:example.com. The user must have joined it")
+	matrixAnswerUsers = flag.String("matrix-answer-users", "", "Comma-separated Matrix user IDs, e.g. @alice:example.com, to also send notifications to by direct message, and accept answers from as replies to them")
+
+	signalAccount    = flag.String("signal-account", "", "Phone number registered with signal-cli to send notifications of new prompts from, e.g. +61400000000")
+	signalRecipients = flag.String("signal-recipients", "", "Comma-separated phone numbers or group IDs to send Signal notifications to")
+	signalRESTURL    = flag.String("signal-rest-url", "", "URL of a signal-cli-rest-api gateway to send Signal notifications through. If unspecified, runs -signal-cli")
+	signalCLI        = flag.String("signal-cli", "signal-cli", "signal-cli command to send Signal notifications with")
+
+	slackWebhookURL      = flag.String("slack-webhook-url", "", "Slack incoming webhook URL to send notifications of new prompts to")
+	discordWebhookURL    = flag.String("discord-webhook-url", "", "Discord webhook URL to send notifications of new prompts to")
+	mattermostWebhookURL = flag.String("mattermost-webhook-url", "", "Mattermost incoming webhook URL to send notifications of new prompts to")
+	chatTemplate         = flag.String("chat-template", "", "Go text/template for messages to -slack-webhook-url, -discord-webhook-url and -mattermost-webhook-url, with fields .Title, .Message, .URL, .Prompt.Name and .Reminder, and an escape function for the service's markup. If unspecified, a default for each service is used")
+
+	webhookURL        = newListFlag("webhook-url", "", "URL to POST a JSON event to whenever a prompt is created, answered, cancelled, expires or is otherwise removed. May be repeated")
+	webhookSecretFile = flag.String("webhook-secret-file", CredentialPath("askpass-http.webhook-secret"), "File containing a secret to sign -webhook-url requests with, using HMAC-SHA256. Defaults to the askpass-http.webhook-secret systemd credential, if present")
+
+	mqttBroker          = flag.String("mqtt-broker", "", "MQTT broker to publish prompts to, e.g. tcp://homeassistant.local:1883 or ssl://host:8883")
+	mqttUser            = flag.String("mqtt-user", "", "User name to authenticate to -mqtt-broker as")
+	mqttPasswordFile    = flag.String("mqtt-password-file", CredentialPath("askpass-http.mqtt-password"), "File containing the password for -mqtt-user. Defaults to the askpass-http.mqtt-password systemd credential, if present")
+	mqttTopic           = flag.String("mqtt-topic", "", "Topic to publish prompts beneath. If unspecified, askpass-http/HOSTNAME")
+	mqttDiscoveryPrefix = flag.String("mqtt-discovery-prefix", "homeassistant", "Prefix of Home Assistant MQTT discovery topics. If empty, discovery configs aren't published")
+
+	unifiedPushEndpoint = newListFlag("unifiedpush-endpoint", "", "UnifiedPush endpoint URL, from the distributor on a phone, to send notifications of new prompts to. May be repeated")
+
+	vaultAddr         = flag.String("vault-addr", "", "URL of a HashiCorp Vault server to fetch vault-kv: and vault-transit: rule secrets from, e.g. https://vault.example.com:8200")
+	vaultCACert       = flag.String("vault-ca-cert", "", "File of CA certificates to verify the Vault server with. If unspecified, the system's are used")
+	vaultNamespace    = flag.String("vault-namespace", "", "Vault namespace, if not the root")
+	vaultAuthMount    = flag.String("vault-auth-mount", "", "Path of the Vault auth method. Defaults to approle with -vault-role-id, or cert with -vault-cert")
+	vaultRoleID       = flag.String("vault-role-id", "", "AppRole role ID to log in to Vault with")
+	vaultSecretIDFile = flag.String("vault-secret-id-file", CredentialPath("askpass-http.vault-secret-id"), "File containing the AppRole secret ID. Defaults to the askpass-http.vault-secret-id systemd credential, if present")
+	vaultCert         = flag.String("vault-cert", "", "Client certificate to log in to Vault with, using cert auth, if -vault-role-id is unspecified")
+	vaultKey          = flag.String("vault-key", "", "Private key of -vault-cert")
+
+	awsRegion = flag.String("aws-region", "", "AWS region of aws-kms: and aws-secretsmanager: rule secrets. If unspecified, the region is taken from the environment, the AWS config or the instance metadata")
+
+	opConnectHost      = flag.String("op-connect-host", "", "URL of a 1Password Connect server to fetch op:// rule secrets from, e.g. http://op-connect:8080")
+	opConnectTokenFile = flag.String("op-connect-token-file", CredentialPath("askpass-http.op-connect-token"), "File containing the 1Password Connect access token. Defaults to the askpass-http.op-connect-token systemd credential, if present")
+
+	bitwardenURL          = flag.String("bitwarden-url", "https://vault.bitwarden.com", "URL of the Bitwarden or Vaultwarden server to fetch bitwarden: rule secrets from")
+	bitwardenClientID     = flag.String("bitwarden-client-id", "", "client_id of a Bitwarden personal API key, e.g. user.0f1e2d3c-.... If unspecified, Bitwarden is disabled")
+	bitwardenSecretFile   = flag.String("bitwarden-client-secret-file", CredentialPath("askpass-http.bitwarden-client-secret"), "File containing the client_secret of the Bitwarden API key. Defaults to the askpass-http.bitwarden-client-secret systemd credential, if present")
+	bitwardenPasswordFile = flag.String("bitwarden-password-file", CredentialPath("askpass-http.bitwarden-password"), "File containing the Bitwarden master password, to decrypt items with. Defaults to the askpass-http.bitwarden-password systemd credential, if present")
+
+	passDir       = flag.String("pass-store-dir", "", "Password store to decrypt pass: rule secrets from. Defaults to $PASSWORD_STORE_DIR, or ~/.password-store")
+	passGnupgHome = flag.String("pass-gnupg-home", "", "GnuPG home directory holding the key to decrypt the password store with. Defaults to $GNUPGHOME, or ~/.gnupg")
+
+	webpushDir     = flag.String("webpush-dir", "", "Directory to keep the VAPID key and subscriptions for Web Push notifications in, e.g. /var/lib/askpass-http/webpush. If unspecified, Web Push is disabled")
+	webpushSubject = flag.String("webpush-subject", "mailto:root@localhost", "Contact for push services about our notifications: a mailto: or https: URL")
+
+	console = flag.String("console", "", "Terminal to show the URL and a QR code of it on at startup, for someone at the machine, e.g. /dev/console or /dev/tty1")
+
+	mdnsAnnounce = flag.Bool("mdns", false, "Announce the server on the local network as _askpass-http._tcp with mDNS, including its certificate fingerprint")
+	mdnsName     = flag.String("mdns-name", "", "Instance name to announce with -mdns. If unspecified, uses the hostname")
+
+	unixMode  = flag.String("unix-mode", "0660", "Permissions of unix: sockets, in octal")
+	unixOwner = flag.String("unix-owner", "", "User to own unix: sockets. If unspecified, the current user")
+	unixGroup = flag.String("unix-group", "", "Group to own unix: sockets. If unspecified, the current group")
+
+	debugListen  = flag.String("debug-listen", "", "Loopback address to serve pprof and expvar debug endpoints on, e.g. localhost:6060")
+	otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export traces to, e.g. http://localhost:4318")
+
+	auditLog = flag.String("audit-log", "", "File to append an audit log of prompts, answers and authentication events to, as JSON lines")
+
+	fido2Device  = flag.String("fido2-device", "", "hidraw device of the FIDO2 security key for -fido2-token and fido2: rule secrets, e.g. /dev/hidraw0. If unspecified, the first one found is used")
+	fido2PinFile = flag.String("fido2-pin-file", CredentialPath("askpass-http.fido2-pin"), "File containing the PIN of the FIDO2 security key, if the token requires one. Defaults to the askpass-http.fido2-pin systemd credential, if present")
+
+	ageIdentity = flag.String("age-identity", CredentialPath("askpass-http.age-identity"), "File of age identities to decrypt -age-secrets with, or tpm:HANDLE?pcrs=... for one sealed in the TPM. Defaults to the askpass-http.age-identity systemd credential, if present")
+
+	keyringCache = flag.Duration("keyring-cache", 0, "Cache answers to prompts with an Id= in the kernel keyring for this long, e.g. 2m30s as systemd-ask-password does, and answer later prompts with the same Id= that accept cached passwords with them. 0 disables caching")
 )
 
 var ErrMissingKey = errors.New("missing key")
 var ErrExpired = errors.New("expired")
+var ErrStale = errors.New("the requester is no longer waiting for an answer")
+var ErrNotFound = errors.New("not found")
+var ErrInvalidAnswer = errors.New("invalid answer")
+
+// maxAnswerFile limits the size of answers given as files, such as LUKS
+// keyfiles, which are usually much smaller.
+const maxAnswerFile = 64 << 10
 
 const WriteTimeout = 10 * time.Second
 
 var (
-	indexTmpl = template.Must(template.New("index").Parse(`<!doctype html>
-<title>Askpass</title>
-<h1>Askpass</h1>
+	indexFuncs = template.FuncMap{
+		"totp":  func() bool { return site.Load().TOTP != nil },
+		"fido2": func() bool { return site.Load().Settings.FIDO2TokenFile > "" },
+		"shamir": func() int {
+			if t := site.Load().Settings.ShamirThreshold; t >= 2 {
+				return t
+			}
+			return 0
+		},
+		"shares":     shareCollector.Count,
+		"e2eKey":     E2EPublicKey,
+		"requireE2E": func() bool { return site.Load().Settings.RequireE2E },
+		"webpushKey": func() string {
+			if webPush == nil {
+				return ""
+			}
+			return webPush.PublicKey()
+		},
+		// prompt is the data of the "prompt" template. focus is whether its
+		// answer should have the focus, as when it's the only prompt.
+		"prompt": func(name string, ap *Askpass, csrf string, focus bool) any {
+			if ap == nil {
+				ap = &Askpass{}
+			}
+			return struct {
+				Name string
+				*Askpass
+				CSRF  string
+				Retry bool
+				Focus bool
+			}{name, ap, csrf, retries.Retried(name), focus}
+		},
+	}
 
-<ul>
-	{{ if not . }}
-	<li>
-		No ask prompts found. Refresh to try again.
+	// indexHTML is the built-in template of the web page, which
+	// -templates-dir can replace.
+	indexHTML = htmlHead + `<title>{{ title }}</title>
+<a class="skip" href="#prompts">{{ T "Skip to the prompts" }}</a>
+{{ template "header" }}
+
+<main>
+<p><a href="qr">{{ T "Continue on another device" }}</a></p>
+
+{{ if .WebPush }}
+<p id="webpush" hidden>
+	<button type="button" data-key="{{ webpushKey }}" data-csrf="{{ .CSRF }}">{{ T "Notify me of new prompts" }}</button>
+</p>
+{{ end }}
+
+{{ if .Session }}
+<form action="logout" method="post">
+	<input type="hidden" name="csrf" value="{{ .CSRF }}" />
+	{{ Tf "Logged in as %s." .Session.User }}
+	<input type="submit" value="{{ T "Log out" }}" />
+</form>
+{{ end }}
+
+{{ define "prompt" }}
+	<li data-name="{{ .Name }}">
+		<form action="pass" method="post" enctype="multipart/form-data">
+			<input type="hidden" name="csrf" value="{{ .CSRF }}" />
+			<input type="hidden" name="ask" value="{{ .Name }}" />
+			<img class="icon" alt="" {{ with .Icon }}src="icon/{{ . }}"{{ else }}hidden{{ end }} />
+			<label class="message" id="message-{{ .Name }}" for="answer-{{ .Name }}">{{ message .Message }}</label>
+			<div class="details" id="details-{{ .Name }}">
+				<strong class="retry" role="alert" {{ if not .Retry }}hidden{{ end }}>{{ T "The last answer appears to have been rejected. Try again." }}</strong>
+				<small class="id" {{ if not .ID }}hidden{{ end }}>{{ .ID }}</small>
+				<small class="cached" {{ if not .AcceptCached }}hidden{{ end }}>{{ T "A cached password is accepted." }}</small>
+				{{ if .NotAfter.IsZero }}<small class="expires" hidden></small>{{ else }}<small class="expires" data-not-after="{{ .NotAfter.UTC.Format "2006-01-02T15:04:05Z" }}">{{ Tf "Expires at %s" (.NotAfter.Format "15:04:05") }}</small>{{ end }}
+				<small class="process" {{ if not .Process.PID }}hidden{{ end }}>{{ if .Process.PID }}{{ Tf "Asked by %s" (.Process.Describe lang) }}{{ end }}</small>
+			</div>
+			<input type="{{ if .Echo }}text{{ else }}password{{ end }}" name="answer" id="answer-{{ .Name }}" aria-describedby="details-{{ .Name }}" {{ if .Focus }}autofocus{{ end }} />
+			<label>
+				{{ T "Or a key file" }}
+				<input type="file" name="answer_file" />
+			</label>
+			{{ if totp }}
+			<label>
+				{{ T "Authenticator code" }}
+				<input type="text" name="totp" inputmode="numeric" pattern="[0-9]*" autocomplete="one-time-code" />
+			</label>
+			{{ end }}
+			<input type="submit" value="{{ T "Submit" }}" aria-describedby="message-{{ .Name }}" />
+			{{ if fido2 }}
+			<input type="submit" formaction="fido2" value="{{ T "Touch to unlock" }}" title="{{ T "Asks for the security key to be touched" }}" aria-describedby="message-{{ .Name }}" />
+			{{ end }}
+		</form>
+		{{ with shamir }}
+		<form action="share" method="post">
+			<input type="hidden" name="csrf" value="{{ $.CSRF }}" />
+			<input type="hidden" name="ask" value="{{ $.Name }}" />
+			<label>
+				{{ T "Share" }}
+				<small class="shares">{{ Tf "%d of %d submitted" (shares $.Name) . }}</small>
+				<input type="text" name="share" autocomplete="off" spellcheck="false" />
+			</label>
+			{{ if totp }}
+			<label>
+				{{ T "Authenticator code" }}
+				<input type="text" name="totp" inputmode="numeric" pattern="[0-9]*" autocomplete="one-time-code" />
+			</label>
+			{{ end }}
+			<input type="submit" value="{{ T "Submit share" }}" aria-describedby="message-{{ $.Name }}" />
+		</form>
+		{{ end }}
+		<form action="cancel" method="post">
+			<input type="hidden" name="csrf" value="{{ .CSRF }}" />
+			<input type="hidden" name="ask" value="{{ .Name }}" />
+			<input type="submit" value="{{ T "Cancel" }}" aria-describedby="message-{{ .Name }}" />
+		</form>
 	</li>
+{{ end }}
+
+<form id="search" method="get" role="search">
+	<label>
+		{{ T "Search" }}
+		<input type="search" name="q" value="{{ .Query }}" placeholder="{{ T "Name, ID or message" }}" />
+	</label>
+</form>
+
+{{ if requireE2E }}
+<noscript><p role="alert">{{ T "Answers must be encrypted by JavaScript, which is turned off." }}</p></noscript>
+{{ end }}
+
+<ul id="prompts" data-e2e-key="{{ e2eKey }}" aria-label="{{ T "Prompts" }}">
+	<li id="no-prompts" {{ if .Askers }}hidden{{ end }}>
+		{{ T "No ask prompts found." }}
+	</li>
+	{{ range $name, $ap := .Askers }}
+	{{ template "prompt" (prompt $name $ap $.CSRF (eq (len $.Askers) 1)) }}
+	{{ end }}
+</ul>
+<p id="announcements" class="visually-hidden" role="status"></p>
+<noscript><p>{{ T "Without JavaScript, this page doesn't update by itself." }} <a href="">{{ T "Refresh" }}</a></p></noscript>
+
+<form id="cancel-all" action="cancel-all" method="post" {{ if not .Askers }}hidden{{ end }}>
+	<input type="hidden" name="csrf" value="{{ .CSRF }}" />
+	<input type="submit" value="{{ T "Cancel all" }}" title="{{ T "Declines every prompt, so that boot carries on to emergency mode" }}" />
+</form>
+
+<form id="bulk" action="pass" method="post" enctype="multipart/form-data" {{ if lt (len .Askers) 2 }}hidden{{ end }}>
+	<h2>{{ T "Answer several at once" }}</h2>
+	<input type="hidden" name="csrf" value="{{ .CSRF }}" />
+	<fieldset>
+		<legend>{{ T "The same answer to" }}</legend>
+		{{ range $name, $ap := .Askers }}
+		<label><input type="checkbox" name="ask" value="{{ $name }}" /> <span class="message">{{ message $ap.Message }}</span></label>
+		{{ end }}
+	</fieldset>
+	<label>
+		{{ T "Passphrase" }}
+		<input type="password" name="answer" />
+	</label>
+	<label>
+		{{ T "Or a key file" }}
+		<input type="file" name="answer_file" />
+	</label>
+	{{ if totp }}
+	<label>
+		{{ T "Authenticator code" }}
+		<input type="text" name="totp" inputmode="numeric" pattern="[0-9]*" autocomplete="one-time-code" />
+	</label>
 	{{ end }}
-	{{ range $name, $ap := . }}
+	<input type="submit" value="{{ T "Submit to those chosen" }}" />
+</form>
+
+{{ with .Approvals }}
+<h2>{{ T "Awaiting approval" }}</h2>
+<ul id="approvals">
+	{{ range . }}
 	<li>
-		<form action="pass" method="post">
-			<input type="hidden" name="ask" value="{{ $name }}" />
+		<span class="message" id="approval-{{ .ID }}">{{ message .Message }}</span>
+		<small>{{ Tf "Answered by %s at %s, until %s" .User (.Submitted.Format "15:04:05") (.Expires.Format "15:04:05") }}</small>
+		<form action="approve" method="post">
+			<input type="hidden" name="csrf" value="{{ $.CSRF }}" />
+			<input type="hidden" name="id" value="{{ .ID }}" />
+			{{ if totp }}
 			<label>
-				{{ $ap.Message }}
-				<input type="password" name="answer" />
+				{{ T "Authenticator code" }}
+				<input type="text" name="totp" inputmode="numeric" pattern="[0-9]*" autocomplete="one-time-code" />
 			</label>
-			<input type="submit" value="Submit" />
+			{{ end }}
+			<input type="submit" value="{{ T "Approve" }}" aria-describedby="approval-{{ .ID }}" />
+		</form>
+		<form action="reject" method="post">
+			<input type="hidden" name="csrf" value="{{ $.CSRF }}" />
+			<input type="hidden" name="id" value="{{ .ID }}" />
+			<input type="submit" value="{{ T "Reject" }}" aria-describedby="approval-{{ .ID }}" />
 		</form>
 	</li>
 	{{ end }}
 </ul>
-`))
+{{ end }}
+
+</main>
+
+<template id="prompt-template">
+	{{ template "prompt" (prompt "" nil $.CSRF false) }}
+</template>
+
+<script>
+// As Tf does, once translated:
+function format(f) {
+	var args = Array.prototype.slice.call(arguments, 1);
+	return f.replace(/%[sd]/g, function() { return args.shift(); });
+}
+
+// Keep the list up to date as prompts come and go, without disturbing
+// anything typed into the other prompts.
+(function() {
+	var list = document.getElementById("prompts");
+	var empty = document.getElementById("no-prompts");
+	var tmpl = document.getElementById("prompt-template");
+	var bulk = document.getElementById("bulk");
+	var cancelAll = document.getElementById("cancel-all");
+	var choices = bulk.querySelector("fieldset");
+	var announcements = document.getElementById("announcements");
+	// For screen readers, which don't notice prompts coming and going:
+	function announce(text) {
+		announcements.textContent = text;
+	}
+	function find(name) {
+		for (var li of list.querySelectorAll("li[data-name]")) {
+			if (li.dataset.name === name) return li;
+		}
+		return null;
+	}
+	function findChoice(name) {
+		for (var input of choices.querySelectorAll("input[name=ask]")) {
+			if (input.value === name) return input.closest("label");
+		}
+		return null;
+	}
+	function fill(li, p) {
+		li.querySelector(".message").textContent = p.message;
+		var choice = findChoice(p.name);
+		if (choice) choice.querySelector(".message").textContent = p.message;
+		var icon = li.querySelector(".icon");
+		if (p.icon) icon.src = "icon/" + encodeURIComponent(p.icon);
+		icon.hidden = !p.icon;
+		var id = li.querySelector(".id");
+		id.textContent = p.id || "";
+		id.hidden = !p.id;
+		li.querySelector(".cached").hidden = !p.accept_cached;
+		li.querySelector(".retry").hidden = !p.retry;
+		var expires = li.querySelector(".expires");
+		if (p.not_after) expires.dataset.notAfter = p.not_after;
+		else delete expires.dataset.notAfter;
+		expires.hidden = !p.not_after;
+		countdown();
+		var proc = li.querySelector(".process");
+		proc.textContent = p.process ? format({{ T "Asked by %s" }}, describe(p.process)) : "";
+		proc.hidden = !p.process;
+		li.querySelector("input[name=answer]").type = p.echo ? "text" : "password";
+	}
+	// As Process.Describe does:
+	function describe(proc) {
+		var s = proc.comm ? proc.comm + " (PID " + proc.pid + ")" : format({{ T "PID %d, which has exited" }}, proc.pid);
+		if (proc.unit) s = format({{ T "%s in %s" }}, s, proc.unit);
+		if (proc.cmdline) s += ": " + proc.cmdline;
+		return s;
+	}
+	// Count down to when prompts expire, and grey them out once they have,
+	// until the server removes them:
+	function countdown() {
+		var now = Date.now();
+		for (var el of list.querySelectorAll(".expires[data-not-after]")) {
+			var li = el.closest("li");
+			var left = Math.ceil((Date.parse(el.dataset.notAfter) - now) / 1000);
+			if (left > 0) {
+				el.textContent = format({{ T "Expires in %s" }}, Math.floor(left / 60) + ":" + String(left % 60).padStart(2, "0"));
+				continue;
+			}
+			el.textContent = {{ T "Expired" }};
+			li.classList.add("expired");
+			for (var input of li.querySelectorAll("input")) input.disabled = true;
+		}
+	}
+	countdown();
+	setInterval(countdown, 1000);
+	// Narrow down the prompts shown as the search is typed, as the server
+	// does once it's submitted:
+	var search = document.querySelector("#search input[name=q]");
+	function filter() {
+		var q = search.value.toLowerCase();
+		for (var li of list.querySelectorAll("li[data-name]")) {
+			var fields = [li.dataset.name, li.querySelector(".id").textContent, li.querySelector(".message").textContent];
+			li.hidden = !fields.some(function(s) { return s.toLowerCase().includes(q); });
+		}
+		update();
+	}
+	search.addEventListener("input", filter);
+	function update() {
+		var n = list.querySelectorAll("li[data-name]").length;
+		empty.hidden = list.querySelector("li[data-name]:not([hidden])") !== null;
+		cancelAll.hidden = n === 0;
+		bulk.hidden = n < 2;
+	}
+	cancelAll.addEventListener("submit", function(e) {
+		if (!confirm({{ T "Cancel every prompt? Boot may carry on to emergency mode." }})) e.preventDefault();
+	});
+	var events = new EventSource("events" + location.search);
+	events.addEventListener("prompt-added", function(e) {
+		var p = JSON.parse(e.data);
+		if (find(p.name)) return;
+		var li = tmpl.content.querySelector("li").cloneNode(true);
+		li.dataset.name = p.name;
+		for (var input of li.querySelectorAll("input[name=ask]")) input.value = p.name;
+		// The template's IDs, and references to them, end in the name:
+		for (var el of li.querySelectorAll("[id]")) el.id += p.name;
+		for (var el of li.querySelectorAll("[for]")) el.htmlFor += p.name;
+		for (var el of li.querySelectorAll("[aria-describedby]")) {
+			el.setAttribute("aria-describedby", el.getAttribute("aria-describedby") + p.name);
+		}
+		var choice = document.createElement("label");
+		var box = document.createElement("input");
+		box.type = "checkbox";
+		box.name = "ask";
+		box.value = p.name;
+		var message = document.createElement("span");
+		message.className = "message";
+		choice.append(box, " ", message);
+		var nextChoice = null;
+		for (var other of choices.querySelectorAll("input[name=ask]")) {
+			if (other.value > p.name) { nextChoice = other.closest("label"); break; }
+		}
+		choices.insertBefore(choice, nextChoice);
+		fill(li, p);
+		var next = null;
+		for (var other of list.querySelectorAll("li[data-name]")) {
+			if (other.dataset.name > p.name) { next = other; break; }
+		}
+		list.insertBefore(li, next);
+		filter();
+		announce(format({{ T "New prompt: %s" }}, p.message));
+		// Unless something else has it, as when typing into another prompt:
+		var answers = list.querySelectorAll("li[data-name] input[name=answer]");
+		if (answers.length === 1 && (!document.activeElement || document.activeElement === document.body)) {
+			answers[0].focus();
+		}
+	});
+	events.addEventListener("prompt-changed", function(e) {
+		var p = JSON.parse(e.data);
+		var li = find(p.name);
+		if (li) fill(li, p);
+		filter();
+	});
+	events.addEventListener("prompt-removed", function(e) {
+		var name = JSON.parse(e.data).name;
+		var li = find(name);
+		if (li) {
+			announce(format({{ T "Prompt gone: %s" }}, li.querySelector(".message").textContent));
+			// Rather than losing the focus with the prompt, move it on to
+			// the next:
+			var focused = li.contains(document.activeElement);
+			var next = li.nextElementSibling || li.previousElementSibling;
+			li.remove();
+			if (focused) {
+				var answer = next && next.querySelector("input[name=answer]");
+				if (answer) answer.focus();
+				else search.focus();
+			}
+		}
+		var choice = findChoice(name);
+		if (choice) choice.remove();
+		update();
+	});
+})();
+
+// Encrypt answers to the server's key before submitting them, so that
+// proxies in between never see them, where the browser supports X25519.
+// Otherwise, they're submitted as typed.
+(function() {
+	var list = document.getElementById("prompts");
+	var serverKey = list.dataset.e2eKey;
+	if (!serverKey || !window.crypto || !crypto.subtle) return;
+	var utf8 = new TextEncoder();
+	function b64(buf) {
+		return btoa(String.fromCharCode.apply(null, new Uint8Array(buf)))
+			.replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+	}
+	function unb64(s) {
+		s = atob(s.replace(/-/g, "+").replace(/_/g, "/"));
+		return Uint8Array.from(s, function(c) { return c.charCodeAt(0); });
+	}
+	function encrypt(answer, name) {
+		var pub = unb64(serverKey);
+		var ephemeral = new Uint8Array(32);
+		return Promise.all([
+			crypto.subtle.importKey("raw", pub, {name: "X25519"}, false, []),
+			crypto.subtle.generateKey({name: "X25519"}, true, ["deriveBits"]),
+		]).then(function(keys) {
+			return Promise.all([
+				crypto.subtle.deriveBits({name: "X25519", public: keys[0]}, keys[1].privateKey, 256),
+				crypto.subtle.exportKey("raw", keys[1].publicKey),
+			]);
+		}).then(function(r) {
+			ephemeral.set(new Uint8Array(r[1]));
+			return crypto.subtle.importKey("raw", r[0], "HKDF", false, ["deriveKey"]);
+		}).then(function(shared) {
+			var salt = new Uint8Array(64);
+			salt.set(ephemeral);
+			salt.set(pub, 32);
+			return crypto.subtle.deriveKey({name: "HKDF", hash: "SHA-256", salt: salt, info: utf8.encode("askpass-http answer")},
+				shared, {name: "AES-GCM", length: 256}, false, ["encrypt"]);
+		}).then(function(key) {
+			var iv = crypto.getRandomValues(new Uint8Array(12));
+			return crypto.subtle.encrypt({name: "AES-GCM", iv: iv, additionalData: utf8.encode(name)}, key, answer)
+				.then(function(sealed) {
+					var out = new Uint8Array(32 + 12 + sealed.byteLength);
+					out.set(ephemeral);
+					out.set(iv, 32);
+					out.set(new Uint8Array(sealed), 44);
+					return b64(out);
+				});
+		});
+	}
+	document.addEventListener("submit", function(e) {
+		var form = e.target;
+		// Not for touching a security key instead:
+		if (form.getAttribute("action") !== "pass" || (e.submitter && e.submitter.hasAttribute("formaction"))) return;
+		e.preventDefault();
+		var input = form.querySelector("input[name=answer]");
+		var file = form.querySelector("input[name=answer_file]");
+		var answer = file.files.length > 0 ?
+			file.files[0].arrayBuffer().then(function(b) { return new Uint8Array(b); }) :
+			Promise.resolve(utf8.encode(input.value));
+		// To each prompt it's for, of which the form for answering several
+		// at once may have more than one:
+		var names = [];
+		for (var ask of form.querySelectorAll("input[name=ask]")) {
+			if (ask.type === "hidden" || ask.checked) names.push(ask.value);
+		}
+		answer.then(function(answer) {
+			return Promise.all(names.map(function(name) { return encrypt(answer, name); }));
+		}).then(function(sealed) {
+			for (var old of form.querySelectorAll("input[name^=answer_e2e]")) old.remove();
+			names.forEach(function(name, i) {
+				var s = document.createElement("input");
+				s.type = "hidden";
+				s.name = "answer_e2e." + name;
+				s.value = sealed[i];
+				form.appendChild(s);
+			});
+			input.value = "";
+			file.value = "";
+			form.submit();
+		}, function() {
+			form.submit();
+		});
+	});
+})();
+
+// Offer to subscribe to Web Push notifications, where the browser supports
+// them.
+(function() {
+	var p = document.getElementById("webpush");
+	if (!p || !("serviceWorker" in navigator) || !("PushManager" in window)) return;
+	var button = p.querySelector("button");
+	function b64(buf) {
+		return btoa(String.fromCharCode.apply(null, new Uint8Array(buf)))
+			.replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+	}
+	function key(s) {
+		s = atob(s.replace(/-/g, "+").replace(/_/g, "/"));
+		return Uint8Array.from(s, function(c) { return c.charCodeAt(0); });
+	}
+	p.hidden = false;
+	button.addEventListener("click", function() {
+		button.disabled = true;
+		navigator.serviceWorker.ready.then(function(reg) {
+			return reg.pushManager.subscribe({userVisibleOnly: true, applicationServerKey: key(button.dataset.key)});
+		}).then(function(sub) {
+			return fetch("webpush", {method: "POST", body: new URLSearchParams({
+				csrf: button.dataset.csrf,
+				endpoint: sub.endpoint,
+				p256dh: b64(sub.getKey("p256dh")),
+				auth: b64(sub.getKey("auth")),
+			})});
+		}).then(function(res) {
+			if (!res.ok) throw new Error(res.statusText);
+			button.textContent = {{ T "Notifications are on" }};
+		}).catch(function(err) {
+			button.disabled = false;
+			button.textContent = format({{ T "Couldn't turn on notifications: %s" }}, err.message);
+		});
+	});
+})();
+</script>
+`
 )
 
 type Askpass struct {
-	Path     string    // /run/systemd/ask-password/<name>
-	Message  string    // question to ask the user
-	Icon     string    // optional, path to icon
-	Socket   string    // socket to write the user-supplied password to
-	NotAfter time.Time // ignore files after this date
+	Path         string    // /run/systemd/ask-password/<name>
+	Message      string    // question to ask the user
+	Icon         string    // optional, path to icon
+	ID           string    // optional, what is being asked about, e.g. cryptsetup:/dev/sda2
+	AcceptCached bool      // whether the requester accepts a cached password
+	Echo         bool      // whether the answer isn't secret, so may be shown as it's typed
+	Process      Process   // optional, the requester, from its PID
+	Socket       string    // socket to write the user-supplied password to
+	NotAfter     time.Time // ignore files after this date
 }
 
 func (a *Askpass) IsExpired() error {
@@ -87,17 +717,68 @@ func (a *Askpass) IsExpired() error {
 	return nil
 }
 
+// IsStale returns an error if the requester has gone without removing the
+// ask file: its process has exited, or nothing is receiving on its socket.
+func (a *Askpass) IsStale() error {
+	if a.Process.PID > 0 && errors.Is(unix.Kill(a.Process.PID, 0), unix.ESRCH) {
+		return fmt.Errorf("%w: PID %d has exited", ErrStale, a.Process.PID)
+	}
+	sock, err := net.Dial("unixgram", a.Socket)
+	if isStaleSocket(err) {
+		return fmt.Errorf("%w: %v", ErrStale, err)
+	}
+	if err == nil {
+		sock.Close()
+	}
+	return nil
+}
+
+// isStaleSocket reports whether err, from connecting to a requester's
+// socket, means that nothing is receiving on it.
+func isStaleSocket(err error) bool {
+	return errors.Is(err, unix.ECONNREFUSED) || errors.Is(err, fs.ErrNotExist)
+}
+
+// bootTime is when CLOCK_MONOTONIC started, to convert times given by it.
+var bootTime = func() time.Time {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(-time.Duration(ts.Nano()))
+}()
+
+// parseNotAfter parses NotAfter=, which systemd gives in microseconds of
+// CLOCK_MONOTONIC, or 0 for never, though a time is also accepted.
+func parseNotAfter(k *ini.Key) time.Time {
+	usec, err := strconv.ParseInt(k.String(), 10, 64)
+	switch {
+	case err != nil:
+		return k.MustTime(time.Time{})
+	case usec <= 0 || bootTime.IsZero():
+		return time.Time{}
+	default:
+		return bootTime.Add(time.Duration(usec) * time.Microsecond)
+	}
+}
+
 func (a *Askpass) UnmarshalINI(path string) error {
 	f, err := ini.Load(path)
 	if err != nil {
 		return err
 	}
 	*a = Askpass{
-		Path:     path,
-		Message:  f.Section("Ask").Key("Message").String(),
-		Icon:     f.Section("Ask").Key("Icon").String(),
-		Socket:   f.Section("Ask").Key("Socket").String(),
-		NotAfter: f.Section("Ask").Key("NotAfter").MustTime(time.Time{}),
+		Path:         path,
+		Message:      f.Section("Ask").Key("Message").String(),
+		Icon:         f.Section("Ask").Key("Icon").String(),
+		ID:           f.Section("Ask").Key("Id").String(),
+		AcceptCached: f.Section("Ask").Key("AcceptCached").MustBool(false),
+		Echo:         f.Section("Ask").Key("Echo").MustBool(false),
+		Socket:       f.Section("Ask").Key("Socket").String(),
+		NotAfter:     parseNotAfter(f.Section("Ask").Key("NotAfter")),
+	}
+	if pid := f.Section("Ask").Key("PID").MustInt(0); pid > 0 {
+		a.Process = ReadProcess(pid)
 	}
 	for _, kv := range []struct{ key, val string }{
 		{"Message", a.Message},
@@ -112,18 +793,38 @@ func (a *Askpass) UnmarshalINI(path string) error {
 
 // Answer writes the password answer to the Socket
 func (a *Askpass) Answer(s string) error {
+	var buf bytes.Buffer
+	buf.WriteByte('+') // '+' = answer, '-' = cancel
+	buf.WriteString(s)
+	return a.reply(buf.Bytes())
+}
+
+// Cancel tells the requester that the user declined to answer.
+func (a *Askpass) Cancel() error {
+	return a.reply([]byte{'-'})
+}
+
+func (a *Askpass) reply(b []byte) (err error) {
+	defer func() {
+		if err != nil {
+			metricSocketErrors.Inc()
+		}
+	}()
+	if err := replySlots.Acquire(WriteTimeout); err != nil {
+		return err
+	}
+	defer replySlots.Release()
 	sock, err := net.Dial("unixgram", a.Socket)
-	if err != nil {
+	if isStaleSocket(err) {
+		return fmt.Errorf("%w: %v", ErrStale, err)
+	} else if err != nil {
 		return err
 	}
 	defer sock.Close()
 	_ = sock.SetDeadline(time.Now().Add(WriteTimeout))
-	var buf bytes.Buffer
-	buf.WriteByte('+') // '+' = answer, '-' = cancel
-	buf.WriteString(s)
-	if n, err := sock.Write(buf.Bytes()); err != nil {
+	if n, err := sock.Write(b); err != nil {
 		return err
-	} else if n < len(s) {
+	} else if n < len(b) {
 		return io.ErrShortWrite
 	}
 	return nil
@@ -138,6 +839,9 @@ func NewAskpass(name string) (*Askpass, error) {
 	if err := ap.IsExpired(); err != nil {
 		return nil, err
 	}
+	if err := ap.IsStale(); err != nil {
+		return nil, err
+	}
 	return &ap, nil
 }
 
@@ -155,13 +859,14 @@ func (a Askers) Find(name string) *Askpass {
 	return ap
 }
 
-// NewAskers enumerates the prompts currently existing.
+// NewAskers enumerates the prompts currently existing, by reading the ask
+// directory. Most callers should use the cached hub.Askers() instead.
 // To avoid passing untrusted input to the filesystem, no input is accepted.
 func NewAskers() Askers {
 	// List the askers:
 	d, err := os.ReadDir(*askDir)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Reading ask directory", "err", err)
 		return nil
 	}
 
@@ -171,7 +876,7 @@ func NewAskers() Askers {
 		if strings.HasPrefix(entry.Name(), "ask.") && !entry.IsDir() {
 			ap, err := NewAskpass(entry.Name())
 			if err != nil {
-				log.Println(err)
+				slog.Warn("Ignoring prompt", "prompt", entry.Name(), "err", err)
 				continue
 			}
 			out[entry.Name()] = ap
@@ -180,53 +885,361 @@ func NewAskers() Askers {
 	return out
 }
 
+// AnswerPrompt finds the named prompt and writes the answer to its socket,
+// on behalf of the request. It returns ErrNotFound if no such prompt currently
+// exists, or ErrLockedOut if the prompt has been answered too many times
+// recently.
+func AnswerPrompt(r *http.Request, name, answer string) (err error) {
+	r = WithLogAttrs(r, "prompt", name)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("askpass.prompt", name))
+	defer func() {
+		Audit(r, "answer", name, err)
+		if err == nil {
+			metricAnswers.Inc()
+			Logger(r).Info("Answered prompt")
+		}
+	}()
+	ap := hub.Askers().Find(name)
+	if ap == nil {
+		return ErrNotFound
+	}
+	// In case it expired since the ask directory was last read:
+	if err := ap.IsExpired(); err != nil {
+		return err
+	}
+	// Requesters like cryptsetup create a new ask file each time they ask
+	// again, so the file name can't be the key. Per client, so that someone
+	// mistyping can't stop everyone else answering:
+	if err := lockout.Attempt(answerKey(ClientIP(r), NewPrompt(name, ap).Key())); err != nil {
+		return err
+	}
+	// Before the requester can see the answer, and remove the prompt:
+	hub.Resolved(name, ReasonAnswered)
+	if err := Trace(r.Context(), "Askpass.Answer", func(context.Context) error {
+		return ap.Answer(answer)
+	}, attribute.String("askpass.socket", ap.Socket)); err != nil {
+		hub.Unresolved(name, ReasonAnswered)
+		return err
+	}
+	retries.Answered(name, NewPrompt(name, ap).Key())
+	CacheAnswer(ap.ID, answer)
+	return nil
+}
+
+// CancelPrompt finds the named prompt and cancels it, on behalf of the
+// request. It returns ErrNotFound if no such prompt currently exists.
+func CancelPrompt(r *http.Request, name string) (err error) {
+	r = WithLogAttrs(r, "prompt", name)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("askpass.prompt", name))
+	defer func() {
+		Audit(r, "cancel", name, err)
+		if err == nil {
+			metricCancellations.Inc()
+			Logger(r).Info("Cancelled prompt")
+		}
+	}()
+	ap := hub.Askers().Find(name)
+	if ap == nil {
+		return ErrNotFound
+	}
+	hub.Resolved(name, ReasonCancelled)
+	if err := Trace(r.Context(), "Askpass.Cancel", func(context.Context) error {
+		return ap.Cancel()
+	}, attribute.String("askpass.socket", ap.Socket)); err != nil {
+		hub.Unresolved(name, ReasonCancelled)
+		return err
+	}
+	return nil
+}
+
+// CancelAllPrompts cancels every current prompt, on behalf of the request,
+// and returns the names of those cancelled.
+func CancelAllPrompts(r *http.Request) ([]string, error) {
+	cancelled := []string{}
+	var errs []error
+	for _, p := range hub.Askers().Prompts() {
+		if err := CancelPrompt(r, p.Name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+			continue
+		}
+		cancelled = append(cancelled, p.Name)
+	}
+	return cancelled, errors.Join(errs...)
+}
+
+// StatusCode maps an error returned by AnswerPrompt, CancelPrompt,
+// ShareCollector.Submit or Approvals to a HTTP status code.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidCode), errors.Is(err, ErrCSRF),
+		errors.Is(err, ErrUnauthenticated), errors.Is(err, ErrSelfApproval):
+		return http.StatusForbidden
+	case errors.Is(err, ErrStale), errors.Is(err, ErrExpired):
+		return http.StatusGone
+	case errors.Is(err, ErrLockedOut):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrInvalidShare), errors.Is(err, ErrNotEncrypted), errors.Is(err, ErrInvalidEncrypted),
+		errors.Is(err, ErrInvalidAnswer):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrDuplicateShare):
+		return http.StatusConflict
+	case errors.Is(err, ErrBusy):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// FormAnswer returns the answer to the named prompt submitted from the web
+// UI, typed or as the contents of a file, decrypting it if it was encrypted
+// in the browser, as it is unless the browser can't.
+func FormAnswer(r *http.Request, name string) (string, error) {
+	if s := r.FormValue("answer_e2e." + name); s > "" {
+		return DecryptAnswer(s, name)
+	}
+	if site.Load().Settings.RequireE2E {
+		return "", ErrNotEncrypted
+	}
+	if r.MultipartForm != nil && len(r.MultipartForm.File["answer_file"]) > 0 {
+		fh := r.MultipartForm.File["answer_file"][0]
+		// Browsers send an empty part if no file was chosen:
+		if fh.Filename > "" || fh.Size > 0 {
+			if fh.Size > maxAnswerFile {
+				return "", fmt.Errorf("%w: files may be at most %d KiB", ErrInvalidAnswer, maxAnswerFile>>10)
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			b, err := io.ReadAll(f)
+			return string(b), err
+		}
+	}
+	return r.FormValue("answer"), nil
+}
+
 func ServePass(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		Error(w, err.Error(), http.StatusBadRequest)
+	if !MayAnswer(r) {
+		Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// The form is multipart, for answers given as files, which are kept in
+	// memory rather than spilling into temporary files. The form for
+	// answering several at once has each prompt's answer encrypted
+	// separately, so allow for as many as there are prompts:
+	limit := 2 * maxAnswerFile * int64(max(hub.Len(), 1))
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := r.ParseMultipartForm(limit); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CheckCSRF(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
 		return
 	}
 
-	// Find the requested asker:
-	ap := NewAskers().Find(r.FormValue("ask"))
-	if ap == nil {
-		Error(w, "Not found", http.StatusNotFound)
+	if err := CheckTOTP(r, r.FormValue("totp")); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
 		return
 	}
 
-	// Provide the answer:
-	if err := ap.Answer(r.FormValue("answer")); err != nil {
-		Error(w, err.Error(), http.StatusInternalServerError)
+	// Provide the answer to each requested asker, of which the form for
+	// answering several at once gives more than one, or with
+	// -require-approval, hold it to be approved:
+	names := r.Form["ask"]
+	if len(names) == 0 {
+		Error(w, r, "No prompts were chosen", http.StatusBadRequest)
+		return
+	}
+	var errs []error
+	for _, name := range names {
+		answer, err := FormAnswer(r, name)
+		if err == nil {
+			_, err = SubmitAnswer(r, name, answer)
+		}
+		if err != nil && len(names) > 1 {
+			err = fmt.Errorf("%s: %w", name, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
 		return
 	}
 
 	// Success:
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	http.Redirect(w, r, URLPath(r, "/"), http.StatusSeeOther)
+}
+
+func ServeCancel(w http.ResponseWriter, r *http.Request) {
+	if !MayAnswer(r) {
+		Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CheckCSRF(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	if err := CancelPrompt(r, r.FormValue("ask")); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	http.Redirect(w, r, URLPath(r, "/"), http.StatusSeeOther)
+}
+
+func ServeCancelAll(w http.ResponseWriter, r *http.Request) {
+	if !MayAnswer(r) {
+		Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CheckCSRF(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	if _, err := CancelAllPrompts(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	http.Redirect(w, r, URLPath(r, "/"), http.StatusSeeOther)
 }
 
 func ServeIndex(w http.ResponseWriter, r *http.Request) {
-	if err := indexTmpl.Execute(w, NewAskers()); err != nil {
-		log.Println(err)
+	w.Header().Add("Vary", "Accept")
+	switch Negotiate(r, "text/html", "application/json", "text/plain") {
+	case "application/json":
+		ServeAPIPrompts(w, r)
+		return
+	case "text/plain":
+		WritePromptsText(w, hub.Askers().Filter(ParsePromptFilter(r.URL.Query())).Prompts())
+		return
+	}
+	data := struct {
+		Askers    Askers
+		Approvals []PendingAnswer
+		Session   *Session
+		CSRF      string
+		Query     string
+		WebPush   bool // whether the user may subscribe to Web Push
+	}{
+		Askers:  hub.Askers().Filter(ParsePromptFilter(r.URL.Query())),
+		Session: sessions.Get(r),
+		CSRF:    CSRFToken(w, r),
+		Query:   r.URL.Query().Get("q"),
+		WebPush: mayWebPush(r),
+	}
+	if site.Load().Settings.RequireApproval {
+		data.Approvals = approvals.Pending()
+	}
+	if err := site.Load().Templates.Index.Execute(w, r, data); err != nil {
+		Logger(r).Error("Rendering index", "err", err)
 	}
 }
 
-func Error(w http.ResponseWriter, error string, code int) {
-	log.Println(code, error)
-	http.Error(w, error, code)
+// Error replies to the request with the error message and HTTP code, and
+// logs it. The request's ID is given too, to find it in the logs.
+func Error(w http.ResponseWriter, r *http.Request, error string, code int) {
+	LogError(r, error, code)
+	lang := Lang(r)
+	msg := T(lang, error)
+	if id := RequestID(r); id > "" {
+		msg += "\n" + Tf(lang, "Request ID: %s", id)
+	}
+	http.Error(w, msg, code)
 }
 
-// Listener is similar to net.Listen, except it supports inetd-style sockets
-// via the fd:0 syntax (where 0 is the fd number).
-func Listener(addr string) (net.Listener, error) {
-	if fdstr, ok := strings.CutPrefix(*listen, "fd:"); ok {
+// LogError logs an error response at a level appropriate to the code.
+func LogError(r *http.Request, error string, code int) {
+	level := slog.LevelWarn
+	if code >= 500 {
+		level = slog.LevelError
+	}
+	Logger(r).Log(r.Context(), level, error, "status", code)
+}
+
+// Listeners is similar to net.Listen, except it supports unix domain sockets
+// via the unix:/path syntax, inetd-style sockets via the fd:0 syntax (where 0
+// is the fd number), and systemd socket activation via the sd:name syntax
+// (where name is the FileDescriptorName= of the socket, or empty for all
+// sockets). The latter can return several listeners. The iface:wg0:8080
+// syntax listens only on a network interface (see ListenInterface),
+// vsock:port listens for the hypervisor host over virtio-vsock, and a ws://
+// or wss:// URL accepts connections through a relay (see TunnelListener).
+func Listeners(addr string) ([]net.Listener, error) {
+	if fdstr, ok := strings.CutPrefix(addr, "fd:"); ok {
 		fd, err := strconv.Atoi(fdstr)
 		if err != nil {
 			return nil, err
 		}
-		f := os.NewFile(uintptr(fd), *listen)
+		f := os.NewFile(uintptr(fd), addr)
 		defer f.Close()
-		return net.FileListener(f)
+		lsn, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
+	} else if name, ok := strings.CutPrefix(addr, "sd:"); ok {
+		return ActivatedListenersNamed(name)
+	} else if iface, ok := strings.CutPrefix(addr, "iface:"); ok {
+		iface, port, ok := strings.Cut(iface, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected iface:NAME:PORT", addr)
+		}
+		lsn, err := ListenInterface(iface, port)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
+	} else if portstr, ok := strings.CutPrefix(addr, "vsock:"); ok {
+		port, err := strconv.ParseUint(portstr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		lsn, err := vsock.Listen(uint32(port), nil)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
+	} else if port, ok := strings.CutPrefix(addr, "tailscale:"); ok {
+		lsn, err := ListenTailscale(port)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
+	} else if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		lsn, err := NewTunnelListener(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
+	} else if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		lsn, err := ListenUnix(path)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
 	} else {
-		return net.Listen("tcp", addr)
+		lsn, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
 	}
 }
 
@@ -246,9 +1259,10 @@ func NewIdleHandler(shutdownIdle time.Duration, shutdownFunc func(context.Contex
 	if shutdownIdle > 0 {
 		ctx, cancel := context.WithCancel(context.Background())
 		t := time.AfterFunc(shutdownIdle, func() {
-			log.Printf("Server was idle for %.0f sec. Closing within %.0f sec...",
-				shutdownIdle.Seconds(), gracePeriod.Seconds())
-			ctx, _ := context.WithTimeout(context.Background(), gracePeriod)
+			slog.Info("Server was idle. Shutting down...",
+				"idle", shutdownIdle, "grace_period", gracePeriod)
+			ctx, cancelGrace := context.WithTimeout(context.Background(), gracePeriod)
+			defer cancelGrace()
 			defer cancel()
 			shutdownFunc(ctx)
 		})
@@ -261,30 +1275,579 @@ func NewIdleHandler(shutdownIdle time.Duration, shutdownFunc func(context.Contex
 	return handler, nil
 }
 
+// NewSite builds a handler for mux for each listener, with authentication
+// and rate limiting as specified by cfg and the listener's profile, and
+// loads the files they refer to.
+func NewSite(mux http.Handler, lsns []Listener, cfg *Settings) (*Site, error) {
+	s := &Site{Settings: *cfg}
+	var err error
+	if s.Logger, err = NewLogger(cfg.LogFormat, cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	if s.BasePath, err = CleanBasePath(cfg.BasePath); err != nil {
+		return nil, err
+	}
+	if s.TrustedProxies, err = ParseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if s.TLS, err = ParseTLSSettings(cfg.TLSMinVersion, cfg.TLSCiphers, cfg.TLSCurves); err != nil {
+		return nil, err
+	}
+	if cfg.CORSOrigins > "" {
+		if s.CORS, err = ParseCORS(cfg.CORSOrigins); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TOTPSecretFile > "" {
+		if s.TOTP, err = LoadTOTP(cfg.TOTPSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AgeSecretsFile > "" {
+		if s.AgeSecrets, err = LoadAgeSecrets(cfg.AgeSecretsFile, *ageIdentity); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AnswerKeyFile > "" {
+		if s.AnswerKey, err = LoadAnswerKey(cfg.AnswerKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RulesFile > "" {
+		if s.Rules, err = LoadRules(cfg.RulesFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Lang > "" {
+		if err := CheckLang(cfg.Lang); err != nil {
+			return nil, err
+		}
+	}
+	if s.Branding, err = LoadBranding(cfg); err != nil {
+		return nil, err
+	}
+	s.Templates = builtinTemplates
+	if cfg.TemplatesDir > "" {
+		if s.Templates, err = LoadTemplates(cfg.TemplatesDir); err != nil {
+			return nil, err
+		}
+	}
+
+	handler := mux
+	authRequired := false
+	var passwords Passwords
+	if cfg.AuthHtpasswd > "" {
+		htpasswd, err := LoadHtpasswd(cfg.AuthHtpasswd)
+		if err != nil {
+			return nil, err
+		}
+		passwords = append(passwords, htpasswd)
+	}
+	if cfg.LDAPURL > "" {
+		l := &LDAP{
+			URL:         cfg.LDAPURL,
+			StartTLS:    cfg.LDAPStartTLS,
+			BaseDN:      cfg.LDAPBaseDN,
+			UserFilter:  cfg.LDAPUserFilter,
+			GroupFilter: cfg.LDAPGroupFilter,
+			BindDN:      cfg.LDAPBindDN,
+			UserDN:      cfg.LDAPUserDN,
+		}
+		if l.BindDN == "" && l.UserDN == "" {
+			return nil, errors.New("-ldap-url requires either -ldap-bind-dn or -ldap-user-dn")
+		}
+		if (l.BindDN != "" || l.GroupFilter != "") && l.BaseDN == "" {
+			return nil, errors.New("-ldap-bind-dn and -ldap-group-filter require -ldap-base-dn")
+		}
+		if cfg.LDAPBindPasswordFile > "" {
+			b, err := os.ReadFile(cfg.LDAPBindPasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			l.BindPassword = strings.TrimSpace(string(b))
+		}
+		passwords = append(passwords, l)
+	}
+	if len(passwords) > 0 {
+		handler = BasicAuth(passwords, handler)
+		authRequired = true
+	}
+
+	if cfg.OIDCIssuer > "" {
+		if cfg.OIDCClientID == "" || cfg.OIDCRedirectURL == "" {
+			return nil, errors.New("-oidc-issuer requires -oidc-client-id and -oidc-redirect-url")
+		}
+		o := &OIDC{
+			Issuer:      cfg.OIDCIssuer,
+			ClientID:    cfg.OIDCClientID,
+			RedirectURL: cfg.OIDCRedirectURL,
+			GroupsClaim: cfg.OIDCGroupsClaim,
+		}
+		if cfg.OIDCClientSecretFile > "" {
+			b, err := os.ReadFile(cfg.OIDCClientSecretFile)
+			if err != nil {
+				return nil, err
+			}
+			o.ClientSecret = strings.TrimSpace(string(b))
+		}
+		if cfg.OIDCAllowGroups > "" {
+			o.AllowGroups = strings.Split(cfg.OIDCAllowGroups, ",")
+		}
+		handler = o.Middleware(handler)
+		authRequired = true
+	}
+	if cfg.SPNEGOKeytab > "" {
+		kt, err := keytab.Load(cfg.SPNEGOKeytab)
+		if err != nil {
+			return nil, err
+		}
+		handler = SPNEGOAuth(kt, cfg.SPNEGOPrincipal, handler)
+		authRequired = true
+	}
+	if cfg.QRHandoff && authRequired {
+		handler = HandoffAuth(handler)
+	}
+	var tokens Tokens
+	if cfg.AuthTokens > "" {
+		if tokens, err = LoadTokens(cfg.AuthTokens); err != nil {
+			return nil, err
+		}
+		otherwise := handler
+		if !authRequired {
+			otherwise = http.HandlerFunc(RequireBearer)
+		}
+		handler = TokenAuth(tokens, mux, otherwise)
+	}
+
+	var peers *PeerCreds
+	if cfg.UnixAllowUIDs > "" || cfg.UnixAllowGIDs > "" {
+		if peers, err = ParsePeerCreds(cfg.UnixAllowUIDs, cfg.UnixAllowGIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	if *cert > "" {
+		c, err := LoadKeyPair(*cert, *key)
+		if err != nil {
+			return nil, err
+		}
+		s.Cert = &c
+	} else if *tlsSelfSigned && *acmeDomain == "" {
+		if s.Cert, err = LoadSelfSigned(*tlsSelfSignedDir); err != nil {
+			return nil, err
+		}
+	}
+	var allow []string
+	if cfg.ClientCA > "" {
+		if !HaveCert() {
+			return nil, errors.New("-client-ca requires a certificate")
+		}
+		if s.ClientCAs, err = LoadCertPool(cfg.ClientCA); err != nil {
+			return nil, err
+		}
+		if cfg.ClientAllow > "" {
+			allow = strings.Split(cfg.ClientAllow, ",")
+		}
+	}
+
+	limiter := &RateLimiter{Rate: rate.Limit(cfg.RateLimit), Burst: cfg.RateBurst}
+	for _, l := range lsns {
+		if l.Proxy && l.Addr().Network() != "tunnel" && len(s.TrustedProxies.Prefixes) == 0 && !s.TrustedProxies.Unix {
+			return nil, fmt.Errorf("%s: proxy=on requires -trusted-proxies", l.URL())
+		}
+		var h http.Handler
+		switch l.Auth {
+		case AuthAll:
+			h = handler
+			// With client certificates, which are checked below, a token
+			// is an alternative, rather than also required:
+			if tokens != nil && !authRequired && l.TLS && s.ClientCAs != nil {
+				h = TokenAuth(tokens, mux, mux)
+			}
+		case AuthTokens:
+			h = TokenAuth(tokens, mux, http.HandlerFunc(RequireBearer))
+		case AuthNone:
+			h = mux
+		}
+		h = Assets(h)
+		if s.CORS != nil {
+			h = s.CORS.Middleware(h)
+		}
+		if peers != nil {
+			h = PeerCredAuth(peers, h)
+		}
+		h = limiter.Middleware(h)
+		// Client certificates can only be required over TLS, so without it
+		// the listener would be open to anyone if they were all there was:
+		if s.ClientCAs != nil && l.Auth == AuthAll && !l.TLS && !authRequired && tokens == nil && (peers == nil || l.Addr().Network() != "unix") {
+			return nil, fmt.Errorf("%s: -client-ca requires TLS, or another means of authentication on this listener", l.URL())
+		}
+		if l.TLS {
+			if !HaveCert() {
+				return nil, fmt.Errorf("%s: TLS requires -cert, -acme-domain or -tls-selfsigned", l.URL())
+			}
+			if s.ClientCAs != nil && l.Auth == AuthAll {
+				h = ClientCertAuth(allow, h)
+			}
+		}
+		s.Handlers = append(s.Handlers, h)
+	}
+	// Last, so that it's not left open if anything else fails:
+	if cfg.AccessLogPath > "" {
+		if s.AccessLog, err = OpenAccessLog(cfg.AccessLogPath, cfg.AccessLogFormat); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
 func main() {
 	flag.Parse()
-	http.HandleFunc("/", ServeIndex)
-	http.HandleFunc("/pass", ServePass)
-	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+	if err := LoadEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if err := LoadConfig(flag.CommandLine, *config, !explicit["config"]); err != nil {
+		log.Fatal(err)
+	}
+	if err := SetupLogging(settings.LogFormat, settings.LogLevel); err != nil {
+		log.Fatal(err)
+	}
+	// Not http.DefaultServeMux, which has the debug endpoints:
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServeIndex)
+	mux.Handle("/pass", formPassDeprecation.Middleware(http.HandlerFunc(ServePass)))
+	mux.HandleFunc("/cancel", ServeCancel)
+	mux.HandleFunc("/cancel-all", ServeCancelAll)
+	mux.HandleFunc("/fido2", ServeFIDO2)
+	mux.HandleFunc("/share", ServeShare)
+	mux.HandleFunc("/approve", ServeApprove)
+	mux.HandleFunc("/reject", ServeReject)
+	mux.HandleFunc(logoutPath, ServeLogout)
+	mux.HandleFunc(qrPath, ServeQR)
+	mux.HandleFunc("/webpush", ServeWebPush)
+	mux.HandleFunc("/icon/", ServeIcon)
+	mux.HandleFunc("/api/v1/prompts", ServeAPIPrompts)
+	mux.HandleFunc("/api/v1/prompts/", ServeAPIPrompt)
+	mux.HandleFunc("/api/v1/wait", ServeAPIWait)
+	mux.HandleFunc("/api/v1/cancel-all", ServeAPICancelAll)
+	mux.HandleFunc("/api/v1/answer-key", ServeAPIAnswerKey)
+	mux.HandleFunc("/api/v1/approvals", ServeAPIApprovals)
+	mux.HandleFunc("/api/v1/approvals/", ServeAPIApproval)
+	mux.Handle("/api/v1/ws", ServeAPIWebSocket)
+	mux.HandleFunc(openapiPath, ServeAPIOpenAPI)
+	mux.HandleFunc("/events", ServeEvents)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "User-Agent: *\nDisallow: /\n")
-		log.Println("/robots.txt was requested. Please do NOT expose this to the internet. *facepalm*")
+		Logger(r).Warn("/robots.txt was requested. Please do NOT expose this to the internet. *facepalm*")
 	})
 
-	lsn, err := Listener(*listen)
+	if *otlpEndpoint > "" {
+		shutdown, err := SetupTracing(context.Background(), *otlpEndpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer shutdown(context.Background())
+	}
+
+	if *acmeDomain > "" {
+		if err := SetupACME(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *debugListen > "" {
+		// They're only for diagnosis, so carry on without them:
+		go func() {
+			if err := ServeDebug(*debugListen); err != nil {
+				slog.Error("Serving debug endpoints", "err", err)
+			}
+		}()
+	}
+
+	hub.Update(NewAskers())
+	go func() {
+		if err := hub.Watch(context.Background(), *askDir, 10*time.Second); err != nil {
+			slog.Warn("Can't watch ask directory, polling instead", "err", err)
+			hub.Poll(context.Background(), time.Second)
+		}
+	}()
+	if *auditLog > "" {
+		var err error
+		if auditor, err = OpenAuditor(*auditLog); err != nil {
+			log.Fatal(err)
+		}
+		go auditor.AuditPrompts(hub)
+	}
+
+	lsns, err := OpenListeners(ListenValues())
+	if err != nil {
+		log.Fatal(err)
+	}
+	LimitConnections(lsns, *maxConnections)
+	replySlots = NewSemaphore(*maxAnswers)
+	s, err := NewSite(mux, lsns, settings)
 	if err != nil {
 		log.Fatal(err)
 	}
-	var srv http.Server
-	h, done := NewIdleHandler(*idle, srv.Shutdown, http.DefaultServeMux)
-	srv.Handler = h
+	s.Activate()
+	if s.Cert != nil && *cert == "" {
+		slog.Info("Using self-signed certificate", "sha256", Fingerprint(s.Cert.Certificate[0]))
+	}
 	if *cert > "" {
-		log.Printf("Listening on https://%s", lsn.Addr())
-		err = fmt.Errorf("http.Server: ServeTLS: %w", srv.ServeTLS(lsn, *cert, *key))
-	} else {
-		log.Printf("Listening on http://%s", lsn.Addr())
-		err = fmt.Errorf("http.Server: Serve: %w", srv.Serve(lsn))
+		go func() {
+			if err := WatchCert(context.Background(), time.Hour); err != nil {
+				slog.Warn("Can't watch certificate, reloading hourly instead", "err", err)
+				PollCert(context.Background(), time.Hour)
+			}
+		}()
 	}
-	if err != nil {
+	go ReloadOnSIGHUP(mux, lsns, explicit)
+
+	notifiers := make(map[string]Notifier)
+	if *webpushDir > "" {
+		if webPush, err = OpenWebPush(*webpushDir, *webpushSubject); err != nil {
+			log.Fatal(err)
+		}
+		notifiers["webpush"] = webPush
+	}
+	if *ntfyURL > "" {
+		n, err := NewNtfy(*ntfyURL, *ntfyTokenFile, *ntfyPriority)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers["ntfy"] = n
+	}
+	if *pushoverUser > "" {
+		p, err := NewPushover(*pushoverTokenFile, *pushoverUser, *pushoverPriority, *pushoverRemind)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers["pushover"] = p
+	}
+	if *gotifyURL > "" {
+		g, err := NewGotify(*gotifyURL, *gotifyTokenFile, *gotifyPriority, *gotifyTemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers["gotify"] = g
+	}
+	if *telegramChats > "" {
+		t, err := NewTelegram(*telegramTokenFile, *telegramChats, *telegramAnswer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers["telegram"] = t
+		if t.Answer {
+			go t.Poll(context.Background())
+		}
+	}
+	if *matrixHomeserver > "" {
+		m, err := NewMatrix(*matrixHomeserver, *matrixTokenFile, *matrixRoom, *matrixAnswerUsers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers["matrix"] = m
+		if len(m.AnswerUsers) > 0 {
+			go m.Sync(context.Background())
+		}
+	}
+	if *signalAccount > "" {
+		s, err := NewSignal(*signalAccount, *signalRecipients, *signalRESTURL, *signalCLI)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers["signal"] = s
+	}
+	for kind, url := range map[string]string{
+		ChatSlack:      *slackWebhookURL,
+		ChatDiscord:    *discordWebhookURL,
+		ChatMattermost: *mattermostWebhookURL,
+	} {
+		if url == "" {
+			continue
+		}
+		c, err := NewChatWebhook(kind, url, *chatTemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers[kind] = c
+	}
+	if len(unifiedPushEndpoint.values) > 0 {
+		u, err := NewUnifiedPush(unifiedPushEndpoint.values)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers["unifiedpush"] = u
+	}
+	dispatcher := NewDispatcher(*notifyDedupe)
+	for name, n := range notifiers {
+		f := notifyFlags[name]
+		if !*f.Enabled {
+			slog.Info("Notifications are disabled", "notifier", name)
+			continue
+		}
+		title, message := *f.Title, *f.Message
+		if title == "" {
+			title = *notifyTitle
+		}
+		if message == "" {
+			message = *notifyMessage
+		}
+		if err := dispatcher.Add(name, n, title, message); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if dispatcher.Len() > 0 {
+		go dispatcher.Run(hub, lsns)
+	}
+	if *vaultAddr > "" {
+		if vault, err = NewVault(*vaultAddr, *vaultCACert, *vaultNamespace, *vaultAuthMount, *vaultRoleID, *vaultSecretIDFile, *vaultCert, *vaultKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *opConnectHost > "" {
+		if onePassword, err = NewOnePassword(*opConnectHost, *opConnectTokenFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *bitwardenClientID > "" {
+		if bitwarden, err = NewBitwarden(*bitwardenURL, *bitwardenClientID, *bitwardenSecretFile, *bitwardenPasswordFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Even without -rules, as they may be added on SIGHUP:
+	go NewAutoAnswerer().Run(hub)
+	if *keyringCache > 0 {
+		go AnswerFromCache(hub)
+	}
+	if *mqttBroker > "" {
+		m, err := NewMQTT(*mqttBroker, *mqttUser, *mqttPasswordFile, *mqttTopic, *mqttDiscoveryPrefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go m.Run(hub, lsns)
+	}
+	if len(webhookURL.values) > 0 {
+		w, err := NewWebhooks(webhookURL.values, *webhookSecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go w.Run(hub, lsns)
+	}
+
+	var handler http.Handler = SiteHandler
+	handler = StripBasePath(handler)
+	handler = LimitBodies(handler)
+	handler = CountRequests(handler)
+	handler = LogRequests(handler)
+	handler = LogAccess(handler)
+	handler = ForwardedHeaders(handler)
+	handler = AssignRequestIDs(handler)
+	handler = TraceRequests(handler)
+	handler = KeepResponseController(handler)
+
+	servers := make([]*http.Server, len(lsns))
+	for i, l := range lsns {
+		servers[i] = &http.Server{
+			BaseContext: ListenerContext(i),
+			ConnContext: PeerCredContext,
+		}
+		SetTimeouts(servers[i])
+		if l.TLS {
+			servers[i].TLSConfig = SiteTLSConfig(l.Auth == AuthAll)
+		}
+	}
+	var quicSrv *QUICServer
+	if *listenQUIC > "" {
+		if quicSrv, err = ListenQUIC(*listenQUIC, lsns); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *console > "" {
+		go func() {
+			if err := ShowOnConsole(*console, lsns); err != nil {
+				slog.Warn("Can't show URL on console", "err", err)
+			}
+		}()
+	}
+	var mdnsSrv *mdns.Server
+	if *mdnsAnnounce {
+		if mdnsSrv, err = Announce(lsns); err != nil {
+			slog.Warn("Can't announce with mDNS", "err", err)
+		}
+	}
+	shutdown := func(ctx context.Context) error {
+		var wg sync.WaitGroup
+		errs := make([]error, len(servers), len(servers)+2)
+		for i, srv := range servers {
+			wg.Add(1)
+			go func(i int, srv *http.Server) {
+				defer wg.Done()
+				errs[i] = srv.Shutdown(ctx)
+			}(i, srv)
+		}
+		wg.Wait()
+		if quicSrv != nil {
+			errs = append(errs, quicSrv.Close())
+		}
+		if mdnsSrv != nil {
+			errs = append(errs, mdnsSrv.Shutdown())
+		}
+		return errors.Join(errs...)
+	}
+
+	h, done := NewIdleHandler(*idle, shutdown, handler)
+	errs := make(chan error, len(lsns)+2)
+	for i, l := range lsns {
+		srv := servers[i]
+		srv.Handler = h
+		if quicSrv != nil && l.TLS {
+			srv.Handler = quicSrv.Advertise(srv.Handler)
+		}
+		if l.H2C {
+			srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+		}
+		slog.Info("Listening on " + l.URL())
+		go func(l Listener) {
+			if l.TLS {
+				errs <- fmt.Errorf("http.Server: ServeTLS: %w", srv.ServeTLS(l, "", ""))
+			} else {
+				errs <- fmt.Errorf("http.Server: Serve: %w", srv.Serve(l))
+			}
+		}(l)
+	}
+	if quicSrv != nil {
+		slog.Info("Listening on quic:" + quicSrv.Addr().String())
+		go func() {
+			errs <- fmt.Errorf("http3.Server: Serve: %w", quicSrv.Serve(h))
+		}()
+	}
+	if *redirectListen > "" {
+		port, err := RedirectPort(lsns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rlsns, err := Listeners(*redirectListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rh := RedirectHandler(port, *acmeWebroot)
+		if acmeIssuer != nil {
+			rh = acmeIssuer.HTTPChallengeHandler(rh)
+		}
+		srv := http.Server{Handler: LogRequests(rh)}
+		SetTimeouts(&srv)
+		for _, lsn := range rlsns {
+			slog.Info("Redirecting to HTTPS from http://" + lsn.Addr().String())
+			go func(lsn net.Listener) {
+				errs <- fmt.Errorf("http.Server: Serve: %w", srv.Serve(lsn))
+			}(lsn)
+		}
+	}
+	if err := <-errs; err != nil {
 		if errors.Is(err, http.ErrServerClosed) {
 			<-done // wait for shutdown to finish
 			return // success
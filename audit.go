@@ -0,0 +1,93 @@
+package main
+
+// Audit log of security-relevant events, kept separate from the diagnostic
+// log. Secrets are never recorded.
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditor is nil unless -audit-log is specified.
+var auditor *Auditor
+
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Result     string    `json:"result,omitempty"` // "success" or "failure"
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Prompt     string    `json:"prompt,omitempty"`
+	Message    string    `json:"message,omitempty"` // the prompt's question
+	ID         string    `json:"id,omitempty"`      // the prompt's Id
+	Error      string    `json:"error,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// Auditor appends records to a file as JSON lines.
+type Auditor struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// OpenAuditor opens the file for appending, creating it if necessary.
+func OpenAuditor(path string) (*Auditor, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Auditor{enc: json.NewEncoder(f)}, nil
+}
+
+func (a *Auditor) Write(rec AuditRecord) {
+	if a == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(rec); err != nil {
+		slog.Error("Writing audit log", "err", err)
+	}
+}
+
+// Audit records an event caused by a request. If err is nil the result is
+// success, otherwise failure.
+func Audit(r *http.Request, event, prompt string, err error) {
+	if auditor == nil {
+		return
+	}
+	rec := AuditRecord{
+		Event:      event,
+		Result:     "success",
+		RemoteAddr: ClientIP(r),
+		User:       User(r),
+		Prompt:     prompt,
+		RequestID:  RequestID(r),
+	}
+	if err != nil {
+		rec.Result = "failure"
+		rec.Error = err.Error()
+	}
+	auditor.Write(rec)
+}
+
+// AuditPrompts records prompts appearing and disappearing. It doesn't
+// return.
+func (a *Auditor) AuditPrompts(h *Hub) {
+	events, _ := h.SubscribeAll()
+	for e := range events {
+		a.Write(AuditRecord{
+			Event:   "prompt-" + string(e.Type),
+			Prompt:  e.Prompt.Name,
+			Message: e.Prompt.Message,
+			ID:      e.Prompt.ID,
+		})
+	}
+}
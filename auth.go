@@ -0,0 +1,291 @@
+package main
+
+// Authentication of HTTP clients.
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// dummyHash is compared against when the user doesn't exist, so that unknown
+// users take as long to reject as known users with the wrong password.
+var dummyHash = []byte("$2a$10$fMEny1ZKCkqJJlYVQWML0e.Q3wZlc2FmvGEU4a62uPSbvrTrWG7.C")
+
+type userKey struct{}
+
+// WithUser returns a copy of r carrying the authenticated user name, which
+// is also included in the request's log messages and access log record.
+func WithUser(r *http.Request, user string) *http.Request {
+	setAccessUser(r, user)
+	r = WithLogAttrs(r, "user", user)
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
+// User returns the authenticated user name, or "" if unauthenticated.
+func User(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+type readOnlyKey struct{}
+
+// WithReadOnly returns a copy of r that is not authorized to answer or cancel
+// prompts, although it may still list them.
+func WithReadOnly(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), readOnlyKey{}, true))
+}
+
+// MayAnswer reports whether the request is authorized to answer or cancel
+// prompts.
+func MayAnswer(r *http.Request) bool {
+	readOnly, _ := r.Context().Value(readOnlyKey{}).(bool)
+	return !readOnly
+}
+
+// PasswordAuthenticator checks a user name and password.
+type PasswordAuthenticator interface {
+	Authenticate(user, pass string) error
+}
+
+// Passwords tries each PasswordAuthenticator in turn, succeeding if any of
+// them do.
+type Passwords []PasswordAuthenticator
+
+func (p Passwords) Authenticate(user, pass string) error {
+	err := ErrUnauthorized
+	for _, a := range p {
+		if err = a.Authenticate(user, pass); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Htpasswd maps user names to bcrypt password hashes.
+type Htpasswd map[string][]byte
+
+// LoadHtpasswd reads an Apache-style htpasswd file, as created by
+// `htpasswd -B`. Only bcrypt hashes are supported.
+func LoadHtpasswd(path string) (Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(Htpasswd)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: missing ':'", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %q: only bcrypt hashes are supported: %w", path, n, user, err)
+		}
+		out[user] = []byte(hash)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Authenticate returns nil if the password is correct for the user.
+func (h Htpasswd) Authenticate(user, pass string) error {
+	hash, ok := h[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return ErrUnauthorized
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(pass)); err != nil {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// BasicAuth requires every request to carry HTTP Basic credentials that are
+// valid according to p, or to belong to a session started by logging in with
+// those credentials. Browsers are sent to the login page.
+func BasicAuth(p PasswordAuthenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == loginPath {
+			ServeLogin(p, w, r)
+			return
+		}
+		if sess := sessions.Get(r); sess != nil {
+			next.ServeHTTP(w, sess.Apply(r))
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if ok {
+			if p.Authenticate(user, pass) == nil {
+				next.ServeHTTP(w, WithUser(r, user))
+				return
+			}
+			AuthFailed(r, "basic", user)
+		}
+		if !ok && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			RedirectToLogin(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="askpass-http", charset="UTF-8"`)
+		Error(w, r, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// LoadCertPool reads one or more PEM-encoded CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// CertNames returns the subject common name and all subject alternative
+// names of the certificate.
+func CertNames(c *x509.Certificate) []string {
+	names := []string{c.Subject.CommonName}
+	names = append(names, c.DNSNames...)
+	names = append(names, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// ClientCertAuth identifies the user by the verified TLS client certificate.
+// The TLS listener must already require and verify client certificates; this
+// additionally restricts access to certificates with a CN or SAN listed in
+// allow, unless allow is empty.
+func ClientCertAuth(allow []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			Error(w, r, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+		leaf := r.TLS.VerifiedChains[0][0]
+		if len(allow) > 0 && !slices.ContainsFunc(CertNames(leaf), func(name string) bool {
+			return name != "" && slices.Contains(allow, name)
+		}) {
+			Error(w, r, fmt.Sprintf("Client certificate %q is not allowed", leaf.Subject), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, WithUser(r, leaf.Subject.CommonName))
+	})
+}
+
+// CredentialPath returns the path of the named systemd credential (see
+// systemd.exec(5) LoadCredential=), or "" if it wasn't passed to us.
+func CredentialPath(name string) string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return ""
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// Tokens maps SHA-256 digests of API bearer tokens to a name identifying the
+// token holder. Digests are compared rather than the tokens themselves, so
+// the comparison time doesn't depend on the token length.
+type Tokens map[[sha256.Size]byte]string
+
+// LoadTokens reads a file containing one token per line, optionally preceded
+// by a name and a colon, e.g. "monitoring:3fa9c0...". Unnamed tokens are
+// identified by their line number.
+func LoadTokens(path string) (Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(Tokens)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(line, ":")
+		if !ok {
+			name, token = fmt.Sprintf("token%d", n), line
+		}
+		out[sha256.Sum256([]byte(token))] = name
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Authenticate returns the name of the token holder. Every token is
+// compared, so timing doesn't reveal which one (if any) matched.
+func (t Tokens) Authenticate(token string) (string, error) {
+	got := sha256.Sum256([]byte(token))
+	var name string
+	for want, n := range t {
+		if subtle.ConstantTimeCompare(got[:], want[:]) == 1 {
+			name = n
+		}
+	}
+	if name == "" {
+		return "", ErrUnauthorized
+	}
+	return name, nil
+}
+
+// TokenAuth accepts requests carrying a valid "Authorization: Bearer" token.
+// Requests without a bearer token are passed to otherwise, which may
+// authenticate them by other means.
+func TokenAuth(t Tokens, next, otherwise http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			otherwise.ServeHTTP(w, r)
+			return
+		}
+		name, err := t.Authenticate(strings.TrimSpace(token))
+		if err != nil {
+			AuthFailed(r, "token", "")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="askpass-http", error="invalid_token"`)
+			Error(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, WithUser(r, name))
+	})
+}
+
+// RequireBearer rejects all requests. It is used as the fallback for
+// TokenAuth when there is no other means of authentication.
+func RequireBearer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="askpass-http"`)
+	Error(w, r, "Unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useTestSite makes s the current site for the duration of the test, with
+// the built-in templates unless it has others.
+func useTestSite(t *testing.T, s *Site) {
+	t.Helper()
+	if s.Settings == (Settings{}) {
+		s.Settings = *settings
+	}
+	if s.Templates == nil {
+		s.Templates = builtinTemplates
+	}
+	if s.Branding == nil {
+		s.Branding = &Branding{Title: "Askpass", Header: "Askpass"}
+	}
+	old := site.Load()
+	site.Store(s)
+	t.Cleanup(func() { site.Store(old) })
+}
+
+// testHtpasswd returns an htpasswd file with the given users and passwords.
+func testHtpasswd(t *testing.T, userpass ...string) string {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("# users\n\n")
+	for i := 0; i < len(userpass); i += 2 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(userpass[i+1]), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.WriteString(userpass[i] + ":" + string(hash) + "\n")
+	}
+	return b.String()
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	h, err := LoadHtpasswd(writeTempFile(t, "htpasswd", testHtpasswd(t, "alice", "hunter2", "bob", "correct horse")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 2 {
+		t.Errorf("loaded %d users, want 2", len(h))
+	}
+	for name, data := range map[string]string{
+		"no colon": "alice\n",
+		"md5":      "alice:$apr1$Vbb2eZMU$cDVSlJMoSqDRqy9K1n2wj/\n",
+		"crypt":    "alice:rqXexS6ZhobKA\n",
+		"sha1":     "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n",
+	} {
+		if _, err := LoadHtpasswd(writeTempFile(t, "htpasswd", data)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+	if _, err := LoadHtpasswd(t.TempDir() + "/missing"); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	h, err := LoadHtpasswd(writeTempFile(t, "htpasswd", testHtpasswd(t, "alice", "hunter2", "bob", "correct horse")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "hunter2", true},
+		{"bob", "correct horse", true},
+		{"alice", "correct horse", false},
+		{"alice", "", false},
+		{"alice", "hunter2 ", false},
+		{"carol", "hunter2", false},
+		{"", "", false},
+	} {
+		err := h.Authenticate(tt.user, tt.pass)
+		if (err == nil) != tt.ok {
+			t.Errorf("Authenticate(%q, %q) = %v", tt.user, tt.pass, err)
+		}
+		if err != nil && err != ErrUnauthorized {
+			t.Errorf("Authenticate(%q, %q) = %v, want ErrUnauthorized", tt.user, tt.pass, err)
+		}
+	}
+
+	// Any of several backends may accept:
+	other, err := LoadHtpasswd(writeTempFile(t, "htpasswd", testHtpasswd(t, "carol", "swordfish")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Passwords{h, other}
+	if err := p.Authenticate("carol", "swordfish"); err != nil {
+		t.Errorf("Passwords.Authenticate(carol) = %v", err)
+	}
+	if err := p.Authenticate("carol", "hunter2"); err == nil {
+		t.Error("Passwords accepted the wrong password")
+	}
+	if err := (Passwords{}).Authenticate("alice", "hunter2"); err == nil {
+		t.Error("no Passwords accepted a password")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	useTestSite(t, &Site{})
+	h, err := LoadHtpasswd(writeTempFile(t, "htpasswd", testHtpasswd(t, "alice", "hunter2")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := BasicAuth(h, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + User(r)))
+	}))
+
+	for _, tt := range []struct {
+		name       string
+		user, pass string // none if user is ""
+		accept     string
+		wantCode   int
+		wantBody   string
+		wantHeader string // WWW-Authenticate or Location
+	}{
+		{name: "correct", user: "alice", pass: "hunter2", wantCode: http.StatusOK, wantBody: "hello alice"},
+		{name: "wrong password", user: "alice", pass: "hunter3", wantCode: http.StatusUnauthorized, wantHeader: "Basic"},
+		{name: "unknown user", user: "mallory", pass: "hunter2", wantCode: http.StatusUnauthorized, wantHeader: "Basic"},
+		{name: "wrong password from a browser", user: "alice", pass: "hunter3", accept: "text/html", wantCode: http.StatusUnauthorized, wantHeader: "Basic"},
+		{name: "no credentials", wantCode: http.StatusUnauthorized, wantHeader: "Basic"},
+		{name: "no credentials from a browser", accept: "text/html,application/xhtml+xml", wantCode: http.StatusFound, wantHeader: "/login?next=%2Fsecret%3Fx%3Dy"},
+	} {
+		req := httptest.NewRequest("GET", "/secret?x=y", nil)
+		if tt.user > "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		if tt.accept > "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if tt.wantBody > "" && w.Body.String() != tt.wantBody {
+			t.Errorf("%s: body %q, want %q", tt.name, w.Body, tt.wantBody)
+		}
+		if got := w.Header().Get("WWW-Authenticate") + w.Header().Get("Location"); !strings.HasPrefix(got, tt.wantHeader) {
+			t.Errorf("%s: WWW-Authenticate/Location = %q, want %q", tt.name, got, tt.wantHeader)
+		}
+		if tt.wantCode != http.StatusOK && strings.Contains(w.Body.String(), "hello") {
+			t.Errorf("%s: reached the handler", tt.name)
+		}
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	useTestSite(t, &Site{})
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice"},
+		DNSNames:       []string{"laptop.example.com"},
+		EmailAddresses: []string{"alice@example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/alice"}},
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	handler := func(allow ...string) http.Handler {
+		return ClientCertAuth(allow, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello " + User(r)))
+		}))
+	}
+
+	for _, tt := range []struct {
+		name     string
+		tls      *tls.ConnectionState
+		allow    []string
+		wantCode int
+	}{
+		{"any verified cert", verified, nil, http.StatusOK},
+		{"allowed by CN", verified, []string{"bob", "alice"}, http.StatusOK},
+		{"allowed by DNS name", verified, []string{"laptop.example.com"}, http.StatusOK},
+		{"allowed by email", verified, []string{"alice@example.com"}, http.StatusOK},
+		{"allowed by URI", verified, []string{"spiffe://example.com/alice"}, http.StatusOK},
+		{"not allowed", verified, []string{"bob"}, http.StatusForbidden},
+		{"empty name isn't allowed", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, []string{""}, http.StatusForbidden},
+		{"no TLS", nil, nil, http.StatusUnauthorized},
+		{"unverified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, nil, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = tt.tls
+		w := httptest.NewRecorder()
+		handler(tt.allow...).ServeHTTP(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if tt.wantCode == http.StatusOK && w.Body.String() != "hello alice" {
+			t.Errorf("%s: body %q", tt.name, w.Body)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	useTestSite(t, &Site{})
+	tokens, err := LoadTokens(writeTempFile(t, "tokens", "monitoring:s3cret\n# a comment\n\nunnamed\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, want := range map[string]string{"s3cret": "monitoring", "unnamed": "token4"} {
+		if name, err := tokens.Authenticate(token); err != nil || name != want {
+			t.Errorf("Authenticate(%q) = %q, %v; want %q", token, name, err, want)
+		}
+	}
+	for _, token := range []string{"", "monitoring:s3cret", "S3CRET", "# a comment"} {
+		if name, err := tokens.Authenticate(token); err == nil {
+			t.Errorf("Authenticate(%q) = %q", token, name)
+		}
+	}
+
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + User(r)))
+	})
+	h := TokenAuth(tokens, hello, http.HandlerFunc(RequireBearer))
+	for _, tt := range []struct {
+		authorization string
+		wantCode      int
+		wantBody      string
+	}{
+		{"Bearer s3cret", http.StatusOK, "hello monitoring"},
+		{"Bearer wrong", http.StatusUnauthorized, ""},
+		{"Basic dXNlcjpwYXNz", http.StatusUnauthorized, ""},
+		{"", http.StatusUnauthorized, ""},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.authorization > "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantCode || tt.wantBody > "" && w.Body.String() != tt.wantBody {
+			t.Errorf("%q: %d %q, want %d %q", tt.authorization, w.Code, w.Body, tt.wantCode, tt.wantBody)
+		}
+		if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer ") {
+			t.Errorf("%q: WWW-Authenticate = %q", tt.authorization, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+// With client certificates and tokens, but nothing else, either will do.
+func TestClientCertOrToken(t *testing.T) {
+	useTestSite(t, &Site{})
+	certPath, _ := useTestCert(t)
+	cfg := *settings
+	cfg.ClientCA, cfg.AuthTokens = certPath, writeTempFile(t, "tokens", "monitoring:s3cret\n")
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsn.Close()
+
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + User(r)))
+	})
+	s, err := NewSite(hello, []Listener{{Listener: lsn, TLS: true, Auth: AuthAll}}, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "alice"}}}}}
+	for _, tt := range []struct {
+		name          string
+		tls           *tls.ConnectionState
+		authorization string
+		wantCode      int
+		wantBody      string
+	}{
+		{"browser with a certificate", verified, "", http.StatusOK, "hello alice"},
+		{"token too", verified, "Bearer s3cret", http.StatusOK, "hello monitoring"},
+		{"wrong token", verified, "Bearer wrong", http.StatusUnauthorized, ""},
+		{"no certificate", nil, "Bearer s3cret", http.StatusUnauthorized, ""},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "https://askpass.example.com/", nil)
+		r.TLS = tt.tls
+		if tt.authorization > "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		s.Handlers[0].ServeHTTP(w, r)
+		if w.Code != tt.wantCode || tt.wantBody > "" && w.Body.String() != tt.wantBody {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, w.Code, w.Body, tt.wantCode, tt.wantBody)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+// Secrets escrowed in AWS, fetched from Secrets Manager or decrypted with
+// KMS, with the credentials of the instance profile or the environment.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// awsConfig is loaded when first needed, rather than at startup, as the
+// network and the instance metadata service may not be reachable yet.
+var awsConfig struct {
+	sync.Mutex
+	cfg *aws.Config
+}
+
+// loadAWSConfig returns the default config, with the region of -aws-region,
+// or the environment, or the instance metadata.
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	awsConfig.Lock()
+	defer awsConfig.Unlock()
+	if awsConfig.cfg != nil {
+		return *awsConfig.cfg, nil
+	}
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithEC2IMDSRegion()}
+	if *awsRegion > "" {
+		opts = append(opts, awsconfig.WithRegion(*awsRegion))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return cfg, err
+	}
+	awsConfig.cfg = &cfg
+	return cfg, nil
+}
+
+// awsRef splits a secret's reference into what it refers to, and a config
+// with the region given by region=, if any.
+func awsRef(ctx context.Context, ref string) (string, url.Values, aws.Config, error) {
+	ref, query, _ := strings.Cut(ref, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, aws.Config{}, err
+	}
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return "", nil, cfg, err
+	}
+	if region := q.Get("region"); region > "" {
+		cfg.Region = region
+	}
+	return ref, q, cfg, nil
+}
+
+// awsSecretsManagerSecret fetches a secret from Secrets Manager, given as
+// its name or ARN, such as disks/data, or disks/data?field=passphrase for a
+// field of a secret stored as JSON.
+func awsSecretsManagerSecret(ctx context.Context, ref string, _ Prompt) ([]byte, error) {
+	id, q, cfg, err := awsRef(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("aws: %w", err)
+	}
+	out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("aws: %w", err)
+	}
+	if out.SecretString == nil {
+		return out.SecretBinary, nil
+	}
+	field := q.Get("field")
+	if field == "" {
+		return []byte(*out.SecretString), nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(*out.SecretString), &fields); err != nil {
+		return nil, fmt.Errorf("aws: %s: %w", id, err)
+	}
+	s, ok := fields[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("aws: %s: no string field %q", id, field)
+	}
+	return []byte(s), nil
+}
+
+// awsKMSSecret decrypts a file of ciphertext from KMS, as output by
+// aws kms encrypt, in base64 or not, such as /etc/askpass-http/data.kms, or
+// /etc/askpass-http/data.kms?key=alias/disks to insist on a key.
+func awsKMSSecret(ctx context.Context, ref string, _ Prompt) ([]byte, error) {
+	path, q, cfg, err := awsRef(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("aws: %w", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if d, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b))); err == nil {
+		b = d
+	}
+	in := &kms.DecryptInput{CiphertextBlob: b}
+	if key := q.Get("key"); key > "" {
+		in.KeyId = aws.String(key)
+	}
+	out, err := kms.NewFromConfig(cfg).Decrypt(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("aws: decrypting %s: %w", path, err)
+	}
+	return out.Plaintext, nil
+}
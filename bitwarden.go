@@ -0,0 +1,309 @@
+package main
+
+// Secrets kept in Bitwarden or Vaultwarden, decrypted here with the master
+// password, as the server only ever has them encrypted.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// bitwarden is nil unless -bitwarden-client-id is specified.
+var bitwarden *Bitwarden
+
+// Bitwarden logs in to a Bitwarden or Vaultwarden server with a personal
+// API key, and decrypts items with the keys unlocked by the master
+// password. The session is kept until the access token expires or is
+// rejected.
+type Bitwarden struct {
+	Identity, API string // URLs of the identity and API services
+
+	clientID, clientSecret, password string
+	deviceID                         string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	userKey []byte // encryption key followed by MAC key
+}
+
+// NewBitwarden returns a Bitwarden for the server at serverURL, such as
+// https://vault.bitwarden.com or a Vaultwarden server, logging in with the
+// API key's client ID and the secret read from secretFile, and unlocking
+// with the master password read from passwordFile.
+func NewBitwarden(serverURL, clientID, secretFile, passwordFile string) (*Bitwarden, error) {
+	if !strings.HasPrefix(serverURL, "https://") && !strings.HasPrefix(serverURL, "http://") {
+		return nil, fmt.Errorf("bitwarden: %q is not an http:// or https:// URL", serverURL)
+	}
+	if secretFile == "" || passwordFile == "" {
+		return nil, errors.New("bitwarden: the API key's client secret and the master password are required")
+	}
+	secret, err := os.ReadFile(secretFile)
+	if err != nil {
+		return nil, err
+	}
+	password, err := os.ReadFile(passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bitwarden{
+		clientID:     clientID,
+		clientSecret: strings.TrimSpace(string(secret)),
+		password:     strings.TrimRight(string(password), "\r\n"),
+		deviceID:     randomUUID(),
+	}
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	switch u, _ := url.Parse(serverURL); u.Host {
+	case "vault.bitwarden.com", "vault.bitwarden.eu":
+		// The cloud services are on their own hosts:
+		domain := strings.TrimPrefix(u.Host, "vault.")
+		b.Identity, b.API = "https://identity."+domain, "https://api."+domain
+	default:
+		b.Identity, b.API = serverURL+"/identity", serverURL+"/api"
+	}
+	return b, nil
+}
+
+// randomUUID returns a random version 4 UUID, for identifying this device.
+func randomUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// login logs in and unlocks the user's key, unless the session is still
+// good.
+func (b *Bitwarden) login(ctx context.Context) (string, []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token > "" && time.Now().Before(b.expires) {
+		return b.token, b.userKey, nil
+	}
+	form := url.Values{
+		"grant_type":       {"client_credentials"},
+		"scope":            {"api"},
+		"client_id":        {b.clientID},
+		"client_secret":    {b.clientSecret},
+		"deviceType":       {"8"}, // Linux desktop
+		"deviceIdentifier": {b.deviceID},
+		"deviceName":       {"askpass-http"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.Identity+"/connect/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if err := ResponseError(resp); err != nil {
+		return "", nil, fmt.Errorf("logging in: %w", err)
+	}
+	var res struct {
+		AccessToken    string `json:"access_token"`
+		ExpiresIn      int    `json:"expires_in"`
+		Key            string
+		Kdf            int
+		KdfIterations  int
+		KdfMemory      int
+		KdfParallelism int
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", nil, err
+	}
+
+	// The master key is derived from the password, salted with the email
+	// address, which is in the access token:
+	var claims struct {
+		Email string `json:"email"`
+	}
+	parts := strings.Split(res.AccessToken, ".")
+	if len(parts) != 3 {
+		return "", nil, errors.New("access token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", nil, fmt.Errorf("access token: %w", err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", nil, fmt.Errorf("access token: %w", err)
+	}
+	salt := []byte(strings.ToLower(strings.TrimSpace(claims.Email)))
+	var master []byte
+	switch res.Kdf {
+	case 0:
+		master = pbkdf2.Key([]byte(b.password), salt, res.KdfIterations, 32, sha256.New)
+	case 1:
+		s := sha256.Sum256(salt)
+		master = argon2.IDKey([]byte(b.password), s[:], uint32(res.KdfIterations), uint32(res.KdfMemory)*1024, uint8(res.KdfParallelism), 32)
+	default:
+		return "", nil, fmt.Errorf("unsupported KDF %d", res.Kdf)
+	}
+	stretched := make([]byte, 64)
+	io.ReadFull(hkdf.Expand(sha256.New, master, []byte("enc")), stretched[:32])
+	io.ReadFull(hkdf.Expand(sha256.New, master, []byte("mac")), stretched[32:])
+	userKey, err := bitwardenDecrypt(res.Key, stretched)
+	if err != nil {
+		return "", nil, fmt.Errorf("unlocking (is the master password right?): %w", err)
+	}
+	if len(userKey) != 64 {
+		return "", nil, errors.New("unlocking: unexpected user key")
+	}
+
+	b.token, b.userKey = res.AccessToken, userKey
+	b.expires = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second * 9 / 10)
+	return b.token, b.userKey, nil
+}
+
+// bitwardenDecrypt decrypts an AES-CBC encrypted string with an HMAC, of
+// the form 2.IV|CIPHERTEXT|MAC, with key, an encryption key followed by a
+// MAC key.
+func bitwardenDecrypt(s string, key []byte) ([]byte, error) {
+	typ, s, _ := strings.Cut(s, ".")
+	if typ != "2" {
+		return nil, fmt.Errorf("unsupported encryption type %s", typ)
+	}
+	parts := strings.Split(s, "|")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed encrypted string")
+	}
+	var iv, ciphertext, mac []byte
+	for i, p := range []*[]byte{&iv, &ciphertext, &mac} {
+		var err error
+		if *p, err = base64.StdEncoding.DecodeString(parts[i]); err != nil {
+			return nil, err
+		}
+	}
+	h := hmac.New(sha256.New, key[32:])
+	h.Write(iv)
+	h.Write(ciphertext)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return nil, errors.New("MAC mismatch")
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("malformed ciphertext")
+	}
+	b := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(b, ciphertext)
+	pad := int(b[len(b)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(b[len(b)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("bad padding")
+	}
+	return b[:len(b)-pad], nil
+}
+
+// bitwardenCipher is an item, with its strings encrypted.
+type bitwardenCipher struct {
+	OrganizationID string `json:"organizationId"`
+	Key            string `json:"key"` // the item's own key, if it has one
+	Login          struct {
+		Password string `json:"password"`
+	} `json:"login"`
+	Fields []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"fields"`
+}
+
+// cipher fetches an item, logging in afresh if the session was rejected.
+func (b *Bitwarden) cipher(ctx context.Context, id string) (*bitwardenCipher, []byte, error) {
+	for attempt := 1; ; attempt++ {
+		token, key, err := b.login(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.API+"/ciphers/"+url.PathEscape(id), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 1 {
+			resp.Body.Close()
+			b.mu.Lock()
+			b.token = ""
+			b.mu.Unlock()
+			continue
+		}
+		if err := ResponseError(resp); err != nil {
+			return nil, nil, err
+		}
+		var c bitwardenCipher
+		if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+			return nil, nil, err
+		}
+		return &c, key, nil
+	}
+}
+
+// bitwardenSecret decrypts an item's password, or a custom field, given as
+// the item's ID, such as 0f1e2d3c-..., or 0f1e2d3c-...?field=NAME.
+func bitwardenSecret(ctx context.Context, ref string, _ Prompt) ([]byte, error) {
+	if bitwarden == nil {
+		return nil, errors.New("bitwarden: -bitwarden-client-id is not set")
+	}
+	id, query, _ := strings.Cut(ref, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("bitwarden: %w", err)
+	}
+	c, key, err := bitwarden.cipher(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("bitwarden: %s: %w", id, err)
+	}
+	if c.OrganizationID != "" {
+		return nil, fmt.Errorf("bitwarden: %s: items shared with an organisation are unsupported", id)
+	}
+	if c.Key > "" {
+		if key, err = bitwardenDecrypt(c.Key, key); err != nil {
+			return nil, fmt.Errorf("bitwarden: %s: item key: %w", id, err)
+		}
+	}
+	field := q.Get("field")
+	if field == "" {
+		if c.Login.Password == "" {
+			return nil, fmt.Errorf("bitwarden: %s has no password", id)
+		}
+		return bitwardenDecrypt(c.Login.Password, key)
+	}
+	for _, f := range c.Fields {
+		if name, err := bitwardenDecrypt(f.Name, key); err == nil && string(name) == field {
+			return bitwardenDecrypt(f.Value, key)
+		}
+	}
+	return nil, fmt.Errorf("bitwarden: %s has no field %q", id, field)
+}
@@ -0,0 +1,84 @@
+package main
+
+// Identifying the site on its pages, with a title, logo and notice of the
+// operator's choosing, such as the warning against unauthorized access that
+// many compliance regimes require on pages like the login page.
+
+import (
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// logoPath is where -logo is served, if it's a file.
+const logoPath = "/logo"
+
+// Branding is how the pages identify the site.
+type Branding struct {
+	Title  string
+	Header string
+	Logo   string // URL of the logo, relative to the pages, or ""
+	Notice string
+
+	logo *asset // -logo, if it's a file
+}
+
+// LoadBranding reads the branding from -title, -header, -logo and -notice.
+// -logo is a http or https URL, or else a file to serve at /logo.
+func LoadBranding(cfg *Settings) (*Branding, error) {
+	b := &Branding{
+		Title:  cfg.Title,
+		Header: cfg.Header,
+		Logo:   cfg.Logo,
+		Notice: cfg.Notice,
+	}
+	if b.Header == "" {
+		b.Header = b.Title
+	}
+	if u, err := url.Parse(b.Logo); b.Logo == "" || err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return b, nil
+	}
+	body, err := os.ReadFile(b.Logo)
+	if err != nil {
+		return nil, fmt.Errorf("-logo: %w", err)
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(b.Logo))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	b.logo = &asset{contentType, body}
+	b.Logo = logoPath[1:]
+	return b, nil
+}
+
+// brandingFuncs give templates the current site's branding.
+var brandingFuncs = template.FuncMap{
+	"title":  func() string { return site.Load().Branding.Title },
+	"header": func() string { return site.Load().Branding.Header },
+	"logo":   func() string { return site.Load().Branding.Logo },
+	"notice": func() string { return site.Load().Branding.Notice },
+}
+
+// headerHTML defines the "header" template, which begins each page's body,
+// with the choice of theme, which needs JavaScript to remember it.
+const headerHTML = `{{ define "header" }}<p id="theme" hidden><label><input type="checkbox" /> {{ T "High contrast" }}</label></p>
+<script>
+(function() {
+	var p = document.getElementById("theme");
+	var input = p.querySelector("input");
+	input.checked = document.documentElement.dataset.theme === "contrast";
+	input.addEventListener("change", function() {
+		var theme = input.checked ? "contrast" : "";
+		if (theme) document.documentElement.dataset.theme = theme;
+		else delete document.documentElement.dataset.theme;
+		try { localStorage.setItem("theme", theme); } catch (e) {}
+	});
+	p.hidden = false;
+})();
+</script>
+<h1>{{ with logo }}<img class="logo" src="{{ . }}" alt="" /> {{ end }}{{ header }}</h1>
+{{ with notice }}<p class="notice">{{ . }}</p>{{ end }}{{ end }}`
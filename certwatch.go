@@ -0,0 +1,106 @@
+package main
+
+// Picking up renewed certificates without restarting, as the server may run
+// for weeks on a machine that's rarely rebooted.
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ReloadCert loads -cert and -key, and makes them the current site's
+// certificate if they have changed.
+func ReloadCert() error {
+	c, err := LoadKeyPair(*cert, *key)
+	if err != nil {
+		return err
+	}
+	for {
+		s := site.Load()
+		if s.Cert != nil && bytes.Equal(s.Cert.Certificate[0], c.Certificate[0]) {
+			return nil
+		}
+		next := *s
+		next.Cert = &c
+		// If SIGHUP replaced the site in the meantime, try again with the new
+		// one, rather than undoing the reload:
+		if site.CompareAndSwap(s, &next) {
+			slog.Info("Reloaded certificate", "path", *cert)
+			return nil
+		}
+	}
+}
+
+// WatchCert calls ReloadCert when -cert or -key change, and every interval
+// in case a change is missed, until ctx is cancelled.
+func WatchCert(ctx context.Context, interval time.Duration) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	// Renewals usually replace the files, rather than writing to them, so
+	// watch the directories they're in:
+	paths := map[string]bool{filepath.Clean(*cert): true}
+	if !IsKeyURI(*key) {
+		paths[filepath.Clean(*key)] = true
+	}
+	for path := range paths {
+		if err := w.Add(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if paths[filepath.Clean(e.Name)] {
+				// Give the other file of the pair a moment to be replaced too:
+				settled = time.After(time.Second)
+			}
+			continue
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("Watching certificate", "err", err)
+			continue
+		case <-settled:
+			settled = nil
+		case <-t.C:
+		}
+		if err := ReloadCert(); err != nil {
+			slog.Error("Reloading certificate, keeping the current one", "err", err)
+		}
+	}
+}
+
+// PollCert calls ReloadCert every interval, until ctx is cancelled. It is a
+// fallback for when WatchCert doesn't work.
+func PollCert(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := ReloadCert(); err != nil {
+			slog.Error("Reloading certificate, keeping the current one", "err", err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// useTestCert generates a certificate, and points -cert and -key at it.
+func useTestCert(t *testing.T) (certPath, keyPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateSelfSigned(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	oldCert, oldKey := *cert, *key
+	*cert, *key = certPath, keyPath
+	t.Cleanup(func() { *cert, *key = oldCert, oldKey })
+	return certPath, keyPath
+}
+
+func TestReloadCert(t *testing.T) {
+	certPath, keyPath := useTestCert(t)
+	useTestSite(t, &Site{BasePath: "/askpass/"})
+
+	if err := ReloadCert(); err != nil {
+		t.Fatal(err)
+	}
+	s := site.Load()
+	if s.Cert == nil || s.BasePath != "/askpass/" {
+		t.Fatalf("site after ReloadCert = %+v", s)
+	}
+	// Unchanged, so nothing to do:
+	if err := ReloadCert(); err != nil {
+		t.Fatal(err)
+	}
+	if site.Load() != s {
+		t.Error("site replaced without a new certificate")
+	}
+
+	if err := GenerateSelfSigned(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadCert(); err != nil {
+		t.Fatal(err)
+	}
+	if next := site.Load(); next.Cert == nil || next.Cert == s.Cert || next.BasePath != "/askpass/" {
+		t.Errorf("site after renewal = %+v", next)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+// Notifications in Slack, Discord and Mattermost channels, through their
+// incoming webhooks.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// The kinds of ChatWebhook.
+const (
+	ChatSlack      = "slack"
+	ChatDiscord    = "discord"
+	ChatMattermost = "mattermost"
+)
+
+// chatTemplates are the default templates, in each kind's markup.
+var chatTemplates = map[string]string{
+	ChatSlack:      "*{{ escape .Title }}*\n{{ escape .Message }}{{ with .URL }}\n<{{ . }}|Answer>{{ end }}",
+	ChatDiscord:    "**{{ escape .Title }}**\n{{ escape .Message }}{{ with .URL }}\n[Answer](<{{ . }}>){{ end }}",
+	ChatMattermost: "**{{ escape .Title }}**\n{{ escape .Message }}{{ with .URL }}\n[Answer]({{ . }}){{ end }}",
+}
+
+// chatEscapers escape text in each kind's markup. A zero-width space after
+// @ stops mentions.
+var chatEscapers = map[string]*strings.Replacer{
+	ChatSlack:      strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;"),
+	ChatDiscord:    strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "~", `\~`, "|", `\|`, "@", "@\u200b"),
+	ChatMattermost: strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "~", `\~`, "@", "@\u200b"),
+}
+
+// ChatWebhook posts notifications to an incoming webhook of a chat service.
+type ChatWebhook struct {
+	Kind     string // ChatSlack, ChatDiscord or ChatMattermost
+	URL      string
+	Template *template.Template // for the message, executed with the Notification
+}
+
+// NewChatWebhook returns a ChatWebhook of the kind for the URL, formatting
+// messages with tmpl, or the kind's default if empty. The template's escape
+// function escapes text in the kind's markup.
+func NewChatWebhook(kind, url, tmpl string) (*ChatWebhook, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, fmt.Errorf("%s: %q is not an http:// or https:// URL", kind, url)
+	}
+	if tmpl == "" {
+		tmpl = chatTemplates[kind]
+	}
+	t, err := template.New(kind).Funcs(template.FuncMap{
+		"escape": chatEscapers[kind].Replace,
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", kind, err)
+	}
+	return &ChatWebhook{Kind: kind, URL: url, Template: t}, nil
+}
+
+func (c *ChatWebhook) Notify(ctx context.Context, n Notification) error {
+	var text strings.Builder
+	if err := c.Template.Execute(&text, n); err != nil {
+		return err
+	}
+	var body any
+	switch c.Kind {
+	case ChatDiscord:
+		body = map[string]any{
+			"content":  text.String(),
+			"username": "askpass-http",
+			// Never ping anyone, whatever the prompt says:
+			"allowed_mentions": map[string]any{"parse": []string{}},
+		}
+	case ChatMattermost:
+		body = map[string]string{"text": text.String(), "username": "askpass-http"}
+	default:
+		body = map[string]string{"text": text.String()}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return ResponseError(resp)
+}
@@ -0,0 +1,125 @@
+package main
+
+// Configuration file and environment variables, as alternatives to command
+// line flags.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix is prepended to flag names to form environment variable names.
+const envPrefix = "ASKPASS_HTTP_"
+
+// EnvName returns the environment variable corresponding to a flag, such as
+// ASKPASS_HTTP_LDAP_URL for -ldap-url.
+func EnvName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// LoadEnv sets flags from environment variables named by EnvName. Flags that
+// were set on the command line take precedence.
+func LoadEnv(flags *flag.FlagSet) error {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if e := flags.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: %w", EnvName(f.Name), e)
+		}
+	})
+	return err
+}
+
+// LoadConfig sets flags from a TOML file read by ReadConfig. Flags that
+// were already set, on the command line or by LoadEnv, take precedence over
+// the file.
+//
+// If the file doesn't exist and optional is true, nothing happens.
+func LoadConfig(flags *flag.FlagSet, path string, optional bool) error {
+	values, err := ReadConfig(flags, path)
+	if err != nil {
+		if optional && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, v := range values {
+		if set[name] {
+			continue
+		}
+		if err := flags.Set(name, v); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// ReadConfig reads a TOML file of flag values. Keys are flag names, and
+// tables are joined to their keys with a dash, so these are equivalent:
+//
+//	ldap-url = "ldaps://dc.example.com"
+//
+//	[ldap]
+//	url = "ldaps://dc.example.com"
+//
+// Arrays are joined with commas, for flags that accept a list.
+//
+// The file may be encrypted with sops, as by sops -e config.toml.
+func ReadConfig(flags *flag.FlagSet, path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if IsSops(b) {
+		if b, err = DecryptSops(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	var m map[string]any
+	if _, err := toml.Decode(string(b), &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string)
+	if err := flattenConfig(flags, "", m, values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func flattenConfig(flags *flag.FlagSet, prefix string, m map[string]any, values map[string]string) error {
+	for k, v := range m {
+		name := prefix + k
+		if table, ok := v.(map[string]any); ok {
+			if err := flattenConfig(flags, name+"-", table, values); err != nil {
+				return err
+			}
+			continue
+		}
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if list, ok := v.([]any); ok {
+			var items []string
+			for _, item := range list {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		} else {
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+// Letting web pages hosted elsewhere, such as a dashboard, call the API from
+// the browser, with -cors-origins.
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS is the policy for cross-origin requests to the API.
+type CORS struct {
+	Origins map[string]bool // allowed with credentials
+	Any     bool            // any origin is allowed, without credentials
+}
+
+// ParseCORS parses a comma-separated list of origins, such as
+// https://dashboard.example.com, which may call the API with the browser's
+// credentials: cookies, HTTP Basic auth or client certificates. * allows
+// any other origin to call it without them, as with a bearer token.
+func ParseCORS(s string) (*CORS, error) {
+	c := &CORS{Origins: make(map[string]bool)}
+	for _, origin := range strings.Split(s, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "*" {
+			c.Any = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("-cors-origins: invalid origin %q, e.g. https://dashboard.example.com", origin)
+		}
+		c.Origins[u.Scheme+"://"+strings.ToLower(u.Host)] = true
+	}
+	return c, nil
+}
+
+// Allow reports whether the origin may call the API, and whether with
+// credentials.
+func (c *CORS) Allow(origin string) (ok, credentials bool) {
+	if c == nil || origin == "" {
+		return false, false
+	}
+	if c.Origins[strings.ToLower(origin)] {
+		return true, true
+	}
+	return c.Any, false
+}
+
+// Middleware adds the CORS headers to responses from the API, and answers
+// preflight requests, which carry no credentials, without passing them to
+// next, which would require them.
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		ok, credentials := c.Allow(origin)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
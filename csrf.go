@@ -0,0 +1,66 @@
+package main
+
+// Cross-site request forgery protection for HTML forms.
+//
+// Each browser is given a random cookie, and forms carry a token derived from
+// it. Another site can cause the browser to send the cookie, but can't read
+// it to forge the token.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+const (
+	csrfCookie = "askpass_csrf"
+	csrfField  = "csrf"
+)
+
+var ErrCSRF = errors.New("invalid CSRF token")
+
+func csrfMAC(cookie string) string {
+	mac := hmac.New(sha256.New, cookieKey)
+	mac.Write([]byte(csrfCookie))
+	mac.Write([]byte{0})
+	mac.Write([]byte(cookie))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CSRFToken returns the token to embed in forms, setting the cookie first if
+// the browser doesn't already have one.
+func CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return csrfMAC(c.Value)
+	}
+	return NewCSRFToken(w, r)
+}
+
+// NewCSRFToken replaces the browser's cookie, invalidating any previously
+// issued tokens. This is done when logging in.
+func NewCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	value := randomString()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     URLPath(r, "/"),
+		Secure:   IsHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return csrfMAC(value)
+}
+
+// CheckCSRF verifies the token submitted in the form.
+func CheckCSRF(r *http.Request) error {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return ErrCSRF
+	}
+	if !hmac.Equal([]byte(r.PostFormValue(csrfField)), []byte(csrfMAC(c.Value))) {
+		return ErrCSRF
+	}
+	return nil
+}
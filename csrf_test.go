@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postForm returns a form submission carrying the cookies set in w.
+func postForm(path string, form url.Values, w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w != nil {
+		r = withCookies(r, w)
+	}
+	return r
+}
+
+func TestCSRF(t *testing.T) {
+	w := httptest.NewRecorder()
+	token := CSRFToken(w, httptest.NewRequest("GET", "/", nil))
+	c := w.Result().Cookies()
+	if len(c) != 1 || c[0].Name != csrfCookie || !c[0].HttpOnly || c[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("CSRFToken set cookies %v", c)
+	}
+	if c[0].Value == token {
+		t.Error("the token is the cookie")
+	}
+
+	// Pages rendered later embed the same token, without a new cookie:
+	w2 := httptest.NewRecorder()
+	if again := CSRFToken(w2, withCookies(httptest.NewRequest("GET", "/", nil), w)); again != token {
+		t.Errorf("CSRFToken changed from %q to %q", token, again)
+	}
+	if c := w2.Result().Cookies(); len(c) > 0 {
+		t.Errorf("CSRFToken replaced the cookie: %v", c)
+	}
+
+	if err := CheckCSRF(postForm("/", url.Values{csrfField: {token}}, w)); err != nil {
+		t.Errorf("CheckCSRF(token) = %v", err)
+	}
+
+	other := httptest.NewRecorder()
+	otherToken := CSRFToken(other, httptest.NewRequest("GET", "/", nil))
+	for name, r := range map[string]*http.Request{
+		"no token":           postForm("/", nil, w),
+		"empty token":        postForm("/", url.Values{csrfField: {""}}, w),
+		"wrong token":        postForm("/", url.Values{csrfField: {otherToken}}, w),
+		"cookie as token":    postForm("/", url.Values{csrfField: {c[0].Value}}, w),
+		"no cookie":          postForm("/", url.Values{csrfField: {token}}, nil),
+		"token in the query": withCookies(httptest.NewRequest("POST", "/?"+csrfField+"="+url.QueryEscape(token), nil), w),
+		"another browser":    postForm("/", url.Values{csrfField: {token}}, other),
+	} {
+		if err := CheckCSRF(r); !errors.Is(err, ErrCSRF) {
+			t.Errorf("%s: CheckCSRF = %v, want ErrCSRF", name, err)
+		}
+	}
+	empty := postForm("/", url.Values{csrfField: {csrfMAC("")}}, nil)
+	empty.AddCookie(&http.Cookie{Name: csrfCookie, Value: ""})
+	if err := CheckCSRF(empty); !errors.Is(err, ErrCSRF) {
+		t.Errorf("empty cookie: CheckCSRF = %v, want ErrCSRF", err)
+	}
+
+	// Logging in issues a new cookie, so tokens from before don't work:
+	login := httptest.NewRecorder()
+	NewCSRFToken(login, httptest.NewRequest("POST", "/login", nil))
+	if err := CheckCSRF(postForm("/", url.Values{csrfField: {token}}, login)); !errors.Is(err, ErrCSRF) {
+		t.Errorf("token from before logging in: CheckCSRF = %v, want ErrCSRF", err)
+	}
+}
+
+func TestServeLogout(t *testing.T) {
+	useTestSite(t, &Site{})
+	lifetime, idle := sessions.Lifetime, sessions.Idle
+	sessions.Lifetime, sessions.Idle = time.Hour, time.Hour
+	t.Cleanup(func() { sessions.Lifetime, sessions.Idle = lifetime, idle })
+
+	login := httptest.NewRecorder()
+	sessions.Create(login, httptest.NewRequest("POST", "/login", nil), "alice", false)
+	page := httptest.NewRecorder()
+	token := CSRFToken(page, withCookies(httptest.NewRequest("GET", "/", nil), login))
+
+	for _, tt := range []struct {
+		name     string
+		r        *http.Request
+		wantCode int
+	}{
+		{"GET", withCookies(httptest.NewRequest("GET", "/logout", nil), login), http.StatusMethodNotAllowed},
+		{"no token", postForm("/logout", nil, login), http.StatusForbidden},
+		{"wrong token", postForm("/logout", url.Values{csrfField: {csrfMAC("x")}}, login), http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		ServeLogout(w, tt.r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if sessions.Get(tt.r) == nil {
+			t.Errorf("%s: logged out", tt.name)
+		}
+	}
+
+	r := postForm("/logout", url.Values{csrfField: {token}}, login)
+	w := httptest.NewRecorder()
+	ServeLogout(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if sessions.Get(r) != nil {
+		t.Error("still logged in")
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+// Profiling and debug variables, served on a separate listener so that they
+// are never exposed on the main port.
+
+import (
+	_ "expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+)
+
+// ServeDebug serves net/http/pprof and expvar, which register themselves on
+// http.DefaultServeMux, at addr. As the endpoints are unauthenticated, addr
+// must be a loopback address.
+func ServeDebug(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("-debug-listen: %q is not a loopback address", host)
+	}
+	lsn, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Debug endpoints on http://%s/debug/pprof/", lsn.Addr()))
+	return http.Serve(lsn, http.DefaultServeMux)
+}
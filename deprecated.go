@@ -0,0 +1,47 @@
+package main
+
+// Telling clients of endpoints that are to be removed, with the Deprecation
+// (RFC 9745) and Sunset (RFC 8594) headers, so that their authors can move
+// to the endpoints replacing them before they break.
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Deprecation is when an endpoint was deprecated, and when it may be
+// removed.
+type Deprecation struct {
+	Since     time.Time
+	Sunset    time.Time
+	Successor string // the endpoint replacing it, described at openapiPath
+}
+
+// formPassDeprecation is of /pass, for clients other than the web page, which
+// should use /api/v1/prompts/{name}/answer instead. The web page still uses
+// it.
+var formPassDeprecation = Deprecation{
+	Since:     time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC),
+	Sunset:    time.Date(2027, time.October, 16, 0, 0, 0, 0, time.UTC),
+	Successor: "/api/v1/prompts/{name}/answer",
+}
+
+// Middleware adds the headers to responses to requests that aren't from a
+// browser navigating, such as submitting a form on the web page, and logs
+// them, so that the clients to be updated can be found.
+func (d Deprecation) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Browsers too old to send Sec-Fetch-Mode get the headers, which they
+		// ignore:
+		if r.Header.Get("Sec-Fetch-Mode") == "navigate" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+		w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"; type="application/json"`, URLPath(r, openapiPath)))
+		Logger(r).Warn("Deprecated endpoint was requested", "successor", d.Successor, "sunset", d.Sunset.Format(time.DateOnly))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+// DNS providers for ACME DNS-01 challenges, which prove control of a domain
+// by publishing a TXT record. These work even if the server can't be reached
+// from the internet.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+// NewDNSProvider returns the DNS provider named by -acme-dns, configured by
+// the other -acme-dns-* flags.
+func NewDNSProvider(name string) (certmagic.DNSProvider, error) {
+	switch name {
+	case "exec":
+		if *acmeDNSExec == "" {
+			return nil, fmt.Errorf("-acme-dns %s requires -acme-dns-exec", name)
+		}
+		return ExecDNS{Command: *acmeDNSExec}, nil
+	case "rfc2136":
+		if *acmeDNSServer == "" {
+			return nil, fmt.Errorf("-acme-dns %s requires -acme-dns-server", name)
+		}
+		p := &RFC2136{
+			Server:    *acmeDNSServer,
+			KeyName:   *acmeDNSTSIGKey,
+			Algorithm: *acmeDNSTSIGAlgorithm,
+		}
+		if *acmeDNSTSIGSecretFile > "" {
+			b, err := os.ReadFile(*acmeDNSTSIGSecretFile)
+			if err != nil {
+				return nil, err
+			}
+			p.Secret = strings.TrimSpace(string(b))
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown -acme-dns provider %q", name)
+}
+
+// ExecDNS runs a command to add and remove records, in the same way as
+// lego's exec provider:
+//
+//	command present _acme-challenge.host.example.com. VALUE
+//	command cleanup _acme-challenge.host.example.com. VALUE
+type ExecDNS struct {
+	Command string
+}
+
+func (p ExecDNS) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return recs, p.run(ctx, "present", zone, recs)
+}
+
+func (p ExecDNS) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return recs, p.run(ctx, "cleanup", zone, recs)
+}
+
+func (p ExecDNS) run(ctx context.Context, action, zone string, recs []libdns.Record) error {
+	for _, rec := range recs {
+		cmd := exec.CommandContext(ctx, p.Command, action, libdns.AbsoluteName(rec.Name, zone), rec.Value)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %s: %w: %s", p.Command, action, err, bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// RFC2136 adds and removes records with dynamic DNS updates, as supported
+// by BIND, Knot and PowerDNS, optionally signed with a TSIG key.
+type RFC2136 struct {
+	Server    string // host:port
+	KeyName   string
+	Algorithm string
+	Secret    string // base64
+}
+
+func (p *RFC2136) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return recs, p.update(ctx, zone, recs, true)
+}
+
+func (p *RFC2136) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return recs, p.update(ctx, zone, recs, false)
+}
+
+func (p *RFC2136) update(ctx context.Context, zone string, recs []libdns.Record, insert bool) error {
+	var rrs []dns.RR
+	for _, rec := range recs {
+		if rec.Type != "TXT" {
+			return fmt.Errorf("rfc2136: unsupported record type %s", rec.Type)
+		}
+		rrs = append(rrs, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   libdns.AbsoluteName(rec.Name, zone),
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(rec.TTL / time.Second),
+			},
+			Txt: []string{rec.Value},
+		})
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	if insert {
+		m.Insert(rrs)
+	} else {
+		m.Remove(rrs)
+	}
+	c := &dns.Client{Net: "tcp"}
+	if p.KeyName > "" {
+		name := dns.Fqdn(p.KeyName)
+		c.TsigSecret = map[string]string{name: p.Secret}
+		m.SetTsig(name, dns.Fqdn(p.Algorithm), 300, time.Now().Unix())
+	}
+	r, _, err := c.ExchangeContext(ctx, m, p.Server)
+	if err != nil {
+		return fmt.Errorf("rfc2136: %w", err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136: %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+// Answers encrypted in the browser to a key generated each time askpass-http
+// starts, and only decrypted here, so that reverse proxies terminating TLS,
+// and middleboxes intercepting it, never see them.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrNotEncrypted     = errors.New("answers must be encrypted in the browser, which requires X25519 support")
+	ErrInvalidEncrypted = errors.New("invalid encrypted answer")
+)
+
+// e2eInfo is the HKDF info, as in the web UI's script, so keys derived for
+// answers aren't used for anything else.
+const e2eInfo = "askpass-http answer"
+
+// e2eKey is only kept in memory, so answers encrypted to it can't be
+// decrypted after askpass-http exits.
+var e2eKey = func() *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// E2EPublicKey returns the public key answers are encrypted to, in
+// unpadded base64url.
+func E2EPublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(e2eKey.PublicKey().Bytes())
+}
+
+// DecryptAnswer decrypts an answer to the named prompt encrypted in the
+// browser: an ephemeral X25519 public key, a 12-byte nonce, and the answer
+// sealed with AES-256-GCM, with the prompt's name as additional data, under
+// the key derived by HKDF-SHA256 from the shared secret, salted with the
+// ephemeral and then our public key; in unpadded base64url.
+func DecryptAnswer(s, name string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) < 32+12 {
+		return "", ErrInvalidEncrypted
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(b[:32])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidEncrypted, err)
+	}
+	shared, err := e2eKey.ECDH(ephemeral)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidEncrypted, err)
+	}
+	salt := append(b[:32:32], e2eKey.PublicKey().Bytes()...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(e2eInfo)), key); err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	answer, err := gcm.Open(nil, b[32:44], b[44:], []byte(name))
+	if err != nil {
+		// Most likely encrypted to the key before a restart:
+		return "", fmt.Errorf("%w: can't decrypt it; reload the page and try again", ErrInvalidEncrypted)
+	}
+	return string(answer), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryptAnswer encrypts an answer as the web UI's script does, to the
+// public key given in base64url.
+func encryptAnswer(t *testing.T, serverKey, name, answer string) string {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ephemeral.ECDH(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := append(ephemeral.PublicKey().Bytes(), server.Bytes()...)
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(e2eInfo)), key)
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	out = gcm.Seal(out, nonce, []byte(answer), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+func TestDecryptAnswer(t *testing.T) {
+	for _, answer := range []string{"hunter2", "", "pässwörd with spaces", strings.Repeat("k", 64<<10)} {
+		s := encryptAnswer(t, E2EPublicKey(), "ask.1234", answer)
+		got, err := DecryptAnswer(s, "ask.1234")
+		if err != nil {
+			t.Fatalf("%.20q: %v", answer, err)
+		}
+		if got != answer {
+			t.Errorf("DecryptAnswer = %.20q, want %.20q", got, answer)
+		}
+	}
+}
+
+func TestDecryptAnswerInvalid(t *testing.T) {
+	valid := encryptAnswer(t, E2EPublicKey(), "ask.1234", "hunter2")
+	b, _ := base64.RawURLEncoding.DecodeString(valid)
+	tampered := append([]byte(nil), b...)
+	tampered[len(tampered)-1] ^= 1
+
+	// As if encrypted before a restart, to another key:
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := base64.RawURLEncoding.EncodeToString(other.PublicKey().Bytes())
+
+	enc := base64.RawURLEncoding.EncodeToString
+	for _, tt := range []struct{ what, s, name string }{
+		{"wrong prompt", valid, "ask.5678"},
+		{"empty", "", "ask.1234"},
+		{"garbage", "not base64!", "ask.1234"},
+		{"padded base64", enc(b) + "==", "ask.1234"},
+		{"key only", enc(b[:32]), "ask.1234"},
+		{"no tag", enc(b[:44]), "ask.1234"},
+		{"truncated", enc(b[:len(b)-1]), "ask.1234"},
+		{"tampered", enc(tampered), "ask.1234"},
+		{"low order key", enc(append(make([]byte, 32), b[32:]...)), "ask.1234"},
+		{"other key", encryptAnswer(t, otherKey, "ask.1234", "hunter2"), "ask.1234"},
+	} {
+		got, err := DecryptAnswer(tt.s, tt.name)
+		if !errors.Is(err, ErrInvalidEncrypted) {
+			t.Errorf("%s: DecryptAnswer = %q, %v; want ErrInvalidEncrypted", tt.what, got, err)
+		}
+	}
+}
+
+func TestServePassBatch(t *testing.T) {
+	useTestSite(t, &Site{})
+	old := hub
+	hub = NewHub()
+	t.Cleanup(func() { hub = old })
+
+	// Answers as large as files may be, encrypted to each prompt:
+	dir := t.TempDir()
+	askers := make(Askers)
+	conns := make(map[string]*net.UnixConn)
+	form := url.Values{}
+	for _, name := range []string{"ask.1", "ask.2", "ask.3"} {
+		socket := filepath.Join(dir, name+".sock")
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[name] = conn
+		askers[name] = &Askpass{Message: "Passphrase for " + name, Socket: socket}
+		form.Add("ask", name)
+		form.Set("answer_e2e."+name, encryptAnswer(t, E2EPublicKey(), name, strings.Repeat(name, maxAnswerFile/len(name))))
+	}
+	hub.Update(askers)
+
+	w := httptest.NewRecorder()
+	form.Set(csrfField, CSRFToken(w, httptest.NewRequest("GET", "/", nil)))
+	resp := httptest.NewRecorder()
+	ServePass(resp, postForm("/pass", form, w))
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("status %d: %s", resp.Code, resp.Body)
+	}
+	b := make([]byte, 2*maxAnswerFile)
+	for name, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want := "+" + strings.Repeat(name, maxAnswerFile/len(name)); string(b[:n]) != want {
+			t.Errorf("%s answered with %.20q..., want %.20q...", name, b[:n], want)
+		}
+	}
+}
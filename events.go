@@ -0,0 +1,416 @@
+package main
+
+// Push notifications of prompt changes to connected clients.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/websocket"
+)
+
+type EventType string
+
+const (
+	EventAdded   EventType = "added"
+	EventChanged EventType = "changed"
+	EventRemoved EventType = "removed"
+)
+
+// Reasons for a prompt being removed.
+const (
+	ReasonAnswered  = "answered"
+	ReasonCancelled = "cancelled"
+	ReasonExpired   = "expired"
+)
+
+// Event describes a change to a single prompt. For EventRemoved, the Prompt
+// is the last known state before it disappeared, and the Reason is why, or
+// "" if unknown, such as when the requester gave up.
+type Event struct {
+	Type   EventType `json:"type"`
+	Prompt Prompt    `json:"prompt"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Hub keeps the current prompts, and fans out events to subscribers when
+// they change.
+type Hub struct {
+	mu      sync.Mutex
+	subs    map[chan Event]struct{}
+	queues  map[*eventQueue]struct{} // for SubscribeAll
+	askers  Askers                   // last seen state
+	reasons map[string]string        // why prompts in askers will be removed
+	expiry  *time.Timer              // rescans when the next prompt expires
+}
+
+var hub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{
+		subs:    make(map[chan Event]struct{}),
+		queues:  make(map[*eventQueue]struct{}),
+		askers:  make(Askers),
+		reasons: make(map[string]string),
+	}
+}
+
+// Subscribe returns a channel receiving all future events, preceded by an
+// EventAdded for every prompt that currently exists. The returned func must
+// be called to unsubscribe.
+func (h *Hub) Subscribe() (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prompts := h.askers.Prompts()
+	ch := make(chan Event, len(prompts)+16)
+	for _, p := range prompts {
+		ch <- Event{Type: EventAdded, Prompt: p}
+	}
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// SubscribeAll is like Subscribe, except that events are queued for as
+// long as the subscriber takes to receive them, rather than it being dropped
+// if it falls behind. It is for subscribers within the server, such as the
+// audit log, which mustn't miss events and which clients can't slow down.
+func (h *Hub) SubscribeAll() (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q := &eventQueue{ready: make(chan struct{}, 1), done: make(chan struct{})}
+	for _, p := range h.askers.Prompts() {
+		q.push(Event{Type: EventAdded, Prompt: p})
+	}
+	h.queues[q] = struct{}{}
+	ch := make(chan Event)
+	go q.run(ch)
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.queues[q]; ok {
+			delete(h.queues, q)
+			close(q.done)
+		}
+	}
+}
+
+// eventQueue holds events for a subscriber from SubscribeAll, without limit.
+type eventQueue struct {
+	mu     sync.Mutex
+	events []Event
+	ready  chan struct{} // signalled when events are pushed
+	done   chan struct{} // closed when unsubscribed
+}
+
+func (q *eventQueue) push(e Event) {
+	q.mu.Lock()
+	q.events = append(q.events, e)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued events to ch in order, until unsubscribed.
+func (q *eventQueue) run(ch chan<- Event) {
+	defer close(ch)
+	for {
+		q.mu.Lock()
+		events := q.events
+		q.events = nil
+		q.mu.Unlock()
+		for _, e := range events {
+			select {
+			case ch <- e:
+			case <-q.done:
+				return
+			}
+		}
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Update compares the askers against the last seen state, and publishes an
+// event for each difference.
+func (h *Hub) Update(askers Askers) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, ap := range askers {
+		if old, ok := h.askers[name]; !ok {
+			metricPromptsSeen.Inc()
+			if retries.Asked(name, NewPrompt(name, ap).Key()) {
+				slog.Info("Prompt asked again, so the last answer appears to have been rejected", "prompt", name)
+			}
+			h.publish(Event{Type: EventAdded, Prompt: NewPrompt(name, ap)})
+		} else if *old != *ap {
+			h.publish(Event{Type: EventChanged, Prompt: NewPrompt(name, ap)})
+		}
+	}
+	for name, ap := range h.askers {
+		if _, ok := askers[name]; !ok {
+			reason := h.reasons[name]
+			if reason == "" && ap.IsExpired() != nil {
+				reason = ReasonExpired
+			}
+			delete(h.reasons, name)
+			retries.Forget(name)
+			h.publish(Event{Type: EventRemoved, Prompt: NewPrompt(name, ap), Reason: reason})
+		}
+	}
+	h.askers = askers
+
+	// Rather than waiting for the next rescan, drop prompts as soon as
+	// they expire:
+	var next time.Time
+	for _, ap := range askers {
+		if !ap.NotAfter.IsZero() && (next.IsZero() || ap.NotAfter.Before(next)) {
+			next = ap.NotAfter
+		}
+	}
+	if h.expiry != nil {
+		h.expiry.Stop()
+	}
+	if !next.IsZero() {
+		h.expiry = time.AfterFunc(time.Until(next), func() { h.Update(NewAskers()) })
+	}
+}
+
+// Resolved records why the named prompt is about to be removed, for its
+// EventRemoved.
+func (h *Hub) Resolved(name, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.askers[name]; ok {
+		h.reasons[name] = reason
+	}
+}
+
+// Unresolved forgets that the named prompt was resolved for the reason, as
+// when answering or cancelling it failed after all.
+func (h *Hub) Unresolved(name, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reasons[name] == reason {
+		delete(h.reasons, name)
+	}
+}
+
+// Askers returns the prompts in the last seen state. It must not be modified.
+func (h *Hub) Askers() Askers {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.askers
+}
+
+// Len returns the number of prompts in the last seen state.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.askers)
+}
+
+// publish must be called with h.mu held. Slow subscribers that have filled
+// their buffer are dropped, rather than blocking everyone else, except for
+// those from SubscribeAll.
+func (h *Hub) publish(e Event) {
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+	for q := range h.queues {
+		q.push(e)
+	}
+}
+
+// Watch rescans the ask directory whenever a prompt is created or removed,
+// until ctx is cancelled. It also rescans every interval, as prompts past
+// their NotAfter time disappear without the directory changing.
+func (h *Hub) Watch(ctx context.Context, dir string, interval time.Duration) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(dir); err != nil {
+		return err
+	}
+	h.Update(NewAskers()) // anything created before the watch was added
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if !strings.HasPrefix(filepath.Base(e.Name), "ask.") {
+				continue
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			// Most likely the event queue overflowed, so rescan:
+			slog.Warn("Watching ask directory", "err", err)
+		case <-t.C:
+		}
+		h.Update(NewAskers())
+	}
+}
+
+// Poll rescans the ask directory every interval, until ctx is cancelled. It
+// is a fallback for when Watch doesn't work.
+func (h *Hub) Poll(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		h.Update(NewAskers())
+	}
+}
+
+// ServeAPIWebSocket streams events to the client as JSON messages until the
+// client disconnects.
+var ServeAPIWebSocket = websocket.Server{
+	Handshake: checkSameOrigin,
+	Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		// The connection outlives the -read-timeout of the request that
+		// opened it:
+		_ = ws.SetReadDeadline(time.Time{})
+		filter := ParsePromptFilter(ws.Request().URL.Query())
+		events, unsubscribe := hub.Subscribe()
+		defer unsubscribe()
+
+		// The client isn't expected to send anything, but reading is the
+		// only way to notice it going away:
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		for {
+			select {
+			case <-gone:
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if e.Type != EventRemoved && !filter.Match(e.Prompt) {
+					continue
+				}
+				_ = ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+				if err := websocket.JSON.Send(ws, e); err != nil {
+					return
+				}
+			}
+		}
+	},
+}
+
+// ServeEvents streams events to the client using Server-Sent Events, with
+// event names of the form "prompt-added", "prompt-changed" and
+// "prompt-removed", and the Prompt as JSON data, its message translated for
+// the web page. Only prompts matching the query parameters are added or
+// changed (see ParsePromptFilter).
+func ServeEvents(w http.ResponseWriter, r *http.Request) {
+	const keepalive = 30 * time.Second
+	filter := ParsePromptFilter(r.URL.Query())
+	lang := Lang(r)
+
+	extendWriteDeadline(r, 0)
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		Logger(r).Error("Starting event stream", "err", err)
+		return
+	}
+
+	events, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+	t := time.NewTicker(keepalive)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Type != EventRemoved && !filter.Match(e.Prompt) {
+				continue
+			}
+			e.Prompt.Message = TranslatePrompt(lang, e.Prompt.Message)
+			data, err := json.Marshal(e.Prompt)
+			if err != nil {
+				Logger(r).Error("Encoding event", "err", err)
+				return
+			}
+			fmt.Fprintf(w, "event: prompt-%s\ndata: %s\n\n", e.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// checkSameOrigin rejects cross-site WebSocket connections from browsers,
+// except from -cors-origins allowed credentials, as browsers send cookies
+// with them regardless. Non-browser clients that send no Origin header are
+// allowed.
+func checkSameOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if _, credentials := site.Load().CORS.Allow(origin); u.Host != r.Host && !credentials {
+		return websocket.ErrBadWebSocketOrigin
+	}
+	cfg.Origin = u
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHubSubscribeAll(t *testing.T) {
+	h := NewHub()
+	h.Update(Askers{"ask.0": &Askpass{Message: "first"}})
+	all, unsubscribe := h.SubscribeAll()
+	some, _ := h.Subscribe()
+
+	// More changes than any subscriber's buffer, while neither is reading:
+	const n = 100
+	for i := 1; i <= n; i++ {
+		h.Update(Askers{fmt.Sprintf("ask.%d", i): &Askpass{Message: "again"}})
+	}
+
+	// The SubscribeAll one gets every event, in order, starting with the
+	// prompt that was already there:
+	want := []string{"added ask.0"}
+	for i := 1; i <= n; i++ {
+		want = append(want, fmt.Sprintf("added ask.%d", i), fmt.Sprintf("removed ask.%d", i-1))
+	}
+	for _, w := range want {
+		select {
+		case e := <-all:
+			if got := fmt.Sprintf("%s %s", e.Type, e.Prompt.Name); got != w {
+				t.Fatalf("got %s, want %s", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event, want %s", w)
+		}
+	}
+
+	// The Subscribe one was dropped:
+	var received int
+	for range some {
+		received++
+	}
+	if received >= len(want) {
+		t.Errorf("slow subscriber received all %d events", received)
+	}
+
+	unsubscribe()
+	select {
+	case e, ok := <-all:
+		if ok {
+			t.Errorf("event %+v after unsubscribing", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("channel not closed after unsubscribing")
+	}
+	h.Update(Askers{})
+	unsubscribe()
+}
+
+func TestRemovedReason(t *testing.T) {
+	old := hub
+	hub = NewHub()
+	t.Cleanup(func() { hub = old })
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+	r := httptest.NewRequest("POST", "/", nil)
+
+	// Answering fails, as no one is listening, and the requester then
+	// gives up:
+	hub.Update(Askers{"ask.1": &Askpass{Message: "Passphrase", Socket: missing}})
+	events, _ := hub.SubscribeAll()
+	<-events
+	if err := AnswerPrompt(r, "ask.1", "hunter2"); err == nil {
+		t.Fatal("answered without a requester")
+	}
+	if err := CancelPrompt(r, "ask.1"); err == nil {
+		t.Fatal("cancelled without a requester")
+	}
+	hub.Update(Askers{})
+	if e := <-events; e.Type != EventRemoved || e.Reason != "" {
+		t.Errorf("event %s, reason %q; want removed for no known reason", e.Type, e.Reason)
+	}
+
+	hub.Update(Askers{"ask.2": &Askpass{Message: "Passphrase", Socket: missing}})
+	<-events
+	hub.Resolved("ask.2", ReasonCancelled)
+	hub.Unresolved("ask.2", ReasonAnswered) // not why it's going
+	hub.Update(Askers{})
+	if e := <-events; e.Reason != ReasonCancelled {
+		t.Errorf("reason %q, want %q", e.Reason, ReasonCancelled)
+	}
+}
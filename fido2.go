@@ -0,0 +1,469 @@
+package main
+
+// Secrets derived from a FIDO2 security key's hmac-secret extension, as
+// enrolled with systemd-cryptenroll --fido2-device, so that someone at the
+// machine can unlock it by touching the key when asked to from afar.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// fido2Token is a LUKS2 token made by systemd-cryptenroll --fido2-device, as
+// exported by cryptsetup token export.
+type fido2Token struct {
+	Type       string `json:"type"`
+	Credential string `json:"fido2-credential"`
+	Salt       string `json:"fido2-salt"`
+	RP         string `json:"fido2-rp"`
+
+	// Unset in tokens enrolled by older versions of systemd:
+	PINRequired *bool `json:"fido2-clientPin-required"`
+	UPRequired  *bool `json:"fido2-up-required"`
+	UVRequired  *bool `json:"fido2-uv-required"`
+}
+
+// fido2Mu serialises transactions with the security key.
+var fido2Mu sync.Mutex
+
+// fido2Secret derives the passphrase enrolled by systemd-cryptenroll from
+// the security key, given the path of its token, such as
+// /etc/askpass-http/fido2.json. Unless the token says otherwise, the key
+// must be touched, and its PIN is read from -fido2-pin-file.
+func fido2Secret(ctx context.Context, path string, _ Prompt) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t fido2Token
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("fido2: %s: %w", path, err)
+	}
+	if t.Type != "systemd-fido2" {
+		return nil, fmt.Errorf("fido2: %s is not a systemd-fido2 token", path)
+	}
+	cred, err := base64.StdEncoding.DecodeString(t.Credential)
+	if err != nil {
+		return nil, fmt.Errorf("fido2: %s: credential: %w", path, err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(t.Salt)
+	if err != nil || len(salt) != 32 {
+		return nil, fmt.Errorf("fido2: %s: salt is not 32 bytes", path)
+	}
+	if t.RP == "" {
+		t.RP = "io.systemd.cryptsetup"
+	}
+	var pin string
+	if t.PINRequired == nil || *t.PINRequired {
+		b, err := os.ReadFile(*fido2PinFile)
+		if err != nil {
+			return nil, fmt.Errorf("fido2: the security key's PIN is required: %w", err)
+		}
+		pin = strings.TrimRight(string(b), "\r\n")
+	}
+
+	fido2Mu.Lock()
+	defer fido2Mu.Unlock()
+	device, err := fido2DevicePath()
+	if err != nil {
+		return nil, fmt.Errorf("fido2: %w", err)
+	}
+	dev, err := openCTAPHID(ctx, device)
+	if err != nil {
+		return nil, fmt.Errorf("fido2: %s: %w", device, err)
+	}
+	defer dev.Close()
+	out, err := dev.hmacSecret(ctx, t, cred, salt, pin)
+	if err != nil {
+		return nil, fmt.Errorf("fido2: %s: %w", device, err)
+	}
+	// systemd-cryptenroll enrols the output as the passphrase, base64
+	// encoded:
+	return []byte(base64.StdEncoding.EncodeToString(out)), nil
+}
+
+// fido2DevicePath returns -fido2-device, or the first hidraw device that is
+// a FIDO security key.
+func fido2DevicePath() (string, error) {
+	if *fido2Device > "" {
+		return *fido2Device, nil
+	}
+	descs, _ := filepath.Glob("/sys/class/hidraw/*/device/report_descriptor")
+	for _, d := range descs {
+		b, err := os.ReadFile(d)
+		// The FIDO Alliance's usage page:
+		if err == nil && bytes.HasPrefix(b, []byte{0x06, 0xd0, 0xf1}) {
+			return filepath.Join("/dev", filepath.Base(filepath.Dir(filepath.Dir(d)))), nil
+		}
+	}
+	return "", errors.New("no security key found")
+}
+
+// CTAPHID commands and CTAP2 commands, from the FIDO Client to
+// Authenticator Protocol.
+const (
+	ctapHIDCancel    = 0x11
+	ctapHIDInit      = 0x06
+	ctapHIDCBOR      = 0x10
+	ctapHIDKeepalive = 0x3b
+	ctapHIDError     = 0x3f
+
+	ctapGetAssertion = 0x02
+	ctapClientPIN    = 0x06
+)
+
+// ctapErrors describes the CTAP2 status codes worth explaining.
+var ctapErrors = map[byte]string{
+	0x27: "operation denied",
+	0x2d: "cancelled",
+	0x2e: "no such credential, so this isn't the security key the token was enrolled with",
+	0x2f: "timed out waiting for the security key to be touched",
+	0x31: "wrong PIN",
+	0x32: "PIN blocked",
+	0x34: "PIN blocked until the security key is reinserted",
+	0x35: "the security key has no PIN",
+	0x36: "PIN required",
+}
+
+// ctapHID is a FIDO security key, spoken to over USB HID.
+type ctapHID struct {
+	f   *os.File
+	cid uint32 // channel ID
+}
+
+// openCTAPHID opens the hidraw device, and allocates a channel on it.
+func openCTAPHID(ctx context.Context, path string) (*ctapHID, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &ctapHID{f: f, cid: 0xffffffff}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		f.Close()
+		return nil, err
+	}
+	for {
+		res, err := d.transact(ctx, ctapHIDInit, nonce)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// Responses to other applications' requests are also broadcast:
+		if len(res) >= 12 && bytes.Equal(res[:8], nonce) {
+			d.cid = binary.BigEndian.Uint32(res[8:12])
+			return d, nil
+		}
+	}
+}
+
+func (d *ctapHID) Close() error {
+	return d.f.Close()
+}
+
+// transact sends a command and returns the response, waiting for the
+// security key to be touched for as long as ctx allows.
+func (d *ctapHID) transact(ctx context.Context, cmd byte, data []byte) ([]byte, error) {
+	if err := d.send(cmd, data); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		// So that the security key stops waiting too:
+		_ = d.send(ctapHIDCancel, nil)
+		_ = d.f.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	for {
+		res, resCmd, err := d.recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		switch resCmd {
+		case cmd:
+			return res, nil
+		case ctapHIDKeepalive:
+			continue
+		case ctapHIDError:
+			if len(res) > 0 {
+				return nil, fmt.Errorf("CTAPHID error %#x", res[0])
+			}
+			return nil, errors.New("CTAPHID error")
+		default:
+			return nil, fmt.Errorf("unexpected CTAPHID command %#x", resCmd)
+		}
+	}
+}
+
+// send writes a message, split into 64-byte reports.
+func (d *ctapHID) send(cmd byte, data []byte) error {
+	// Each report is preceded by its report ID, which is always 0:
+	report := make([]byte, 65)
+	binary.BigEndian.PutUint32(report[1:], d.cid)
+	report[5] = 0x80 | cmd
+	binary.BigEndian.PutUint16(report[6:], uint16(len(data)))
+	n := copy(report[8:], data)
+	data = data[n:]
+	if _, err := d.f.Write(report); err != nil {
+		return err
+	}
+	for seq := byte(0); len(data) > 0; seq++ {
+		clear(report[5:])
+		report[5] = seq
+		n := copy(report[6:], data)
+		data = data[n:]
+		if _, err := d.f.Write(report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recv reads a message on our channel.
+func (d *ctapHID) recv() ([]byte, byte, error) {
+	report := make([]byte, 64)
+	for {
+		if _, err := d.f.Read(report); err != nil {
+			return nil, 0, err
+		}
+		if binary.BigEndian.Uint32(report) != d.cid || report[4]&0x80 == 0 {
+			continue
+		}
+		cmd := report[4] &^ 0x80
+		size := int(binary.BigEndian.Uint16(report[5:]))
+		data := append([]byte(nil), report[7:min(7+size, 64)]...)
+		for seq := byte(0); len(data) < size; seq++ {
+			if _, err := d.f.Read(report); err != nil {
+				return nil, 0, err
+			}
+			if binary.BigEndian.Uint32(report) != d.cid {
+				continue
+			}
+			if report[4] != seq {
+				return nil, 0, errors.New("CTAPHID message out of sequence")
+			}
+			data = append(data, report[5:min(5+size-len(data), 64)]...)
+		}
+		return data, cmd, nil
+	}
+}
+
+var ctapEncMode, _ = cbor.CTAP2EncOptions().EncMode()
+
+// call sends a CTAP2 command, decoding the response into res.
+func (d *ctapHID) call(ctx context.Context, cmd byte, req, res any) error {
+	b, err := ctapEncMode.Marshal(req)
+	if err != nil {
+		return err
+	}
+	b, err = d.transact(ctx, ctapHIDCBOR, append([]byte{cmd}, b...))
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return errors.New("empty CTAP2 response")
+	}
+	if b[0] != 0 {
+		if s, ok := ctapErrors[b[0]]; ok {
+			return errors.New(s)
+		}
+		return fmt.Errorf("CTAP2 error %#x", b[0])
+	}
+	return cbor.Unmarshal(b[1:], res)
+}
+
+// coseKey is a P-256 public key, for ECDH with the security key.
+type coseKey struct {
+	Kty int    `cbor:"1,keyasint"`
+	Alg int    `cbor:"3,keyasint"`
+	Crv int    `cbor:"-1,keyasint"`
+	X   []byte `cbor:"-2,keyasint"`
+	Y   []byte `cbor:"-3,keyasint"`
+}
+
+// hmacSecret asks the security key for the output of its hmac-secret
+// extension for the credential and salt, with PIN/UV auth protocol one.
+func (d *ctapHID) hmacSecret(ctx context.Context, t fido2Token, cred, salt []byte, pin string) ([]byte, error) {
+	// Agree on a shared secret to encrypt the salt, PIN and output with:
+	var ka struct {
+		KeyAgreement coseKey `cbor:"1,keyasint"`
+	}
+	if err := d.call(ctx, ctapClientPIN, map[int]any{1: 1, 2: 2}, &ka); err != nil {
+		return nil, fmt.Errorf("key agreement: %w", err)
+	}
+	peer, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, ka.KeyAgreement.X...), ka.KeyAgreement.Y...))
+	if err != nil {
+		return nil, fmt.Errorf("key agreement: %w", err)
+	}
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	z, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement: %w", err)
+	}
+	shared := sha256.Sum256(z)
+	pub := priv.PublicKey().Bytes()
+	platformKey := coseKey{Kty: 2, Alg: -25, Crv: 1, X: pub[1:33], Y: pub[33:]}
+
+	cdh := make([]byte, 32)
+	if _, err := rand.Read(cdh); err != nil {
+		return nil, err
+	}
+	saltEnc := fido2Crypt(shared[:], salt, true)
+	req := map[int]any{
+		1: t.RP,
+		2: cdh,
+		3: []map[string]any{{"type": "public-key", "id": cred}},
+		4: map[string]any{"hmac-secret": map[int]any{
+			1: platformKey,
+			2: saltEnc,
+			3: fido2Auth(shared[:], saltEnc),
+		}},
+	}
+	options := make(map[string]bool)
+	if t.UPRequired != nil && !*t.UPRequired {
+		options["up"] = false
+	}
+	if t.UVRequired != nil && *t.UVRequired {
+		options["uv"] = true
+	}
+	if len(options) > 0 {
+		req[5] = options
+	}
+	if pin > "" {
+		pinHash := sha256.Sum256([]byte(pin))
+		var res struct {
+			PINToken []byte `cbor:"2,keyasint"`
+		}
+		if err := d.call(ctx, ctapClientPIN, map[int]any{
+			1: 1,
+			2: 5,
+			3: platformKey,
+			6: fido2Crypt(shared[:], pinHash[:16], true),
+		}, &res); err != nil {
+			return nil, fmt.Errorf("PIN: %w", err)
+		}
+		req[6] = fido2Auth(fido2Crypt(shared[:], res.PINToken, false), cdh)
+		req[7] = 1
+	}
+
+	var res struct {
+		AuthData []byte `cbor:"2,keyasint"`
+	}
+	if err := d.call(ctx, ctapGetAssertion, req, &res); err != nil {
+		return nil, err
+	}
+	// The extension outputs follow the RP ID hash, flags and counter:
+	if len(res.AuthData) < 37 || res.AuthData[32]&0x80 == 0 {
+		return nil, errors.New("no hmac-secret in the assertion")
+	}
+	var ext struct {
+		HMACSecret []byte `cbor:"hmac-secret"`
+	}
+	if _, err := cbor.UnmarshalFirst(res.AuthData[37:], &ext); err != nil {
+		return nil, fmt.Errorf("assertion: %w", err)
+	}
+	if len(ext.HMACSecret) != 32 {
+		return nil, errors.New("no hmac-secret in the assertion")
+	}
+	return fido2Crypt(shared[:], ext.HMACSecret, false), nil
+}
+
+// fido2Crypt encrypts or decrypts b with AES-256-CBC and a zero IV, as PIN/UV
+// auth protocol one does. b must be a multiple of the block size.
+func fido2Crypt(key, b []byte, encrypt bool) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	out := make([]byte, len(b)/aes.BlockSize*aes.BlockSize)
+	if encrypt {
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, b[:len(out)])
+	} else {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, b[:len(out)])
+	}
+	return out
+}
+
+// fido2Auth authenticates b with key, as PIN/UV auth protocol one does.
+func fido2Auth(key, b []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return h.Sum(nil)[:16]
+}
+
+// ServeFIDO2 answers a prompt with the secret derived from the security key
+// enrolled in -fido2-token, once someone at the machine touches it, or with
+// -require-approval, submits it for approval.
+func ServeFIDO2(w http.ResponseWriter, r *http.Request) {
+	tokenFile := site.Load().Settings.FIDO2TokenFile
+	if tokenFile == "" {
+		Error(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !MayAnswer(r) {
+		Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CheckCSRF(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+	if err := CheckTOTP(r, r.FormValue("totp")); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+	// Before asking for a touch that would be for nothing:
+	name := r.FormValue("ask")
+	if hub.Askers().Find(name) == nil {
+		Error(w, r, ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	Logger(r).Info("Waiting for the security key to be touched", "prompt", name)
+	const touchTimeout = 30 * time.Second
+	extendWriteDeadline(r, touchTimeout)
+	ctx, cancel := context.WithTimeout(r.Context(), touchTimeout)
+	defer cancel()
+	secret, err := fido2Secret(ctx, tokenFile, Prompt{})
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// Held for approval, as -require-approval does to all answers from the
+	// web UI:
+	if _, err := SubmitAnswer(r, name, string(secret)); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	http.Redirect(w, r, URLPath(r, "/"), http.StatusSeeOther)
+}
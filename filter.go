@@ -0,0 +1,109 @@
+package main
+
+// Choosing which prompts to show, by query parameters on the web page, the
+// API and the event stream, for when there are many.
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// filterFields are the fields of a Prompt that can be filtered on.
+var filterFields = map[string]func(Prompt) string{
+	"name":    func(p Prompt) string { return p.Name },
+	"id":      func(p Prompt) string { return p.ID },
+	"message": func(p Prompt) string { return p.Message },
+}
+
+// PromptFilter matches prompts against the query parameters it was parsed
+// from. The zero PromptFilter matches every prompt.
+type PromptFilter []func(Prompt) bool
+
+// ParsePromptFilter parses the query parameters of a PromptFilter:
+//
+//   - name=, id= and message= match the whole field against a pattern, in
+//     which * matches anything (including /) and ? any one character, e.g.
+//     id=cryptsetup:*
+//   - name~=, id~= and message~= match part of the field, ignoring case,
+//     e.g. message~=sda
+//   - q= matches part of any of them, ignoring case, as the search box does
+//
+// Other parameters are ignored.
+func ParsePromptFilter(q url.Values) PromptFilter {
+	var f PromptFilter
+	for key, values := range q {
+		for _, v := range values {
+			field, substring := strings.CutSuffix(key, "~")
+			get, ok := filterFields[field]
+			switch {
+			case key == "q":
+				v := strings.ToLower(v)
+				f = append(f, func(p Prompt) bool {
+					for _, get := range filterFields {
+						if strings.Contains(strings.ToLower(get(p)), v) {
+							return true
+						}
+					}
+					return false
+				})
+			case !ok:
+			case substring:
+				v := strings.ToLower(v)
+				f = append(f, func(p Prompt) bool {
+					return strings.Contains(strings.ToLower(get(p)), v)
+				})
+			default:
+				re := globRegexp(v)
+				f = append(f, func(p Prompt) bool {
+					return re.MatchString(get(p))
+				})
+			}
+		}
+	}
+	return f
+}
+
+// globRegexp compiles a pattern in which * matches anything and ? any one
+// character. Unlike path.Match, * matches /, as in IDs such as
+// cryptsetup:/dev/sda2.
+func globRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString(`)$`)
+	return regexp.MustCompile(b.String())
+}
+
+// Match reports whether the prompt matches every parameter.
+func (f PromptFilter) Match(p Prompt) bool {
+	for _, match := range f {
+		if !match(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter returns the askers matching the filter.
+func (a Askers) Filter(f PromptFilter) Askers {
+	if len(f) == 0 {
+		return a
+	}
+	out := make(Askers)
+	for name, ap := range a {
+		if f.Match(NewPrompt(name, ap)) {
+			out[name] = ap
+		}
+	}
+	return out
+}
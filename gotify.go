@@ -0,0 +1,85 @@
+package main
+
+// Notifications through a Gotify server (https://gotify.net).
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Gotify sends notifications to a Gotify server as an application.
+type Gotify struct {
+	URL      string // of the server
+	Token    string // of the application
+	Priority int
+	Template *template.Template // for the message, executed with the Notification
+}
+
+// NewGotify returns a Gotify for the server, with the application token read
+// from tokenFile, and the message formatted by tmpl.
+func NewGotify(url, tokenFile string, priority int, tmpl string) (*Gotify, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, fmt.Errorf("gotify: %q is not an http:// or https:// URL", url)
+	}
+	if tokenFile == "" {
+		return nil, fmt.Errorf("gotify: an application token is required")
+	}
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New("gotify").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("gotify: %w", err)
+	}
+	return &Gotify{
+		URL:      strings.TrimSuffix(url, "/"),
+		Token:    strings.TrimSpace(string(b)),
+		Priority: priority,
+		Template: t,
+	}, nil
+}
+
+func (g *Gotify) Notify(ctx context.Context, n Notification) error {
+	var msg strings.Builder
+	if err := g.Template.Execute(&msg, n); err != nil {
+		return err
+	}
+	type click struct {
+		URL string `json:"url"`
+	}
+	body := struct {
+		Title    string         `json:"title"`
+		Message  string         `json:"message"`
+		Priority int            `json:"priority"`
+		Extras   map[string]any `json:"extras,omitempty"`
+	}{Title: n.Title, Message: msg.String(), Priority: g.Priority}
+	if n.URL > "" {
+		// Opens the URL when the notification is tapped on Android.
+		body.Extras = map[string]any{
+			"client::notification": map[string]any{"click": click{n.URL}},
+		}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.URL+"/message", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return ResponseError(resp)
+}
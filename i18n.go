@@ -0,0 +1,432 @@
+package main
+
+// Translating the web pages, their error messages and common prompts into
+// each browser's preferred language, or the one given by -lang.
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// languages have catalogs, except English, which is the fallback.
+var languages = []language.Tag{language.English, language.German, language.French, language.Spanish}
+
+var languageMatcher = language.NewMatcher(languages)
+
+// catalogs translate English text, by language. Formats are as for
+// fmt.Sprintf, and their verbs must stay in the same order, as the web
+// page's scripts fill them in too.
+var catalogs = map[string]map[string]string{
+	"de": {
+		// Every page:
+		"High contrast": "Hoher Kontrast",
+
+		// Index:
+		"Continue on another device":         "Auf einem anderen Gerät fortfahren",
+		"Notify me of new prompts":           "Bei neuen Abfragen benachrichtigen",
+		"Notifications are on":               "Benachrichtigungen sind eingeschaltet",
+		"Couldn't turn on notifications: %s": "Benachrichtigungen konnten nicht eingeschaltet werden: %s",
+		"Logged in as %s.":                   "Angemeldet als %s.",
+		"Log out":                            "Abmelden",
+		"The last answer appears to have been rejected. Try again.": "Die letzte Antwort wurde anscheinend abgelehnt. Bitte erneut versuchen.",
+		"A cached password is accepted.":                            "Ein zwischengespeichertes Passwort wird akzeptiert.",
+		"Expires at %s":                                             "Läuft um %s ab",
+		"Expires in %s":                                             "Läuft in %s ab",
+		"Expired":                                                   "Abgelaufen",
+		"Asked by %s":                                               "Gefragt von %s",
+		"PID %d, which has exited":                                  "PID %d, der beendet wurde",
+		"%s in %s":                                                  "%s in %s",
+		"Or a key file":                                             "Oder eine Schlüsseldatei",
+		"Authenticator code":                                        "Authenticator-Code",
+		"Submit":                                                    "Absenden",
+		"Touch to unlock":                                           "Zum Entsperren berühren",
+		"Asks for the security key to be touched":                   "Fordert auf, den Sicherheitsschlüssel zu berühren",
+		"Share":                 "Anteil",
+		"%d of %d submitted":    "%d von %d abgegeben",
+		"Submit share":          "Anteil absenden",
+		"Cancel":                "Abbrechen",
+		"Search":                "Suchen",
+		"Name, ID or message":   "Name, ID oder Meldung",
+		"No ask prompts found.": "Keine Abfragen gefunden.",
+		"Skip to the prompts":   "Zu den Abfragen springen",
+		"Prompts":               "Abfragen",
+		"Answers must be encrypted by JavaScript, which is turned off.": "Antworten müssen per JavaScript verschlüsselt werden, das ausgeschaltet ist.",
+		"Without JavaScript, this page doesn't update by itself.":       "Ohne JavaScript aktualisiert sich diese Seite nicht von selbst.",
+		"Refresh":         "Neu laden",
+		"New prompt: %s":  "Neue Abfrage: %s",
+		"Prompt gone: %s": "Abfrage entfernt: %s",
+		"Cancel all":      "Alle abbrechen",
+		"Declines every prompt, so that boot carries on to emergency mode": "Lehnt alle Abfragen ab, sodass der Systemstart im Notfallmodus fortfährt",
+		"Cancel every prompt? Boot may carry on to emergency mode.":        "Alle Abfragen abbrechen? Der Systemstart fährt womöglich im Notfallmodus fort.",
+		"Answer several at once":         "Mehrere auf einmal beantworten",
+		"The same answer to":             "Dieselbe Antwort an",
+		"Passphrase":                     "Passphrase",
+		"Submit to those chosen":         "An die ausgewählten absenden",
+		"Awaiting approval":              "Warten auf Freigabe",
+		"Answered by %s at %s, until %s": "Beantwortet von %s um %s, bis %s",
+		"Approve":                        "Freigeben",
+		"Reject":                         "Ablehnen",
+
+		// Login:
+		"%s login":                        "Anmeldung bei %s",
+		"Username":                        "Benutzername",
+		"Password":                        "Passwort",
+		"Log in":                          "Anmelden",
+		"Incorrect username or password.": "Benutzername oder Passwort ist falsch.",
+
+		// QR code:
+		"Scan this code to continue on another device:": "Diesen Code scannen, um auf einem anderen Gerät fortzufahren:",
+		"QR code": "QR-Code",
+		"The code logs in as %s. It can only be used once, and expires in %s. Don't share it with anyone you wouldn't give your password to.": "Der Code meldet als %s an. Er kann nur einmal verwendet werden und läuft in %s ab. Nur an jemanden weitergeben, dem Sie auch Ihr Passwort geben würden.",
+		"Back": "Zurück",
+
+		// Errors:
+		"Request ID: %s":         "Anfrage-ID: %s",
+		"Request body too large": "Anfrage zu groß",
+		"Bad Request":            "Ungültige Anfrage",
+		"Forbidden":              "Verboten",
+		"Not Found":              "Nicht gefunden",
+		"Not found":              "Nicht gefunden",
+		"not found":              "nicht gefunden",
+		"Unauthorized":           "Nicht angemeldet",
+		"Method not allowed":     "Methode nicht erlaubt",
+		"Too many requests":      "Zu viele Anfragen",
+		"too many attempts":      "zu viele Versuche",
+		"too many answers are being given at once":         "zu viele gleichzeitige Antworten",
+		"Client certificate required":                      "Client-Zertifikat erforderlich",
+		"No prompts were chosen":                           "Es wurden keine Abfragen ausgewählt",
+		"This link is invalid, or has already been used":   "Dieser Link ist ungültig oder wurde bereits verwendet",
+		"invalid CSRF token":                               "ungültiges CSRF-Token",
+		"invalid TOTP code":                                "ungültiger TOTP-Code",
+		"invalid answer":                                   "ungültige Antwort",
+		"invalid share":                                    "ungültiger Anteil",
+		"share already submitted":                          "Anteil wurde bereits abgegeben",
+		"the requester is no longer waiting for an answer": "der Anfragende wartet nicht mehr auf eine Antwort",
+		"answers must be approved by another user":         "Antworten müssen von einem anderen Benutzer freigegeben werden",
+		"approving answers requires users to log in":       "zum Freigeben von Antworten müssen sich Benutzer anmelden",
+		"answers must be encrypted in the browser, which requires X25519 support": "Antworten müssen im Browser verschlüsselt werden, was X25519-Unterstützung erfordert",
+		"invalid encrypted answer": "ungültige verschlüsselte Antwort",
+
+		// Prompts:
+		"Please enter passphrase for disk %s:":   "Bitte Passphrase für Datenträger %s eingeben:",
+		"Please enter recovery key for disk %s:": "Bitte Wiederherstellungsschlüssel für Datenträger %s eingeben:",
+		"Please enter LUKS2 token PIN:":          "Bitte PIN des LUKS2-Tokens eingeben:",
+		"Enter passphrase for %s:":               "Passphrase für %s eingeben:",
+	},
+	"fr": {
+		// Every page:
+		"High contrast": "Contraste élevé",
+
+		// Index:
+		"Continue on another device":         "Continuer sur un autre appareil",
+		"Notify me of new prompts":           "M'avertir des nouvelles demandes",
+		"Notifications are on":               "Les notifications sont activées",
+		"Couldn't turn on notifications: %s": "Impossible d'activer les notifications : %s",
+		"Logged in as %s.":                   "Connecté en tant que %s.",
+		"Log out":                            "Se déconnecter",
+		"The last answer appears to have been rejected. Try again.": "La dernière réponse semble avoir été refusée. Réessayez.",
+		"A cached password is accepted.":                            "Un mot de passe en cache est accepté.",
+		"Expires at %s":                                             "Expire à %s",
+		"Expires in %s":                                             "Expire dans %s",
+		"Expired":                                                   "Expirée",
+		"Asked by %s":                                               "Demandée par %s",
+		"PID %d, which has exited":                                  "PID %d, qui s'est terminé",
+		"%s in %s":                                                  "%s dans %s",
+		"Or a key file":                                             "Ou un fichier de clé",
+		"Authenticator code":                                        "Code d'authentification",
+		"Submit":                                                    "Envoyer",
+		"Touch to unlock":                                           "Toucher pour déverrouiller",
+		"Asks for the security key to be touched":                   "Demande de toucher la clé de sécurité",
+		"Share":                 "Part",
+		"%d of %d submitted":    "%d sur %d envoyées",
+		"Submit share":          "Envoyer la part",
+		"Cancel":                "Annuler",
+		"Search":                "Rechercher",
+		"Name, ID or message":   "Nom, ID ou message",
+		"No ask prompts found.": "Aucune demande trouvée.",
+		"Skip to the prompts":   "Aller aux demandes",
+		"Prompts":               "Demandes",
+		"Answers must be encrypted by JavaScript, which is turned off.": "Les réponses doivent être chiffrées par JavaScript, qui est désactivé.",
+		"Without JavaScript, this page doesn't update by itself.":       "Sans JavaScript, cette page ne se met pas à jour d'elle-même.",
+		"Refresh":         "Actualiser",
+		"New prompt: %s":  "Nouvelle demande : %s",
+		"Prompt gone: %s": "Demande disparue : %s",
+		"Cancel all":      "Tout annuler",
+		"Declines every prompt, so that boot carries on to emergency mode": "Refuse toutes les demandes, pour que le démarrage continue en mode d'urgence",
+		"Cancel every prompt? Boot may carry on to emergency mode.":        "Annuler toutes les demandes ? Le démarrage risque de continuer en mode d'urgence.",
+		"Answer several at once":         "Répondre à plusieurs à la fois",
+		"The same answer to":             "La même réponse à",
+		"Passphrase":                     "Phrase secrète",
+		"Submit to those chosen":         "Envoyer à celles choisies",
+		"Awaiting approval":              "En attente d'approbation",
+		"Answered by %s at %s, until %s": "Répondu par %s à %s, jusqu'à %s",
+		"Approve":                        "Approuver",
+		"Reject":                         "Refuser",
+
+		// Login:
+		"%s login":                        "Connexion à %s",
+		"Username":                        "Nom d'utilisateur",
+		"Password":                        "Mot de passe",
+		"Log in":                          "Se connecter",
+		"Incorrect username or password.": "Nom d'utilisateur ou mot de passe incorrect.",
+
+		// QR code:
+		"Scan this code to continue on another device:": "Scannez ce code pour continuer sur un autre appareil :",
+		"QR code": "Code QR",
+		"The code logs in as %s. It can only be used once, and expires in %s. Don't share it with anyone you wouldn't give your password to.": "Le code connecte en tant que %s. Il ne peut servir qu'une fois et expire dans %s. Ne le partagez qu'avec quelqu'un à qui vous donneriez votre mot de passe.",
+		"Back": "Retour",
+
+		// Errors:
+		"Request ID: %s":         "ID de requête : %s",
+		"Request body too large": "Requête trop volumineuse",
+		"Bad Request":            "Requête invalide",
+		"Forbidden":              "Interdit",
+		"Not Found":              "Introuvable",
+		"Not found":              "Introuvable",
+		"not found":              "introuvable",
+		"Unauthorized":           "Non authentifié",
+		"Method not allowed":     "Méthode non autorisée",
+		"Too many requests":      "Trop de requêtes",
+		"too many attempts":      "trop de tentatives",
+		"too many answers are being given at once":         "trop de réponses à la fois",
+		"Client certificate required":                      "Certificat client requis",
+		"No prompts were chosen":                           "Aucune demande n'a été choisie",
+		"This link is invalid, or has already been used":   "Ce lien est invalide ou a déjà été utilisé",
+		"invalid CSRF token":                               "jeton CSRF invalide",
+		"invalid TOTP code":                                "code TOTP invalide",
+		"invalid answer":                                   "réponse invalide",
+		"invalid share":                                    "part invalide",
+		"share already submitted":                          "part déjà envoyée",
+		"the requester is no longer waiting for an answer": "le demandeur n'attend plus de réponse",
+		"answers must be approved by another user":         "les réponses doivent être approuvées par un autre utilisateur",
+		"approving answers requires users to log in":       "l'approbation des réponses exige que les utilisateurs se connectent",
+		"answers must be encrypted in the browser, which requires X25519 support": "les réponses doivent être chiffrées dans le navigateur, ce qui nécessite la prise en charge de X25519",
+		"invalid encrypted answer": "réponse chiffrée invalide",
+
+		// Prompts:
+		"Please enter passphrase for disk %s:":   "Veuillez saisir la phrase secrète du disque %s :",
+		"Please enter recovery key for disk %s:": "Veuillez saisir la clé de récupération du disque %s :",
+		"Please enter LUKS2 token PIN:":          "Veuillez saisir le code PIN du jeton LUKS2 :",
+		"Enter passphrase for %s:":               "Saisissez la phrase secrète de %s :",
+	},
+	"es": {
+		// Every page:
+		"High contrast": "Alto contraste",
+
+		// Index:
+		"Continue on another device":         "Continuar en otro dispositivo",
+		"Notify me of new prompts":           "Avisarme de nuevas solicitudes",
+		"Notifications are on":               "Las notificaciones están activadas",
+		"Couldn't turn on notifications: %s": "No se pudieron activar las notificaciones: %s",
+		"Logged in as %s.":                   "Sesión iniciada como %s.",
+		"Log out":                            "Cerrar sesión",
+		"The last answer appears to have been rejected. Try again.": "Parece que la última respuesta fue rechazada. Inténtelo de nuevo.",
+		"A cached password is accepted.":                            "Se acepta una contraseña almacenada en caché.",
+		"Expires at %s":                                             "Caduca a las %s",
+		"Expires in %s":                                             "Caduca en %s",
+		"Expired":                                                   "Caducada",
+		"Asked by %s":                                               "Solicitada por %s",
+		"PID %d, which has exited":                                  "PID %d, que ha terminado",
+		"%s in %s":                                                  "%s en %s",
+		"Or a key file":                                             "O un archivo de clave",
+		"Authenticator code":                                        "Código de autenticación",
+		"Submit":                                                    "Enviar",
+		"Touch to unlock":                                           "Tocar para desbloquear",
+		"Asks for the security key to be touched":                   "Pide tocar la llave de seguridad",
+		"Share":                 "Parte",
+		"%d of %d submitted":    "%d de %d enviadas",
+		"Submit share":          "Enviar parte",
+		"Cancel":                "Cancelar",
+		"Search":                "Buscar",
+		"Name, ID or message":   "Nombre, ID o mensaje",
+		"No ask prompts found.": "No se encontraron solicitudes.",
+		"Skip to the prompts":   "Ir a las solicitudes",
+		"Prompts":               "Solicitudes",
+		"Answers must be encrypted by JavaScript, which is turned off.": "Las respuestas deben cifrarse con JavaScript, que está desactivado.",
+		"Without JavaScript, this page doesn't update by itself.":       "Sin JavaScript, esta página no se actualiza sola.",
+		"Refresh":         "Recargar",
+		"New prompt: %s":  "Nueva solicitud: %s",
+		"Prompt gone: %s": "Solicitud retirada: %s",
+		"Cancel all":      "Cancelar todas",
+		"Declines every prompt, so that boot carries on to emergency mode": "Rechaza todas las solicitudes, para que el arranque continúe en modo de emergencia",
+		"Cancel every prompt? Boot may carry on to emergency mode.":        "¿Cancelar todas las solicitudes? El arranque puede continuar en modo de emergencia.",
+		"Answer several at once":         "Responder a varias a la vez",
+		"The same answer to":             "La misma respuesta a",
+		"Passphrase":                     "Frase de contraseña",
+		"Submit to those chosen":         "Enviar a las elegidas",
+		"Awaiting approval":              "Pendientes de aprobación",
+		"Answered by %s at %s, until %s": "Respondida por %s a las %s, hasta las %s",
+		"Approve":                        "Aprobar",
+		"Reject":                         "Rechazar",
+
+		// Login:
+		"%s login":                        "Inicio de sesión en %s",
+		"Username":                        "Usuario",
+		"Password":                        "Contraseña",
+		"Log in":                          "Iniciar sesión",
+		"Incorrect username or password.": "Usuario o contraseña incorrectos.",
+
+		// QR code:
+		"Scan this code to continue on another device:": "Escanee este código para continuar en otro dispositivo:",
+		"QR code": "Código QR",
+		"The code logs in as %s. It can only be used once, and expires in %s. Don't share it with anyone you wouldn't give your password to.": "El código inicia sesión como %s. Solo se puede usar una vez y caduca en %s. No lo comparta con nadie a quien no daría su contraseña.",
+		"Back": "Volver",
+
+		// Errors:
+		"Request ID: %s":         "ID de solicitud: %s",
+		"Request body too large": "Solicitud demasiado grande",
+		"Bad Request":            "Solicitud incorrecta",
+		"Forbidden":              "Prohibido",
+		"Not Found":              "No encontrado",
+		"Not found":              "No encontrado",
+		"not found":              "no encontrado",
+		"Unauthorized":           "No autenticado",
+		"Method not allowed":     "Método no permitido",
+		"Too many requests":      "Demasiadas solicitudes",
+		"too many attempts":      "demasiados intentos",
+		"too many answers are being given at once":         "demasiadas respuestas a la vez",
+		"Client certificate required":                      "Se requiere un certificado de cliente",
+		"No prompts were chosen":                           "No se eligió ninguna solicitud",
+		"This link is invalid, or has already been used":   "Este enlace no es válido o ya se ha usado",
+		"invalid CSRF token":                               "token CSRF no válido",
+		"invalid TOTP code":                                "código TOTP no válido",
+		"invalid answer":                                   "respuesta no válida",
+		"invalid share":                                    "parte no válida",
+		"share already submitted":                          "parte ya enviada",
+		"the requester is no longer waiting for an answer": "el solicitante ya no espera una respuesta",
+		"answers must be approved by another user":         "las respuestas deben ser aprobadas por otro usuario",
+		"approving answers requires users to log in":       "aprobar respuestas requiere que los usuarios inicien sesión",
+		"answers must be encrypted in the browser, which requires X25519 support": "las respuestas deben cifrarse en el navegador, lo que requiere compatibilidad con X25519",
+		"invalid encrypted answer": "respuesta cifrada no válida",
+
+		// Prompts:
+		"Please enter passphrase for disk %s:":   "Introduzca la frase de contraseña del disco %s:",
+		"Please enter recovery key for disk %s:": "Introduzca la clave de recuperación del disco %s:",
+		"Please enter LUKS2 token PIN:":          "Introduzca el PIN del token LUKS2:",
+		"Enter passphrase for %s:":               "Introduzca la frase de contraseña de %s:",
+	},
+}
+
+// promptFormats are the messages of common prompts, as systemd-cryptsetup
+// and cryptsetup ask them, to translate with their specifics, such as the
+// disk, filled in.
+var promptFormats = []string{
+	"Please enter passphrase for disk %s:",
+	"Please enter recovery key for disk %s:",
+	"Please enter LUKS2 token PIN:",
+	"Enter passphrase for %s:",
+}
+
+// promptRegexps match the promptFormats, in the same order.
+var promptRegexps = func() []*regexp.Regexp {
+	var out []*regexp.Regexp
+	for _, format := range promptFormats {
+		re := strings.ReplaceAll(regexp.QuoteMeta(format), "%s", "(.+)")
+		out = append(out, regexp.MustCompile("^"+re+"$"))
+	}
+	return out
+}()
+
+// Lang returns the language to respond to the request in, as a tag such as
+// "de": -lang if given, or else the best match for its Accept-Language.
+func Lang(r *http.Request) string {
+	if lang := site.Load().Settings.Lang; lang > "" {
+		return lang
+	}
+	_, i := language.MatchStrings(languageMatcher, r.Header.Get("Accept-Language"))
+	return languages[i].String()
+}
+
+// CheckLang checks that there's a translation for -lang.
+func CheckLang(lang string) error {
+	var tags []string
+	for _, tag := range languages {
+		if tag.String() == lang {
+			return nil
+		}
+		tags = append(tags, tag.String())
+	}
+	return fmt.Errorf("-lang: no translation for %q, only %s", lang, strings.Join(tags, ", "))
+}
+
+// T translates the text into the language, or returns it as is if it has
+// no translation.
+func T(lang, text string) string {
+	if s, ok := catalogs[lang][text]; ok {
+		return s
+	}
+	return text
+}
+
+// Tf is like T, then formats it as fmt.Sprintf does.
+func Tf(lang, format string, args ...any) string {
+	return fmt.Sprintf(T(lang, format), args...)
+}
+
+// TranslatePrompt translates the message of a prompt into the language, if
+// it's a common one.
+func TranslatePrompt(lang, message string) string {
+	s := strings.TrimSpace(message)
+	for i, re := range promptRegexps {
+		m := re.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		args := make([]any, len(m)-1)
+		for j, arg := range m[1:] {
+			args[j] = arg
+		}
+		return Tf(lang, promptFormats[i], args...)
+	}
+	return message
+}
+
+// Localized is a template parsed for each language, with functions
+// translating into it:
+//
+//   - T translates text, e.g. {{ T "Cancel" }}
+//   - Tf translates and formats text, e.g. {{ Tf "Logged in as %s." .User }}
+//   - message translates the message of a common prompt
+//   - lang is the language, e.g. de
+type Localized map[string]*template.Template
+
+// ParseLocalized parses the template text for each language.
+func ParseLocalized(name, text string, funcs template.FuncMap) (Localized, error) {
+	l := make(Localized)
+	for _, tag := range languages {
+		lang := tag.String()
+		t, err := template.New(name).Funcs(brandingFuncs).Funcs(funcs).Funcs(template.FuncMap{
+			"T":  func(text string) string { return T(lang, text) },
+			"Tf": func(format string, args ...any) string { return Tf(lang, format, args...) },
+			"message": func(message string) string {
+				return TranslatePrompt(lang, message)
+			},
+			"lang": func() string { return lang },
+		}).Parse(headerHTML)
+		if err == nil {
+			_, err = t.Parse(text)
+		}
+		if err != nil {
+			return nil, err
+		}
+		l[lang] = t
+	}
+	return l, nil
+}
+
+// Execute writes the template in the request's language.
+func (l Localized) Execute(w http.ResponseWriter, r *http.Request, data any) error {
+	lang := Lang(r)
+	t, ok := l[lang]
+	if !ok {
+		lang, t = "en", l["en"]
+	}
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	return t.Execute(w, data)
+}
@@ -0,0 +1,95 @@
+package main
+
+// Icons named by prompts' Icon=, from the freedesktop icon themes installed,
+// or drawn here for the common ones, as the initramfs has no icon themes.
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// iconThemeDirs are searched in order for icons.
+var iconThemeDirs = []string{"/usr/share/icons/Adwaita", "/usr/share/icons/hicolor"}
+
+// iconSizes are searched in order within each theme, preferring ones that
+// scale.
+var iconSizes = []string{"scalable", "48x48", "64x64", "32x32", "128x128", "256x256", "24x24"}
+
+// iconName is what an icon name may be, which also keeps it from escaping
+// the theme directories, or being a glob pattern.
+var iconName = regexp.MustCompile(`^[A-Za-z0-9_+-][A-Za-z0-9._+-]*$`)
+
+// fallbackIcons are drawn for names not found in a theme, in the style of
+// iconSVG.
+var fallbackIcons = map[string]string{
+	"drive-harddisk": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+<rect x="10" y="25" width="80" height="50" rx="6" fill="#1d4ed8"/>
+<rect x="18" y="58" width="40" height="6" rx="2" fill="#fff"/>
+<circle cx="76" cy="61" r="4" fill="#fff"/>
+</svg>
+`,
+	"drive-removable-media": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+<rect x="30" y="8" width="40" height="24" fill="#1d4ed8"/>
+<rect x="38" y="14" width="8" height="8" fill="#fff"/>
+<rect x="54" y="14" width="8" height="8" fill="#fff"/>
+<rect x="22" y="32" width="56" height="60" rx="6" fill="#1d4ed8"/>
+</svg>
+`,
+	"network-wired": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+<rect x="38" y="10" width="24" height="20" fill="#1d4ed8"/>
+<rect x="10" y="70" width="24" height="20" fill="#1d4ed8"/>
+<rect x="66" y="70" width="24" height="20" fill="#1d4ed8"/>
+<path d="M47 30h6v17h28v23h-6v-17h-50v17h-6v-23h28z" fill="#1d4ed8"/>
+</svg>
+`,
+	"dialog-password": iconSVG,
+}
+
+// findIcon returns the path of the named icon in the themes, or "".
+func findIcon(name string) string {
+	for _, theme := range iconThemeDirs {
+		for _, size := range iconSizes {
+			for _, ext := range []string{".svg", ".png"} {
+				matches, _ := filepath.Glob(filepath.Join(theme, size, "*", name+ext))
+				if len(matches) > 0 {
+					return matches[0]
+				}
+			}
+		}
+	}
+	for _, ext := range []string{".svg", ".png"} {
+		path := filepath.Join("/usr/share/pixmaps", name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// ServeIcon serves the icon named by the path, /icon/{name}, from the
+// themes, or drawn here, or else a padlock.
+func ServeIcon(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/icon/")
+	if !iconName.MatchString(name) {
+		Error(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=86400")
+	if path := findIcon(name); path > "" {
+		http.ServeFile(w, r, path)
+		return
+	}
+	svg, ok := fallbackIcons[name]
+	if !ok {
+		svg = fallbackIcons["dialog-password"]
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(svg)))
+	if r.Method != http.MethodHead {
+		w.Write([]byte(svg))
+	}
+}
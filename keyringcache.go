@@ -0,0 +1,105 @@
+package main
+
+// Answers cached in the kernel keyring, as systemd-ask-password caches
+// them, so that a requester asking the same question again, such as
+// systemd-cryptsetup for the same disk after the switch from the initramfs,
+// can be answered without anyone having to answer again.
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// keyringCacheDescription returns the description of the user key caching
+// answers to prompts with the ID.
+func keyringCacheDescription(id string) string {
+	return "askpass-http:" + id
+}
+
+// keyctlRead reads the payload of a key.
+func keyctlRead(id int) ([]byte, error) {
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if n, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, b, 0); err != nil {
+		return nil, err
+	}
+	return b[:min(n, len(b))], nil
+}
+
+// CachedAnswers returns the answers cached for prompts with the ID, most
+// recent last, if caching is enabled.
+func CachedAnswers(id string) [][]byte {
+	if *keyringCache <= 0 || id == "" {
+		return nil
+	}
+	// In the user keyring, rather than the session keyring that
+	// request_key searches, which systemd doesn't link to it for services:
+	key, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", keyringCacheDescription(id), 0)
+	if err != nil {
+		return nil
+	}
+	b, err := keyctlRead(key)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return bytes.Split(b, []byte{0})
+}
+
+// CacheAnswer adds an answer to those cached for prompts with the ID, and
+// keeps them for another -keyring-cache. As with systemd-ask-password, each
+// different answer is kept, in case an earlier one was wrong.
+func CacheAnswer(id, answer string) {
+	if *keyringCache <= 0 || id == "" || answer == "" {
+		return
+	}
+	answers := CachedAnswers(id)
+	// Including each of the answers given from the cache:
+	for _, s := range bytes.Split([]byte(answer), []byte{0}) {
+		if !slices.ContainsFunc(answers, func(a []byte) bool { return bytes.Equal(a, s) }) {
+			answers = append(answers, s)
+		}
+	}
+	log := slog.With("id", id)
+	key, err := unix.AddKey("user", keyringCacheDescription(id), bytes.Join(answers, []byte{0}), unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		log.Warn("Can't cache answer in the kernel keyring", "err", err)
+		return
+	}
+	timeout := int(math.Ceil(keyringCache.Seconds()))
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, key, timeout, 0, 0); err != nil {
+		log.Warn("Can't set the timeout of the answer cached in the kernel keyring", "err", err)
+	}
+}
+
+// AnswerFromCache answers prompts that accept a cached password with the
+// answers cached for their ID. It doesn't return.
+func AnswerFromCache(h *Hub) {
+	events, _ := h.SubscribeAll()
+	for e := range events {
+		if e.Type != EventAdded || !e.Prompt.AcceptCached {
+			continue
+		}
+		answers := CachedAnswers(e.Prompt.ID)
+		if answers == nil {
+			continue
+		}
+		go func(p Prompt) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			// Requesters try each of the answers, separated by NULs:
+			r := BotRequest(ctx, "keyring", "keyring-cache")
+			if err := AnswerPrompt(r, p.Name, string(bytes.Join(answers, []byte{0}))); err != nil {
+				slog.Warn("Can't answer prompt from the cache", "prompt", p.Name, "err", err)
+			}
+		}(e.Prompt)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+// TLS private keys that stay in hardware, so that a copy of the initramfs
+// doesn't give away the server's identity.
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// IsKeyURI reports whether a -key value refers to a key in hardware, rather
+// than a file.
+func IsKeyURI(key string) bool {
+	return strings.HasPrefix(key, "pkcs11:") || strings.HasPrefix(key, "tpm:")
+}
+
+// signers are kept open for the life of the process, rather than being
+// reopened each time the certificate is reloaded.
+var signers = struct {
+	sync.Mutex
+	m map[string]crypto.Signer
+}{m: make(map[string]crypto.Signer)}
+
+func openSigner(uri string) (crypto.Signer, error) {
+	signers.Lock()
+	defer signers.Unlock()
+	if s, ok := signers.m[uri]; ok {
+		return s, nil
+	}
+	var s crypto.Signer
+	var err error
+	if strings.HasPrefix(uri, "tpm:") {
+		s, err = OpenTPMKey(uri)
+	} else {
+		s, err = OpenPKCS11(uri)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", uri, err)
+	}
+	signers.m[uri] = s
+	return s, nil
+}
+
+// LoadKeyPair is like tls.LoadX509KeyPair, except that keyFile may also be a
+// PKCS#11 URI, such as pkcs11:token=askpass;object=tls, or the persistent
+// handle of a key in the TPM, such as tpm:0x81000001.
+func LoadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	if !IsKeyURI(keyFile) {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	var c tls.Certificate
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return c, err
+	}
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			c.Certificate = append(c.Certificate, block.Bytes)
+		}
+	}
+	if len(c.Certificate) == 0 {
+		return c, fmt.Errorf("%s: no certificates found", certFile)
+	}
+	if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+		return c, fmt.Errorf("%s: %w", certFile, err)
+	}
+
+	s, err := openSigner(keyFile)
+	if err != nil {
+		return c, err
+	}
+	pub, ok := s.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(c.Leaf.PublicKey) {
+		return c, fmt.Errorf("%s doesn't match the key in %s", certFile, keyFile)
+	}
+	c.PrivateKey = s
+	return c, nil
+}
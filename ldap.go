@@ -0,0 +1,112 @@
+package main
+
+// LDAP / Active Directory password authentication.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP authenticates users by binding to a directory server as them.
+//
+// If BindDN is set, the server is first searched (as BindDN) for the user's
+// DN. Otherwise, the user's DN is formed from the UserDN template, which for
+// Active Directory can simply be "%s@example.com".
+//
+// If GroupFilter is set, only users matching it may log in, for example
+// "(memberOf=CN=Disk Unlockers,OU=Groups,DC=example,DC=com)".
+type LDAP struct {
+	URL          string // ldap:// or ldaps://
+	StartTLS     bool
+	BaseDN       string
+	UserFilter   string // e.g. "(uid=%s)" or "(sAMAccountName=%s)"
+	GroupFilter  string
+	BindDN       string
+	BindPassword string
+	UserDN       string // e.g. "uid=%s,ou=people,dc=example,dc=com"
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	if l.StartTLS {
+		u, err := url.Parse(l.URL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate returns nil if the password is correct for the user, and the
+// user matches the GroupFilter.
+func (l *LDAP) Authenticate(user, pass string) error {
+	// An empty password would be an unauthenticated bind, which succeeds:
+	if user == "" || pass == "" {
+		return ErrUnauthorized
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		slog.Error("LDAP: connecting", "url", l.URL, "err", err)
+		return err
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(user))
+	if l.GroupFilter != "" {
+		filter = "(&" + filter + l.GroupFilter + ")"
+	}
+
+	var dn string
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			slog.Error("LDAP: binding", "dn", l.BindDN, "err", err)
+			return err
+		}
+		if dn, err = l.search(conn, filter); err != nil {
+			return err
+		}
+		if err := conn.Bind(dn, pass); err != nil {
+			return ErrUnauthorized
+		}
+	} else {
+		dn = fmt.Sprintf(l.UserDN, ldap.EscapeDN(user))
+		if err := conn.Bind(dn, pass); err != nil {
+			return ErrUnauthorized
+		}
+		if l.GroupFilter != "" {
+			if _, err := l.search(conn, filter); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// search returns the DN of the single entry matching filter.
+func (l *LDAP) search(conn *ldap.Conn, filter string) (string, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false, filter, []string{"dn"}, nil))
+	if err != nil {
+		slog.Error("LDAP: searching", "filter", filter, "err", err)
+		return "", err
+	}
+	if len(res.Entries) != 1 {
+		slog.Warn("LDAP: expected exactly 1 entry", "filter", filter, "entries", len(res.Entries))
+		return "", ErrUnauthorized
+	}
+	return res.Entries[0].DN, nil
+}
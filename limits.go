@@ -0,0 +1,126 @@
+package main
+
+// Limiting how long clients may take, and how much they may send, so that
+// slow or malicious clients can't tie up the server while it's needed to
+// boot.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/netutil"
+)
+
+// SetTimeouts sets the server's timeouts from the flags. Handlers that stream
+// or wait, such as ServeEvents, lift or extend the write timeout themselves.
+func SetTimeouts(srv *http.Server) {
+	srv.ReadHeaderTimeout = *readHeaderTimeout
+	srv.ReadTimeout = *readTimeout
+	srv.WriteTimeout = *writeTimeout
+	srv.IdleTimeout = *keepaliveTimeout
+}
+
+// LimitBodies rejects request bodies larger than -max-body-size. Handlers
+// may limit their bodies further, as ServePass does.
+func LimitBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || *maxBodySize <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Those sent with a length can be rejected without reading them, and
+		// the rest once they exceed it:
+		if r.ContentLength > *maxBodySize {
+			Error(w, r, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, *maxBodySize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+type responseControllerKey struct{}
+
+// KeepResponseController remembers the server's own ResponseWriter for
+// extendWriteDeadline, as middleware such as CountRequests wraps it in one
+// that can't set deadlines.
+func KeepResponseController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseControllerKey{}, rc)))
+	})
+}
+
+// extendWriteDeadline lets a handler that waits up to d before responding
+// take that long longer than -write-timeout, or forever if d is zero, as for
+// event streams.
+func extendWriteDeadline(r *http.Request, d time.Duration) {
+	rc, ok := r.Context().Value(responseControllerKey{}).(*http.ResponseController)
+	if !ok {
+		return
+	}
+	var deadline time.Time
+	if d > 0 && *writeTimeout > 0 {
+		deadline = time.Now().Add(d + *writeTimeout)
+	}
+	// Not all ResponseWriters support it, such as HTTP/3's, which have no
+	// deadline to extend:
+	_ = rc.SetWriteDeadline(deadline)
+}
+
+// ErrBusy is returned when too many answers are being given at once.
+var ErrBusy = errors.New("too many answers are being given at once")
+
+// replySlots limits the answers being written to requesters at once to
+// -max-answers. It's set in main.
+var replySlots Semaphore
+
+// Semaphore limits how many of something can happen at once. The zero
+// Semaphore is unlimited.
+type Semaphore chan struct{}
+
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(Semaphore, n)
+}
+
+// Acquire waits up to timeout for a slot, which must be released by calling
+// Release.
+func (s Semaphore) Acquire(timeout time.Duration) error {
+	if s == nil {
+		return nil
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-t.C:
+		return ErrBusy
+	}
+}
+
+func (s Semaphore) Release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// LimitConnections limits each listener to n connections at once, beyond
+// which new connections wait to be accepted, except unix: sockets, which only
+// local processes can connect to, and whose connections must stay
+// *net.UnixConn for PeerCredContext.
+func LimitConnections(lsns []Listener, n int) {
+	if n <= 0 {
+		return
+	}
+	for i, l := range lsns {
+		if l.Addr().Network() != "unix" {
+			lsns[i].Listener = netutil.LimitListener(l.Listener, n)
+		}
+	}
+}
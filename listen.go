@@ -0,0 +1,277 @@
+package main
+
+// Multiple listeners, each with its own TLS and authentication profile.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// Authentication profiles for listeners.
+const (
+	AuthAll    = "all"    // every configured authentication method
+	AuthTokens = "tokens" // bearer tokens only
+	AuthNone   = "none"   // no authentication, for example behind -unix-allow-uids
+)
+
+// listFlag is a flag that may be repeated, or given a comma-separated list.
+// The first use replaces the default, rather than appending to it.
+type listFlag struct {
+	values []string
+	set    bool
+}
+
+// newListFlag defines a listFlag, like flag.String.
+func newListFlag(name, value, usage string) *listFlag {
+	f := &listFlag{values: splitList(value)}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *listFlag) String() string { return strings.Join(f.values, ",") }
+
+func (f *listFlag) Set(s string) error {
+	if !f.set {
+		f.values, f.set = nil, true
+	}
+	f.values = append(f.values, splitList(s)...)
+	return nil
+}
+
+// ListenValues returns the -listen values, followed by an iface: address
+// for each -listen-iface. The default -listen is dropped if only
+// -listen-iface or -tailscale-hostname is given, so that the server isn't
+// reachable on other interfaces.
+func ListenValues() []string {
+	var values []string
+	if listen.set || (len(listenIface.values) == 0 && *tailscaleHostname == "") {
+		values = append(values, listen.values...)
+	}
+	for _, v := range listenIface.values {
+		values = append(values, "iface:"+v)
+	}
+	if *tailscaleHostname > "" && !listen.set {
+		values = append(values, "tailscale:80")
+	}
+	return values
+}
+
+// ListenInterface listens on port, but only accepts connections that arrive
+// on the named network interface (SO_BINDTODEVICE), whatever the routing
+// table says.
+func ListenInterface(iface, port string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), iface)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("binding to %s: %w", iface, err)
+		}
+		return nil
+	}}
+	lsn, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return nil, err
+	}
+	return ifaceListener{lsn, iface}, nil
+}
+
+// ifaceListener reports the interface it is bound to as the zone of its
+// address, e.g. [::%wg0]:8080.
+type ifaceListener struct {
+	net.Listener
+	iface string
+}
+
+func (l ifaceListener) Addr() net.Addr {
+	addr, ok := l.Listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return l.Listener.Addr()
+	}
+	return &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: l.iface}
+}
+
+// Listener is a listener with the profile it was configured with.
+type Listener struct {
+	net.Listener
+	TLS   bool
+	Auth  string
+	Proxy bool // PROXY protocol
+	H2C   bool // HTTP/2 without TLS
+}
+
+// OpenListeners opens the listeners for each -listen value, which is an
+// address accepted by Listeners, optionally followed by options:
+//
+//	tls=on|off         whether to use TLS. Defaults to on if there is a
+//	                   certificate, except for unix domain sockets, vsock
+//	                   and tailscale, whose connections are already
+//	                   private
+//	auth=all|tokens|none  which authentication methods to accept. Defaults
+//	                   to all
+//	proxy=on|off       whether to accept PROXY protocol headers from
+//	                   -trusted-proxies. Defaults to off, but must be on
+//	                   for tunnels
+//	h2c=on|off         whether to accept HTTP/2 without TLS (h2c), for
+//	                   proxies that speak it. Defaults to off
+//
+// For example: unix:/run/askpass-http.sock?auth=none
+func OpenListeners(values []string) ([]Listener, error) {
+	var out []Listener
+	for _, v := range values {
+		addr, rawOpts, _ := strings.Cut(v, "?")
+		opts, err := url.ParseQuery(rawOpts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", v, err)
+		}
+		auth := opts.Get("auth")
+		switch auth {
+		case "":
+			auth = AuthAll
+		case AuthAll, AuthTokens, AuthNone:
+		default:
+			return nil, fmt.Errorf("%s: unknown auth profile %q", v, auth)
+		}
+		tls := opts.Get("tls")
+		if tls != "" && tls != "on" && tls != "off" {
+			return nil, fmt.Errorf("%s: tls must be on or off", v)
+		}
+		proxy := opts.Get("proxy")
+		if proxy != "" && proxy != "on" && proxy != "off" {
+			return nil, fmt.Errorf("%s: proxy must be on or off", v)
+		}
+		h2c := opts.Get("h2c")
+		if h2c != "" && h2c != "on" && h2c != "off" {
+			return nil, fmt.Errorf("%s: h2c must be on or off", v)
+		}
+
+		lsns, err := Listeners(addr)
+		if err != nil {
+			return nil, err
+		}
+		for _, lsn := range lsns {
+			l := Listener{Listener: lsn, Auth: auth, Proxy: proxy == "on", H2C: h2c == "on"}
+			// Otherwise every client would have the relay's address, and
+			// share its rate limit and lockouts:
+			if lsn.Addr().Network() == "tunnel" && !l.Proxy {
+				lsn.Close()
+				return nil, fmt.Errorf("%s: tunnels require proxy=on, for the relay to give each client's address", v)
+			}
+			if l.Proxy {
+				l.Listener = &proxyproto.Listener{Listener: lsn, Policy: ProxyProtocolPolicy}
+			}
+			switch tls {
+			case "on":
+				l.TLS = true
+			case "":
+				network := lsn.Addr().Network()
+				l.TLS = HaveCert() && network != "unix" && network != "vsock" && network != "tailscale" && !l.H2C
+			}
+			if l.TLS && l.H2C {
+				return nil, fmt.Errorf("%s: h2c can't be used with tls", v)
+			}
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+// URL returns the base URL of the listener, for logging.
+func (l Listener) URL() string {
+	switch l.Addr().Network() {
+	case "unix":
+		return "unix:" + l.Addr().String()
+	case "tunnel":
+		return l.Addr().String()
+	case "vsock":
+		return "vsock:" + l.Addr().String()
+	}
+	if l.TLS {
+		return "https://" + l.Addr().String()
+	}
+	return "http://" + l.Addr().String()
+}
+
+// PrimaryListener returns the listener to tell people on other machines
+// about: the first TCP listener that isn't on loopback, preferring one using
+// TLS.
+func PrimaryListener(lsns []Listener) (Listener, bool) {
+	var primary Listener
+	var found bool
+	for _, l := range lsns {
+		addr, ok := l.Addr().(*net.TCPAddr)
+		if !ok || addr.IP.IsLoopback() || (found && (primary.TLS || !l.TLS)) {
+			continue
+		}
+		primary, found = l, true
+	}
+	return primary, found
+}
+
+// ListenerIPs returns the addresses a TCP listener can be reached at: its own,
+// or if it's listening on all addresses, those of the interfaces that are up.
+func ListenerIPs(addr *net.TCPAddr) []net.IP {
+	if !addr.IP.IsUnspecified() {
+		return []net.IP{addr.IP}
+	}
+	var ips []net.IP
+	for _, ip := range localIPs(addr.Zone) {
+		if addr.IP.To4() != nil && ip.To4() == nil {
+			continue // IPv4 only
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// localIPs returns the addresses of the interfaces that are up, other than
+// loopback, or only those of the named interface.
+func localIPs(name string) []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || (name != "" && iface.Name != name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return ips
+}
+
+type listenerKey struct{}
+
+// ListenerContext returns a http.Server BaseContext func that records which
+// of the listeners requests arrive on, for SiteHandler.
+func ListenerContext(i int) func(net.Listener) context.Context {
+	return func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), listenerKey{}, i)
+	}
+}
+
+// listenerIndex returns the index of the listener the request arrived on.
+func listenerIndex(r *http.Request) int {
+	i, _ := r.Context().Value(listenerKey{}).(int)
+	return i
+}
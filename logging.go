@@ -0,0 +1,73 @@
+package main
+
+// Structured logging.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type loggerKey struct{}
+
+// SetupLogging replaces the default logger with one from NewLogger.
+func SetupLogging(format, level string) error {
+	l, err := NewLogger(format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(l)
+	return nil
+}
+
+// NewLogger returns a logger to stderr. The format is "text" or "json", and
+// the level is one of "debug", "info", "warn" or "error".
+func NewLogger(format, level string) (*slog.Logger, error) {
+	var opts slog.HandlerOptions
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("-log-level: %w", err)
+	}
+	opts.Level = lvl
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, &opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, &opts)
+	default:
+		return nil, fmt.Errorf("-log-format: unknown format %q", format)
+	}
+	return slog.New(h), nil
+}
+
+// Logger returns the logger for the request, which includes attributes
+// identifying the request.
+func Logger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// WithLogAttrs returns a copy of r whose logger includes the attributes.
+func WithLogAttrs(r *http.Request, args ...any) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, Logger(r).With(args...)))
+}
+
+// LogRequests attaches a logger to every request identifying the client and
+// the requested path.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = WithLogAttrs(r,
+			"remote_addr", r.RemoteAddr,
+			"method", r.Method,
+			"path", r.URL.Path,
+		)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,374 @@
+package main
+
+// Notifications in a Matrix room, through the client-server API, and
+// optionally by direct message, accepting answers as replies.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Matrix posts notifications to a room, as a user that has joined it, and
+// optionally to particular users by direct message, taking their replies as
+// answers.
+type Matrix struct {
+	Homeserver  string   // URL, e.g. https://matrix.example.com
+	Room        string   // ID, e.g. !abc:example.com, or alias, e.g. #ops:example.com
+	AnswerUsers []string // sent direct messages, and allowed to answer, e.g. @alice:example.com
+
+	token    string
+	directMu sync.Mutex // held while finding or creating direct rooms
+	mu       sync.Mutex
+	direct   map[string]string     // room ID of the direct messages with each user
+	sent     map[string]sentPrompt // by event ID
+	renamed  map[string]sentPrompt // by the name of a prompt that was asked again
+}
+
+// NewMatrix returns a Matrix for the room, with the user's access token read
+// from tokenFile, and the comma-separated user IDs to take answers from.
+func NewMatrix(homeserver, tokenFile, room, answerUsers string) (*Matrix, error) {
+	if !strings.HasPrefix(homeserver, "https://") && !strings.HasPrefix(homeserver, "http://") {
+		return nil, fmt.Errorf("matrix: %q is not an http:// or https:// URL", homeserver)
+	}
+	if !strings.HasPrefix(room, "!") && !strings.HasPrefix(room, "#") {
+		return nil, fmt.Errorf("matrix: %q is not a room ID or alias", room)
+	}
+	if tokenFile == "" {
+		return nil, errors.New("matrix: an access token is required")
+	}
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	m := &Matrix{
+		Homeserver: strings.TrimSuffix(homeserver, "/"),
+		Room:       room,
+		token:      strings.TrimSpace(string(b)),
+		direct:     make(map[string]string),
+		sent:       make(map[string]sentPrompt),
+		renamed:    make(map[string]sentPrompt),
+	}
+	for _, user := range splitList(answerUsers) {
+		if !strings.HasPrefix(user, "@") || !strings.Contains(user, ":") {
+			return nil, fmt.Errorf("matrix: %q is not a user ID", user)
+		}
+		m.AnswerUsers = append(m.AnswerUsers, user)
+	}
+	return m, nil
+}
+
+// call calls the client-server API, decoding the response into v, if not
+// nil.
+func (m *Matrix) call(ctx context.Context, method, path string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, m.Homeserver+"/_matrix/client/v3"+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := ResponseError(resp); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// roomID resolves the room's alias, if it is one.
+func (m *Matrix) roomID(ctx context.Context) (string, error) {
+	if strings.HasPrefix(m.Room, "!") {
+		return m.Room, nil
+	}
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := m.call(ctx, http.MethodGet, "/directory/room/"+url.PathEscape(m.Room), nil, &res); err != nil {
+		return "", fmt.Errorf("resolving %s: %w", m.Room, err)
+	}
+	return res.RoomID, nil
+}
+
+func (m *Matrix) Notify(ctx context.Context, n Notification) error {
+	room, err := m.roomID(ctx)
+	if err != nil {
+		return err
+	}
+	msg := map[string]any{
+		"msgtype":        "m.text",
+		"body":           n.Title + ": " + n.Message,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": "<strong>" + html.EscapeString(n.Title) + "</strong><br>" + html.EscapeString(n.Message),
+	}
+	if n.URL > "" {
+		msg["body"] = msg["body"].(string) + "\n" + n.URL
+		msg["formatted_body"] = msg["formatted_body"].(string) + `<br><a href="` + html.EscapeString(n.URL) + `">Answer</a>`
+	}
+	var errs []error
+	if _, err := m.send(ctx, room, msg); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Direct messages are to be replied to with the answer:
+	text := BotInstructions()
+	msg["body"] = msg["body"].(string) + "\n\n" + text
+	msg["formatted_body"] = msg["formatted_body"].(string) + "<br><br>" + html.EscapeString(text)
+	for _, user := range m.AnswerUsers {
+		room, err := m.directRoom(ctx, user)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		id, err := m.send(ctx, room, msg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.mu.Lock()
+		now := time.Now()
+		for id, p := range m.sent {
+			if now.Sub(p.Time) > 48*time.Hour {
+				delete(m.sent, id)
+			}
+		}
+		for name, p := range m.renamed {
+			if now.Sub(p.Time) > 48*time.Hour {
+				delete(m.renamed, name)
+			}
+		}
+		m.sent[id] = sentPrompt{n.Prompt.Name, now}
+		m.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// send sends a message to the room, returning its event ID.
+func (m *Matrix) send(ctx context.Context, room string, msg any) (string, error) {
+	var res struct {
+		EventID string `json:"event_id"`
+	}
+	path := "/rooms/" + url.PathEscape(room) + "/send/m.room.message/" + randomString()
+	err := m.call(ctx, http.MethodPut, path, msg, &res)
+	return res.EventID, err
+}
+
+// directRoom returns the ID of the room for direct messages with the user,
+// as listed in the m.direct account data. If there isn't one, it's created,
+// unencrypted, and the user invited to it.
+func (m *Matrix) directRoom(ctx context.Context, user string) (string, error) {
+	m.directMu.Lock()
+	defer m.directMu.Unlock()
+	m.mu.Lock()
+	room, ok := m.direct[user]
+	m.mu.Unlock()
+	if ok {
+		return room, nil
+	}
+
+	var me struct {
+		UserID string `json:"user_id"`
+	}
+	if err := m.call(ctx, http.MethodGet, "/account/whoami", nil, &me); err != nil {
+		return "", err
+	}
+	path := "/user/" + url.PathEscape(me.UserID) + "/account_data/m.direct"
+	direct := make(map[string][]string)
+	var herr *HTTPError
+	if err := m.call(ctx, http.MethodGet, path, nil, &direct); err != nil && !(errors.As(err, &herr) && herr.StatusCode == http.StatusNotFound) {
+		return "", err
+	}
+	if rooms := direct[user]; len(rooms) > 0 {
+		room = rooms[len(rooms)-1]
+	} else {
+		var res struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := m.call(ctx, http.MethodPost, "/createRoom", map[string]any{
+			"preset":    "trusted_private_chat",
+			"is_direct": true,
+			"invite":    []string{user},
+		}, &res); err != nil {
+			return "", fmt.Errorf("creating a room for direct messages with %s: %w", user, err)
+		}
+		room = res.RoomID
+		direct[user] = append(direct[user], room)
+		if err := m.call(ctx, http.MethodPut, path, direct, nil); err != nil {
+			return "", err
+		}
+	}
+	m.mu.Lock()
+	m.direct[user] = room
+	m.mu.Unlock()
+	return room, nil
+}
+
+// Follow takes replies to the notification of prompt from as answers to
+// prompt to, which asks the same question again.
+func (m *Matrix) Follow(from, to string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.renamed[from] = sentPrompt{to, time.Now()}
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		Body      string `json:"body"`
+		RelatesTo *struct {
+			InReplyTo *struct {
+				EventID string `json:"event_id"`
+			} `json:"m.in_reply_to"`
+		} `json:"m.relates_to"`
+	} `json:"content"`
+}
+
+// matrixFilter limits syncs to the messages in joined rooms.
+const matrixFilter = `{"presence":{"types":[]},"account_data":{"types":[]},` +
+	`"room":{"timeline":{"types":["m.room.message","m.room.encrypted"]},"state":{"types":[]},"ephemeral":{"types":[]},"account_data":{"types":[]}}}`
+
+// Sync receives replies to direct messages with long polling, and answers
+// their prompts, until ctx is done. Messages from before it started are
+// ignored. Replies are redacted once read, so that the answer doesn't stay in
+// the room's history.
+func (m *Matrix) Sync(ctx context.Context) {
+	// So that the users can accept the invitations before they're needed:
+	for _, user := range m.AnswerUsers {
+		if _, err := m.directRoom(ctx, user); err != nil {
+			slog.Warn("Finding Matrix room for direct messages", "user", user, "err", err)
+		}
+	}
+	var since string
+	for ctx.Err() == nil {
+		q := url.Values{"filter": {matrixFilter}, "timeout": {"50000"}}
+		if since > "" {
+			q.Set("since", since)
+		} else {
+			q.Set("timeout", "0")
+		}
+		var res struct {
+			NextBatch string `json:"next_batch"`
+			Rooms     struct {
+				Join map[string]struct {
+					Timeline struct {
+						Events []matrixEvent `json:"events"`
+					} `json:"timeline"`
+				} `json:"join"`
+			} `json:"rooms"`
+		}
+		if err := m.call(ctx, http.MethodGet, "/sync?"+q.Encode(), nil, &res); err != nil {
+			slog.Warn("Receiving Matrix messages", "err", err)
+			select {
+			case <-time.After(10 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		first := since == ""
+		since = res.NextBatch
+		if first {
+			continue
+		}
+		for room, joined := range res.Rooms.Join {
+			for _, e := range joined.Timeline.Events {
+				m.reply(ctx, room, e)
+			}
+		}
+	}
+}
+
+func (m *Matrix) reply(ctx context.Context, room string, e matrixEvent) {
+	m.mu.Lock()
+	direct := m.direct[e.Sender] == room
+	var p sentPrompt
+	var ok bool
+	var replyTo string
+	if c := e.Content; c.RelatesTo != nil && c.RelatesTo.InReplyTo != nil {
+		replyTo = c.RelatesTo.InReplyTo.EventID
+		p, ok = m.sent[replyTo]
+		p.Name = latestPrompt(m.renamed, p.Name)
+	}
+	m.mu.Unlock()
+	if !direct {
+		return // from anyone else, or in another room
+	}
+
+	var text string
+	switch {
+	case e.Type == "m.room.encrypted":
+		// The reply to a notification is inside the encryption:
+		text = "This room is end-to-end encrypted, which isn't supported, so messages in it can't be read."
+	case !ok:
+		return // not a reply to a notification
+	}
+	if err := m.redact(ctx, room, e.EventID); err != nil {
+		slog.Warn("Redacting Matrix message with answer", "room", room, "err", err)
+	}
+	if text == "" {
+		// As the user ID has colons in it, it's given a port, for ClientIP
+		// to take it whole:
+		r := BotRequest(ctx, net.JoinHostPort("matrix/"+e.Sender, "0"), "matrix:"+e.Sender)
+		pending, err := BotAnswer(r, p.Name, stripReplyFallback(e.Content.Body))
+		text = BotResult(pending, err)
+	}
+	msg := map[string]any{"msgtype": "m.notice", "body": text}
+	if replyTo > "" {
+		msg["m.relates_to"] = map[string]any{"m.in_reply_to": map[string]string{"event_id": replyTo}}
+	}
+	if _, err := m.send(ctx, room, msg); err != nil {
+		slog.Warn("Sending Matrix message", "room", room, "err", err)
+	}
+}
+
+// redact removes the content of an event, such as a message with an answer.
+func (m *Matrix) redact(ctx context.Context, room, event string) error {
+	path := "/rooms/" + url.PathEscape(room) + "/redact/" + url.PathEscape(event) + "/" + randomString()
+	return m.call(ctx, http.MethodPut, path, map[string]string{}, nil)
+}
+
+// stripReplyFallback removes the quotation of the message replied to that
+// clients may put at the start of the body of a reply, as lines beginning
+// "> <@user:example.com>" and "> ", followed by a blank line.
+func stripReplyFallback(body string) string {
+	if !strings.HasPrefix(body, "> <") {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	if i < len(lines) && lines[i] == "" {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
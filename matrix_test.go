@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatrixAnswer(t *testing.T) {
+	useTestSite(t, &Site{})
+	useTestLockout(t, 5, time.Minute)
+	old := hub
+	hub = NewHub()
+	t.Cleanup(func() { hub = old })
+
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "ask.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hub.Update(Askers{"ask.1": &Askpass{Message: "Passphrase", Socket: socket}})
+
+	// A homeserver, where the user has no room for direct messages yet:
+	var mu sync.Mutex
+	var sent []string // rooms sent to
+	var redacted []string
+	syncs := 0
+	reply := `{"type":"m.room.message","event_id":"$reply","sender":"@alice:example.com","content":{` +
+		`"msgtype":"m.text","body":"> <@askpass:example.com> Passphrase\n\nhunter2",` +
+		`"m.relates_to":{"m.in_reply_to":{"event_id":"$2"}}}}`
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.EscapedPath(), "/_matrix/client/v3")
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case path == "/account/whoami":
+			fmt.Fprint(w, `{"user_id":"@askpass:example.com"}`)
+		case strings.HasSuffix(path, "/account_data/m.direct") && r.Method == http.MethodGet:
+			http.Error(w, `{"errcode":"M_NOT_FOUND"}`, http.StatusNotFound)
+		case strings.HasSuffix(path, "/account_data/m.direct"):
+			fmt.Fprint(w, `{}`)
+		case path == "/createRoom":
+			fmt.Fprint(w, `{"room_id":"!dm:example.com"}`)
+		case strings.Contains(path, "/send/m.room.message/"):
+			room, _ := url.PathUnescape(strings.Split(path, "/")[2])
+			sent = append(sent, room)
+			fmt.Fprintf(w, `{"event_id":"$%d"}`, len(sent))
+		case strings.Contains(path, "/redact/"):
+			event, _ := url.PathUnescape(strings.Split(path, "/")[4])
+			redacted = append(redacted, event)
+			fmt.Fprint(w, `{"event_id":"$redaction"}`)
+		case path == "/sync":
+			syncs++
+			switch syncs {
+			case 1: // from before it started
+				fmt.Fprint(w, `{"next_batch":"s1","rooms":{"join":{"!dm:example.com":{"timeline":{"events":[`+
+					strings.Replace(reply, "hunter2", "wrong", 1)+`]}}}}}`)
+			case 2:
+				// From someone else, then from the user:
+				other := strings.Replace(reply, "@alice:", "@mallory:", 1)
+				fmt.Fprint(w, `{"next_batch":"s2","rooms":{"join":{"!dm:example.com":{"timeline":{"events":[`+
+					other+`,`+reply+`]}}}}}`)
+			default:
+				mu.Unlock()
+				<-r.Context().Done()
+				mu.Lock()
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+
+	tokenFile := writeTempFile(t, "token", "secret\n")
+	m, err := NewMatrix(srv.URL, tokenFile, "!ops:example.com", "@alice:example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := m.Notify(ctx, Notification{Title: "Passphrase", Message: "for the disk", Prompt: Prompt{Name: "ask.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	go m.Sync(ctx)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != "+hunter2" {
+		t.Errorf("answered %q, want %q", got, "+hunter2")
+	}
+	// Wait for the result to be sent:
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		done := len(sent) == 3
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"!ops:example.com", "!dm:example.com", "!dm:example.com"}; fmt.Sprint(sent) != fmt.Sprint(want) {
+		t.Errorf("sent to %v, want %v", sent, want)
+	}
+	if want := []string{"$reply"}; fmt.Sprint(redacted) != fmt.Sprint(want) {
+		t.Errorf("redacted %v, want %v", redacted, want)
+	}
+}
+
+func TestNewMatrixAnswerUsers(t *testing.T) {
+	tokenFile := writeTempFile(t, "token", "secret\n")
+	for users, ok := range map[string]bool{
+		"":                                     true,
+		"@alice:example.com":                   true,
+		"@alice:example.com, @bob:example.org": true,
+		"alice":                                false,
+		"@alice":                               false,
+		"@alice:example.com,#ops:example.com":  false,
+	} {
+		_, err := NewMatrix("https://matrix.example.com", tokenFile, "!ops:example.com", users)
+		if (err == nil) != ok {
+			t.Errorf("NewMatrix(%q) error = %v", users, err)
+		}
+	}
+}
+
+func TestStripReplyFallback(t *testing.T) {
+	for body, want := range map[string]string{
+		"hunter2": "hunter2",
+		"> <@askpass:example.com> Passphrase\n> for the disk\n\nhunter2": "hunter2",
+		"> <@askpass:example.com> Passphrase\n\n123456 hunter2":          "123456 hunter2",
+		">hunter2": ">hunter2",
+	} {
+		if got := stripReplyFallback(body); got != want {
+			t.Errorf("stripReplyFallback(%q) = %q, want %q", body, got, want)
+		}
+	}
+}
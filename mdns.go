@@ -0,0 +1,74 @@
+package main
+
+// Announcing the server on the local network with mDNS and DNS-SD, so that
+// a phone can find it without knowing the address it was given by DHCP.
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+const mdnsService = "_askpass-http._tcp"
+
+// mdnsZone answers mDNS queries for the server. The records are made afresh
+// for each query, so that addresses assigned after we start, and certificate
+// changes, are announced.
+type mdnsZone struct {
+	instance string
+	host     string
+	addr     *net.TCPAddr
+	tls      bool
+}
+
+// Announce answers mDNS queries for the PrimaryListener, as an instance of
+// _askpass-http._tcp named -mdns-name. Its TXT records give the base path,
+// whether TLS is used, and the SHA-256 fingerprint of the certificate, if
+// there is one.
+func Announce(lsns []Listener) (*mdns.Server, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	z := &mdnsZone{instance: *mdnsName, host: hostname + ".local."}
+	if z.instance == "" {
+		z.instance = hostname
+	}
+	l, ok := PrimaryListener(lsns)
+	if !ok {
+		return nil, errors.New("-mdns requires a TCP listener")
+	}
+	z.addr, z.tls = l.Addr().(*net.TCPAddr), l.TLS
+	return mdns.NewServer(&mdns.Config{Zone: z})
+}
+
+func (z *mdnsZone) Records(q dns.Question) []dns.RR {
+	ips := ListenerIPs(z.addr)
+	if len(ips) == 0 {
+		return nil
+	}
+	svc, err := mdns.NewMDNSService(z.instance, mdnsService, "", z.host, z.addr.Port, ips, z.txt())
+	if err != nil {
+		return nil
+	}
+	return svc.Records(q)
+}
+
+func (z *mdnsZone) txt() []string {
+	s := site.Load()
+	path := s.BasePath
+	if path == "" {
+		path = "/"
+	}
+	txt := []string{"path=" + path, "tls=" + strconv.FormatBool(z.tls)}
+	if z.tls && s.Cert != nil {
+		txt = append(txt, "sha256="+Fingerprint(s.Cert.Certificate[0]))
+	}
+	return txt
+}
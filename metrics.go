@@ -0,0 +1,80 @@
+package main
+
+// Prometheus metrics, so that monitoring can alert when a host is stuck
+// waiting for a passphrase.
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricPromptsSeen = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "askpass_prompts_seen_total",
+		Help: "Number of distinct prompts that have been seen.",
+	})
+	metricAnswers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "askpass_answers_total",
+		Help: "Number of answers sent to requesters.",
+	})
+	metricCancellations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "askpass_cancellations_total",
+		Help: "Number of prompts cancelled.",
+	})
+	metricSocketErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "askpass_socket_errors_total",
+		Help: "Number of failures to send a reply to a requester's socket.",
+	})
+	metricNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "askpass_notifications_total",
+		Help: "Number of notifications sent, by notifier and result.",
+	}, []string{"notifier", "result"})
+	metricHTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "askpass_http_requests_total",
+		Help: "Number of HTTP requests, by status code.",
+	}, []string{"code"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "askpass_prompts_pending",
+		Help: "Number of prompts currently waiting for an answer.",
+	}, func() float64 {
+		return float64(hub.Len())
+	})
+)
+
+func init() {
+	prometheus.MustRegister(promptCollector{prometheus.NewDesc(
+		"askpass_prompt_pending",
+		"Number of prompts currently waiting for an answer, by Id, or \"unknown\" if the requester gave no Id.",
+		[]string{"id"}, nil,
+	)})
+}
+
+// promptCollector reports the pending prompts by Id, which unlike their
+// names, stays the same when a requester asks again, so that alerts can be
+// about a particular disk. Prompts without an Id are counted together, as
+// messages could be anything, and would make a new series each time.
+type promptCollector struct{ desc *prometheus.Desc }
+
+func (c promptCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+
+func (c promptCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[string]int)
+	for _, p := range hub.Askers().Prompts() {
+		id := p.ID
+		if id == "" {
+			id = "unknown"
+		}
+		counts[id]++
+	}
+	for key, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), key)
+	}
+}
+
+// CountRequests counts responses by HTTP status code.
+func CountRequests(next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerCounter(metricHTTPRequests, next)
+}
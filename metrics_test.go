@@ -0,0 +1,35 @@
+package main
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPromptCollector(t *testing.T) {
+	old := hub
+	hub = NewHub()
+	t.Cleanup(func() { hub = old })
+	hub.Update(Askers{
+		"ask.1": &Askpass{Message: "Please enter passphrase for disk root", ID: "cryptsetup:/dev/sda2"},
+		"ask.2": &Askpass{Message: "Enter PIN for token"},
+		"ask.3": &Askpass{Message: "Password for user@example.com"},
+	})
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(promptCollector{prometheus.NewDesc("askpass_prompt_pending", "Pending prompts.", []string{"id"}, nil)})
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			got[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{"cryptsetup:/dev/sda2": 1, "unknown": 2}
+	if !maps.Equal(got, want) {
+		t.Errorf("askpass_prompt_pending = %v, want %v", got, want)
+	}
+}
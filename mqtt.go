@@ -0,0 +1,179 @@
+package main
+
+// Publishing prompts to an MQTT broker, with Home Assistant discovery, so
+// that smart home automations can react to a machine waiting to be
+// unlocked.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT publishes to topics beneath Topic:
+//
+//	TOPIC/status  online or offline (retained)
+//	TOPIC/state   MQTTState as JSON (retained)
+//	TOPIC/event   WebhookEvent as JSON, for each prompt created or removed
+//
+// If DiscoveryPrefix is set, it also publishes Home Assistant discovery
+// configs for a binary sensor that is on while any prompt is waiting, and a
+// sensor of the number of prompts.
+type MQTT struct {
+	Topic           string
+	DiscoveryPrefix string
+
+	host   string
+	opts   *mqtt.ClientOptions
+	client mqtt.Client
+}
+
+// MQTTState is published to TOPIC/state whenever the prompts change.
+type MQTTState struct {
+	Waiting string   `json:"waiting"` // ON or OFF, as Home Assistant expects
+	Count   int      `json:"count"`
+	Prompts []Prompt `json:"prompts"`
+	URL     string   `json:"url,omitempty"`
+}
+
+// NewMQTT returns an MQTT for the broker, such as tcp://host:1883 or
+// ssl://host:8883, authenticating with the user name and the password read
+// from passwordFile, if given. If topic is empty, askpass-http/HOSTNAME is
+// used.
+func NewMQTT(broker, user, passwordFile, topic, discoveryPrefix string) (*MQTT, error) {
+	host, _ := os.Hostname()
+	m := &MQTT{
+		Topic:           strings.TrimSuffix(topic, "/"),
+		DiscoveryPrefix: strings.TrimSuffix(discoveryPrefix, "/"),
+		host:            host,
+	}
+	if m.Topic == "" {
+		m.Topic = "askpass-http/" + mqttID(host)
+	}
+	m.opts = mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("askpass-http-"+mqttID(host)).
+		SetWill(m.Topic+"/status", "offline", 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("Lost connection to MQTT broker", "broker", broker, "err", err)
+		})
+	if user > "" {
+		m.opts.SetUsername(user)
+	}
+	if passwordFile > "" {
+		b, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		m.opts.SetPassword(strings.TrimSpace(string(b)))
+	}
+	return m, nil
+}
+
+// mqttID returns s with only the characters allowed in Home Assistant
+// object IDs, and MQTT client IDs by brokers that are strict about them.
+func mqttID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func (m *MQTT) publish(topic string, retained bool, v any) {
+	b, ok := v.([]byte)
+	if !ok {
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			panic(err)
+		}
+	}
+	// Don't wait for the broker, as while disconnected, that would block
+	// until reconnecting, when the state is published again anyway:
+	m.client.Publish(topic, 1, retained, b)
+}
+
+// discover publishes the Home Assistant discovery configs.
+func (m *MQTT) discover() {
+	id := mqttID(m.host)
+	device := map[string]any{
+		"identifiers": []string{"askpass-http_" + id},
+		"name":        m.host,
+		"model":       "askpass-http",
+	}
+	common := func(name, object string) map[string]any {
+		return map[string]any{
+			"name":                  name,
+			"object_id":             "askpass_" + id + "_" + object,
+			"unique_id":             "askpass-http_" + id + "_" + object,
+			"state_topic":           m.Topic + "/state",
+			"availability_topic":    m.Topic + "/status",
+			"json_attributes_topic": m.Topic + "/state",
+			"device":                device,
+		}
+	}
+	waiting := common("Waiting for password", "waiting")
+	waiting["device_class"] = "problem"
+	waiting["icon"] = "mdi:lock-clock"
+	waiting["value_template"] = "{{ value_json.waiting }}"
+	m.publish(fmt.Sprintf("%s/binary_sensor/%s/waiting/config", m.DiscoveryPrefix, id), true, waiting)
+
+	prompts := common("Password prompts", "prompts")
+	prompts["icon"] = "mdi:form-textbox-password"
+	prompts["state_class"] = "measurement"
+	prompts["value_template"] = "{{ value_json.count }}"
+	m.publish(fmt.Sprintf("%s/sensor/%s/prompts/config", m.DiscoveryPrefix, id), true, prompts)
+}
+
+// Run connects to the broker, and publishes the hub's prompts, linking to
+// the PublicURL of lsns. It doesn't return.
+func (m *MQTT) Run(h *Hub, lsns []Listener) {
+	state := func() MQTTState {
+		prompts := h.Askers().Prompts()
+		s := MQTTState{Waiting: "OFF", Count: len(prompts), Prompts: prompts, URL: PublicURL(lsns)}
+		if len(prompts) > 0 {
+			s.Waiting = "ON"
+		}
+		return s
+	}
+	// On every connection, as the broker may have restarted without keeping
+	// retained messages:
+	m.opts.SetOnConnectHandler(func(mqtt.Client) {
+		slog.Info("Connected to MQTT broker", "topic", m.Topic)
+		if m.DiscoveryPrefix > "" {
+			m.discover()
+		}
+		m.publish(m.Topic+"/status", true, []byte("online"))
+		m.publish(m.Topic+"/state", true, state())
+	})
+	m.client = mqtt.NewClient(m.opts)
+	m.client.Connect() // retries in the background until connected
+
+	events, _ := h.SubscribeAll()
+	for e := range events {
+		if e.Type == EventChanged {
+			continue
+		}
+		m.publish(m.Topic+"/state", true, state())
+		if name := WebhookEventName(e); name > "" {
+			m.publish(m.Topic+"/event", false, WebhookEvent{
+				Event:  name,
+				Time:   time.Now(),
+				Host:   m.host,
+				URL:    PublicURL(lsns),
+				Prompt: e.Prompt,
+			})
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+// Serving the prompts at / in whichever form the client asks for with its
+// Accept header, so that curl and scripts can use the same URL as browsers.
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Negotiate returns the offered media type that the request's Accept header
+// prefers, or else the first, as for browsers, and clients that accept
+// anything or don't say.
+func Negotiate(r *http.Request, offers ...string) string {
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQ(r.Header.Get("Accept"), offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQ returns the quality the Accept header gives the media type, from
+// the most specific range matching it, e.g. text/plain over text/*.
+func acceptQ(accept, mediaType string) float64 {
+	major, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, s := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(s)
+		if err != nil {
+			continue
+		}
+		var n int
+		switch t {
+		case mediaType:
+			n = 2
+		case major + "/*":
+			n = 1
+		case "*/*":
+			n = 0
+		default:
+			continue
+		}
+		if n < specificity {
+			continue
+		}
+		specificity, q = n, 1
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+	}
+	return q
+}
+
+// WritePromptsText writes the prompts as plain text, a line for each with
+// its name and message separated by a tab, e.g. for cut -f1.
+func WritePromptsText(w http.ResponseWriter, prompts []Prompt) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	oneLine := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+	for _, p := range prompts {
+		fmt.Fprintf(w, "%s\t%s\n", oneLine.Replace(p.Name), oneLine.Replace(p.Message))
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+// Notifying people elsewhere that a prompt is waiting to be answered.
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notification is a message about a new prompt.
+type Notification struct {
+	Title   string
+	Message string
+	URL     string // of the page to answer it on, or "" if unknown
+	Host    string // that the prompt is on
+	Prompt  Prompt
+
+	// Reminder is set if the prompt has been waiting for a while already.
+	Reminder bool
+}
+
+// Notifier sends notifications somewhere.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Reminder is implemented by notifiers that also want a notification about
+// prompts left unanswered for longer than RemindAfter. A RemindAfter of 0
+// disables reminders.
+type Reminder interface {
+	RemindAfter() time.Duration
+}
+
+// Follower is implemented by notifiers that take replies to their
+// notifications as answers to the prompt. When a repeated prompt isn't
+// notified of, they're told to take replies to the earlier prompt's
+// notification as answers to the new one.
+type Follower interface {
+	Follow(from, to string)
+}
+
+// NewNotification describes a new prompt.
+func NewNotification(p Prompt, url string) Notification {
+	host, _ := os.Hostname()
+	return Notification{
+		Title:   fmt.Sprintf("%s is waiting for a password", host),
+		Message: p.Message,
+		URL:     url,
+		Host:    host,
+		Prompt:  p,
+	}
+}
+
+// PublicURL returns -public-url, or the first of the PrimaryURLs, or "" if
+// there aren't any.
+func PublicURL(lsns []Listener) string {
+	if *publicURL > "" {
+		return *publicURL
+	}
+	if urls := PrimaryURLs(lsns); len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
+// BotRequest returns a request on behalf of user, for answering prompts
+// from outside of HTTP, such as by chat. remote identifies the client in
+// place of an IP address, for logging, auditing and lockout.
+func BotRequest(ctx context.Context, remote, user string) *http.Request {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	if err != nil {
+		panic(err)
+	}
+	r.RemoteAddr = remote
+	return WithUser(r, user)
+}
+
+// BotInstructions tells people how to answer a prompt by replying to its
+// notification.
+func BotInstructions() string {
+	s := "Reply to this message with the answer."
+	if site.Load().TOTP != nil {
+		s += " Begin it with a code from your authenticator app, and a space."
+	}
+	return s
+}
+
+// BotAnswer submits an answer given in reply to a notification, on behalf
+// of the request from BotRequest, as SubmitAnswer does. If TOTP is enabled,
+// the answer must begin with a code and a space.
+func BotAnswer(r *http.Request, name, answer string) (*PendingAnswer, error) {
+	if lockout.Remaining(authKey(ClientIP(r))) > 0 {
+		return nil, ErrLockedOut
+	}
+	if !MayAnswer(r) {
+		return nil, ErrUnauthorized
+	}
+	if site.Load().TOTP != nil {
+		code, rest, _ := strings.Cut(answer, " ")
+		if err := CheckTOTP(r, code); err != nil {
+			return nil, err
+		}
+		answer = rest
+	}
+	return SubmitAnswer(r, name, answer)
+}
+
+// BotResult describes what BotAnswer did, for replying with.
+func BotResult(pending *PendingAnswer, err error) string {
+	switch {
+	case pending != nil:
+		return "Awaiting approval."
+	case errors.Is(err, ErrNotFound):
+		return "That prompt has already gone."
+	case err != nil:
+		return "Couldn't answer: " + err.Error()
+	}
+	return "Answered."
+}
+
+// HTTPError is an unsuccessful response from a notification service.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       string // the start of it
+}
+
+func (e *HTTPError) Error() string { return e.Status + ": " + e.Body }
+
+// ResponseError returns an *HTTPError if the response isn't successful, or
+// nil if it is.
+func ResponseError(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &HTTPError{resp.StatusCode, resp.Status, strings.TrimSpace(string(b))}
+}
+
+// Transient reports whether sending a notification might succeed if tried
+// again. Errors other than HTTPErrors are assumed to be network errors.
+func Transient(err error) bool {
+	var herr *HTTPError
+	if errors.As(err, &herr) {
+		return herr.StatusCode >= 500 || herr.StatusCode == http.StatusTooManyRequests || herr.StatusCode == http.StatusRequestTimeout
+	}
+	return err != nil
+}
+
+// notifierFlags are the flags of each notifier, named -notify-NAME-*, which
+// can be set in a [notify.NAME] table in the config file.
+type notifierFlags struct {
+	Enabled        *bool
+	Title, Message *string
+}
+
+// newNotifierFlags defines notifierFlags for each of the named notifiers.
+func newNotifierFlags(names ...string) map[string]notifierFlags {
+	m := make(map[string]notifierFlags)
+	for _, name := range names {
+		prefix := "notify-" + name + "-"
+		m[name] = notifierFlags{
+			Enabled: flag.Bool(prefix+"enabled", true, fmt.Sprintf("Send notifications to %s, if it's configured", name)),
+			Title:   flag.String(prefix+"title", "", fmt.Sprintf("Template for the title of notifications to %s. If unspecified, uses -notify-title", name)),
+			Message: flag.String(prefix+"message", "", fmt.Sprintf("Template for the message of notifications to %s. If unspecified, uses -notify-message", name)),
+		}
+	}
+	return m
+}
+
+// Dispatcher sends notifications of new prompts to each of its notifiers.
+// Each has a queue, so that a slow notifier doesn't hold up the others,
+// and is retried with backoff if it fails transiently. A notification of
+// the same question (by Prompt.Key) as one sent within the Dedupe window is
+// dropped, as requesters such as cryptsetup ask again with a new prompt
+// after a wrong answer, though Followers are told of the new prompt, and
+// Reminders are still reminded of it.
+type Dispatcher struct {
+	Dedupe   time.Duration
+	Attempts int // per notification, including the first
+
+	notifiers map[string]*dispatchee
+	mu        sync.Mutex
+	recent    map[string]recentPrompt // by question
+}
+
+// recentPrompt is the latest prompt asking a question, and when a
+// notification of it was last sent.
+type recentPrompt struct {
+	Name string
+	Sent time.Time
+}
+
+type dispatchee struct {
+	Notifier
+	title, message *template.Template
+	queue          chan Notification
+}
+
+// NewDispatcher returns a Dispatcher with no notifiers.
+func NewDispatcher(dedupe time.Duration) *Dispatcher {
+	return &Dispatcher{
+		Dedupe:    dedupe,
+		Attempts:  5,
+		notifiers: make(map[string]*dispatchee),
+		recent:    make(map[string]recentPrompt),
+	}
+}
+
+// Add adds the named notifier, with Go text/templates for the titles and
+// messages of its notifications, which are executed with the Notification.
+func (d *Dispatcher) Add(name string, n Notifier, title, message string) error {
+	t, err := template.New(name + " title").Parse(title)
+	if err != nil {
+		return fmt.Errorf("%s: title: %w", name, err)
+	}
+	m, err := template.New(name + " message").Parse(message)
+	if err != nil {
+		return fmt.Errorf("%s: message: %w", name, err)
+	}
+	d.notifiers[name] = &dispatchee{n, t, m, make(chan Notification, 64)}
+	return nil
+}
+
+// Len returns the number of notifiers.
+func (d *Dispatcher) Len() int { return len(d.notifiers) }
+
+// Run sends notifications whenever a prompt appears, linking to the
+// PublicURL of lsns. Notifiers that are Reminders are notified again if
+// it's still there later. It doesn't return.
+func (d *Dispatcher) Run(h *Hub, lsns []Listener) {
+	for name, dn := range d.notifiers {
+		go d.work(name, dn)
+	}
+	reminders := make(map[string][]*time.Timer) // by prompt name
+	events, _ := h.SubscribeAll()
+	for e := range events {
+		switch e.Type {
+		case EventAdded:
+			n := NewNotification(e.Prompt, PublicURL(lsns))
+			previous, dup := d.duplicate(n)
+			if dup {
+				slog.Info("Not notifying of repeated prompt", "prompt", e.Prompt.Name, "previous", previous)
+			}
+			for name, dn := range d.notifiers {
+				if !dup {
+					d.enqueue(name, dn, n)
+				} else if f, ok := dn.Notifier.(Follower); ok {
+					f.Follow(previous, e.Prompt.Name)
+				}
+				if r, ok := dn.Notifier.(Reminder); ok && r.RemindAfter() > 0 {
+					name, dn, n := name, dn, n
+					n.Reminder = true
+					t := time.AfterFunc(r.RemindAfter(), func() { d.enqueue(name, dn, n) })
+					reminders[e.Prompt.Name] = append(reminders[e.Prompt.Name], t)
+				}
+			}
+		case EventRemoved:
+			for _, t := range reminders[e.Prompt.Name] {
+				t.Stop()
+			}
+			delete(reminders, e.Prompt.Name)
+		}
+	}
+}
+
+// duplicate reports whether a notification of the same question was sent
+// within the Dedupe window, returning the name of the last prompt to ask
+// it if so. It records this one either way.
+func (d *Dispatcher) duplicate(n Notification) (previous string, dup bool) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for q, r := range d.recent {
+		if now.Sub(r.Sent) > d.Dedupe {
+			delete(d.recent, q)
+		}
+	}
+	r, dup := d.recent[n.Prompt.Key()]
+	previous = r.Name
+	if !dup {
+		r.Sent = now
+	}
+	r.Name = n.Prompt.Name
+	d.recent[n.Prompt.Key()] = r
+	return previous, dup
+}
+
+func (d *Dispatcher) enqueue(name string, dn *dispatchee, n Notification) {
+	select {
+	case dn.queue <- n:
+	default:
+		slog.Warn("Dropping notification, as the queue is full", "notifier", name, "prompt", n.Prompt.Name)
+	}
+}
+
+// work sends the notifier's queued notifications.
+func (d *Dispatcher) work(name string, dn *dispatchee) {
+	for n := range dn.queue {
+		var title, message strings.Builder
+		if err := dn.title.Execute(&title, n); err != nil {
+			slog.Warn("Formatting notification", "notifier", name, "err", err)
+			continue
+		}
+		if err := dn.message.Execute(&message, n); err != nil {
+			slog.Warn("Formatting notification", "notifier", name, "err", err)
+			continue
+		}
+		n.Title, n.Message = title.String(), message.String()
+
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := dn.Notify(ctx, n)
+			cancel()
+			if err == nil {
+				metricNotifications.WithLabelValues(name, "success").Inc()
+				break
+			}
+			if !Transient(err) || attempt >= d.Attempts {
+				metricNotifications.WithLabelValues(name, "failure").Inc()
+				slog.Warn("Sending notification", "notifier", name, "prompt", n.Prompt.Name, "attempts", attempt, "err", err)
+				break
+			}
+			slog.Debug("Retrying notification", "notifier", name, "prompt", n.Prompt.Name, "in", backoff, "err", err)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, time.Minute)
+		}
+	}
+}
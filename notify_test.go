@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNotifier records what it's sent and told to follow.
+type testNotifier struct {
+	sent   chan Notification
+	remind time.Duration
+
+	mu       sync.Mutex
+	followed [][2]string
+}
+
+func (n *testNotifier) Notify(ctx context.Context, notification Notification) error {
+	n.sent <- notification
+	return nil
+}
+
+func (n *testNotifier) RemindAfter() time.Duration { return n.remind }
+
+func (n *testNotifier) Follow(from, to string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.followed = append(n.followed, [2]string{from, to})
+}
+
+func (n *testNotifier) expect(t *testing.T, name string, reminder bool) {
+	t.Helper()
+	select {
+	case got := <-n.sent:
+		if got.Prompt.Name != name || got.Reminder != reminder {
+			t.Errorf("notified of %s (reminder %v), want %s (reminder %v)", got.Prompt.Name, got.Reminder, name, reminder)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not notified of %s", name)
+	}
+}
+
+func (n *testNotifier) expectNothing(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case got := <-n.sent:
+		t.Errorf("notified of %s (reminder %v)", got.Prompt.Name, got.Reminder)
+	case <-time.After(d):
+	}
+}
+
+func TestDispatcherRepeatedPrompt(t *testing.T) {
+	n := &testNotifier{sent: make(chan Notification, 16), remind: 200 * time.Millisecond}
+	d := NewDispatcher(time.Minute)
+	if err := d.Add("test", n, "{{ .Title }}", "{{ .Message }}"); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub()
+	go d.Run(h, nil)
+	luks := Askpass{Message: "Please enter passphrase for disk root", ID: "cryptsetup:/dev/sda2"}
+
+	first := luks
+	h.Update(Askers{"ask.1": &first})
+	n.expect(t, "ask.1", false)
+
+	// After a wrong answer, cryptsetup asks again:
+	h.Update(Askers{})
+	second := luks
+	h.Update(Askers{"ask.2": &second})
+	n.expectNothing(t, 50*time.Millisecond)
+	n.mu.Lock()
+	if len(n.followed) != 1 || n.followed[0] != [2]string{"ask.1", "ask.2"} {
+		t.Errorf("followed %v, want ask.1 to ask.2", n.followed)
+	}
+	n.mu.Unlock()
+	// The reminder is of the new prompt, as the earlier one's was cancelled:
+	n.expect(t, "ask.2", true)
+
+	third := luks
+	h.Update(Askers{})
+	h.Update(Askers{"ask.3": &third})
+	time.Sleep(50 * time.Millisecond)
+	n.mu.Lock()
+	if len(n.followed) != 2 || n.followed[1] != [2]string{"ask.2", "ask.3"} {
+		t.Errorf("followed %v, want ask.2 to ask.3", n.followed)
+	}
+	n.mu.Unlock()
+	n.expect(t, "ask.3", true)
+	n.expectNothing(t, 300*time.Millisecond)
+
+	// Other questions aren't repeats:
+	other := Askpass{Message: "Please enter passphrase for disk swap", ID: "cryptsetup:/dev/sda3"}
+	h.Update(Askers{"ask.3": &third, "ask.4": &other})
+	n.expect(t, "ask.4", false)
+}
+
+func TestTelegramFollow(t *testing.T) {
+	tg := &Telegram{sent: make(map[telegramMessage]sentPrompt), renamed: make(map[string]sentPrompt)}
+	tg.Follow("ask.1", "ask.2")
+	tg.Follow("ask.2", "ask.3")
+	for name, want := range map[string]string{"ask.1": "ask.3", "ask.2": "ask.3", "ask.3": "ask.3", "ask.9": "ask.9"} {
+		if got := tg.latest(name); got != want {
+			t.Errorf("latest(%s) = %s, want %s", name, got, want)
+		}
+	}
+	// Even if prompt names were reused:
+	tg.Follow("ask.3", "ask.1")
+	if got := tg.latest("ask.1"); got == "" {
+		t.Error("latest = \"\"")
+	}
+}
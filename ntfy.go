@@ -0,0 +1,64 @@
+package main
+
+// Notifications through ntfy (https://ntfy.sh), self-hosted or not.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Ntfy publishes notifications to an ntfy topic.
+type Ntfy struct {
+	URL      string // of the topic, e.g. https://ntfy.sh/mytopic
+	Token    string // access token, or "" if the topic is public
+	Priority string // 1 to 5, or min, low, default, high, max or urgent
+}
+
+// NewNtfy returns an Ntfy for the topic URL, with the access token read from
+// tokenFile, if given.
+func NewNtfy(url, tokenFile, priority string) (*Ntfy, error) {
+	n := &Ntfy{URL: url, Priority: priority}
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, fmt.Errorf("ntfy: %q is not an http:// or https:// URL", url)
+	}
+	switch priority {
+	case "", "1", "2", "3", "4", "5", "min", "low", "default", "high", "max", "urgent":
+	default:
+		return nil, fmt.Errorf("ntfy: unknown priority %q", priority)
+	}
+	if tokenFile > "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		n.Token = strings.TrimSpace(string(b))
+	}
+	return n, nil
+}
+
+func (n *Ntfy) Notify(ctx context.Context, notif Notification) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(notif.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", notif.Title)
+	req.Header.Set("Tags", "lock")
+	if n.Priority > "" {
+		req.Header.Set("Priority", n.Priority)
+	}
+	if notif.URL > "" {
+		req.Header.Set("Click", notif.URL)
+	}
+	if n.Token > "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return ResponseError(resp)
+}
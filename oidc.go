@@ -0,0 +1,180 @@
+package main
+
+// OpenID Connect login, using the authorization code flow.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcCallbackPath = "/oidc/callback"
+	oidcStateCookie  = "askpass_oidc_state"
+)
+
+type OIDC struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string   // must end in oidcCallbackPath
+	GroupsClaim  string   // claim in the ID token listing the user's groups
+	AllowGroups  []string // groups allowed to answer; empty allows everyone
+
+	mu       sync.Mutex
+	verifier *oidc.IDTokenVerifier
+	config   *oauth2.Config
+}
+
+// oidcState is stored in a cookie for the duration of the login redirect.
+type oidcState struct {
+	State    string
+	Nonce    string
+	Redirect string // where to return to after login
+}
+
+// setup performs provider discovery. It is done lazily rather than at startup,
+// as the network might not be up yet during early boot.
+func (o *OIDC) setup(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.config != nil {
+		return nil
+	}
+	provider, err := oidc.NewProvider(ctx, o.Issuer)
+	if err != nil {
+		return fmt.Errorf("oidc: %w", err)
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.ClientID})
+	o.config = &oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  o.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+	}
+	return nil
+}
+
+// Middleware requires the user to have logged in. Users that are not in
+// AllowGroups may view prompts, but not answer them.
+func (o *OIDC) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sess := sessions.Get(r); sess != nil {
+			next.ServeHTTP(w, sess.Apply(r))
+			return
+		}
+		if err := o.setup(r.Context()); err != nil {
+			Error(w, r, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == oidcCallbackPath {
+			o.serveCallback(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			Error(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		o.redirectToProvider(w, r)
+	})
+}
+
+func (o *OIDC) redirectToProvider(w http.ResponseWriter, r *http.Request) {
+	state := oidcState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Redirect: r.URL.RequestURI(),
+	}
+	SetSignedCookie(w, r, oidcStateCookie, state, time.Now().Add(10*time.Minute))
+	http.Redirect(w, r, o.config.AuthCodeURL(state.State, oidc.Nonce(state.Nonce)), http.StatusFound)
+}
+
+func (o *OIDC) serveCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcState
+	if err := ReadSignedCookie(r, oidcStateCookie, &state); err != nil {
+		AuthFailed(r, "oidc", "")
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("state") != state.State {
+		AuthFailed(r, "oidc", "")
+		Error(w, r, "oidc: state mismatch", http.StatusBadRequest)
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		AuthFailed(r, "oidc", "")
+		Error(w, r, fmt.Sprintf("oidc: %s: %s", e, r.FormValue("error_description")), http.StatusUnauthorized)
+		return
+	}
+
+	token, err := o.config.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		Error(w, r, fmt.Sprintf("oidc: exchange: %v", err), http.StatusBadGateway)
+		return
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		Error(w, r, "oidc: no id_token in response", http.StatusBadGateway)
+		return
+	}
+	idToken, err := o.verifier.Verify(r.Context(), raw)
+	if err != nil {
+		AuthFailed(r, "oidc", "")
+		Error(w, r, fmt.Sprintf("oidc: %v", err), http.StatusUnauthorized)
+		return
+	}
+	if idToken.Nonce != state.Nonce {
+		AuthFailed(r, "oidc", idToken.Subject)
+		Error(w, r, "oidc: nonce mismatch", http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		Error(w, r, fmt.Sprintf("oidc: %v", err), http.StatusBadGateway)
+		return
+	}
+	user := idToken.Subject
+	for _, c := range []string{"preferred_username", "email"} {
+		if s, ok := claims[c].(string); ok && s != "" {
+			user = s
+			break
+		}
+	}
+	groups := claimStrings(claims[o.GroupsClaim])
+	readOnly := len(o.AllowGroups) > 0 && !slices.ContainsFunc(groups, func(g string) bool {
+		return slices.Contains(o.AllowGroups, g)
+	})
+	// They may still look, but weren't allowed what they logged in for:
+	if readOnly {
+		AuthFailed(r, "oidc", user)
+	}
+	sessions.Create(w, r, user, readOnly)
+	Audit(WithUser(r, user), "login", "", nil)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: URLPath(r, "/"), MaxAge: -1})
+	http.Redirect(w, r, URLPath(r, LocalRedirect(state.Redirect)), http.StatusSeeOther)
+}
+
+// claimStrings accepts a claim that is either a string or a list of strings.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
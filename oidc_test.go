@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOIDCCallbackFailures(t *testing.T) {
+	useTestSite(t, &Site{})
+	o := &OIDC{}
+	w := httptest.NewRecorder()
+	SetSignedCookie(w, httptest.NewRequest("GET", "/", nil), oidcStateCookie, oidcState{State: "right"}, time.Now().Add(time.Minute))
+
+	for name, r := range map[string]*http.Request{
+		"no state":       httptest.NewRequest("GET", oidcCallbackPath+"?state=right&code=x", nil),
+		"wrong state":    withCookies(httptest.NewRequest("GET", oidcCallbackPath+"?state=wrong&code=x", nil), w),
+		"issuer refused": withCookies(httptest.NewRequest("GET", oidcCallbackPath+"?state=right&error=access_denied", nil), w),
+	} {
+		t.Run(name, func(t *testing.T) {
+			useTestLockout(t, 1, time.Minute)
+			resp := httptest.NewRecorder()
+			o.serveCallback(resp, r)
+			if resp.Code < 400 {
+				t.Errorf("status %d", resp.Code)
+			}
+			if lockout.Remaining(authKey(ClientIP(r))) == 0 {
+				t.Error("not counted as a failed attempt")
+			}
+		})
+	}
+}
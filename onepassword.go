@@ -0,0 +1,117 @@
+package main
+
+// Secrets kept in 1Password, through a 1Password Connect server.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// onePassword is nil unless -op-connect-host is specified.
+var onePassword *OnePassword
+
+// OnePassword reads items from a 1Password Connect server.
+type OnePassword struct {
+	Host string // URL, e.g. http://op-connect:8080
+
+	token string
+}
+
+// NewOnePassword returns a OnePassword for the Connect server, with the
+// access token read from tokenFile.
+func NewOnePassword(host, tokenFile string) (*OnePassword, error) {
+	if !strings.HasPrefix(host, "https://") && !strings.HasPrefix(host, "http://") {
+		return nil, fmt.Errorf("1password: %q is not an http:// or https:// URL", host)
+	}
+	if tokenFile == "" {
+		return nil, errors.New("1password: a Connect access token is required")
+	}
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &OnePassword{Host: strings.TrimSuffix(host, "/"), token: strings.TrimSpace(string(b))}, nil
+}
+
+// get calls the Connect API, decoding the response into v.
+func (op *OnePassword) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, op.Host+"/v1/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+op.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := ResponseError(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// opID returns the ID of the vault or item named by name, which may already
+// be an ID, from those at path.
+func (op *OnePassword) opID(ctx context.Context, path, name string) (string, error) {
+	var found []struct {
+		ID string `json:"id"`
+	}
+	filter := url.Values{"filter": {fmt.Sprintf("title eq %q", name)}}
+	if err := op.get(ctx, path+"?"+filter.Encode(), &found); err != nil {
+		return "", err
+	}
+	switch len(found) {
+	case 0:
+		// Connect doesn't match IDs with filters:
+		return name, nil
+	case 1:
+		return found[0].ID, nil
+	}
+	return "", fmt.Errorf("more than one %q", name)
+}
+
+// onePasswordSecret reads a field of an item, given by a secret reference
+// like 1Password's own, op://VAULT/ITEM/FIELD, where each may be a name or
+// an ID. If the field is left out, the item's password is used.
+func onePasswordSecret(ctx context.Context, ref string, _ Prompt) ([]byte, error) {
+	if onePassword == nil {
+		return nil, errors.New("1password: -op-connect-host is not set")
+	}
+	parts := strings.Split(strings.TrimPrefix(ref, "//"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("1password: %q is not op://VAULT/ITEM/FIELD", ref)
+	}
+	vault, err := onePassword.opID(ctx, "vaults", parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("1password: vault %s: %w", parts[0], err)
+	}
+	item, err := onePassword.opID(ctx, "vaults/"+url.PathEscape(vault)+"/items", parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("1password: item %s: %w", parts[1], err)
+	}
+	var res struct {
+		Fields []struct {
+			ID      string `json:"id"`
+			Label   string `json:"label"`
+			Purpose string `json:"purpose"`
+			Value   string `json:"value"`
+		} `json:"fields"`
+	}
+	if err := onePassword.get(ctx, "vaults/"+url.PathEscape(vault)+"/items/"+url.PathEscape(item), &res); err != nil {
+		return nil, fmt.Errorf("1password: item %s: %w", parts[1], err)
+	}
+	for _, f := range res.Fields {
+		if len(parts) == 3 && (f.Label == parts[2] || f.ID == parts[2]) ||
+			len(parts) == 2 && f.Purpose == "PASSWORD" {
+			return []byte(f.Value), nil
+		}
+	}
+	return nil, fmt.Errorf("1password: item %s has no such field", parts[1])
+}
@@ -0,0 +1,339 @@
+package main
+
+// Describing the JSON API with OpenAPI 3, for generating clients, and for
+// API gateways to validate requests against.
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// openapiPath is where openapiJSON is served.
+const openapiPath = "/api/openapi.json"
+
+// openapiJSON describes the endpoints in api.go, answerkey.go and
+// approval.go. Keep it up to date with them. The server URL is relative to
+// openapiPath, so it's right beneath -base-path.
+const openapiJSON = `{
+	"openapi": "3.0.3",
+	"info": {
+		"title": "askpass-http",
+		"description": "Answer systemd password prompts, such as for disk encryption during boot.",
+		"version": "1"
+	},
+	"servers": [{"url": ".."}],
+	"security": [{"bearer": []}, {"basic": []}, {"session": []}, {}],
+	"paths": {
+		"/api/v1/prompts": {
+			"get": {
+				"operationId": "listPrompts",
+				"summary": "List the current prompts",
+				"parameters": [
+					{"$ref": "#/components/parameters/name"},
+					{"$ref": "#/components/parameters/id"},
+					{"$ref": "#/components/parameters/message"},
+					{"$ref": "#/components/parameters/q"}
+				],
+				"responses": {
+					"200": {"$ref": "#/components/responses/Prompts"},
+					"401": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/wait": {
+			"get": {
+				"operationId": "waitForPrompts",
+				"summary": "List the current prompts, once there are any",
+				"description": "Waits until there's a prompt matching the filter, or the timeout expires, when the list may be empty.",
+				"parameters": [
+					{"name": "timeout", "in": "query", "description": "How long to wait, e.g. 30s, up to 5m.", "schema": {"type": "string", "default": "30s"}},
+					{"$ref": "#/components/parameters/name"},
+					{"$ref": "#/components/parameters/id"},
+					{"$ref": "#/components/parameters/message"},
+					{"$ref": "#/components/parameters/q"}
+				],
+				"responses": {
+					"200": {"$ref": "#/components/responses/Prompts"},
+					"400": {"$ref": "#/components/responses/Error"},
+					"401": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/prompts/{name}/answer": {
+			"parameters": [{"$ref": "#/components/parameters/promptName"}],
+			"post": {
+				"operationId": "answerPrompt",
+				"summary": "Answer a prompt",
+				"requestBody": {
+					"required": true,
+					"content": {"application/json": {"schema": {"$ref": "#/components/schemas/AnswerRequest"}}}
+				},
+				"responses": {
+					"202": {
+						"description": "The answer awaits approval by another user, with -require-approval.",
+						"content": {"application/json": {"schema": {"$ref": "#/components/schemas/PendingAnswer"}}}
+					},
+					"204": {"description": "The answer was given to the requester."},
+					"400": {"$ref": "#/components/responses/Error"},
+					"401": {"$ref": "#/components/responses/Error"},
+					"403": {"$ref": "#/components/responses/Error"},
+					"404": {"$ref": "#/components/responses/Error"},
+					"410": {"$ref": "#/components/responses/Error"},
+					"415": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/prompts/{name}/cancel": {
+			"parameters": [{"$ref": "#/components/parameters/promptName"}],
+			"post": {
+				"operationId": "cancelPrompt",
+				"summary": "Decline a prompt",
+				"requestBody": {
+					"required": true,
+					"content": {"application/json": {"schema": {"type": "object"}}}
+				},
+				"responses": {
+					"204": {"description": "The prompt was declined."},
+					"401": {"$ref": "#/components/responses/Error"},
+					"403": {"$ref": "#/components/responses/Error"},
+					"404": {"$ref": "#/components/responses/Error"},
+					"410": {"$ref": "#/components/responses/Error"},
+					"415": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/prompts/{name}/share": {
+			"parameters": [{"$ref": "#/components/parameters/promptName"}],
+			"post": {
+				"operationId": "submitShare",
+				"summary": "Submit a share of the answer, with -shamir-threshold",
+				"requestBody": {
+					"required": true,
+					"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ShareRequest"}}}
+				},
+				"responses": {
+					"202": {
+						"description": "More shares are needed.",
+						"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Shares"}}}
+					},
+					"204": {"description": "The answer was combined from the shares, and given to the requester."},
+					"400": {"$ref": "#/components/responses/Error"},
+					"401": {"$ref": "#/components/responses/Error"},
+					"403": {"$ref": "#/components/responses/Error"},
+					"404": {"$ref": "#/components/responses/Error"},
+					"410": {"$ref": "#/components/responses/Error"},
+					"415": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/cancel-all": {
+			"post": {
+				"operationId": "cancelAllPrompts",
+				"summary": "Decline every prompt",
+				"requestBody": {
+					"required": true,
+					"content": {"application/json": {"schema": {"type": "object"}}}
+				},
+				"responses": {
+					"200": {
+						"description": "The names of the prompts declined.",
+						"content": {"application/json": {"schema": {
+							"type": "object",
+							"required": ["cancelled"],
+							"properties": {"cancelled": {"type": "array", "items": {"type": "string"}}}
+						}}}
+					},
+					"401": {"$ref": "#/components/responses/Error"},
+					"403": {"$ref": "#/components/responses/Error"},
+					"415": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/answer-key": {
+			"get": {
+				"operationId": "getAnswerKey",
+				"summary": "Get the public key of -answer-key, to encrypt answers to",
+				"responses": {
+					"200": {
+						"description": "The public key.",
+						"content": {"text/plain": {"schema": {"type": "string"}}}
+					},
+					"401": {"$ref": "#/components/responses/Error"},
+					"404": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/approvals": {
+			"get": {
+				"operationId": "listApprovals",
+				"summary": "List the answers awaiting approval, with -require-approval",
+				"responses": {
+					"200": {
+						"description": "The answers awaiting approval.",
+						"content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PendingAnswer"}}}}
+					},
+					"401": {"$ref": "#/components/responses/Error"},
+					"404": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/approvals/{id}/approve": {
+			"parameters": [{"$ref": "#/components/parameters/approvalID"}],
+			"post": {
+				"operationId": "approveAnswer",
+				"summary": "Approve an answer, giving it to the requester",
+				"requestBody": {
+					"required": true,
+					"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ApprovalRequest"}}}
+				},
+				"responses": {
+					"204": {"description": "The answer was given to the requester."},
+					"400": {"$ref": "#/components/responses/Error"},
+					"401": {"$ref": "#/components/responses/Error"},
+					"403": {"$ref": "#/components/responses/Error"},
+					"404": {"$ref": "#/components/responses/Error"},
+					"410": {"$ref": "#/components/responses/Error"},
+					"415": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		},
+		"/api/v1/approvals/{id}/reject": {
+			"parameters": [{"$ref": "#/components/parameters/approvalID"}],
+			"post": {
+				"operationId": "rejectAnswer",
+				"summary": "Reject an answer",
+				"requestBody": {
+					"required": true,
+					"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ApprovalRequest"}}}
+				},
+				"responses": {
+					"204": {"description": "The answer was discarded."},
+					"400": {"$ref": "#/components/responses/Error"},
+					"401": {"$ref": "#/components/responses/Error"},
+					"403": {"$ref": "#/components/responses/Error"},
+					"404": {"$ref": "#/components/responses/Error"},
+					"415": {"$ref": "#/components/responses/Error"}
+				}
+			}
+		}
+	},
+	"components": {
+		"securitySchemes": {
+			"bearer": {"type": "http", "scheme": "bearer", "description": "A token from -auth-tokens."},
+			"basic": {"type": "http", "scheme": "basic", "description": "A user from -auth-htpasswd or -ldap-url."},
+			"session": {"type": "apiKey", "in": "cookie", "name": "askpass_session", "description": "The session of a user logged in on the web page."}
+		},
+		"parameters": {
+			"promptName": {"name": "name", "in": "path", "required": true, "description": "The name of the prompt, which changes each time the requester asks again.", "schema": {"type": "string"}},
+			"approvalID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+			"name": {"name": "name", "in": "query", "description": "Pattern the name must match, in which * matches anything and ? any one character.", "schema": {"type": "string"}},
+			"id": {"name": "id", "in": "query", "description": "Pattern the ID must match, e.g. cryptsetup:*", "schema": {"type": "string"}},
+			"message": {"name": "message", "in": "query", "description": "Pattern the message must match.", "schema": {"type": "string"}},
+			"q": {"name": "q", "in": "query", "description": "Part of the name, ID or message, ignoring case. name~, id~ and message~ match part of just that field.", "schema": {"type": "string"}}
+		},
+		"responses": {
+			"Prompts": {
+				"description": "The prompts, sorted by name.",
+				"content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Prompt"}}}}
+			},
+			"Error": {
+				"description": "The request failed.",
+				"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+			}
+		},
+		"schemas": {
+			"Prompt": {
+				"type": "object",
+				"required": ["name", "message"],
+				"properties": {
+					"name": {"type": "string", "description": "The name of the ask file, which changes each time the requester asks again."},
+					"message": {"type": "string"},
+					"icon": {"type": "string", "description": "A freedesktop icon name, whose image is at /icon/{name}."},
+					"id": {"type": "string", "description": "What's being asked about, e.g. cryptsetup:/dev/sda2, which stays the same when the requester asks again."},
+					"accept_cached": {"type": "boolean"},
+					"echo": {"type": "boolean", "description": "The answer isn't secret, so may be shown as it's typed."},
+					"process": {"$ref": "#/components/schemas/Process"},
+					"not_after": {"type": "string", "format": "date-time"},
+					"retry": {"type": "boolean", "description": "The last answer appears to have been rejected."}
+				}
+			},
+			"Process": {
+				"type": "object",
+				"description": "The requester. Only pid is given if it has exited.",
+				"required": ["pid"],
+				"properties": {
+					"pid": {"type": "integer"},
+					"comm": {"type": "string"},
+					"cmdline": {"type": "string"},
+					"unit": {"type": "string", "description": "The systemd unit it's in."}
+				}
+			},
+			"AnswerRequest": {
+				"type": "object",
+				"properties": {
+					"answer": {"type": "string"},
+					"answer_base64": {"type": "string", "format": "byte", "description": "The answer, base64-encoded instead, if it isn't UTF-8."},
+					"encrypted": {"type": "string", "description": "The answer, encrypted to -answer-key instead."},
+					"totp": {"type": "string", "description": "Required if TOTP is enabled."}
+				}
+			},
+			"ShareRequest": {
+				"type": "object",
+				"required": ["share"],
+				"properties": {
+					"share": {"type": "string"},
+					"totp": {"type": "string", "description": "Required if TOTP is enabled."}
+				}
+			},
+			"ApprovalRequest": {
+				"type": "object",
+				"properties": {
+					"totp": {"type": "string", "description": "Required to approve if TOTP is enabled."}
+				}
+			},
+			"Shares": {
+				"type": "object",
+				"required": ["shares", "threshold"],
+				"properties": {
+					"shares": {"type": "integer", "description": "How many have been submitted."},
+					"threshold": {"type": "integer", "description": "How many are needed."}
+				}
+			},
+			"PendingAnswer": {
+				"type": "object",
+				"required": ["id", "prompt", "message", "user", "submitted", "expires"],
+				"properties": {
+					"id": {"type": "string"},
+					"prompt": {"type": "string", "description": "The name of the prompt."},
+					"message": {"type": "string"},
+					"user": {"type": "string", "description": "Who submitted it."},
+					"submitted": {"type": "string", "format": "date-time"},
+					"expires": {"type": "string", "format": "date-time"}
+				}
+			},
+			"Error": {
+				"type": "object",
+				"required": ["error"],
+				"properties": {
+					"error": {"type": "string"},
+					"request_id": {"type": "string", "description": "The ID of the request, as in the X-Request-ID header, to find it in the logs."}
+				}
+			}
+		}
+	}
+}
+`
+
+// ServeAPIOpenAPI responds with openapiJSON.
+func ServeAPIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		APIError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(openapiJSON)))
+	if r.Method == http.MethodGet {
+		w.Write([]byte(openapiJSON))
+	}
+}
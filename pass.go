@@ -0,0 +1,71 @@
+package main
+
+// Secrets kept in a password store, as managed by pass
+// (https://www.passwordstore.org), decrypted with gpg.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// passStoreDir returns -pass-store-dir, or where pass keeps the store by
+// default.
+func passStoreDir() string {
+	if *passDir > "" {
+		return *passDir
+	}
+	if dir := os.Getenv("PASSWORD_STORE_DIR"); dir > "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".password-store")
+}
+
+// passSecret decrypts an entry in the password store, given by its name,
+// such as disks/data. As with pass, the password is the first line, or with
+// ?field=NAME, the rest of the first line that starts with NAME:.
+func passSecret(ctx context.Context, ref string, _ Prompt) ([]byte, error) {
+	name, query, _ := strings.Cut(ref, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("pass: %w", err)
+	}
+	dir := passStoreDir()
+	path := filepath.Join(dir, filepath.Clean("/"+name)+".gpg")
+	cmd := exec.CommandContext(ctx, "gpg", "--quiet", "--batch", "--yes", "--decrypt", path)
+	if *passGnupgHome > "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+*passGnupgHome)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("pass: %s: %w: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	field := q.Get("field")
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for first := true; s.Scan(); first = false {
+		line := s.Bytes()
+		if field == "" {
+			return bytes.TrimRight(line, "\r"), nil
+		}
+		if first {
+			continue
+		}
+		if k, v, ok := bytes.Cut(line, []byte(":")); ok && string(bytes.TrimSpace(k)) == field {
+			return bytes.TrimSpace(v), nil
+		}
+	}
+	if field == "" {
+		return nil, fmt.Errorf("pass: %s is empty", name)
+	}
+	return nil, fmt.Errorf("pass: %s has no field %q", name, field)
+}
@@ -0,0 +1,83 @@
+//go:build cgo
+
+package main
+
+// Keys in PKCS#11 tokens, such as smartcards and HSMs.
+
+import (
+	"crypto"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// OpenPKCS11 finds a key pair given a PKCS#11 URI (RFC 7512). The token,
+// object and id attributes, and the module-path, pin-value and pin-source
+// query attributes are supported; -pkcs11-module and -pkcs11-pin-file are
+// used for the latter if unspecified.
+func OpenPKCS11(uri string) (crypto.Signer, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, "pkcs11:"), "?")
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(path, ";") {
+		k, v, _ := strings.Cut(attr, "=")
+		v, err := url.PathUnescape(v)
+		if err != nil {
+			return nil, err
+		}
+		attrs[k] = v
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &crypto11.Config{
+		Path:       q.Get("module-path"),
+		TokenLabel: attrs["token"],
+		Pin:        q.Get("pin-value"),
+	}
+	if cfg.Path == "" {
+		cfg.Path = *pkcs11Module
+	}
+	if cfg.Path == "" {
+		return nil, errors.New("-pkcs11-module is required")
+	}
+	if cfg.TokenLabel == "" {
+		return nil, errors.New("token is required")
+	}
+	pinSource := q.Get("pin-source")
+	if pinSource == "" {
+		pinSource = *pkcs11PinFile
+	}
+	if cfg.Pin == "" && pinSource > "" {
+		b, err := os.ReadFile(strings.TrimPrefix(pinSource, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Pin = strings.TrimSpace(string(b))
+	}
+
+	ctx, err := crypto11.Configure(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var id, label []byte
+	if v, ok := attrs["id"]; ok {
+		id = []byte(v)
+	}
+	if v, ok := attrs["object"]; ok {
+		label = []byte(v)
+	}
+	s, err := ctx.FindKeyPair(id, label)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		ctx.Close()
+		return nil, errors.New("key pair not found")
+	}
+	return s, nil
+}
@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package main
+
+import (
+	"crypto"
+	"errors"
+)
+
+// OpenPKCS11 is unavailable, as PKCS#11 modules can only be loaded with cgo.
+func OpenPKCS11(uri string) (crypto.Signer, error) {
+	return nil, errors.New("PKCS#11 keys are not supported by this build, which lacks cgo")
+}
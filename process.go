@@ -0,0 +1,83 @@
+package main
+
+// The process that asked, from the PID= of its ask file, so that whoever
+// answers can see that it's really what they expect asking.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Process describes the process that asked, as it was when the prompt was
+// last read.
+type Process struct {
+	PID     int    `json:"pid"`
+	Comm    string `json:"comm,omitempty"`    // empty if it has exited
+	Cmdline string `json:"cmdline,omitempty"` // arguments, separated by spaces
+	Unit    string `json:"unit,omitempty"`    // systemd unit, if any
+}
+
+// unitSuffixes are those of the units processes can be in.
+var unitSuffixes = []string{".service", ".scope", ".socket", ".mount", ".swap"}
+
+// ReadProcess describes the process with the PID, from /proc.
+func ReadProcess(pid int) Process {
+	p := Process{PID: pid}
+	dir := "/proc/" + strconv.Itoa(pid)
+	if b, err := os.ReadFile(dir + "/comm"); err == nil {
+		p.Comm = strings.TrimSpace(string(b))
+	}
+	if b, err := os.ReadFile(dir + "/cmdline"); err == nil {
+		p.Cmdline = string(bytes.ReplaceAll(bytes.TrimRight(b, "\x00"), []byte{0}, []byte{' '}))
+	}
+	// The unified hierarchy's line, e.g.
+	// 0::/system.slice/systemd-cryptsetup@root.service:
+	if b, err := os.ReadFile(dir + "/cgroup"); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			cgroup, ok := strings.CutPrefix(line, "0::")
+			if !ok {
+				continue
+			}
+			for ; cgroup != "/" && cgroup != "."; cgroup = path.Dir(cgroup) {
+				if unit := path.Base(cgroup); hasUnitSuffix(unit) {
+					p.Unit = unit
+					break
+				}
+			}
+		}
+	}
+	return p
+}
+
+func hasUnitSuffix(s string) bool {
+	for _, suffix := range unitSuffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the process in English.
+func (p Process) String() string {
+	return p.Describe("en")
+}
+
+// Describe describes the process in the language, as the web page does.
+func (p Process) Describe(lang string) string {
+	s := fmt.Sprintf("%s (PID %d)", p.Comm, p.PID)
+	if p.Comm == "" {
+		s = Tf(lang, "PID %d, which has exited", p.PID)
+	}
+	if p.Unit > "" {
+		s = Tf(lang, "%s in %s", s, p.Unit)
+	}
+	if p.Cmdline > "" {
+		s += ": " + p.Cmdline
+	}
+	return s
+}
@@ -0,0 +1,194 @@
+package main
+
+// Running behind a reverse proxy: trusting its X-Forwarded-* headers, and
+// being mounted somewhere other than the root of the site.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+type (
+	basePathKey       struct{}
+	forwardedHTTPSKey struct{}
+)
+
+// TrustedProxies are the reverse proxies whose X-Forwarded-* headers are
+// believed.
+type TrustedProxies struct {
+	Prefixes []netip.Prefix
+	Unix     bool // any peer on a unix domain socket
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses, CIDR
+// prefixes, and "unix" for peers on unix domain sockets.
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var t TrustedProxies
+	for _, item := range splitList(s) {
+		if item == "unix" {
+			t.Unix = true
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return t, fmt.Errorf("-trusted-proxies: %w", err)
+			}
+			t.Prefixes = append(t.Prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return t, fmt.Errorf("-trusted-proxies: %w", err)
+		}
+		t.Prefixes = append(t.Prefixes, prefix.Masked())
+	}
+	return t, nil
+}
+
+// Contains reports whether addr is one of the proxies.
+func (t TrustedProxies) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range t.Prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsConn reports whether the peer at addr, a connection's remote
+// address, is one of the proxies.
+func (t TrustedProxies) containsConn(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return t.Contains(addr.AddrPort().Addr())
+	case *net.UnixAddr:
+		return t.Unix
+	case tunnelAddr:
+		// We dialled the relay ourselves.
+		return true
+	}
+	return false
+}
+
+// ProxyProtocolPolicy believes PROXY protocol headers, which carry the
+// client's address to the server, only from the current site's trusted
+// proxies. Connections from anyone else that send one are dropped, as are
+// those from a tunnel's relay that don't.
+func ProxyProtocolPolicy(upstream net.Addr) (proxyproto.Policy, error) {
+	if _, ok := upstream.(tunnelAddr); ok {
+		return proxyproto.REQUIRE, nil
+	}
+	if site.Load().TrustedProxies.containsConn(upstream) {
+		return proxyproto.USE, nil
+	}
+	return proxyproto.REJECT, nil
+}
+
+// trusts reports whether the request came directly from one of the proxies.
+func (t TrustedProxies) trusts(r *http.Request) bool {
+	if PeerCred(r) != nil {
+		return t.Unix
+	}
+	addr, err := netip.ParseAddr(ClientIP(r))
+	return err == nil && t.Contains(addr)
+}
+
+// ForwardedHeaders believes X-Forwarded-For and X-Forwarded-Proto in requests
+// from the current site's trusted proxies. The client's address replaces
+// r.RemoteAddr, so that it is logged, rate limited and locked out rather
+// than the proxy's.
+func ForwardedHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxies := site.Load().TrustedProxies
+		if !proxies.trusts(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if proto := lastHeaderValue(r, "X-Forwarded-Proto"); proto == "https" {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedHTTPSKey{}, true))
+		}
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			// Each proxy appends the address it received the request from,
+			// so walk back from the right until reaching one that isn't a
+			// trusted proxy. Anything further left could be forged.
+			addrs := strings.Split(strings.Join(xff, ","), ",")
+			r = r.Clone(r.Context())
+			for i := len(addrs) - 1; i >= 0; i-- {
+				addr, err := netip.ParseAddr(strings.TrimSpace(addrs[i]))
+				if err != nil {
+					break
+				}
+				r.RemoteAddr = addr.Unmap().String()
+				if !proxies.Contains(addr) {
+					break
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lastHeaderValue returns the last of the comma-separated values of a header,
+// which is the one added by the nearest proxy.
+func lastHeaderValue(r *http.Request, name string) string {
+	values := r.Header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	items := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(items[len(items)-1])
+}
+
+// IsHTTPS reports whether the client connected over HTTPS, either directly or
+// to a trusted proxy.
+func IsHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Context().Value(forwardedHTTPSKey{}) != nil
+}
+
+// CleanBasePath returns p with a leading and trailing slash.
+func CleanBasePath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("-base-path must start with /: %q", p)
+	}
+	return strings.TrimSuffix(p, "/") + "/", nil
+}
+
+// StripBasePath serves next at the current site's base path, removing it
+// from the request path. Requests outside the base path are not found.
+func StripBasePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := strings.TrimSuffix(site.Load().BasePath, "/")
+		if base == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == base {
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+			return
+		}
+		p, ok := strings.CutPrefix(r.URL.Path, base+"/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		r = r.Clone(context.WithValue(r.Context(), basePathKey{}, base))
+		r.URL.Path = "/" + p
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	})
+}
+
+// URLPath returns the path the client sees for p, a path relative to the
+// base path.
+func URLPath(r *http.Request, p string) string {
+	base, _ := r.Context().Value(basePathKey{}).(string)
+	return base + p
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	p, err := ParseTrustedProxies("10.0.0.1, 192.168.0.0/16,unix, 2001:db8::/32, fd00::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Unix {
+		t.Error("unix isn't trusted")
+	}
+	for addr, want := range map[string]bool{
+		"10.0.0.1":           true,
+		"::ffff:10.0.0.1":    true,
+		"10.0.0.2":           false,
+		"192.168.44.1":       true,
+		"192.169.0.1":        false,
+		"2001:db8::1":        true,
+		"2001:db9::1":        false,
+		"fd00::1":            true,
+		"fd00::2":            false,
+		"::ffff:192.168.0.1": true,
+	} {
+		if got := p.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	for _, s := range []string{"10.0.0", "10.0.0.0/33", "example.com", "10.0.0.1/8/8"} {
+		if _, err := ParseTrustedProxies(s); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) succeeded", s)
+		}
+	}
+	if p, err := ParseTrustedProxies(""); err != nil || p.Unix || len(p.Prefixes) > 0 {
+		t.Errorf("ParseTrustedProxies(\"\") = %+v, %v", p, err)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestSite(t, &Site{TrustedProxies: proxies})
+
+	for _, tt := range []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		proto      string
+		wantIP     string
+		wantHTTPS  bool
+	}{
+		{"direct", "192.0.2.1:1234", nil, "", "192.0.2.1", false},
+		{"untrusted peer", "192.0.2.1:1234", []string{"198.51.100.1"}, "https", "192.0.2.1", false},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "https", "198.51.100.1", true},
+		{"trusted proxy, http", "10.0.0.1:1234", []string{"198.51.100.1"}, "http", "198.51.100.1", false},
+		{"trusted proxy, no header", "10.0.0.1:1234", nil, "", "10.0.0.1", false},
+		{"forged by the client", "10.0.0.1:1234", []string{"127.0.0.1, 198.51.100.1"}, "", "198.51.100.1", false},
+		{"chain of proxies", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2", "10.0.0.3"}, "", "198.51.100.1", false},
+		{"client behind an untrusted proxy", "10.0.0.1:1234", []string{"198.51.100.1, 192.0.2.2"}, "", "192.0.2.2", false},
+		{"garbage", "10.0.0.1:1234", []string{"198.51.100.1, nonsense"}, "", "10.0.0.1", false},
+		{"garbage before", "10.0.0.1:1234", []string{"nonsense, 198.51.100.1"}, "", "198.51.100.1", false},
+		{"IPv6", "10.0.0.1:1234", []string{"2001:db8::1"}, "", "2001:db8::1", false},
+		{"mapped IPv4", "10.0.0.1:1234", []string{"::ffff:198.51.100.1"}, "", "198.51.100.1", false},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.2, 10.0.0.3"}, "", "10.0.0.2", false},
+		{"last proto counts", "10.0.0.1:1234", []string{"198.51.100.1"}, "http, https", "198.51.100.1", true},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if tt.proto > "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		var gotIP string
+		var gotHTTPS bool
+		ForwardedHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotIP, gotHTTPS = ClientIP(r), IsHTTPS(r)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if gotIP != tt.wantIP || gotHTTPS != tt.wantHTTPS {
+			t.Errorf("%s: client %s, HTTPS %v; want %s, %v", tt.name, gotIP, gotHTTPS, tt.wantIP, tt.wantHTTPS)
+		}
+	}
+}
+
+func TestStripBasePath(t *testing.T) {
+	useTestSite(t, &Site{BasePath: "/askpass/"})
+	handler := StripBasePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + URLPath(r, "/login")))
+	}))
+	for _, tt := range []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"/askpass/", http.StatusOK, "/ /askpass/login"},
+		{"/askpass/qr", http.StatusOK, "/qr /askpass/login"},
+		{"/askpass", http.StatusMovedPermanently, ""},
+		{"/askpassword/", http.StatusNotFound, ""},
+		{"/", http.StatusNotFound, ""},
+		{"/login", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d", tt.path, w.Code, tt.wantCode)
+		}
+		if tt.wantBody > "" && w.Body.String() != tt.wantBody {
+			t.Errorf("%s: body %q, want %q", tt.path, w.Body, tt.wantBody)
+		}
+	}
+
+	for p, want := range map[string]string{"/": "/", "/askpass": "/askpass/", "/askpass/": "/askpass/"} {
+		if got, err := CleanBasePath(p); err != nil || got != want {
+			t.Errorf("CleanBasePath(%q) = %q, %v; want %q", p, got, err, want)
+		}
+	}
+	if _, err := CleanBasePath("askpass"); err == nil {
+		t.Error("CleanBasePath accepted a relative path")
+	}
+}
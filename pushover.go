@@ -0,0 +1,72 @@
+package main
+
+// Notifications through Pushover (https://pushover.net).
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pushoverAPI = "https://api.pushover.net/1/messages.json"
+
+// Pushover sends notifications to a Pushover user or group.
+type Pushover struct {
+	Token    string // of the application
+	User     string // user or group key
+	Priority int    // -2 to 1; emergency priority (2) isn't supported
+	Remind   time.Duration
+}
+
+// NewPushover returns a Pushover with the application token read from
+// tokenFile.
+func NewPushover(tokenFile, user string, priority int, remind time.Duration) (*Pushover, error) {
+	if priority < -2 || priority > 1 {
+		return nil, fmt.Errorf("pushover: priority must be from -2 to 1, not %d", priority)
+	}
+	if tokenFile == "" || user == "" {
+		return nil, fmt.Errorf("pushover: both an application token and a user key are required")
+	}
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Pushover{
+		Token:    strings.TrimSpace(string(b)),
+		User:     user,
+		Priority: priority,
+		Remind:   remind,
+	}, nil
+}
+
+func (p *Pushover) RemindAfter() time.Duration { return p.Remind }
+
+func (p *Pushover) Notify(ctx context.Context, n Notification) error {
+	form := url.Values{
+		"token":    {p.Token},
+		"user":     {p.User},
+		"title":    {n.Title},
+		"message":  {n.Message},
+		"priority": {strconv.Itoa(p.Priority)},
+	}
+	if n.URL > "" {
+		form.Set("url", n.URL)
+		form.Set("url_title", "Answer")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushoverAPI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return ResponseError(resp)
+}
@@ -0,0 +1,399 @@
+package main
+
+// Installing the page on a phone's home screen as a progressive web app,
+// and making it usable on a small screen, where most unlocking happens.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// htmlHead begins every page, in the language it's shown in.
+const htmlHead = `<!doctype html>
+<html lang="{{ lang }}">
+<meta charset="utf-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1" />
+<meta name="theme-color" content="#1d4ed8" media="(prefers-color-scheme: light)" />
+<meta name="theme-color" content="#111827" media="(prefers-color-scheme: dark)" />
+<link rel="manifest" href="manifest.webmanifest" crossorigin="use-credentials" />
+<link rel="icon" href="icon.svg" type="image/svg+xml" />
+<link rel="apple-touch-icon" href="icon-192.png" />
+<link rel="stylesheet" href="style.css" />
+<script>
+if ("serviceWorker" in navigator) navigator.serviceWorker.register("sw.js");
+// Before anything is drawn, so that the page doesn't flash in another theme:
+try {
+	if (localStorage.getItem("theme")) document.documentElement.dataset.theme = localStorage.getItem("theme");
+} catch (e) {}
+</script>
+`
+
+// The colours follow the system's light or dark mode, unless the high
+// contrast theme is chosen, which is remembered by the browser.
+
+const styleCSS = `:root {
+	color-scheme: light dark;
+	--accent: #1d4ed8;
+	--accent-text: #fff;
+	--background: #fff;
+	--border: #8884;
+	--danger: #dc2626;
+	--text: #111827;
+}
+@media (prefers-color-scheme: dark) {
+	:root {
+		--accent: #2563eb;
+		--background: #111827;
+		--danger: #f87171;
+		--text: #e5e7eb;
+	}
+}
+:root[data-theme=contrast] {
+	color-scheme: dark;
+	--accent: #ff0;
+	--accent-text: #000;
+	--background: #000;
+	--border: #fff;
+	--danger: #f66;
+	--text: #fff;
+}
+:root[data-theme=contrast] input, :root[data-theme=contrast] select {
+	background: #000;
+	border: 2px solid #fff;
+	color: #fff;
+}
+:root[data-theme=contrast] :focus-visible {
+	outline: 3px solid var(--accent);
+	outline-offset: 2px;
+}
+:root[data-theme=contrast] a {
+	color: var(--accent);
+}
+:root[data-theme=contrast] label small:not([hidden]),
+:root[data-theme=contrast] .details small:not([hidden]) {
+	opacity: 1;
+}
+.visually-hidden, .skip:not(:focus) {
+	clip-path: inset(50%);
+	height: 1px;
+	overflow: hidden;
+	position: absolute;
+	white-space: nowrap;
+	width: 1px;
+}
+body {
+	background: var(--background);
+	color: var(--text);
+	font: 1rem/1.5 system-ui, sans-serif;
+	margin: 0 auto;
+	max-width: 40rem;
+	padding: 0 1rem 2rem;
+}
+h1 {
+	font-size: 1.5rem;
+}
+h1 img.logo {
+	height: 2rem;
+	vertical-align: middle;
+	width: auto;
+}
+.notice {
+	border-left: 0.25rem solid var(--accent);
+	padding-left: 0.75rem;
+	white-space: pre-line;
+}
+#theme {
+	float: right;
+	margin: 0;
+}
+#theme label {
+	margin: 0;
+}
+label {
+	display: block;
+	margin: 0.5rem 0;
+}
+input[type=text], input[type=password], input[type=search] {
+	box-sizing: border-box;
+	display: block;
+	font-size: 1rem; /* any smaller, and iOS zooms in */
+	margin-top: 0.25rem;
+	padding: 0.5rem;
+	width: 100%;
+}
+input[type=submit] {
+	background: var(--accent);
+	border: 0;
+	border-radius: 0.25rem;
+	color: var(--accent-text);
+	font-size: 1rem;
+	min-height: 2.75rem;
+	padding: 0 1rem;
+}
+form[action=cancel] input[type=submit], form[action=cancel-all] input[type=submit],
+form[action=logout] input[type=submit] {
+	background: transparent;
+	border: 1px solid var(--border);
+	color: inherit;
+}
+#prompts {
+	list-style: none;
+	padding: 0;
+}
+#prompts li {
+	border: 1px solid var(--border);
+	border-radius: 0.5rem;
+	margin: 1rem 0;
+	padding: 0.5rem 1rem 1rem;
+}
+#prompts li.expired {
+	opacity: 0.5;
+}
+#prompts li#no-prompts {
+	border-style: dashed;
+	padding: 1rem;
+}
+#prompts form {
+	display: inline;
+}
+#prompts form[action=pass] {
+	display: block;
+	margin-bottom: 0.5rem;
+}
+#bulk fieldset {
+	border: 1px solid var(--border);
+	border-radius: 0.5rem;
+}
+.message {
+	font-weight: bold;
+	overflow-wrap: anywhere;
+}
+.retry:not([hidden]) {
+	color: var(--danger);
+	display: block;
+}
+label small:not([hidden]), .details small:not([hidden]) {
+	display: block;
+	opacity: 0.7;
+	overflow-wrap: anywhere;
+}
+img {
+	height: auto;
+	max-width: 100%;
+}
+img.icon {
+	float: right;
+	height: 2rem;
+	margin-left: 0.5rem;
+	width: 2rem;
+}
+`
+
+var offlineHTML = strings.Replace(htmlHead, "{{ lang }}", "en", 1) + `<title>Askpass</title>
+<h1>Askpass</h1>
+
+<p>The server can't be reached. The machine may be rebooting, or its network
+may not be up yet. This page will keep trying.</p>
+
+<script>
+setTimeout(function() { location.reload(); }, 5000);
+</script>
+`
+
+const manifestJSON = `{
+	"name": "Askpass",
+	"short_name": "Askpass",
+	"description": "Answer password prompts during boot",
+	"start_url": ".",
+	"scope": ".",
+	"display": "standalone",
+	"theme_color": "#1d4ed8",
+	"background_color": "#1d4ed8",
+	"icons": [
+		{"src": "icon.svg", "sizes": "any", "type": "image/svg+xml", "purpose": "any maskable"},
+		{"src": "icon-192.png", "sizes": "192x192", "type": "image/png", "purpose": "any maskable"},
+		{"src": "icon-512.png", "sizes": "512x512", "type": "image/png", "purpose": "any maskable"}
+	]
+}
+`
+
+// iconSVG is a padlock, drawn within the safe zone of a maskable icon.
+const iconSVG = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+<rect width="100" height="100" fill="#1d4ed8"/>
+<path d="M35 45v-7a15 15 0 0 1 30 0v7h-6v-7a9 9 0 0 0-18 0v7z" fill="#fff"/>
+<rect x="30" y="45" width="40" height="30" rx="3" fill="#fff"/>
+<circle cx="50" cy="57" r="4" fill="#1d4ed8"/>
+<rect x="48.5" y="57" width="3" height="10" fill="#1d4ed8"/>
+</svg>
+`
+
+// The service worker only caches the assets, and the offline page to show
+// when navigating while the server is unreachable. Pages and the API always
+// go to the network, so prompts are never stale. The cache is named after a
+// digest of the assets, so that upgrades replace it.
+const swJSFormat = `var CACHE = "askpass-%s";
+var ASSETS = ["style.css", "icon.svg", "icon-192.png", "icon-512.png", "manifest.webmanifest", "offline.html"];
+
+self.addEventListener("install", function(e) {
+	e.waitUntil(caches.open(CACHE).then(function(c) { return c.addAll(ASSETS); }));
+	self.skipWaiting();
+});
+
+self.addEventListener("activate", function(e) {
+	e.waitUntil(caches.keys().then(function(keys) {
+		return Promise.all(keys.filter(function(k) { return k !== CACHE; }).map(function(k) { return caches.delete(k); }));
+	}).then(function() { return self.clients.claim(); }));
+});
+
+self.addEventListener("fetch", function(e) {
+	var req = e.request;
+	if (req.method !== "GET") return;
+	if (req.mode === "navigate") {
+		e.respondWith(fetch(req).catch(function() { return caches.match("offline.html"); }));
+		return;
+	}
+	var url = new URL(req.url);
+	var asset = ASSETS.some(function(a) { return new URL(a, self.registration.scope).href === url.href; });
+	if (asset) {
+		e.respondWith(caches.match(req).then(function(res) { return res || fetch(req); }));
+	}
+});
+
+self.addEventListener("push", function(e) {
+	var data = e.data ? e.data.json() : {};
+	e.waitUntil(self.registration.showNotification(data.title || "Askpass", {
+		body: data.body,
+		icon: "icon-192.png",
+		tag: data.tag,
+		data: {url: data.url || self.registration.scope},
+	}));
+});
+
+self.addEventListener("notificationclick", function(e) {
+	e.notification.close();
+	e.waitUntil(self.clients.openWindow(e.notification.data.url));
+});
+`
+
+type asset struct {
+	contentType string
+	body        []byte
+}
+
+// assets are served without authentication, as they contain nothing
+// secret, and the login page needs them. -templates-dir can add to or
+// replace them.
+var assets = NewAssets(nil)
+
+// NewAssets returns the built-in assets, with overrides added to or
+// replacing them, and a service worker to cache them all.
+func NewAssets(overrides map[string]asset) map[string]asset {
+	m := map[string]asset{
+		"/style.css":            {"text/css; charset=utf-8", []byte(styleCSS)},
+		"/offline.html":         {"text/html; charset=utf-8", []byte(offlineHTML)},
+		"/manifest.webmanifest": {"application/manifest+json", []byte(manifestJSON)},
+		"/icon.svg":             {"image/svg+xml", []byte(iconSVG)},
+		"/icon-192.png":         {"image/png", iconPNG(192)},
+		"/icon-512.png":         {"image/png", iconPNG(512)},
+	}
+	maps.Copy(m, overrides)
+	var paths []string
+	for path := range m {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	h := sha256.New()
+	for _, path := range paths {
+		h.Write(m[path].body)
+	}
+	m["/sw.js"] = asset{"text/javascript; charset=utf-8", []byte(fmt.Sprintf(swJSFormat, hex.EncodeToString(h.Sum(nil))[:16]))}
+	return m
+}
+
+// Assets serves the static assets of the web app, and passes every other
+// request to next.
+func Assets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := site.Load()
+		a, ok := s.Templates.Assets[r.URL.Path]
+		if r.URL.Path == logoPath && s.Branding.logo != nil {
+			a, ok = *s.Branding.logo, true
+		}
+		if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", a.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(a.body)))
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.URL.Path == "/sw.js" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		if r.Method == http.MethodGet {
+			w.Write(a.body)
+		}
+	})
+}
+
+// iconPNG draws iconSVG as a size×size PNG.
+func iconPNG(size int) []byte {
+	blue := color.RGBA{0x1d, 0x4e, 0xd8, 0xff}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	const samples = 4 // per axis, for anti-aliasing
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			n := 0
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					x := (float64(px) + (float64(sx)+0.5)/samples) * 100 / float64(size)
+					y := (float64(py) + (float64(sy)+0.5)/samples) * 100 / float64(size)
+					if padlock(x, y) {
+						n++
+					}
+				}
+			}
+			f := float64(n) / samples / samples
+			img.SetRGBA(px, py, color.RGBA{
+				R: uint8(float64(blue.R) + f*float64(0xff-blue.R)),
+				G: uint8(float64(blue.G) + f*float64(0xff-blue.G)),
+				B: uint8(float64(blue.B) + f*float64(0xff-blue.B)),
+				A: 0xff,
+			})
+		}
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// padlock reports whether the point, in the 100×100 coordinates of iconSVG,
+// is on the white part of the padlock.
+func padlock(x, y float64) bool {
+	// Keyhole:
+	if math.Hypot(x-50, y-57) < 4 || (x >= 48.5 && x < 51.5 && y >= 57 && y < 67) {
+		return false
+	}
+	// Body:
+	if x >= 30 && x < 70 && y >= 45 && y < 75 {
+		return true
+	}
+	// Shackle:
+	if y < 38 {
+		d := math.Hypot(x-50, y-38)
+		return d >= 9 && d < 15
+	}
+	return y < 45 && ((x >= 35 && x < 41) || (x >= 59 && x < 65))
+}
@@ -0,0 +1,224 @@
+package main
+
+// QR codes of the server's URL, so that unlocking can be handed off to a
+// phone.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	qrPath      = "/qr"
+	handoffPath = "/handoff"
+	handoffTTL  = 5 * time.Minute
+)
+
+var handoffs = &HandoffStore{}
+
+// qrHTML is the built-in template of the page for continuing on another
+// device, which -templates-dir can replace.
+const qrHTML = htmlHead + `<title>{{ title }}</title>
+{{ template "header" }}
+
+<main>
+<p>{{ T "Scan this code to continue on another device:" }}</p>
+<p><img src="{{ .Image }}" alt="{{ T "QR code" }}" width="320" height="320" /></p>
+<p><a href="{{ .URL }}">{{ .URL }}</a></p>
+{{ if .Handoff }}
+<p>{{ Tf "The code logs in as %s. It can only be used once, and expires in %s. Don't share it with anyone you wouldn't give your password to." .User .TTL }}</p>
+{{ end }}
+<p><a href=".">{{ T "Back" }}</a></p>
+</main>
+`
+
+// PrimaryURLs returns the URLs of the PrimaryListener, one for each address
+// it can be reached at, with IPv4 addresses first.
+func PrimaryURLs(lsns []Listener) []string {
+	l, ok := PrimaryListener(lsns)
+	if !ok {
+		return nil
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	scheme := "http"
+	if l.TLS {
+		scheme = "https"
+	}
+	path := site.Load().BasePath
+	if path == "" {
+		path = "/"
+	}
+	var v4, v6 []string
+	for _, ip := range ListenerIPs(addr) {
+		if ip.IsLinkLocalUnicast() {
+			continue // would need a zone, which browsers don't accept
+		}
+		url := scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)) + path
+		if ip.To4() != nil {
+			v4 = append(v4, url)
+		} else {
+			v6 = append(v6, url)
+		}
+	}
+	return append(v4, v6...)
+}
+
+// ConsoleQR returns a QR code of text drawn with block characters, for a
+// terminal with light text on a dark background.
+func ConsoleQR(text string) (string, error) {
+	q, err := qrcode.New(text, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	return q.ToSmallString(false), nil
+}
+
+// ShowOnConsole writes the PrimaryURLs, and a QR code of the first, to the
+// terminal at path, for someone standing at the machine. If the machine has
+// no addresses yet, it waits until it does.
+func ShowOnConsole(path string, lsns []Listener) error {
+	var urls []string
+	for {
+		if urls = PrimaryURLs(lsns); len(urls) > 0 {
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
+	qr, err := ConsoleQR(urls[0])
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\nTo enter passphrases, scan the code or visit:\n\n%s\n", qr)
+	for _, url := range urls {
+		fmt.Fprintf(&b, "    %s\n", url)
+	}
+	if s := site.Load(); s.Cert != nil {
+		fmt.Fprintf(&b, "\nCertificate SHA-256: %s\n", Fingerprint(s.Cert.Certificate[0]))
+	}
+	b.WriteString("\n")
+
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(b.Bytes()); err != nil {
+		return err
+	}
+	slog.Info("Showed URL on console", "path", path, "url", urls[0])
+	return nil
+}
+
+// ServeQR shows a QR code of the server's URL, as seen by the browser. With
+// -qr-handoff, the URL includes a handoff token, which logs the device that
+// scans it in as the same user.
+func ServeQR(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if IsHTTPS(r) {
+		scheme = "https"
+	}
+	data := struct {
+		URL, User, TTL string
+		Image          template.URL
+		Handoff        bool
+	}{
+		URL:     scheme + "://" + r.Host + URLPath(r, "/"),
+		User:    User(r),
+		TTL:     handoffTTL.String(),
+		Handoff: site.Load().Settings.QRHandoff && User(r) != "",
+	}
+	if data.Handoff {
+		token := handoffs.Create(User(r), !MayAnswer(r))
+		data.URL = scheme + "://" + r.Host + URLPath(r, handoffPath) + "?token=" + token
+		Audit(r, "handoff-created", "", nil)
+	}
+	q, err := qrcode.New(data.URL, qrcode.Medium)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	png, err := q.PNG(320)
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Image = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	w.Header().Set("Cache-Control", "no-store")
+	if err := site.Load().Templates.QR.Execute(w, r, data); err != nil {
+		Logger(r).Error("Rendering QR code", "err", err)
+	}
+}
+
+type handoff struct {
+	User     string
+	ReadOnly bool
+	Expires  time.Time
+}
+
+// HandoffStore keeps handoff tokens in memory until they are claimed, or
+// handoffTTL passes.
+type HandoffStore struct {
+	mu     sync.Mutex
+	tokens map[string]handoff
+}
+
+// Create returns a new token for the user.
+func (h *HandoffStore) Create(user string, readOnly bool) string {
+	token := randomString()
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens == nil {
+		h.tokens = make(map[string]handoff)
+	}
+	for t, ho := range h.tokens {
+		if now.After(ho.Expires) {
+			delete(h.tokens, t)
+		}
+	}
+	h.tokens[token] = handoff{User: user, ReadOnly: readOnly, Expires: now.Add(handoffTTL)}
+	return token
+}
+
+// Claim returns the handoff for the token, which can't be claimed again.
+func (h *HandoffStore) Claim(token string) (handoff, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ho, ok := h.tokens[token]
+	delete(h.tokens, token)
+	return ho, ok && time.Now().Before(ho.Expires)
+}
+
+// HandoffAuth starts a session for anyone with a valid handoff token from
+// ServeQR, and passes every other request to next.
+func HandoffAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != handoffPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ho, ok := handoffs.Claim(r.FormValue("token"))
+		if !ok {
+			AuthFailed(r, "handoff", "")
+			Error(w, r, "This link is invalid, or has already been used", http.StatusForbidden)
+			return
+		}
+		sessions.Create(w, r, ho.User, ho.ReadOnly)
+		Audit(WithUser(r, ho.User), "handoff", "", nil)
+		http.Redirect(w, r, URLPath(r, "/"), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+// HTTP/3 over QUIC, which copes better than TCP with lossy mobile networks.
+// Experimental.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// QUICServer serves HTTP/3 for the same site as one of the TLS listeners.
+type QUICServer struct {
+	*http3.Server
+	conn net.PacketConn
+}
+
+// ListenQUIC listens for HTTP/3 on a UDP address, with the same handler and
+// TLS config as the first TLS listener.
+func ListenQUIC(addr string, lsns []Listener) (*QUICServer, error) {
+	i := slices.IndexFunc(lsns, func(l Listener) bool { return l.TLS })
+	if i < 0 {
+		return nil, errors.New("-listen-quic requires a TLS listener")
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &QUICServer{
+		Server: &http3.Server{
+			TLSConfig: SiteTLSConfig(lsns[i].Auth == AuthAll),
+			ConnContext: func(ctx context.Context, _ quic.Connection) context.Context {
+				return context.WithValue(ctx, listenerKey{}, i)
+			},
+		},
+		conn: conn,
+	}, nil
+}
+
+// Addr returns the UDP address the server is listening on.
+func (s *QUICServer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Serve serves HTTP/3 requests with handler until the server is closed.
+func (s *QUICServer) Serve(handler http.Handler) error {
+	s.Handler = handler
+	return s.Server.Serve(s.conn)
+}
+
+// Advertise adds an Alt-Svc header to responses, so that browsers switch to
+// HTTP/3 for later requests.
+func (s *QUICServer) Advertise(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.SetQuicHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
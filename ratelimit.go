@@ -0,0 +1,172 @@
+package main
+
+// Rate limiting and lockout, to slow down passphrase and password guessing.
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var ErrLockedOut = errors.New("too many attempts")
+
+var lockout = &Lockout{}
+
+// ClientIP returns the IP address of the client that sent the request.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimiter is a token bucket rate limiter per client IP address.
+type RateLimiter struct {
+	Rate  rate.Limit
+	Burst int
+
+	mu      sync.Mutex
+	clients map[string]*rateClient
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Allow reports whether the client may make a request now.
+func (l *RateLimiter) Allow(ip string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		l.clients = make(map[string]*rateClient)
+	}
+	c, ok := l.clients[ip]
+	if !ok {
+		// Forget clients whose buckets have long since refilled:
+		for ip, c := range l.clients {
+			if now.Sub(c.lastSeen) > time.Hour {
+				delete(l.clients, ip)
+			}
+		}
+		c = &rateClient{limiter: rate.NewLimiter(l.Rate, l.Burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c.limiter.AllowN(now, 1)
+}
+
+// Middleware rejects requests from clients that exceed the rate limit, or
+// that are locked out after too many failed authentication attempts.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r)
+		if wait := lockout.Remaining(authKey(ip)); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			Error(w, r, fmt.Sprintf("%v: locked out for %s", ErrLockedOut, wait.Round(time.Second)), http.StatusTooManyRequests)
+			return
+		}
+		if l.Rate > 0 && !l.Allow(ip) {
+			w.Header().Set("Retry-After", "1")
+			Error(w, r, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Lockout counts attempts per key, and locks the key out for Duration once
+// there have been Max attempts within Duration. If Max is 0, it is disabled.
+type Lockout struct {
+	Max      int
+	Duration time.Duration
+
+	mu      sync.Mutex
+	strikes map[string]*strike
+}
+
+type strike struct {
+	count int
+	first time.Time // first attempt in the current window
+	until time.Time // locked out until
+}
+
+// Attempt records an attempt for key, returning ErrLockedOut if the key is
+// (now) locked out.
+func (l *Lockout) Attempt(key string) error {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Max <= 0 {
+		return nil
+	}
+	l.expire(now)
+	if l.strikes == nil {
+		l.strikes = make(map[string]*strike)
+	}
+	s, ok := l.strikes[key]
+	if !ok {
+		s = &strike{first: now}
+		l.strikes[key] = s
+	}
+	if now.Before(s.until) {
+		return ErrLockedOut
+	}
+	s.count++
+	if s.count >= l.Max {
+		s.until = now.Add(l.Duration)
+		slog.Warn("Locked out", "key", key, "duration", l.Duration, "attempts", s.count)
+	}
+	return nil
+}
+
+// SetLimits changes Max and Duration, such as when reloading.
+func (l *Lockout) SetLimits(max int, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Max, l.Duration = max, d
+}
+
+// Remaining returns how much longer key is locked out for, or 0 if it isn't.
+func (l *Lockout) Remaining(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.strikes[key]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(s.until), 0)
+}
+
+// expire must be called with l.mu held.
+func (l *Lockout) expire(now time.Time) {
+	for key, s := range l.strikes {
+		if now.After(s.until) && now.Sub(s.first) > l.Duration {
+			delete(l.strikes, key)
+		}
+	}
+}
+
+func authKey(ip string) string { return "auth " + ip }
+
+func answerKey(ip, prompt string) string { return "answer " + ip + " " + prompt }
+
+// AuthFailed records a failed authentication attempt by the client, using
+// the given method, for the given user (if known).
+func AuthFailed(r *http.Request, method, user string) {
+	err := lockout.Attempt(authKey(ClientIP(r)))
+	if err == nil {
+		err = ErrUnauthorized
+	}
+	Audit(WithUser(r, user), "auth-"+method, "", err)
+}
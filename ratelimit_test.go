@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestLockout replaces the global lockout for the duration of the test.
+func useTestLockout(t *testing.T, max int, d time.Duration) {
+	old := lockout
+	lockout = &Lockout{Max: max, Duration: d}
+	t.Cleanup(func() { lockout = old })
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &RateLimiter{Rate: 1, Burst: 3}
+	for i := 0; i < 3; i++ {
+		if !l.Allow("192.0.2.1") {
+			t.Fatalf("request %d denied within the burst", i+1)
+		}
+	}
+	if l.Allow("192.0.2.1") {
+		t.Error("request allowed beyond the burst")
+	}
+	if !l.Allow("192.0.2.2") {
+		t.Error("another client was limited")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if !l.Allow("192.0.2.1") {
+		t.Error("request denied after the bucket refilled")
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	useTestSite(t, &Site{})
+	useTestLockout(t, 2, time.Hour)
+	l := &RateLimiter{Rate: 1, Burst: 2}
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := get("192.0.2.1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+	if w := get("192.0.2.1"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("beyond the burst: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Failing to authenticate too often locks the client out entirely:
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "192.0.2.2:1234"
+	AuthFailed(r, "basic", "alice")
+	if w := get("192.0.2.2"); w.Code != http.StatusOK {
+		t.Errorf("after one failure: status %d", w.Code)
+	}
+	AuthFailed(r, "basic", "alice")
+	w := get("192.0.2.2")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("after two failures: status %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("Retry-After = %q, want 3600", got)
+	}
+	if w := get("192.0.2.3"); w.Code != http.StatusOK {
+		t.Errorf("another client: status %d", w.Code)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l := &Lockout{Max: 3, Duration: 200 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		if err := l.Attempt("a"); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+	}
+	if err := l.Attempt("a"); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("attempt 4 = %v, want ErrLockedOut", err)
+	}
+	if d := l.Remaining("a"); d <= 0 || d > l.Duration {
+		t.Errorf("Remaining = %v", d)
+	}
+	if err := l.Attempt("b"); err != nil || l.Remaining("b") != 0 {
+		t.Errorf("another key: %v, remaining %v", err, l.Remaining("b"))
+	}
+
+	// Both the lockout and the count of attempts expire:
+	time.Sleep(250 * time.Millisecond)
+	if d := l.Remaining("a"); d != 0 {
+		t.Errorf("Remaining after the lockout = %v", d)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.Attempt("a"); err != nil {
+			t.Errorf("attempt %d after the lockout: %v", i+1, err)
+		}
+	}
+	if d := l.Remaining("a"); d != 0 {
+		t.Errorf("locked out again after %d attempts: %v", 2, d)
+	}
+
+	disabled := &Lockout{Duration: time.Hour}
+	for i := 0; i < 100; i++ {
+		if err := disabled.Attempt("a"); err != nil {
+			t.Fatalf("disabled: attempt %d: %v", i+1, err)
+		}
+	}
+	if d := disabled.Remaining("a"); d != 0 {
+		t.Errorf("disabled: Remaining = %v", d)
+	}
+}
+
+func TestAnswerLockout(t *testing.T) {
+	useTestLockout(t, 2, time.Minute)
+	old := hub
+	hub = NewHub()
+	t.Cleanup(func() { hub = old })
+	socket := filepath.Join(t.TempDir(), "ask.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hub.Update(Askers{"ask.1": &Askpass{Message: "Passphrase", ID: "cryptsetup:/dev/sda2", Socket: socket}})
+
+	answer := func(ip string) error {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		return AnswerPrompt(r, "ask.1", "wrong")
+	}
+	for i := 0; i < 2; i++ {
+		if err := answer("192.0.2.1"); err != nil {
+			t.Fatalf("answer %d: %v", i+1, err)
+		}
+	}
+	if err := answer("192.0.2.1"); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("answer 3 = %v, want ErrLockedOut", err)
+	}
+	// Someone else can still answer:
+	if err := answer("192.0.2.2"); err != nil {
+		t.Errorf("another client: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+// A plain HTTP listener that redirects to HTTPS, for users who type the bare
+// hostname.
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// acmeChallengePath is where ACME HTTP-01 challenges are fetched from.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// RedirectHandler permanently redirects requests to the same host and path
+// over HTTPS on port. If webroot is not empty, ACME HTTP-01 challenges are
+// served from files in it, as written by certbot --webroot.
+func RedirectHandler(port, webroot string) http.Handler {
+	mux := http.NewServeMux()
+	if webroot > "" {
+		mux.Handle(acmeChallengePath, http.FileServer(http.Dir(webroot)))
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			Error(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "443" {
+			host += ":" + port
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	return mux
+}
+
+// RedirectPort returns the port of the first TLS listener, to redirect to.
+func RedirectPort(lsns []Listener) (string, error) {
+	for _, l := range lsns {
+		if !l.TLS || l.Addr().Network() != "tcp" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(l.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		return port, nil
+	}
+	return "", errors.New("-redirect-listen requires a TLS listener")
+}
@@ -0,0 +1,166 @@
+package main
+
+// Reloading the configuration on SIGHUP, without dropping the listener.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+)
+
+// Site is everything built from the settings and the files they refer to.
+type Site struct {
+	Settings Settings
+	Logger   *slog.Logger
+
+	Handlers  []http.Handler   // for each listener
+	Cert      *tls.Certificate // nil unless -cert or -tls-selfsigned is specified
+	ClientCAs *x509.CertPool   // nil unless client certificates are required
+	TOTP      *TOTP
+	TLS       TLSSettings
+
+	Rules      *Rules            // nil unless -rules is specified
+	AgeSecrets map[string]string // nil unless -age-secrets is specified
+	AnswerKey  *AnswerKey        // nil unless -answer-key is specified
+	Templates  *Templates
+	Branding   *Branding
+
+	BasePath       string
+	TrustedProxies TrustedProxies
+	CORS           *CORS      // nil unless -cors-origins is specified
+	AccessLog      *AccessLog // nil unless -access-log is specified
+}
+
+// Activate makes s the current site.
+func (s *Site) Activate() {
+	slog.SetDefault(s.Logger)
+	sessions.SetExpiry(s.Settings.SessionLifetime, s.Settings.SessionIdle)
+	lockout.SetLimits(s.Settings.LockoutAttempts, s.Settings.LockoutDuration)
+	old := site.Swap(s)
+	// Each site opens the access log afresh, so that it can be rotated:
+	if old != nil && old.AccessLog != nil && old.AccessLog != s.AccessLog {
+		if err := old.AccessLog.Close(); err != nil {
+			slog.Error("Closing access log", "err", err)
+		}
+	}
+}
+
+// site is replaced as a whole when reloading.
+var site atomic.Pointer[Site]
+
+// SiteHandler passes requests to the current site's handler for the listener
+// they arrived on.
+var SiteHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	site.Load().Handlers[listenerIndex(r)].ServeHTTP(w, r)
+})
+
+// SiteTLSConfig returns a TLS config that uses the certificate of the
+// current site for each new connection, and its client CAs if clientCerts
+// is true.
+func SiteTLSConfig(clientCerts bool) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s := site.Load()
+			cfg := &tls.Config{
+				GetCertificate: GetCertificate,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}
+			s.TLS.Apply(cfg)
+			if acmeConfig != nil {
+				// For TLS-ALPN-01 challenges:
+				cfg.NextProtos = append(cfg.NextProtos, "acme-tls/1")
+			}
+			if clientCerts && s.ClientCAs != nil {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.ClientCAs = s.ClientCAs
+			}
+			return cfg, nil
+		},
+		// Unused, as GetConfigForClient takes precedence, but older versions
+		// of http.Server.ServeTLS insist on a certificate:
+		GetCertificate: GetCertificate,
+	}
+}
+
+// Reload re-reads the configuration file and builds a new site from it.
+// Settings in explicit, which were given on the command line or in the
+// environment, keep their values from startup. The flags themselves are
+// left alone, and changes to those that aren't Settings are ignored, with a
+// warning. If anything fails, the current site is kept.
+func Reload(mux http.Handler, lsns []Listener, explicit map[string]bool) error {
+	values, err := ReadConfig(flag.CommandLine, *config)
+	if errors.Is(err, fs.ErrNotExist) && !explicit["config"] {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("reload", flag.ContinueOnError)
+	cfg := NewSettings(flags)
+	flags.VisitAll(func(f *flag.Flag) {
+		v, ok := values[f.Name]
+		if explicit[f.Name] {
+			v, ok = flag.Lookup(f.Name).Value.String(), true
+		}
+		if !ok || err != nil {
+			return
+		}
+		if err = f.Value.Set(v); err != nil {
+			err = fmt.Errorf("%s: %w", f.Name, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if flags.Lookup(f.Name) != nil || explicit[f.Name] {
+			return
+		}
+		v, ok := values[f.Name]
+		if !ok {
+			v = f.DefValue
+		}
+		if !sameValue(f, v) {
+			slog.Warn("Ignoring change to a setting that only takes effect on restart", "flag", f.Name)
+		}
+	})
+
+	s, err := NewSite(mux, lsns, cfg)
+	if err != nil {
+		return err
+	}
+	s.Activate()
+	return nil
+}
+
+// sameValue reports whether v means the same as the flag's current value,
+// such as 5m for a duration of 5m0s, by setting a new value of the same type
+// to it.
+func sameValue(f *flag.Flag, v string) bool {
+	fresh := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+	return fresh.Set(v) == nil && fresh.String() == f.Value.String()
+}
+
+// ReloadOnSIGHUP calls Reload whenever the process receives SIGHUP.
+func ReloadOnSIGHUP(mux http.Handler, lsns []Listener, explicit map[string]bool) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := Reload(mux, lsns, explicit); err != nil {
+			slog.Error("Reload failed, keeping the current configuration", "err", err)
+			continue
+		}
+		slog.Info("Reloaded configuration")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reloadForTest reloads from the config, leaving go test's own flags alone,
+// and puts back what Activate changes afterwards.
+func reloadForTest(t *testing.T, toml string) error {
+	t.Helper()
+	explicit := make(map[string]bool)
+	flag.VisitAll(func(f *flag.Flag) {
+		explicit[f.Name] = f.Name == "config" || strings.HasPrefix(f.Name, "test.")
+	})
+	oldConfig, logger := *config, slog.Default()
+	lifetime, idle := sessions.Lifetime, sessions.Idle
+	attempts, duration := lockout.Max, lockout.Duration
+	t.Cleanup(func() {
+		*config = oldConfig
+		slog.SetDefault(logger)
+		sessions.SetExpiry(lifetime, idle)
+		lockout.SetLimits(attempts, duration)
+	})
+	*config = writeTempFile(t, "config.toml", toml)
+	return Reload(http.NotFoundHandler(), nil, explicit)
+}
+
+func TestReload(t *testing.T) {
+	useTestSite(t, &Site{})
+	var logs bytes.Buffer
+	logger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(logger) })
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	if err := reloadForTest(t, `
+title = "Reloaded"
+listen = ["127.0.0.1:8080", "unix:/run/askpass.sock"]
+read-timeout = "60s"
+`); err != nil {
+		t.Fatal(err)
+	}
+	if s := site.Load(); s.Settings.Title != "Reloaded" || s.Branding.Title != "Reloaded" {
+		t.Errorf("site's -title = %q, branding's = %q", s.Settings.Title, s.Branding.Title)
+	}
+	// The startup values, which the flags are bound to, are left alone:
+	if settings.Title != flag.Lookup("title").DefValue {
+		t.Errorf("startup -title = %q", settings.Title)
+	}
+	if got := listen.String(); got != flag.Lookup("listen").DefValue {
+		t.Errorf("-listen = %q", got)
+	}
+	if !strings.Contains(logs.String(), "flag=listen") {
+		t.Errorf("no warning about -listen: %s", logs.String())
+	}
+	// 60s is the same as the default:
+	if strings.Contains(logs.String(), "flag=read-timeout") || strings.Contains(logs.String(), "flag=title") {
+		t.Errorf("spurious warning: %s", logs.String())
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	useTestSite(t, &Site{})
+	before := site.Load()
+	for name, config := range map[string]string{
+		"site":        "title = \"Reloaded\"\nlisten = [\"127.0.0.1:8080\"]\nclient-ca = \"/nonexistent/ca.pem\"\n",
+		"flag":        "title = \"Reloaded\"\nlisten = [\"127.0.0.1:8080\"]\nlockout-attempts = \"many\"\n",
+		"config file": "title = \"Reloaded\"\nlisten = [",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := reloadForTest(t, config); err == nil {
+				t.Fatal("Reload succeeded")
+			}
+			if site.Load() != before {
+				t.Error("site replaced")
+			}
+		})
+	}
+}
+
+func TestReloadAccessLog(t *testing.T) {
+	useTestSite(t, &Site{})
+	path := filepath.Join(t.TempDir(), "access.log")
+	config := "listen = [\"127.0.0.1:8080\"]\naccess-log = \"" + path + "\"\n"
+	if err := reloadForTest(t, config); err != nil {
+		t.Fatal(err)
+	}
+	first := site.Load().AccessLog
+	if first == nil {
+		t.Fatal("no access log")
+	}
+
+	// As logrotate would:
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadForTest(t, config); err != nil {
+		t.Fatal(err)
+	}
+	LogAccess(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/after", nil))
+	first.Write(&AccessRecord{Path: "/late"})
+	if b, err := os.ReadFile(path); err != nil || !strings.Contains(string(b), "/after") {
+		t.Errorf("reopened access log = %q, %v", b, err)
+	}
+	if b, _ := os.ReadFile(path + ".1"); len(b) > 0 {
+		t.Errorf("rotated access log written to: %q", b)
+	}
+}
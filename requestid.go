@@ -0,0 +1,58 @@
+package main
+
+// Identifying each request, in the log, the audit log and error responses, so
+// that a failed attempt to unlock can be found in the logs of each proxy it
+// passed through, as well as this server's.
+
+import (
+	"context"
+	"net/http"
+)
+
+// requestIDHeader is set on every response, and believed in requests from
+// -trusted-proxies.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestID limits the length of IDs given by proxies.
+const maxRequestID = 128
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request, or "" if it has none, as when
+// it's not from a client.
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// AssignRequestIDs gives every request an ID: that in its X-Request-ID header
+// if it's from one of the current site's trusted proxies, or else a random
+// one. It must see the proxy's address, so it's outside ForwardedHeaders.
+func AssignRequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) || !site.Load().TrustedProxies.trusts(r) {
+			id = randomString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		next.ServeHTTP(w, WithLogAttrs(r, "request_id", id))
+	})
+}
+
+// validRequestID reports whether id is safe to log and send back: not too
+// long, and of characters that proxies use in IDs, such as UUIDs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '/' || c == '+' || c == '=' || c == '@':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+// Tell when an answer was rejected. Requesters like cryptsetup ask again with
+// a new ask file when the passphrase was wrong, which would otherwise look
+// just like the prompt that was answered.
+
+import (
+	"sync"
+	"time"
+)
+
+// retryWindow is how soon after an answer the requester must ask again for
+// the answer to be taken as rejected. Trying a passphrase against Argon2 can
+// take cryptsetup a few seconds.
+const retryWindow = 30 * time.Second
+
+// Retries remembers recent answers, to tell which prompts are asking again.
+type Retries struct {
+	mu       sync.Mutex
+	answered map[string]answered // by Prompt.Key
+	retried  map[string]bool     // by prompt name
+}
+
+type answered struct {
+	name string
+	at   time.Time
+}
+
+var retries = NewRetries()
+
+func NewRetries() *Retries {
+	return &Retries{
+		answered: make(map[string]answered),
+		retried:  make(map[string]bool),
+	}
+}
+
+// Answered records that the named prompt was answered.
+func (r *Retries) Answered(name, key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for k, a := range r.answered {
+		if now.Sub(a.at) > retryWindow {
+			delete(r.answered, k)
+		}
+	}
+	r.answered[key] = answered{name, now}
+}
+
+// Asked records that the named prompt appeared, and reports whether it's
+// asking again soon after another prompt for the same key was answered.
+func (r *Retries) Asked(name, key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.answered[key]
+	if !ok || a.name == name || time.Since(a.at) > retryWindow {
+		return false
+	}
+	delete(r.answered, key)
+	r.retried[name] = true
+	return true
+}
+
+// Retried reports whether the named prompt is asking again.
+func (r *Retries) Retried(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.retried[name]
+}
+
+// Forget forgets the named prompt, once it's gone.
+func (r *Retries) Forget(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.retried, name)
+}
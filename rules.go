@@ -0,0 +1,356 @@
+package main
+
+// Answering known prompts automatically, with secrets from elsewhere, while
+// unknown ones still wait for someone to answer them.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/sys/unix"
+)
+
+// Rule answers the prompts it matches with a secret. Every condition that is
+// set must match.
+type Rule struct {
+	Name    string `toml:"name"`
+	ID      string `toml:"id"`      // the prompt's Id, e.g. cryptsetup:/dev/sda2
+	Message string `toml:"message"` // regexp of the prompt's message
+	Host    string `toml:"host"`    // glob of this machine's hostname
+	Secret  string `toml:"secret"`  // URI of the secret, e.g. file:/etc/keys/data
+
+	// Windows are when the rule may answer, e.g. "Mon-Fri 09:00-17:00", in
+	// TimeZone, or local time. Outside them, someone must answer.
+	Windows  []string `toml:"windows"`
+	TimeZone string   `toml:"timezone"`
+
+	// Networks and Beacon are where the rule may answer: while this machine
+	// has an address in one of the Networks, e.g. "192.0.2.0/24", or can
+	// reach the Beacon, a host and port, e.g. "beacon.example.com:443".
+	Networks []string `toml:"networks"`
+	Beacon   string   `toml:"beacon"`
+
+	message  *regexp.Regexp
+	windows  []timeWindow
+	location *time.Location
+	networks []netip.Prefix
+}
+
+// Rules are tried in order, and the first that matches a prompt answers it.
+type Rules struct {
+	Rules []Rule `toml:"rule"`
+}
+
+// LoadRules reads rules from a TOML file, such as:
+//
+//	[[rule]]
+//	name = "data"
+//	id = "cryptsetup:/dev/sdb1"
+//	secret = "file:/etc/askpass-http/keys/data"
+func LoadRules(path string) (*Rules, error) {
+	var rs Rules
+	md, err := toml.DecodeFile(path, &rs)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %s", path, undecoded[0])
+	}
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprint(i + 1)
+		}
+		if r.message, err = regexp.Compile(r.Message); err != nil {
+			return nil, fmt.Errorf("%s: rule %s: %w", path, r.Name, err)
+		}
+		scheme, _, _ := strings.Cut(r.Secret, ":")
+		if _, ok := secretSources[scheme]; !ok {
+			return nil, fmt.Errorf("%s: rule %s: unknown secret %q", path, r.Name, r.Secret)
+		}
+		if r.location, err = time.LoadLocation(r.TimeZone); err != nil {
+			return nil, fmt.Errorf("%s: rule %s: %w", path, r.Name, err)
+		}
+		for _, s := range r.Windows {
+			w, err := parseTimeWindow(s, r.location)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %s: %w", path, r.Name, err)
+			}
+			r.windows = append(r.windows, w)
+		}
+		for _, s := range r.Networks {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %s: %w", path, r.Name, err)
+			}
+			r.networks = append(r.networks, prefix.Masked())
+		}
+		if r.Beacon > "" {
+			if _, _, err := net.SplitHostPort(r.Beacon); err != nil {
+				return nil, fmt.Errorf("%s: rule %s: beacon: %w", path, r.Name, err)
+			}
+		}
+	}
+	return &rs, nil
+}
+
+// Match returns the first rule matching the prompt, or nil if none do.
+func (rs *Rules) Match(p Prompt) *Rule {
+	host, _ := os.Hostname()
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		if r.ID > "" && r.ID != p.ID {
+			continue
+		}
+		if r.Host > "" {
+			if ok, _ := path.Match(r.Host, host); !ok {
+				continue
+			}
+		}
+		if !r.message.MatchString(p.Message) {
+			continue
+		}
+		if !r.InWindow(time.Now()) {
+			slog.Info("Not answering prompt automatically outside the rule's time windows", "rule", r.Name, "prompt", p.Name)
+			continue
+		}
+		if !r.OnTrustedNetwork() {
+			slog.Info("Not answering prompt automatically away from the rule's networks", "rule", r.Name, "prompt", p.Name)
+			continue
+		}
+		return r
+	}
+	return nil
+}
+
+// InWindow reports whether t is within one of the rule's time windows, or
+// the rule has none.
+func (r *Rule) InWindow(t time.Time) bool {
+	if len(r.windows) == 0 {
+		return true
+	}
+	t = t.In(r.location)
+	for _, w := range r.windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnTrustedNetwork reports whether this machine has an address in one of
+// the rule's networks, or can reach its beacon, or the rule has neither.
+func (r *Rule) OnTrustedNetwork() bool {
+	if len(r.networks) == 0 && r.Beacon == "" {
+		return true
+	}
+	return onNetwork(r.networks) || r.Beacon > "" && reachable(r.Beacon)
+}
+
+// A SecretSource fetches the secret referred to by ref, the part of a
+// rule's secret URI after the scheme, for the prompt.
+type SecretSource func(ctx context.Context, ref string, p Prompt) ([]byte, error)
+
+// secretSources are keyed by URI scheme.
+var secretSources = map[string]SecretSource{
+	"file":    fileSecret,
+	"exec":    execSecret,
+	"keyring": keyringSecret,
+	"https":   httpsSecret,
+	"tpm":     tpmSecret,
+	"tang":    tangSecret,
+	"fido2":   fido2Secret,
+
+	"vault-kv":      vaultKVSecret,
+	"vault-transit": vaultTransitSecret,
+
+	"aws-kms":            awsKMSSecret,
+	"aws-secretsmanager": awsSecretsManagerSecret,
+
+	"op":        onePasswordSecret,
+	"bitwarden": bitwardenSecret,
+	"pass":      passSecret,
+	"age":       ageSecret,
+	"sops":      sopsSecret,
+}
+
+// FetchSecret fetches the secret at the URI.
+func FetchSecret(ctx context.Context, uri string, p Prompt) ([]byte, error) {
+	scheme, ref, _ := strings.Cut(uri, ":")
+	fetch, ok := secretSources[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown secret %q", uri)
+	}
+	return fetch(ctx, ref, p)
+}
+
+// fileSecret reads a file, such as file:/etc/keys/data, without a trailing
+// newline.
+func fileSecret(_ context.Context, path string, _ Prompt) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	return bytes.TrimRight(b, "\r\n"), err
+}
+
+// execSecret runs a command, such as exec:/usr/local/bin/get-key data,
+// split on spaces, without a shell. Its output, without a trailing newline,
+// is the secret. The prompt is in $ASKPASS_NAME and $ASKPASS_MESSAGE.
+func execSecret(ctx context.Context, command string, p Prompt) ([]byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("exec: no command")
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "ASKPASS_NAME="+p.Name, "ASKPASS_MESSAGE="+p.Message)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// keyringSecret reads a key from the kernel keyrings, such as
+// keyring:cryptsetup, or keyring:TYPE:DESCRIPTION for a type other than
+// user, as cached by systemd-cryptsetup and others.
+func keyringSecret(_ context.Context, ref string, _ Prompt) ([]byte, error) {
+	typ, desc, ok := strings.Cut(ref, ":")
+	if !ok {
+		typ, desc = "user", ref
+	}
+	id, err := unix.RequestKey(typ, desc, "", 0)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: %s: %w", desc, err)
+	}
+	b, err := keyctlRead(id)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: %s: %w", desc, err)
+	}
+	return b, nil
+}
+
+// httpsSecret fetches a URL, such as https://keys.example.com/data, whose
+// body is the secret. Authenticate with the URL's userinfo, or by the
+// server checking where the request comes from.
+func httpsSecret(ctx context.Context, ref string, _ Prompt) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https:"+ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := ResponseError(resp); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(http.MaxBytesReader(nil, resp.Body, 64<<10)); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b.Bytes(), "\r\n"), nil
+}
+
+// AutoAnswerer answers prompts that match the current site's rules.
+type AutoAnswerer struct {
+	// Retry is how long to wait before trying again to answer a prompt, at
+	// first, doubling each time up to MaxRetry.
+	Retry, MaxRetry time.Duration
+
+	mu       sync.Mutex
+	answered map[string]time.Time // by rule and prompt key
+}
+
+// NewAutoAnswerer returns an AutoAnswerer that tries again after a second,
+// then after up to a minute.
+func NewAutoAnswerer() *AutoAnswerer {
+	return &AutoAnswerer{Retry: time.Second, MaxRetry: time.Minute, answered: make(map[string]time.Time)}
+}
+
+// Run answers prompts as they appear. It doesn't return.
+func (a *AutoAnswerer) Run(h *Hub) {
+	events, _ := h.SubscribeAll()
+	for e := range events {
+		if e.Type != EventAdded {
+			continue
+		}
+		rules := site.Load().Rules
+		if rules == nil {
+			continue
+		}
+		// It's answered from the cache instead:
+		if e.Prompt.AcceptCached && CachedAnswers(e.Prompt.ID) != nil {
+			continue
+		}
+		if r := rules.Match(e.Prompt); r != nil {
+			go a.answer(h, r, e.Prompt)
+		}
+	}
+}
+
+func (a *AutoAnswerer) answer(h *Hub, rule *Rule, p Prompt) {
+	log := slog.With("rule", rule.Name, "prompt", p.Name)
+
+	// If the requester asks the same question again soon after, the answer
+	// was probably wrong, so leave it for someone to answer:
+	key := rule.Name + "\x00" + p.Key()
+	now := time.Now()
+	a.mu.Lock()
+	for k, t := range a.answered {
+		if now.Sub(t) > site.Load().Settings.LockoutDuration {
+			delete(a.answered, k)
+		}
+	}
+	_, again := a.answered[key]
+	a.mu.Unlock()
+	if again {
+		log.Warn("Not answering prompt automatically again, as the last answer may have been wrong")
+		return
+	}
+
+	// The secret may be out of reach for a while, such as until the network
+	// is up, so keep trying for as long as the prompt is waiting:
+	retry := a.Retry
+	for {
+		err := a.try(rule, p)
+		if err == nil {
+			a.mu.Lock()
+			a.answered[key] = time.Now()
+			a.mu.Unlock()
+			return
+		}
+		log.Warn("Can't answer prompt automatically, trying again", "err", err, "in", retry)
+		time.Sleep(retry)
+		if ap := h.Askers().Find(p.Name); ap == nil || NewPrompt(p.Name, ap).Key() != p.Key() {
+			return
+		}
+		retry = min(2*retry, a.MaxRetry)
+	}
+}
+
+// try fetches the rule's secret, and answers the prompt with it.
+func (a *AutoAnswerer) try(rule *Rule, p Prompt) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	secret, err := FetchSecret(ctx, rule.Secret, p)
+	if err != nil {
+		return fmt.Errorf("fetching secret: %w", err)
+	}
+	r := BotRequest(ctx, "rules", "rule:"+rule.Name)
+	return AnswerPrompt(r, p.Name, string(secret))
+}
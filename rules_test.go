@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAutoAnswererRetry(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	rules, err := LoadRules(writeTempFile(t, "rules.toml", `
+[[rule]]
+name = "data"
+id = "cryptsetup:/dev/sdb1"
+secret = "file:`+secret+`"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestSite(t, &Site{Rules: rules})
+	old := hub
+	hub = NewHub()
+	t.Cleanup(func() { hub = old })
+
+	socket := filepath.Join(dir, "ask.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	a := NewAutoAnswerer()
+	a.Retry, a.MaxRetry = 10*time.Millisecond, 50*time.Millisecond
+	go a.Run(hub)
+	hub.Update(Askers{"ask.1": &Askpass{Message: "Passphrase", ID: "cryptsetup:/dev/sdb1", Socket: socket}})
+
+	// The secret isn't there at first, such as until a filesystem is
+	// mounted:
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(secret, []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != "+hunter2" {
+		t.Errorf("answered %q, want %q", got, "+hunter2")
+	}
+}
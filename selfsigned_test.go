@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	c, err := LoadSelfSigned(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadSelfSigned(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Certificate[0], c.Certificate[0]) {
+		t.Error("generated another certificate")
+	}
+
+	// Half of it missing isn't fixed by replacing the rest:
+	for _, name := range []string{"selfsigned.key", "selfsigned.crt"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if _, err := LoadSelfSigned(dir); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadSelfSigned(dir); err == nil {
+				t.Errorf("loaded without %s", name)
+			}
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				t.Errorf("%s generated again", name)
+			}
+		})
+	}
+}
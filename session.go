@@ -0,0 +1,262 @@
+package main
+
+// Cookie-based login sessions, shared by the interactive auth backends.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "askpass_session"
+	loginPath     = "/login"
+	logoutPath    = "/logout"
+)
+
+var ErrBadCookie = errors.New("invalid cookie")
+
+// cookieKey signs cookies. Sessions don't survive a restart anyway, so a new
+// key is generated every time.
+var cookieKey = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+var sessions = &SessionStore{}
+
+// loginHTML is the built-in template of the login page, which -templates-dir
+// can replace.
+const loginHTML = htmlHead + `<title>{{ Tf "%s login" title }}</title>
+{{ template "header" }}
+
+<main>
+{{ if .Error }}<p id="login-error" role="alert">{{ T .Error }}</p>{{ end }}
+
+<form action="login" method="post">
+	<input type="hidden" name="next" value="{{ .Next }}" />
+	<label>
+		{{ T "Username" }}
+		<input type="text" name="username" autocomplete="username" required autofocus {{ if .Error }}aria-invalid="true" aria-describedby="login-error"{{ end }} />
+	</label>
+	<label>
+		{{ T "Password" }}
+		<input type="password" name="password" autocomplete="current-password" required {{ if .Error }}aria-invalid="true" aria-describedby="login-error"{{ end }} />
+	</label>
+	<input type="submit" value="{{ T "Log in" }}" />
+</form>
+</main>
+`
+
+type Session struct {
+	User     string
+	ReadOnly bool // see WithReadOnly
+	Created  time.Time
+	LastSeen time.Time
+}
+
+// Apply returns a copy of r carrying the session's identity.
+func (s *Session) Apply(r *http.Request) *http.Request {
+	r = WithUser(r, s.User)
+	if s.ReadOnly {
+		r = WithReadOnly(r)
+	}
+	return r
+}
+
+// SessionStore keeps sessions in memory. Sessions expire after Lifetime, or
+// after Idle without any requests, whichever comes first.
+type SessionStore struct {
+	Lifetime time.Duration
+	Idle     time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// SetExpiry changes Lifetime and Idle, such as when reloading.
+func (s *SessionStore) SetExpiry(lifetime, idle time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Lifetime, s.Idle = lifetime, idle
+}
+
+// Create starts a new session and sets the session cookie.
+func (s *SessionStore) Create(w http.ResponseWriter, r *http.Request, user string, readOnly bool) {
+	now := time.Now()
+	id := randomString()
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*Session)
+	}
+	s.expire(now)
+	s.sessions[id] = &Session{
+		User:     user,
+		ReadOnly: readOnly,
+		Created:  now,
+		LastSeen: now,
+	}
+	s.mu.Unlock()
+	SetSignedCookie(w, r, sessionCookie, id, time.Time{})
+	NewCSRFToken(w, r)
+}
+
+// Get returns the session for the request, or nil if there isn't a valid one.
+func (s *SessionStore) Get(r *http.Request) *Session {
+	var id string
+	if err := ReadSignedCookie(r, sessionCookie, &id); err != nil {
+		return nil
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	sess.LastSeen = now
+	out := *sess
+	return &out
+}
+
+// Delete ends the session for the request, if any, and clears the cookie.
+func (s *SessionStore) Delete(w http.ResponseWriter, r *http.Request) {
+	var id string
+	if err := ReadSignedCookie(r, sessionCookie, &id); err == nil {
+		s.mu.Lock()
+		delete(s.sessions, id)
+		s.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: URLPath(r, "/"), MaxAge: -1})
+}
+
+// expire must be called with s.mu held.
+func (s *SessionStore) expire(now time.Time) {
+	for id, sess := range s.sessions {
+		if now.Sub(sess.Created) > s.Lifetime || now.Sub(sess.LastSeen) > s.Idle {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// ServeLogin shows a login form, and starts a session if the username and
+// password are correct according to p.
+func ServeLogin(p PasswordAuthenticator, w http.ResponseWriter, r *http.Request) {
+	data := struct{ Next, Error string }{Next: r.FormValue("next")}
+	if r.Method == http.MethodPost {
+		user := r.PostFormValue("username")
+		if err := p.Authenticate(user, r.PostFormValue("password")); err == nil {
+			sessions.Create(w, r, user, false)
+			Audit(WithUser(r, user), "login", "", nil)
+			http.Redirect(w, r, URLPath(r, LocalRedirect(data.Next)), http.StatusSeeOther)
+			return
+		}
+		Logger(r).Warn("Failed login", "user", user)
+		AuthFailed(r, "login", user)
+		data.Error = "Incorrect username or password."
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	if err := site.Load().Templates.Login.Execute(w, r, data); err != nil {
+		Logger(r).Error("Rendering login", "err", err)
+	}
+}
+
+func ServeLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := CheckCSRF(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+	sessions.Delete(w, r)
+	Audit(r, "logout", "", nil)
+	http.Redirect(w, r, URLPath(r, "/"), http.StatusSeeOther)
+}
+
+// RedirectToLogin sends browsers to the login page, returning afterwards to
+// the page they originally requested.
+func RedirectToLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, URLPath(r, loginPath)+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+}
+
+// LocalRedirect returns target if it is a path on this server, or "/"
+// otherwise, to avoid open redirects.
+func LocalRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+// SetSignedCookie stores v as JSON in a cookie, with a MAC so that it can't
+// be tampered with. If expires is zero, it is a browser session cookie.
+func SetSignedCookie(w http.ResponseWriter, r *http.Request, name string, v any, expires time.Time) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    base64.RawURLEncoding.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString(cookieMAC(name, b)),
+		Path:     URLPath(r, "/"),
+		Expires:  expires,
+		Secure:   IsHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ReadSignedCookie is the reverse of SetSignedCookie.
+func ReadSignedCookie(r *http.Request, name string, v any) error {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return ErrBadCookie
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ErrBadCookie
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrBadCookie
+	}
+	if !hmac.Equal(got, cookieMAC(name, b)) {
+		return ErrBadCookie
+	}
+	return json.Unmarshal(b, v)
+}
+
+func cookieMAC(name string, b []byte) []byte {
+	mac := hmac.New(sha256.New, cookieKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCookies returns a request carrying the cookies set in w.
+func withCookies(r *http.Request, w *httptest.ResponseRecorder) *http.Request {
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+func TestSessionStore(t *testing.T) {
+	s := &SessionStore{Lifetime: time.Hour, Idle: 10 * time.Minute}
+	w := httptest.NewRecorder()
+	s.Create(w, httptest.NewRequest("POST", "/login", nil), "alice", true)
+	r := withCookies(httptest.NewRequest("GET", "/", nil), w)
+
+	sess := s.Get(r)
+	if sess == nil {
+		t.Fatal("no session after Create")
+	}
+	if sess.User != "alice" || !sess.ReadOnly {
+		t.Errorf("session = %+v", sess)
+	}
+	applied := sess.Apply(r)
+	if User(applied) != "alice" || MayAnswer(applied) {
+		t.Errorf("Apply: user %q, may answer %v", User(applied), MayAnswer(applied))
+	}
+
+	// Only the cookie from Create is a session:
+	if s.Get(httptest.NewRequest("GET", "/", nil)) != nil {
+		t.Error("session without a cookie")
+	}
+	forged := httptest.NewRequest("GET", "/", nil)
+	forged.AddCookie(&http.Cookie{Name: sessionCookie, Value: "e30.AAAA"})
+	if s.Get(forged) != nil {
+		t.Error("session with a forged cookie")
+	}
+	other := httptest.NewRecorder()
+	(&SessionStore{Lifetime: time.Hour, Idle: time.Hour}).Create(other, httptest.NewRequest("POST", "/login", nil), "bob", false)
+	if s.Get(withCookies(httptest.NewRequest("GET", "/", nil), other)) != nil {
+		t.Error("session from another store")
+	}
+
+	// Logging out ends it, and clears the cookie:
+	w = httptest.NewRecorder()
+	s.Delete(w, r)
+	if s.Get(r) != nil {
+		t.Error("session after Delete")
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Name != sessionCookie || c[0].MaxAge >= 0 {
+		t.Errorf("Delete set cookies %v", c)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := &SessionStore{Lifetime: time.Hour, Idle: 10 * time.Minute}
+	create := func() *http.Request {
+		w := httptest.NewRecorder()
+		s.Create(w, httptest.NewRequest("POST", "/login", nil), "alice", false)
+		return withCookies(httptest.NewRequest("GET", "/", nil), w)
+	}
+	age := func(created, lastSeen time.Duration) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, sess := range s.sessions {
+			sess.Created = sess.Created.Add(-created)
+			sess.LastSeen = sess.LastSeen.Add(-lastSeen)
+		}
+	}
+
+	r := create()
+	age(50*time.Minute, 9*time.Minute)
+	if s.Get(r) == nil {
+		t.Fatal("active session expired")
+	}
+	// Get counts as activity:
+	age(0, 9*time.Minute)
+	if s.Get(r) == nil {
+		t.Error("session expired despite activity")
+	}
+	age(0, 11*time.Minute)
+	if s.Get(r) != nil {
+		t.Error("idle session didn't expire")
+	}
+
+	r = create()
+	age(61*time.Minute, 0)
+	if s.Get(r) != nil {
+		t.Error("session outlived its lifetime")
+	}
+}
+
+func TestSignedCookie(t *testing.T) {
+	type value struct{ A, B string }
+	w := httptest.NewRecorder()
+	SetSignedCookie(w, httptest.NewRequest("GET", "/", nil), "test", value{"x", "y"}, time.Time{})
+	c := w.Result().Cookies()[0]
+	if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("cookie %v isn't HttpOnly and SameSite=Lax", c)
+	}
+
+	var got value
+	if err := ReadSignedCookie(withCookies(httptest.NewRequest("GET", "/", nil), w), "test", &got); err != nil || got != (value{"x", "y"}) {
+		t.Errorf("ReadSignedCookie = %+v, %v", got, err)
+	}
+
+	payload, sig, _ := strings.Cut(c.Value, ".")
+	for name, cookie := range map[string]*http.Cookie{
+		"renamed":     {Name: "other", Value: c.Value},
+		"no MAC":      {Name: "test", Value: payload},
+		"bad MAC":     {Name: "test", Value: payload + "." + strings.Repeat("A", len(sig))},
+		"changed":     {Name: "test", Value: "eyJBIjoieiIsIkIiOiJ5In0." + sig},
+		"not base64":  {Name: "test", Value: "!." + sig},
+		"MAC garbage": {Name: "test", Value: payload + ".!"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		if err := ReadSignedCookie(r, cookie.Name, &got); !errors.Is(err, ErrBadCookie) {
+			t.Errorf("%s: ReadSignedCookie = %v, want ErrBadCookie", name, err)
+		}
+	}
+}
+
+func TestServeLogin(t *testing.T) {
+	useTestSite(t, &Site{})
+	lifetime, idle := sessions.Lifetime, sessions.Idle
+	sessions.Lifetime, sessions.Idle = time.Hour, time.Hour
+	t.Cleanup(func() { sessions.Lifetime, sessions.Idle = lifetime, idle })
+	h, err := LoadHtpasswd(writeTempFile(t, "htpasswd", testHtpasswd(t, "alice", "hunter2")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(user, pass, next string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {user}, "password": {pass}, "next": {next}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ServeLogin(h, w, r)
+		return w
+	}
+
+	w := login("alice", "hunter2", "/?x=y")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/?x=y" {
+		t.Errorf("login: %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	sess := sessions.Get(withCookies(httptest.NewRequest("GET", "/", nil), w))
+	if sess == nil || sess.User != "alice" || sess.ReadOnly {
+		t.Errorf("login started session %+v", sess)
+	}
+
+	for _, tt := range []struct{ user, pass string }{
+		{"alice", "hunter3"},
+		{"mallory", "hunter2"},
+		{"", ""},
+	} {
+		w := login(tt.user, tt.pass, "/")
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("login(%q, %q): status %d", tt.user, tt.pass, w.Code)
+		}
+		if len(w.Result().Cookies()) > 0 {
+			t.Errorf("login(%q, %q) set cookies", tt.user, tt.pass)
+		}
+		if !strings.Contains(w.Body.String(), "Incorrect username or password.") {
+			t.Errorf("login(%q, %q) didn't say why", tt.user, tt.pass)
+		}
+	}
+
+	// Only redirect within the site afterwards:
+	if got := login("alice", "hunter2", "https://evil.example/").Header().Get("Location"); got != "/" {
+		t.Errorf("redirected to %q", got)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	for target, want := range map[string]string{
+		"/":                    "/",
+		"/?x=y":                "/?x=y",
+		"/qr":                  "/qr",
+		"":                     "/",
+		"https://evil.example": "/",
+		"//evil.example/":      "/",
+		"/\\evil.example/":     "/",
+		"javascript:alert(1)":  "/",
+		"qr":                   "/",
+	} {
+		if got := LocalRedirect(target); got != want {
+			t.Errorf("LocalRedirect(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+// Settings that can be changed by reloading, as opposed to the rest of the
+// flags, which are only read at startup.
+
+import (
+	"flag"
+	"time"
+)
+
+// Settings are the flags that take effect again whenever the configuration
+// is reloaded, such as TLSMinVersion for -tls-min-version. Each Site has its
+// own copy, which doesn't change once built.
+type Settings struct {
+	TLSMinVersion string
+	TLSCiphers    string
+	TLSCurves     string
+
+	QRHandoff bool
+
+	Lang         string
+	Title        string
+	Header       string
+	Logo         string
+	Notice       string
+	TemplatesDir string
+
+	BasePath       string
+	TrustedProxies string
+	CORSOrigins    string
+
+	UnixAllowUIDs string
+	UnixAllowGIDs string
+
+	LogFormat string
+	LogLevel  string
+
+	AccessLogPath   string
+	AccessLogFormat string
+
+	AuthHtpasswd string
+	AuthTokens   string
+	ClientCA     string
+	ClientAllow  string
+
+	LDAPURL              string
+	LDAPStartTLS         bool
+	LDAPBaseDN           string
+	LDAPUserFilter       string
+	LDAPGroupFilter      string
+	LDAPBindDN           string
+	LDAPBindPasswordFile string
+	LDAPUserDN           string
+
+	SPNEGOKeytab    string
+	SPNEGOPrincipal string
+
+	RateLimit       float64
+	RateBurst       int
+	LockoutAttempts int
+	LockoutDuration time.Duration
+
+	SessionLifetime time.Duration
+	SessionIdle     time.Duration
+
+	TOTPSecretFile string
+
+	RequireE2E bool
+
+	ShamirThreshold int
+
+	RequireApproval bool
+	ApprovalTimeout time.Duration
+
+	FIDO2TokenFile string
+
+	AgeSecretsFile string
+
+	AnswerKeyFile string
+
+	RulesFile string
+
+	OIDCIssuer           string
+	OIDCClientID         string
+	OIDCClientSecretFile string
+	OIDCRedirectURL      string
+	OIDCGroupsClaim      string
+	OIDCAllowGroups      string
+}
+
+// settings are the values given at startup, on the command line, in the
+// environment or in the configuration file. They're the first site's, and
+// aren't changed by reloading.
+var settings = NewSettings(flag.CommandLine)
+
+// NewSettings defines a flag on fs for each setting, with its default.
+func NewSettings(fs *flag.FlagSet) *Settings {
+	s := &Settings{}
+	fs.StringVar(&s.TLSMinVersion, "tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringVar(&s.TLSCiphers, "tls-ciphers", "", "Comma-separated TLS 1.2 cipher suites to allow, e.g. TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384. TLS 1.3 suites can't be configured. If unspecified, uses the Go defaults")
+	fs.StringVar(&s.TLSCurves, "tls-curves", "", "Comma-separated key exchange curves in order of preference: X25519, P-256, P-384 or P-521. If unspecified, uses the Go defaults")
+
+	fs.BoolVar(&s.QRHandoff, "qr-handoff", false, "Include a single-use token in the URL shown by /qr, so that the device scanning it is logged in as the same user. Only works with -auth-htpasswd, -ldap-url and -oidc-issuer")
+
+	fs.StringVar(&s.Lang, "lang", "", "Language of the web pages, such as de, fr or es, instead of each browser's preferred one. en for English")
+	fs.StringVar(&s.Title, "title", "Askpass", "Title of the web pages, such as the machine's name")
+	fs.StringVar(&s.Header, "header", "", "Heading at the top of the web pages. If unspecified, the -title")
+	fs.StringVar(&s.Logo, "logo", "", "Logo to show beside the -header: a http or https URL, or an image file to serve")
+	fs.StringVar(&s.Notice, "notice", "", "Notice to show beneath the -header on every page, such as \"Property of Example Corp. Unauthorized access prohibited.\"")
+	fs.StringVar(&s.TemplatesDir, "templates-dir", "", "Directory of templates (index.html, login.html, qr.html) and static assets (in static/, such as static/style.css) to use instead of the built-in ones, or in addition to them. Reloaded on SIGHUP")
+
+	fs.StringVar(&s.BasePath, "base-path", "/", "Path the server is mounted at behind a reverse proxy, e.g. /askpass/")
+	fs.StringVar(&s.TrustedProxies, "trusted-proxies", "", "Comma-separated IP addresses or CIDR prefixes of reverse proxies whose X-Forwarded-For and X-Forwarded-Proto headers are trusted, or unix for any peer on a unix: socket")
+	fs.StringVar(&s.CORSOrigins, "cors-origins", "", "Comma-separated origins of web pages allowed to call the API from the browser, with its cookies or other credentials, e.g. https://dashboard.example.com, or * for any, without them")
+
+	fs.StringVar(&s.UnixAllowUIDs, "unix-allow-uids", "", "Comma-separated users or UIDs allowed to connect over unix: sockets. If neither this nor -unix-allow-gids is specified, anyone with permission to the socket may connect")
+	fs.StringVar(&s.UnixAllowGIDs, "unix-allow-gids", "", "Comma-separated groups or GIDs allowed to connect over unix: sockets")
+
+	fs.StringVar(&s.LogFormat, "log-format", "text", "Log format: text or json")
+	fs.StringVar(&s.LogLevel, "log-level", "info", "Minimum log level: debug, info, warn or error")
+
+	fs.StringVar(&s.AccessLogPath, "access-log", "", "File to append an access log of every request to, or - for stdout")
+	fs.StringVar(&s.AccessLogFormat, "access-log-format", "common", "Access log format: common, combined or json")
+
+	fs.StringVar(&s.AuthHtpasswd, "auth-htpasswd", CredentialPath("askpass-http.htpasswd"), "htpasswd file (bcrypt only) to require HTTP Basic auth against. Defaults to the askpass-http.htpasswd systemd credential, if present")
+	fs.StringVar(&s.AuthTokens, "auth-tokens", CredentialPath("askpass-http.tokens"), "File of API bearer tokens, one per line. Defaults to the askpass-http.tokens systemd credential, if present")
+	fs.StringVar(&s.ClientCA, "client-ca", "", "PEM-encoded CA certificate(s) to require and verify TLS client certificates against")
+	fs.StringVar(&s.ClientAllow, "client-allow", "", "Comma-separated CNs or SANs of client certificates to allow. If unspecified, any verified certificate is allowed")
+
+	fs.StringVar(&s.LDAPURL, "ldap-url", "", "LDAP server URL (ldap:// or ldaps://) to authenticate users against")
+	fs.BoolVar(&s.LDAPStartTLS, "ldap-starttls", false, "Use StartTLS with an ldap:// server")
+	fs.StringVar(&s.LDAPBaseDN, "ldap-base-dn", "", "Base DN to search for users")
+	fs.StringVar(&s.LDAPUserFilter, "ldap-user-filter", "(uid=%s)", "Filter to find a user, where %s is the user name. For Active Directory, use (sAMAccountName=%s)")
+	fs.StringVar(&s.LDAPGroupFilter, "ldap-group-filter", "", "Additional filter users must match to log in, e.g. (memberOf=cn=unlockers,ou=groups,dc=example,dc=com)")
+	fs.StringVar(&s.LDAPBindDN, "ldap-bind-dn", "", "DN to bind as to search for users. If unspecified, users bind directly using -ldap-user-dn")
+	fs.StringVar(&s.LDAPBindPasswordFile, "ldap-bind-password-file", CredentialPath("askpass-http.ldap-bind-password"), "File containing the password for -ldap-bind-dn. Defaults to the askpass-http.ldap-bind-password systemd credential, if present")
+	fs.StringVar(&s.LDAPUserDN, "ldap-user-dn", "", "Template for a user's bind DN, where %s is the user name. For Active Directory, use %s@example.com")
+
+	fs.StringVar(&s.SPNEGOKeytab, "spnego-keytab", "", "Kerberos keytab. If specified, clients must authenticate with SPNEGO (Negotiate)")
+	fs.StringVar(&s.SPNEGOPrincipal, "spnego-principal", "", "Service principal in -spnego-keytab to accept, e.g. HTTP/host.example.com. If unspecified, any is accepted")
+
+	fs.Float64Var(&s.RateLimit, "rate-limit", 5, "Maximum sustained requests per second per client IP. 0 disables rate limiting")
+	fs.IntVar(&s.RateBurst, "rate-burst", 20, "Maximum burst of requests per client IP")
+	fs.IntVar(&s.LockoutAttempts, "lockout-attempts", 5, "Lock out a client IP after this many failed authentication attempts, or from a prompt after this many answers to it. 0 disables lockout")
+	fs.DurationVar(&s.LockoutDuration, "lockout-duration", 5*time.Minute, "How long a lockout lasts, and the window in which attempts are counted")
+
+	fs.DurationVar(&s.SessionLifetime, "session-lifetime", 12*time.Hour, "Maximum lifetime of a login session")
+	fs.DurationVar(&s.SessionIdle, "session-idle", 30*time.Minute, "Login sessions expire after this long without any requests")
+
+	fs.StringVar(&s.TOTPSecretFile, "totp-secret-file", CredentialPath("askpass-http.totp"), "File containing a base32 TOTP secret or otpauth:// URI. If specified, a code is required to answer prompts. Defaults to the askpass-http.totp systemd credential, if present")
+
+	fs.BoolVar(&s.RequireE2E, "require-e2e", false, "Reject answers from the web UI that weren't encrypted in the browser, such as from browsers without X25519 support in WebCrypto, rather than accepting them as sent")
+
+	fs.IntVar(&s.ShamirThreshold, "shamir-threshold", 0, "If at least 2, prompts can also be answered by this many people each submitting a share of the answer, as split by util/shamir-split, so that no one person can answer alone. Each user may submit one share")
+
+	fs.BoolVar(&s.RequireApproval, "require-approval", false, "Hold answers given through the web UI, the API, Telegram or Matrix until a different user approves them. Requires users to log in")
+	fs.DurationVar(&s.ApprovalTimeout, "approval-timeout", 5*time.Minute, "How long answers are held awaiting approval, with -require-approval")
+
+	fs.StringVar(&s.FIDO2TokenFile, "fido2-token", "", "JSON file of a LUKS2 token enrolled with systemd-cryptenroll --fido2-device, as exported by cryptsetup token export, e.g. /etc/askpass-http/fido2.json. If specified, prompts can be answered by touching the security key, when asked to from the web UI")
+
+	fs.StringVar(&s.AgeSecretsFile, "age-secrets", "", "age-encrypted TOML file of secrets by name, for age: rule secrets, decrypted into memory at startup and on SIGHUP")
+
+	fs.StringVar(&s.AnswerKeyFile, "answer-key", CredentialPath("askpass-http.answer-key"), "File of age identities, or an ASCII-armored OpenPGP private key without a passphrase, or tpm:HANDLE?pcrs=... for one sealed in the TPM, to decrypt answers encrypted to it over the API with. Its public key is at /api/v1/answer-key. Defaults to the askpass-http.answer-key systemd credential, if present")
+
+	fs.StringVar(&s.RulesFile, "rules", "", "TOML file of rules answering matching prompts automatically with secrets from files, commands, the kernel keyring or URLs, e.g. /etc/askpass-http/rules.toml. Reloaded on SIGHUP")
+
+	fs.StringVar(&s.OIDCIssuer, "oidc-issuer", "", "OpenID Connect issuer URL. If specified, users must log in via the issuer")
+	fs.StringVar(&s.OIDCClientID, "oidc-client-id", "", "OpenID Connect client ID")
+	fs.StringVar(&s.OIDCClientSecretFile, "oidc-client-secret-file", CredentialPath("askpass-http.oidc-client-secret"), "File containing the OpenID Connect client secret. Defaults to the askpass-http.oidc-client-secret systemd credential, if present")
+	fs.StringVar(&s.OIDCRedirectURL, "oidc-redirect-url", "", "Absolute URL of this server's "+oidcCallbackPath+" endpoint, as registered with the issuer")
+	fs.StringVar(&s.OIDCGroupsClaim, "oidc-groups-claim", "groups", "ID token claim listing the user's groups")
+	fs.StringVar(&s.OIDCAllowGroups, "oidc-allow-groups", "", "Comma-separated groups allowed to answer prompts. If unspecified, any logged in user may answer")
+	return s
+}
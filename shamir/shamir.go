@@ -0,0 +1,112 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8), with
+// shares laid out as HashiCorp Vault's are: a byte for each byte of the
+// secret, followed by the share's x coordinate.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// mul multiplies in GF(2^8), with the polynomial AES uses.
+func mul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// inv returns the multiplicative inverse of a, which must be nonzero, as
+// a^254.
+func inv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = mul(mul(r, r), a)
+	}
+	return mul(r, r)
+}
+
+// Split splits secret into parts shares, any threshold of which can be
+// combined to recover it.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("shamir: empty secret")
+	}
+	if threshold < 2 || threshold > parts || parts > 255 {
+		return nil, fmt.Errorf("shamir: can't split into %d shares with a threshold of %d", parts, threshold)
+	}
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coeffs := make([]byte, threshold)
+	for j, s := range secret {
+		// A random polynomial of degree threshold-1, through (0, s):
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			x := share[len(secret)]
+			var y byte
+			for k := len(coeffs) - 1; k >= 0; k-- {
+				y = mul(y, x) ^ coeffs[k]
+			}
+			share[j] = y
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers the secret from at least the threshold of its shares.
+// With fewer, or shares of a different secret, the result is garbage.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("shamir: at least two shares are required")
+	}
+	n := len(shares[0])
+	if n < 2 {
+		return nil, errors.New("shamir: share too short")
+	}
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool)
+	for i, share := range shares {
+		if len(share) != n {
+			return nil, errors.New("shamir: shares are of different lengths")
+		}
+		xs[i] = share[n-1]
+		if xs[i] == 0 || seen[xs[i]] {
+			return nil, errors.New("shamir: duplicate share")
+		}
+		seen[xs[i]] = true
+	}
+	// Interpolate the polynomial at x = 0, with Lagrange's basis
+	// polynomials, where subtraction is XOR:
+	basis := make([]byte, len(shares))
+	for i := range shares {
+		basis[i] = 1
+		for j := range shares {
+			if i != j {
+				basis[i] = mul(basis[i], mul(xs[j], inv(xs[j]^xs[i])))
+			}
+		}
+	}
+	secret := make([]byte, n-1)
+	for b := range secret {
+		for i, share := range shares {
+			secret[b] ^= mul(share[b], basis[i])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,105 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMul(t *testing.T) {
+	for _, tt := range []struct{ a, b, want byte }{
+		{0x57, 0x83, 0xc1}, // FIPS-197 4.2
+		{0x57, 0x13, 0xfe}, // FIPS-197 4.2.1
+		{0x00, 0xff, 0x00},
+		{0x01, 0xab, 0xab},
+	} {
+		if got := mul(tt.a, tt.b); got != tt.want {
+			t.Errorf("mul(%#x, %#x) = %#x, want %#x", tt.a, tt.b, got, tt.want)
+		}
+	}
+	for a := 1; a < 256; a++ {
+		if got := mul(byte(a), inv(byte(a))); got != 1 {
+			t.Errorf("%#x * inv(%#x) = %#x, want 1", a, a, got)
+		}
+	}
+}
+
+// subsets calls f with every subset of k of the n shares.
+func subsets(shares [][]byte, k int, f func([][]byte)) {
+	var rec func(start int, chosen [][]byte)
+	rec = func(start int, chosen [][]byte) {
+		if len(chosen) == k {
+			f(chosen)
+			return
+		}
+		for i := start; i < len(shares); i++ {
+			rec(i+1, append(chosen[:len(chosen):len(chosen)], shares[i]))
+		}
+	}
+	rec(0, nil)
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple, of a decent length")
+	for _, tt := range []struct{ n, k int }{
+		{2, 2},
+		{3, 2},
+		{5, 3},
+		{6, 6},
+		{7, 4},
+	} {
+		shares, err := Split(secret, tt.n, tt.k)
+		if err != nil {
+			t.Fatalf("Split(%d, %d): %v", tt.n, tt.k, err)
+		}
+		if len(shares) != tt.n {
+			t.Fatalf("Split(%d, %d) returned %d shares", tt.n, tt.k, len(shares))
+		}
+		for k := 2; k <= tt.n; k++ {
+			subsets(shares, k, func(subset [][]byte) {
+				got, err := Combine(subset)
+				if err != nil {
+					t.Fatalf("%d of %d shares: Combine: %v", k, tt.n, err)
+				}
+				// Fewer than the threshold give garbage, which matches the
+				// secret with negligible probability:
+				if recovered := bytes.Equal(got, secret); recovered != (k >= tt.k) {
+					t.Errorf("%d of %d shares with threshold %d: recovered = %v", k, tt.n, tt.k, recovered)
+				}
+			})
+		}
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	for _, tt := range []struct {
+		secret []byte
+		n, k   int
+	}{
+		{nil, 3, 2},
+		{[]byte("x"), 3, 1},
+		{[]byte("x"), 2, 3},
+		{[]byte("x"), 256, 2},
+	} {
+		if _, err := Split(tt.secret, tt.n, tt.k); err == nil {
+			t.Errorf("Split(%q, %d, %d) succeeded", tt.secret, tt.n, tt.k)
+		}
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, shares := range map[string][][]byte{
+		"one share":        shares[:1],
+		"duplicate":        {shares[0], shares[0]},
+		"different length": {shares[0], shares[1][1:]},
+		"too short":        {{1}, {2}},
+		"zero x":           {shares[0], append(bytes.Clone(shares[1][:6]), 0)},
+	} {
+		if _, err := Combine(shares); err == nil {
+			t.Errorf("%s: Combine succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+// Answers split with Shamir's secret sharing, so that no one person can
+// answer prompts: shares are collected from several people, and the answer
+// is only recovered once there are -shamir-threshold of them.
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"jeremy.visser.name/go/askpass-http/shamir"
+)
+
+var (
+	ErrInvalidShare   = errors.New("invalid share")
+	ErrDuplicateShare = errors.New("share already submitted")
+)
+
+// ShareCollector collects shares of the answers to prompts.
+type ShareCollector struct {
+	mu     sync.Mutex
+	shares map[string][]submittedShare // by prompt name
+}
+
+type submittedShare struct {
+	user  string
+	share []byte
+}
+
+var shareCollector = &ShareCollector{shares: make(map[string][]submittedShare)}
+
+// ParseShare decodes a share, as output by shamir-split.
+func ParseShare(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil || len(b) < 2 {
+		return nil, ErrInvalidShare
+	}
+	return b, nil
+}
+
+// Count returns how many shares have been submitted for the named prompt.
+func (c *ShareCollector) Count(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.shares[name])
+}
+
+// Submit adds a share of the answer to the named prompt, on behalf of the
+// request, and returns how many there are. Once there are enough, the
+// answer is recovered, and the prompt answered with it. Each user may only
+// submit one share.
+func (c *ShareCollector) Submit(r *http.Request, name string, share []byte) (n int, err error) {
+	threshold := site.Load().Settings.ShamirThreshold
+	defer func() {
+		Audit(r, "share", name, err)
+		if err == nil {
+			Logger(r).Info("Share submitted", "prompt", name, "shares", n, "threshold", threshold)
+		}
+	}()
+	if hub.Askers().Find(name) == nil {
+		return 0, ErrNotFound
+	}
+
+	c.mu.Lock()
+	// Forget the shares for prompts that have gone:
+	for other := range c.shares {
+		if hub.Askers().Find(other) == nil {
+			delete(c.shares, other)
+		}
+	}
+	user := User(r)
+	shares := c.shares[name]
+	for _, s := range shares {
+		switch {
+		case len(s.share) != len(share):
+			c.mu.Unlock()
+			return len(shares), fmt.Errorf("%w: not a share of the same answer", ErrInvalidShare)
+		case user > "" && s.user == user, s.share[len(s.share)-1] == share[len(share)-1]:
+			c.mu.Unlock()
+			return len(shares), ErrDuplicateShare
+		}
+	}
+	shares = append(shares, submittedShare{user: user, share: share})
+	if len(shares) < threshold {
+		c.shares[name] = shares
+		c.mu.Unlock()
+		return len(shares), nil
+	}
+	// If the answer turns out to be wrong, the requester asks again, and
+	// the shares start over:
+	delete(c.shares, name)
+	c.mu.Unlock()
+
+	parts := make([][]byte, len(shares))
+	for i, s := range shares {
+		parts[i] = s.share
+	}
+	answer, err := shamir.Combine(parts)
+	if err != nil {
+		return len(shares), fmt.Errorf("%w: %v", ErrInvalidShare, err)
+	}
+	return len(shares), AnswerPrompt(r, name, string(answer))
+}
+
+// ServeShare submits a share of the answer to a prompt from the web UI.
+func ServeShare(w http.ResponseWriter, r *http.Request) {
+	if site.Load().Settings.ShamirThreshold < 2 {
+		Error(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !MayAnswer(r) {
+		Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CheckCSRF(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	if err := CheckTOTP(r, r.FormValue("totp")); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	share, err := ParseShare(r.FormValue("share"))
+	if err == nil {
+		_, err = shareCollector.Submit(r, r.FormValue("ask"), share)
+	}
+	if err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+
+	http.Redirect(w, r, URLPath(r, "/"), http.StatusSeeOther)
+}
@@ -0,0 +1,97 @@
+package main
+
+// Notifications through Signal, sent with signal-cli, or a REST gateway in
+// front of it, such as signal-cli-rest-api.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// Signal sends notifications from Account, a phone number registered with
+// signal-cli, to Recipients, which are phone numbers or group IDs.
+type Signal struct {
+	Account    string
+	Recipients []string
+
+	// RESTURL is the URL of a signal-cli-rest-api gateway. If empty,
+	// Command is run instead.
+	RESTURL string
+	Command string
+}
+
+// NewSignal returns a Signal from account to the comma-separated
+// recipients, through the gateway at restURL, or the command if restURL is
+// empty.
+func NewSignal(account, recipients, restURL, command string) (*Signal, error) {
+	s := &Signal{
+		Account: account,
+		RESTURL: strings.TrimSuffix(restURL, "/"),
+		Command: command,
+	}
+	for _, r := range strings.Split(recipients, ",") {
+		if r = strings.TrimSpace(r); r > "" {
+			s.Recipients = append(s.Recipients, r)
+		}
+	}
+	if len(s.Recipients) == 0 {
+		return nil, errors.New("signal: no recipients")
+	}
+	if s.RESTURL == "" {
+		if _, err := exec.LookPath(s.Command); err != nil {
+			return nil, fmt.Errorf("signal: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *Signal) Notify(ctx context.Context, n Notification) error {
+	text := n.Title + "\n\n" + n.Message
+	if n.URL > "" {
+		text += "\n\n" + n.URL
+	}
+	if s.RESTURL > "" {
+		return s.sendREST(ctx, text)
+	}
+	args := []string{"-a", s.Account, "send", "-m", text}
+	for _, r := range s.Recipients {
+		if strings.HasPrefix(r, "+") {
+			args = append(args, r)
+		} else {
+			args = append(args, "-g", r)
+		}
+	}
+	cmd := exec.CommandContext(ctx, s.Command, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s send: %w: %s", s.Command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (s *Signal) sendREST(ctx context.Context, text string) error {
+	b, err := json.Marshal(struct {
+		Message    string   `json:"message"`
+		Number     string   `json:"number"`
+		Recipients []string `json:"recipients"`
+	}{text, s.Account, s.Recipients})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.RESTURL+"/v2/send", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return ResponseError(resp)
+}
@@ -0,0 +1,262 @@
+package main
+
+// Files encrypted with sops (https://getsops.io), so that the same
+// encrypted, version-controlled files that configure everything else can
+// configure askpass-http.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/BurntSushi/toml"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// sopsFile is a file encrypted by sops in its binary format, as it does for
+// file types it doesn't understand, such as TOML.
+type sopsFile struct {
+	Data string `json:"data"`
+	Sops struct {
+		Age []struct {
+			Recipient string `json:"recipient"`
+			Enc       string `json:"enc"`
+		} `json:"age"`
+		KMS []struct {
+			ARN     string            `json:"arn"`
+			Enc     string            `json:"enc"`
+			Context map[string]string `json:"context"`
+		} `json:"kms"`
+		PGP []struct {
+			FP  string `json:"fp"`
+			Enc string `json:"enc"`
+		} `json:"pgp"`
+		LastModified string `json:"lastmodified"`
+		MAC          string `json:"mac"`
+	} `json:"sops"`
+}
+
+// IsSops reports whether b is the contents of a file encrypted by sops.
+func IsSops(b []byte) bool {
+	var f struct {
+		Sops json.RawMessage `json:"sops"`
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) && json.Unmarshal(b, &f) == nil && f.Sops != nil
+}
+
+// DecryptSops decrypts a file encrypted by sops in its binary format, such
+// as with sops -e config.toml, with whichever of its keys is available:
+// age, with the identities of -age-identity, $SOPS_AGE_KEY_FILE or
+// $SOPS_AGE_KEY; AWS KMS, with the usual AWS credentials; or PGP, with gpg.
+func DecryptSops(b []byte) ([]byte, error) {
+	var f sopsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("sops: %w", err)
+	}
+	if f.Data == "" {
+		return nil, errors.New("sops: only files encrypted in the binary format are supported")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	key, err := f.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decryptSopsValue(f.Data, key, "data:")
+	if err != nil {
+		return nil, fmt.Errorf("sops: data: %w", err)
+	}
+	// The MAC is of the values, so that they can't be swapped around or
+	// removed:
+	mac, err := decryptSopsValue(f.Sops.MAC, key, f.Sops.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("sops: MAC: %w", err)
+	}
+	sum := sha512.Sum512(data)
+	if !strings.EqualFold(string(mac), hex.EncodeToString(sum[:])) {
+		return nil, errors.New("sops: MAC mismatch, so the file has been tampered with")
+	}
+	return data, nil
+}
+
+// dataKey decrypts the key that the values are encrypted with.
+func (f *sopsFile) dataKey(ctx context.Context) ([]byte, error) {
+	var errs []error
+	if len(f.Sops.Age) > 0 {
+		ids, err := sopsAgeIdentities()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("age: %w", err))
+			ids = nil
+		}
+		for _, a := range f.Sops.Age {
+			if ids == nil {
+				break
+			}
+			r, err := age.Decrypt(armor.NewReader(strings.NewReader(a.Enc)), ids...)
+			if err == nil {
+				return io.ReadAll(r)
+			}
+			errs = append(errs, fmt.Errorf("age %s: %w", a.Recipient, err))
+		}
+	}
+	for _, k := range f.Sops.KMS {
+		key, err := sopsKMS(ctx, k.ARN, k.Enc, k.Context)
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, fmt.Errorf("kms %s: %w", k.ARN, err))
+	}
+	for _, p := range f.Sops.PGP {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "gpg", "--quiet", "--batch", "--decrypt")
+		cmd.Stdin = strings.NewReader(p.Enc)
+		cmd.Stderr = &stderr
+		key, err := cmd.Output()
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, fmt.Errorf("pgp %s: %w: %s", p.FP, err, bytes.TrimSpace(stderr.Bytes())))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("sops: no age, KMS or PGP keys")
+	}
+	return nil, fmt.Errorf("sops: can't decrypt the data key: %w", errors.Join(errs...))
+}
+
+// sopsAgeIdentities returns the age identities from -age-identity, and
+// wherever sops would look for them.
+func sopsAgeIdentities() ([]age.Identity, error) {
+	var keys bytes.Buffer
+	if *ageIdentity > "" {
+		if strings.HasPrefix(*ageIdentity, "tpm:") {
+			b, err := tpmSecret(context.Background(), strings.TrimPrefix(*ageIdentity, "tpm:"), Prompt{})
+			if err != nil {
+				return nil, err
+			}
+			keys.Write(b)
+		} else if b, err := os.ReadFile(*ageIdentity); err == nil {
+			keys.Write(b)
+		}
+		keys.WriteByte('\n')
+	}
+	path := os.Getenv("SOPS_AGE_KEY_FILE")
+	if path == "" {
+		dir, _ := os.UserConfigDir()
+		path = filepath.Join(dir, "sops", "age", "keys.txt")
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		keys.Write(b)
+		keys.WriteByte('\n')
+	}
+	keys.WriteString(os.Getenv("SOPS_AGE_KEY"))
+	return age.ParseIdentities(&keys)
+}
+
+// sopsSecret decrypts a file encrypted by sops, given by its path, such as
+// /etc/askpass-http/secrets.sops, or with ?field=NAME, a secret in it by
+// name, if it's a TOML file of secrets, as for -age-secrets.
+func sopsSecret(_ context.Context, ref string, _ Prompt) ([]byte, error) {
+	path, query, _ := strings.Cut(ref, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("sops: %w", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = DecryptSops(b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	field := q.Get("field")
+	if field == "" {
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+	secrets := make(map[string]string)
+	if err := toml.Unmarshal(b, &secrets); err != nil {
+		// Without quoting the contents, which are secret:
+		return nil, fmt.Errorf("sops: %s: not a TOML table of strings", path)
+	}
+	s, ok := secrets[field]
+	if !ok {
+		return nil, fmt.Errorf("sops: %s has no secret %q", path, field)
+	}
+	return []byte(s), nil
+}
+
+// sopsKMS decrypts a data key with AWS KMS, in the key's region.
+func sopsKMS(ctx context.Context, arn, enc string, encContext map[string]string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if parts := strings.Split(arn, ":"); len(parts) > 3 && parts[3] > "" {
+		cfg.Region = parts[3]
+	}
+	out, err := kms.NewFromConfig(cfg).Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    b,
+		KeyId:             aws.String(arn),
+		EncryptionContext: encContext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+var sopsValueRegexp = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+// decryptSopsValue decrypts a value of the form
+// ENC[AES256_GCM,data:...,iv:...,tag:...,type:...], with the key, and aad
+// being the path to the value, or for the MAC, the last modified time.
+func decryptSopsValue(s string, key []byte, aad string) ([]byte, error) {
+	m := sopsValueRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, errors.New("not an encrypted value")
+	}
+	var data, iv, tag []byte
+	for i, p := range []*[]byte{&data, &iv, &tag} {
+		var err error
+		if *p, err = base64.StdEncoding.DecodeString(m[i+1]); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	b, err := gcm.Open(nil, iv, append(data, tag...), []byte(aad))
+	if err != nil {
+		return nil, err
+	}
+	if m[4] == "bytes" || m[4] == "str" {
+		return b, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", m[4])
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The files in testdata/sops were encrypted by sops 3.9.4 to the age key
+// in testdata/sops/age.key:
+//
+//	sops -e --input-type binary --output-type json --age age1mte63jp9m6tpyxwtzaxz760ax2czl2557x22m03u30fj4a0hmedqazanvk FILE
+
+// useSopsTestKey makes the test's age key the only one sops can find.
+func useSopsTestKey(t *testing.T) {
+	t.Setenv("SOPS_AGE_KEY_FILE", "testdata/sops/age.key")
+	t.Setenv("SOPS_AGE_KEY", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+}
+
+func TestSopsSecret(t *testing.T) {
+	useSopsTestKey(t)
+	for _, tt := range []struct{ ref, want string }{
+		{"testdata/sops/passphrase.sops", "hunter2"},
+		{"testdata/sops/secrets.sops?field=disk", "hunter2"},
+		{"testdata/sops/secrets.sops?field=root", "correct horse battery staple"},
+	} {
+		got, err := sopsSecret(context.Background(), tt.ref, Prompt{})
+		if err != nil {
+			t.Errorf("%s: %v", tt.ref, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+	for _, ref := range []string{
+		"testdata/sops/secrets.sops?field=nope",
+		"testdata/sops/passphrase.sops?field=disk", // not TOML
+		"testdata/sops/missing.sops",
+		"testdata/sops/age.key", // not encrypted
+	} {
+		if got, err := sopsSecret(context.Background(), ref, Prompt{}); err == nil {
+			t.Errorf("%s = %q, want an error", ref, got)
+		}
+	}
+}
+
+func TestSopsWithoutKey(t *testing.T) {
+	useSopsTestKey(t)
+	t.Setenv("SOPS_AGE_KEY_FILE", "testdata/sops/missing.key")
+	b, err := os.ReadFile("testdata/sops/passphrase.sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecryptSops(b); err == nil {
+		t.Errorf("decrypted %q without the key", got)
+	}
+}
+
+// encryptSopsValue encrypts a value as sops does.
+func encryptSopsValue(t *testing.T, plaintext, key []byte, aad string) string {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, 32)
+	rand.Read(iv)
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(aad))
+	data, tag := sealed[:len(plaintext)], sealed[len(plaintext):]
+	enc := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]", enc(data), enc(iv), enc(tag))
+}
+
+func TestSopsTampered(t *testing.T) {
+	useSopsTestKey(t)
+	b, err := os.ReadFile("testdata/sops/passphrase.sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptSops(b); err != nil {
+		t.Fatal(err)
+	}
+	var f sopsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	key, err := f.dataKey(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tamper := range map[string]func(m map[string]any){
+		// Validly encrypted, but not what the MAC is of:
+		"data replaced": func(m map[string]any) {
+			m["data"] = encryptSopsValue(t, []byte("12345\n"), key, "data:")
+		},
+		"data corrupted": func(m map[string]any) {
+			m["data"] = strings.Replace(m["data"].(string), "data:", "data:AAAA", 1)
+		},
+		"MAC corrupted": func(m map[string]any) {
+			sops := m["sops"].(map[string]any)
+			mac := []byte(sops["mac"].(string))
+			i := len("ENC[AES256_GCM,data:")
+			mac[i] ^= 1
+			sops["mac"] = string(mac)
+		},
+		"MAC replaced": func(m map[string]any) {
+			sops := m["sops"].(map[string]any)
+			sops["mac"] = encryptSopsValue(t, []byte(strings.Repeat("0", 128)), key, sops["lastmodified"].(string))
+		},
+		"MAC removed": func(m map[string]any) {
+			delete(m["sops"].(map[string]any), "mac")
+		},
+		"lastmodified changed": func(m map[string]any) {
+			m["sops"].(map[string]any)["lastmodified"] = "2020-01-01T00:00:00Z"
+		},
+	} {
+		var m map[string]any
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		tamper(m)
+		tampered, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := DecryptSops(tampered); err == nil {
+			t.Errorf("%s: decrypted %q", name, got)
+		}
+	}
+}
+
+func TestIsSops(t *testing.T) {
+	b, err := os.ReadFile("testdata/sops/secrets.sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		b    string
+		want bool
+	}{
+		{string(b), true},
+		{`disk = "hunter2"`, false},
+		{`{"data": "x"}`, false},
+		{"", false},
+	} {
+		if got := IsSops([]byte(tt.b)); got != tt.want {
+			t.Errorf("IsSops(%.20q) = %v, want %v", tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// Kerberos authentication via SPNEGO ("Negotiate"), for domain-joined clients.
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/jcmturner/goidentity/v6"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// SPNEGOAuth requires every request to authenticate with a Kerberos ticket
+// for a service principal in the keytab. If principal is "", any principal
+// in the keytab is accepted.
+func SPNEGOAuth(kt *keytab.Keytab, principal string, next http.Handler) http.Handler {
+	settings := []func(*service.Settings){
+		service.Logger(slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug)),
+		service.DecodePAC(false),
+	}
+	if principal != "" {
+		settings = append(settings, service.KeytabPrincipal(principal))
+	}
+	h := spnego.SPNEGOKRB5Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = w.(spnegoWriter).ResponseWriter
+		id := goidentity.FromHTTPRequestContext(r)
+		if id == nil || !id.Authenticated() {
+			AuthFailed(r, "negotiate", "")
+			Error(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, WithUser(r, id.UserName()+"@"+id.Domain()))
+	}), kt, settings...)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(spnegoWriter{w, r}, r)
+	})
+}
+
+// spnegoWriter records the tokens that SPNEGOKRB5Authenticate rejects as
+// failed attempts. Asking for a token, when the client didn't send one,
+// isn't a failure.
+type spnegoWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (w spnegoWriter) WriteHeader(code int) {
+	if code == http.StatusUnauthorized && strings.HasPrefix(w.r.Header.Get("Authorization"), "Negotiate ") {
+		AuthFailed(w.r, "negotiate", "")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+func TestSPNEGOAuthFailures(t *testing.T) {
+	useTestSite(t, &Site{})
+	h := SPNEGOAuth(keytab.New(), "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("served without a ticket")
+	}))
+	for _, tt := range []struct {
+		authorization string
+		failed        bool
+	}{
+		{"", false}, // asked for a ticket
+		{"Basic dXNlcjpwYXNz", false},
+		{"Negotiate not base64!", true},
+		{"Negotiate Z2FyYmFnZQ==", true},
+	} {
+		useTestLockout(t, 1, time.Minute)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.authorization > "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: status %d", tt.authorization, w.Code)
+		}
+		if failed := lockout.Remaining(authKey(ClientIP(r))) > 0; failed != tt.failed {
+			t.Errorf("%q: counted as a failed attempt = %v, want %v", tt.authorization, failed, tt.failed)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+//go:build tsnet
+
+package main
+
+// Joining a tailnet directly with tsnet, so that the machine can be unlocked
+// from anywhere on it, even behind NAT, without tailscaled in the initramfs
+// or any port exposed to the network.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"tailscale.com/tsnet"
+)
+
+var (
+	tailscaleOnce   sync.Once
+	tailscaleServer *tsnet.Server
+	tailscaleErr    error
+)
+
+// ListenTailscale listens on port on the tailnet, joining it as
+// -tailscale-hostname the first time.
+func ListenTailscale(port string) (net.Listener, error) {
+	tailscaleOnce.Do(func() {
+		tailscaleServer, tailscaleErr = StartTailscale()
+	})
+	if tailscaleErr != nil {
+		return nil, tailscaleErr
+	}
+	lsn, err := tailscaleServer.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("tailscale: %w", err)
+	}
+	return tailscaleListener{lsn, net.JoinHostPort(*tailscaleHostname, port)}, nil
+}
+
+// StartTailscale starts the node, which connects to the tailnet in the
+// background, as the network may not be up yet.
+func StartTailscale() (*tsnet.Server, error) {
+	if *tailscaleHostname == "" {
+		return nil, fmt.Errorf("tailscale: listeners require -tailscale-hostname")
+	}
+	s := &tsnet.Server{
+		Hostname: *tailscaleHostname,
+		Dir:      *tailscaleStateDir,
+		Logf: func(format string, args ...any) {
+			msg := fmt.Sprintf(format, args...)
+			// Without an auth key, someone has to log in to add the node:
+			if strings.HasPrefix(msg, "To start this tsnet server") {
+				slog.Warn("Tailscale needs a login", "msg", msg)
+				return
+			}
+			slog.Debug("tsnet: " + msg)
+		},
+	}
+	if s.Dir == "" {
+		dir, err := os.MkdirTemp("", "askpass-http-tailscale")
+		if err != nil {
+			return nil, err
+		}
+		s.Dir, s.Ephemeral = dir, true
+	}
+	if *tailscaleAuthKeyFile > "" {
+		b, err := os.ReadFile(*tailscaleAuthKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.AuthKey = strings.TrimSpace(string(b))
+	}
+	if err := s.Start(); err != nil {
+		return nil, fmt.Errorf("tailscale: %w", err)
+	}
+	go func() {
+		status, err := s.Up(context.Background())
+		if err != nil {
+			slog.Error("Can't join tailnet", "err", err)
+			return
+		}
+		slog.Info("Joined tailnet", "name", status.Self.DNSName, "addrs", status.TailscaleIPs)
+	}()
+	return s, nil
+}
+
+// tailscaleListener is reported as being on the tailscale network, at the
+// node's name, rather than tsnet's tcp address without a host.
+type tailscaleListener struct {
+	net.Listener
+	addr string
+}
+
+func (l tailscaleListener) Addr() net.Addr { return tailscaleAddr(l.addr) }
+
+type tailscaleAddr string
+
+func (a tailscaleAddr) Network() string { return "tailscale" }
+func (a tailscaleAddr) String() string  { return string(a) }
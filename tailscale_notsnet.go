@@ -0,0 +1,14 @@
+//go:build !tsnet
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenTailscale is unavailable, as tsnet is too large to build in by
+// default.
+func ListenTailscale(port string) (net.Listener, error) {
+	return nil, errors.New("tailscale: not supported by this build; rebuild with -tags tsnet")
+}
@@ -0,0 +1,296 @@
+package main
+
+// Secrets bound to a Tang server with Clevis, which can only be recovered
+// while the server is reachable, such as on the network the machine belongs
+// to.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// tangJWK is an elliptic curve public key, as in a Tang advertisement.
+type tangJWK struct {
+	Kty    string   `json:"kty"`
+	Crv    string   `json:"crv"`
+	X      string   `json:"x"`
+	Y      string   `json:"y"`
+	KeyOps []string `json:"key_ops,omitempty"`
+	Alg    string   `json:"alg,omitempty"`
+}
+
+var tangCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func newTangJWK(curve elliptic.Curve, x, y *big.Int) tangJWK {
+	size := (curve.Params().BitSize + 7) / 8
+	return tangJWK{
+		Kty: "EC",
+		Crv: curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(x.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(y.FillBytes(make([]byte, size))),
+	}
+}
+
+// point returns the key's curve and coordinates.
+func (k tangJWK) point() (elliptic.Curve, *big.Int, *big.Int, error) {
+	curve, ok := tangCurves[k.Crv]
+	if k.Kty != "EC" || !ok {
+		return nil, nil, nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	x, y := new(big.Int).SetBytes(xb), new(big.Int).SetBytes(yb)
+	if !curve.IsOnCurve(x, y) {
+		return nil, nil, nil, errors.New("point is not on the curve")
+	}
+	return curve, x, y, nil
+}
+
+// thumbprint returns the key's RFC 7638 thumbprint, as Clevis uses for the
+// kid of the Tang key it encrypted to.
+func (k tangJWK) thumbprint(h hash.Hash) string {
+	fmt.Fprintf(h, `{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// tangHeader is the protected header of a JWE encrypted by
+// clevis encrypt tang.
+type tangHeader struct {
+	Alg    string  `json:"alg"`
+	Enc    string  `json:"enc"`
+	Kid    string  `json:"kid"`
+	Epk    tangJWK `json:"epk"`
+	Apu    string  `json:"apu"`
+	Apv    string  `json:"apv"`
+	Clevis struct {
+		Pin  string `json:"pin"`
+		Tang struct {
+			URL string `json:"url"`
+			Adv struct {
+				Keys []tangJWK `json:"keys"`
+			} `json:"adv"`
+		} `json:"tang"`
+	} `json:"clevis"`
+}
+
+// tangJWE is a JWE, in any of the forms Clevis keeps them in.
+type tangJWE struct {
+	Protected  string `json:"protected"`
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	Tag        string `json:"tag"`
+
+	JWE *tangJWE `json:"jwe"` // of a LUKS2 token
+}
+
+// parseTangJWE parses the compact JWE output by clevis encrypt tang, or a
+// LUKS2 token made by clevis luks bind, as exported by
+// cryptsetup token export.
+func parseTangJWE(b []byte) (*tangJWE, error) {
+	b = bytes.TrimSpace(b)
+	if bytes.HasPrefix(b, []byte("{")) {
+		var jwe tangJWE
+		if err := json.Unmarshal(b, &jwe); err != nil {
+			return nil, err
+		}
+		if jwe.JWE != nil {
+			return jwe.JWE, nil
+		}
+		return &jwe, nil
+	}
+	parts := strings.Split(string(b), ".")
+	if len(parts) != 5 {
+		return nil, errors.New("not a JWE")
+	}
+	return &tangJWE{Protected: parts[0], IV: parts[2], Ciphertext: parts[3], Tag: parts[4]}, nil
+}
+
+// tangSecret decrypts a secret encrypted with Clevis's tang pin, given as
+// the path of a file holding the JWE, such as
+// tang:/etc/askpass-http/data.jwe. The Tang server the JWE names is asked to
+// help recover the key, without learning it, by the McCallum-Relyea
+// exchange.
+func tangSecret(ctx context.Context, path string, _ Prompt) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	jwe, err := parseTangJWE(b)
+	if err != nil {
+		return nil, fmt.Errorf("tang: %s: %w", path, err)
+	}
+	b, err = base64.RawURLEncoding.DecodeString(jwe.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("tang: %s: %w", path, err)
+	}
+	var h tangHeader
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("tang: %s: %w", path, err)
+	}
+	if h.Clevis.Pin != "tang" || h.Alg != "ECDH-ES" {
+		return nil, fmt.Errorf("tang: %s: not encrypted with the tang pin", path)
+	}
+
+	// The Tang key the secret was encrypted to:
+	var server *tangJWK
+	for i, k := range h.Clevis.Tang.Adv.Keys {
+		if k.thumbprint(sha256.New()) == h.Kid || k.thumbprint(sha1.New()) == h.Kid {
+			server = &h.Clevis.Tang.Adv.Keys[i]
+		}
+	}
+	if server == nil {
+		return nil, fmt.Errorf("tang: %s: key %s is not in the advertisement", path, h.Kid)
+	}
+	curve, sx, sy, err := server.point()
+	if err != nil {
+		return nil, fmt.Errorf("tang: %s: %w", path, err)
+	}
+	ccurve, cx, cy, err := h.Epk.point()
+	if err != nil {
+		return nil, fmt.Errorf("tang: %s: %w", path, err)
+	}
+	if ccurve != curve {
+		return nil, fmt.Errorf("tang: %s: keys are on different curves", path)
+	}
+
+	// Blind the client's key with an ephemeral one, so that the server
+	// learns nothing, then take the ephemeral one away again:
+	e, ex, ey, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	xx, xy := curve.Add(cx, cy, ex, ey)
+	yx, yy, err := tangRecover(ctx, h.Clevis.Tang.URL, h.Kid, newTangJWK(curve, xx, xy))
+	if err != nil {
+		return nil, fmt.Errorf("tang: %s: %w", h.Clevis.Tang.URL, err)
+	}
+	if !curve.IsOnCurve(yx, yy) {
+		return nil, fmt.Errorf("tang: %s: response is not on the curve", h.Clevis.Tang.URL)
+	}
+	esx, esy := curve.ScalarMult(sx, sy, e)
+	esy.Sub(curve.Params().P, esy)
+	kx, _ := curve.Add(yx, yy, esx, esy)
+
+	return tangDecrypt(jwe, h, kx.FillBytes(make([]byte, (curve.Params().BitSize+7)/8)))
+}
+
+// tangRecover sends the blinded key to the Tang server, which returns it
+// multiplied by its private key.
+func tangRecover(ctx context.Context, url, kid string, x tangJWK) (*big.Int, *big.Int, error) {
+	body, err := json.Marshal(x)
+	if err != nil {
+		return nil, nil, err
+	}
+	url = strings.TrimSuffix(url, "/") + "/rec/" + kid
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jwk+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if err := ResponseError(resp); err != nil {
+		return nil, nil, err
+	}
+	var y tangJWK
+	if err := json.NewDecoder(resp.Body).Decode(&y); err != nil {
+		return nil, nil, err
+	}
+	if y.Crv != x.Crv {
+		return nil, nil, fmt.Errorf("response is on %s, not %s", y.Crv, x.Crv)
+	}
+	_, yx, yy, err := y.point()
+	return yx, yy, err
+}
+
+// tangDecrypt decrypts the JWE's content with the ECDH-ES shared secret z.
+func tangDecrypt(jwe *tangJWE, h tangHeader, z []byte) ([]byte, error) {
+	var size int
+	switch h.Enc {
+	case "A128GCM":
+		size = 16
+	case "A192GCM":
+		size = 24
+	case "A256GCM":
+		size = 32
+	default:
+		return nil, fmt.Errorf("tang: unsupported encryption %s", h.Enc)
+	}
+	var fields [4][]byte
+	for i, s := range []string{jwe.IV, jwe.Ciphertext, jwe.Tag, h.Apu} {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("tang: %w", err)
+		}
+		fields[i] = b
+	}
+	iv, ciphertext, tag, apu := fields[0], fields[1], fields[2], fields[3]
+	apv, err := base64.RawURLEncoding.DecodeString(h.Apv)
+	if err != nil {
+		return nil, fmt.Errorf("tang: %w", err)
+	}
+
+	block, err := aes.NewCipher(concatKDF(z, h.Enc, apu, apv, size))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	b, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(jwe.Protected))
+	if err != nil {
+		return nil, fmt.Errorf("tang: %w", err)
+	}
+	return b, nil
+}
+
+// concatKDF derives a key of size bytes from the ECDH-ES shared secret z, as
+// in RFC 7518 section 4.6.2, with alg being the enc of direct key agreement.
+func concatKDF(z []byte, alg string, apu, apv []byte, size int) []byte {
+	var other []byte
+	for _, b := range [][]byte{[]byte(alg), apu, apv} {
+		other = binary.BigEndian.AppendUint32(other, uint32(len(b)))
+		other = append(other, b...)
+	}
+	other = binary.BigEndian.AppendUint32(other, uint32(size*8))
+
+	var key []byte
+	for counter := uint32(1); len(key) < size; counter++ {
+		h := sha256.New()
+		binary.Write(h, binary.BigEndian, counter)
+		h.Write(z)
+		h.Write(other)
+		key = h.Sum(key)
+	}
+	return key[:size]
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tangTestKey is the fixed private key of the fake Tang server.
+var tangTestKey, _ = new(big.Int).SetString("4f3b9c1a2e6d8f0a7b5c3e1d9f2a4b6c8e0d1f3a5b7c9e2d4f6a8b0c1e3d5f7a", 16)
+
+// newTangServer returns a fake Tang server, which answers recovery
+// requests for its key by multiplying the point by it, as tangd does, and
+// the public JWK it advertises. Each point it's sent is appended to seen.
+func newTangServer(t *testing.T, seen *[]tangJWK) (*httptest.Server, tangJWK) {
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(tangTestKey.Bytes())
+	jwk := newTangJWK(curve, x, y)
+	kid := jwk.thumbprint(sha256.New())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/rec/"+kid {
+			http.NotFound(w, r)
+			return
+		}
+		var x tangJWK
+		if err := json.NewDecoder(r.Body).Decode(&x); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*seen = append(*seen, x)
+		_, xx, xy, err := x.point()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		yx, yy := curve.ScalarMult(xx, xy, tangTestKey.Bytes())
+		w.Header().Set("Content-Type", "application/jwk+json")
+		json.NewEncoder(w).Encode(newTangJWK(curve, yx, yy))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, jwk
+}
+
+// clevisEncrypt encrypts plaintext to the Tang server's key, as
+// clevis encrypt tang does, returning the compact JWE and the client's
+// ephemeral key.
+func clevisEncrypt(t *testing.T, url string, server tangJWK, plaintext []byte) (string, tangJWK) {
+	t.Helper()
+	curve, sx, sy, err := server.point()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cx, cy, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zx, _ := curve.ScalarMult(sx, sy, c)
+	var h tangHeader
+	h.Alg, h.Enc, h.Kid = "ECDH-ES", "A256GCM", server.thumbprint(sha256.New())
+	h.Epk = newTangJWK(curve, cx, cy)
+	h.Clevis.Pin = "tang"
+	h.Clevis.Tang.URL = url
+	h.Clevis.Tang.Adv.Keys = []tangJWK{server}
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected := base64.RawURLEncoding.EncodeToString(b)
+
+	key := concatKDF(zx.FillBytes(make([]byte, 32)), h.Enc, nil, nil, 32)
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	iv := make([]byte, gcm.NonceSize())
+	rand.Read(iv)
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(plaintext)], sealed[len(plaintext):]
+	enc := base64.RawURLEncoding.EncodeToString
+	return strings.Join([]string{protected, "", enc(iv), enc(ciphertext), enc(tag)}, "."), h.Epk
+}
+
+func writeTempFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTangSecret(t *testing.T) {
+	var seen []tangJWK
+	srv, server := newTangServer(t, &seen)
+	jwe, epk := clevisEncrypt(t, srv.URL, server, []byte("hunter2"))
+
+	for name, data := range map[string]string{
+		"compact": jwe,
+		"luks2":   `{"type":"clevis","keyslots":["1"],"jwe":` + tangCompactToJSON(t, jwe) + `}`,
+	} {
+		seen = nil
+		got, err := tangSecret(context.Background(), writeTempFile(t, "data.jwe", data), Prompt{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(got) != "hunter2" {
+			t.Errorf("%s: got %q", name, got)
+		}
+		// The server must only see the client's key blinded:
+		if len(seen) != 1 || seen[0].X == epk.X {
+			t.Errorf("%s: server saw %+v, with the client's key %+v", name, seen, epk)
+		}
+	}
+}
+
+// tangCompactToJSON converts a compact JWE to the JSON serialization, as in
+// a LUKS2 token.
+func tangCompactToJSON(t *testing.T, jwe string) string {
+	parts := strings.Split(jwe, ".")
+	b, err := json.Marshal(tangJWE{Protected: parts[0], IV: parts[2], Ciphertext: parts[3], Tag: parts[4]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTangSecretErrors(t *testing.T) {
+	var seen []tangJWK
+	srv, server := newTangServer(t, &seen)
+	jwe, _ := clevisEncrypt(t, srv.URL, server, []byte("hunter2"))
+	parts := strings.Split(jwe, ".")
+
+	// A server whose key isn't the one the secret was encrypted to:
+	wrong := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var x tangJWK
+		json.NewDecoder(r.Body).Decode(&x)
+		curve, xx, xy, _ := x.point()
+		yx, yy := curve.ScalarMult(xx, xy, []byte{42})
+		json.NewEncoder(w).Encode(newTangJWK(curve, yx, yy))
+	}))
+	defer wrong.Close()
+	wrongKey, _ := clevisEncrypt(t, wrong.URL, server, []byte("hunter2"))
+	notFound, _ := clevisEncrypt(t, srv.URL+"/elsewhere", server, []byte("hunter2"))
+	down, _ := clevisEncrypt(t, "http://127.0.0.1:1", server, []byte("hunter2"))
+
+	tampered := []byte(parts[3])
+	tampered[0] ^= 1
+	for name, data := range map[string]string{
+		"garbage":          "not a jwe",
+		"tampered":         strings.Join([]string{parts[0], "", parts[2], string(tampered), parts[4]}, "."),
+		"unknown kid":      strings.Replace(jwe, parts[0], rewriteTangKid(t, parts[0], "nope"), 1),
+		"server down":      down,
+		"wrong server key": wrongKey,
+		"server 404s":      notFound,
+		"not the tang pin": strings.Replace(jwe, parts[0], base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"dir","clevis":{"pin":"sss"}}`)), 1),
+	} {
+		if got, err := tangSecret(context.Background(), writeTempFile(t, "data.jwe", data), Prompt{}); err == nil {
+			t.Errorf("%s: got %q", name, got)
+		}
+	}
+}
+
+// rewriteTangKid changes the kid in the protected header.
+func rewriteTangKid(t *testing.T, protected, kid string) string {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h tangHeader
+	if err := json.Unmarshal(b, &h); err != nil {
+		t.Fatal(err)
+	}
+	h.Kid = kid
+	if b, err = json.Marshal(h); err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// TestConcatKDF checks the example in RFC 7518 appendix C.
+func TestConcatKDF(t *testing.T) {
+	z := []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132, 38, 156, 251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121, 140, 254, 144, 196}
+	got := concatKDF(z, "A128GCM", []byte("Alice"), []byte("Bob"), 16)
+	if want, _ := base64.RawURLEncoding.DecodeString("VqqN6vgjbSBcIijNcacQGg"); !bytes.Equal(got, want) {
+		t.Errorf("concatKDF = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+// A Telegram bot, which notifies chats of new prompts, and optionally
+// accepts answers as replies, for when the web interface can't be reached.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const telegramAPI = "https://api.telegram.org/bot"
+
+// Telegram sends notifications to allowlisted chats through the Bot API.
+type Telegram struct {
+	Chats  []int64 // allowed to receive notifications, and to answer
+	Answer bool    // accept answers as replies to notifications
+
+	token   string
+	mu      sync.Mutex
+	sent    map[telegramMessage]sentPrompt
+	renamed map[string]sentPrompt // by the name of a prompt that was asked again
+}
+
+type telegramMessage struct {
+	Chat, ID int64
+}
+
+type sentPrompt struct {
+	Name string
+	Time time.Time
+}
+
+// NewTelegram returns a Telegram for the bot with the token in tokenFile,
+// and the comma-separated chat IDs.
+func NewTelegram(tokenFile, chats string, answer bool) (*Telegram, error) {
+	if tokenFile == "" {
+		return nil, errors.New("telegram: a bot token is required")
+	}
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	t := &Telegram{
+		Answer:  answer,
+		token:   strings.TrimSpace(string(b)),
+		sent:    make(map[telegramMessage]sentPrompt),
+		renamed: make(map[string]sentPrompt),
+	}
+	for _, s := range strings.Split(chats, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("telegram: invalid chat ID %q", s)
+		}
+		t.Chats = append(t.Chats, id)
+	}
+	return t, nil
+}
+
+// call calls a Bot API method, decoding the result into v, if not nil.
+func (t *Telegram) call(ctx context.Context, method string, params, v any) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPI+t.token+"/"+method, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The URL includes the token, so don't let it into the logs:
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("telegram: %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("telegram: %s: %s", method, resp.Status)
+	}
+	if !res.OK {
+		return fmt.Errorf("telegram: %s: %s", method, res.Description)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, v)
+}
+
+func (t *Telegram) Notify(ctx context.Context, n Notification) error {
+	text := n.Title + "\n\n" + n.Message
+	params := make(map[string]any)
+	if t.Answer {
+		text += "\n\n" + BotInstructions()
+		params["reply_markup"] = map[string]any{"force_reply": true, "input_field_placeholder": "Answer"}
+	} else if n.URL > "" {
+		params["reply_markup"] = map[string]any{
+			"inline_keyboard": [][]map[string]string{{{"text": "Answer", "url": n.URL}}},
+		}
+	}
+	params["text"] = text
+
+	var errs []error
+	for _, chat := range t.Chats {
+		params["chat_id"] = chat
+		var msg struct {
+			MessageID int64 `json:"message_id"`
+		}
+		if err := t.call(ctx, "sendMessage", params, &msg); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		t.mu.Lock()
+		now := time.Now()
+		for m, p := range t.sent {
+			if now.Sub(p.Time) > 48*time.Hour {
+				delete(t.sent, m)
+			}
+		}
+		for name, p := range t.renamed {
+			if now.Sub(p.Time) > 48*time.Hour {
+				delete(t.renamed, name)
+			}
+		}
+		t.sent[telegramMessage{chat, msg.MessageID}] = sentPrompt{n.Prompt.Name, now}
+		t.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Follow takes replies to the notification of prompt from as answers to
+// prompt to, which asks the same question again.
+func (t *Telegram) Follow(from, to string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.renamed[from] = sentPrompt{to, time.Now()}
+}
+
+// latest returns the name of the prompt that last asked the question that
+// the named prompt did. t.mu must be held.
+func (t *Telegram) latest(name string) string { return latestPrompt(t.renamed, name) }
+
+// latestPrompt follows renamed from the named prompt to the one that last
+// asked the same question.
+func latestPrompt(renamed map[string]sentPrompt, name string) string {
+	// Each prompt is only asked again once, but don't trust that:
+	for i := 0; i < len(renamed); i++ {
+		next, ok := renamed[name]
+		if !ok {
+			break
+		}
+		name = next.Name
+	}
+	return name
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		MessageID int64 `json:"message_id"`
+		From      *struct {
+			ID       int64  `json:"id"`
+			Username string `json:"username"`
+		} `json:"from"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text           string `json:"text"`
+		ReplyToMessage *struct {
+			MessageID int64 `json:"message_id"`
+		} `json:"reply_to_message"`
+	} `json:"message"`
+}
+
+// Poll receives replies to notifications with long polling, and answers
+// their prompts, until ctx is done. Replies are deleted once read, so that
+// the answer doesn't stay in the chat history.
+func (t *Telegram) Poll(ctx context.Context) {
+	var offset int64
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := t.call(ctx, "getUpdates", map[string]any{
+			"offset":          offset,
+			"timeout":         50,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			slog.Warn("Receiving Telegram messages", "err", err)
+			select {
+			case <-time.After(10 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil && u.Message.ReplyToMessage != nil {
+				t.reply(ctx, u)
+			}
+		}
+	}
+}
+
+func (t *Telegram) reply(ctx context.Context, u telegramUpdate) {
+	m := u.Message
+	t.mu.Lock()
+	p, ok := t.sent[telegramMessage{m.Chat.ID, m.ReplyToMessage.MessageID}]
+	p.Name = t.latest(p.Name)
+	t.mu.Unlock()
+	if !ok {
+		return // not a reply to a notification, or from another chat
+	}
+	if err := t.call(ctx, "deleteMessage", map[string]any{"chat_id": m.Chat.ID, "message_id": m.MessageID}, nil); err != nil {
+		slog.Warn("Deleting Telegram message with answer", "chat", m.Chat.ID, "err", err)
+	}
+
+	user := "telegram:" + strconv.FormatInt(m.Chat.ID, 10)
+	if m.From != nil {
+		user = "telegram:" + strconv.FormatInt(m.From.ID, 10)
+		if m.From.Username != "" {
+			user = "telegram:@" + m.From.Username
+		}
+	}
+	r := BotRequest(ctx, "telegram/"+strconv.FormatInt(m.Chat.ID, 10), user)
+	pending, err := BotAnswer(r, p.Name, m.Text)
+	if err := t.call(ctx, "sendMessage", map[string]any{
+		"chat_id":          m.Chat.ID,
+		"text":             BotResult(pending, err),
+		"reply_parameters": map[string]any{"message_id": m.ReplyToMessage.MessageID},
+	}, nil); err != nil {
+		slog.Warn("Sending Telegram message", "chat", m.Chat.ID, "err", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+// Replacing the web pages and their assets with those in -templates-dir, to
+// rebrand or restructure them without rebuilding the binary, such as the
+// one in the initramfs.
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Templates are the web pages, and the static assets they use.
+type Templates struct {
+	Index  Localized
+	Login  Localized
+	QR     Localized
+	Assets map[string]asset
+}
+
+// builtinTemplates are used unless -templates-dir replaces them.
+var builtinTemplates = func() *Templates {
+	t, err := LoadTemplates("")
+	if err != nil {
+		panic(err)
+	}
+	return t
+}()
+
+// LoadTemplates reads index.html, login.html and qr.html from dir, in place
+// of the built-in templates, and adds the files in dir/static to the static
+// assets, replacing those with the same name, such as style.css. Templates
+// and assets that aren't there are built in, as all are if dir is "".
+func LoadTemplates(dir string) (*Templates, error) {
+	// Only what's in it is optional:
+	if dir > "" {
+		if _, err := os.ReadDir(dir); err != nil {
+			return nil, fmt.Errorf("-templates-dir: %w", err)
+		}
+	}
+	t := &Templates{}
+	var err error
+	if t.Index, err = loadTemplate(dir, "index.html", indexHTML, indexFuncs); err != nil {
+		return nil, err
+	}
+	if t.Login, err = loadTemplate(dir, "login.html", loginHTML, nil); err != nil {
+		return nil, err
+	}
+	if t.QR, err = loadTemplate(dir, "qr.html", qrHTML, nil); err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]asset)
+	var entries []fs.DirEntry
+	if dir > "" {
+		entries, err = os.ReadDir(filepath.Join(dir, "static"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("-templates-dir: %w", err)
+		}
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "static", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("-templates-dir: %w", err)
+		}
+		path := "/" + entry.Name()
+		contentType := assets[path].contentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(path))
+		}
+		if contentType == "" {
+			contentType = http.DetectContentType(b)
+		}
+		overrides[path] = asset{contentType, b}
+	}
+	t.Assets = NewAssets(overrides)
+	return t, nil
+}
+
+// loadTemplate parses the named template from dir, or else the built-in
+// text.
+func loadTemplate(dir, name, builtin string, funcs template.FuncMap) (Localized, error) {
+	text := builtin
+	if dir > "" {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		switch {
+		case err == nil:
+			text = string(b)
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, fmt.Errorf("-templates-dir: %w", err)
+		}
+	}
+	t, err := ParseLocalized(name, text, funcs)
+	if err != nil {
+		return nil, fmt.Errorf("-templates-dir: %w", err)
+	}
+	return t, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // for time zones in the initramfs, which lacks them
+)
+
+// timeWindow is a period of each week, such as Mon-Fri 09:00-17:00, or a
+// one-off period, such as 2024-06-01T22:00/2024-06-02T02:00.
+type timeWindow struct {
+	days       [7]bool // by time.Weekday
+	start, end int     // minutes since midnight; if end <= start, it spans midnight
+
+	from, until time.Time // if it's a one-off
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseTimeWindow parses a period of each week, as days, times or both:
+// Mon-Fri, Sat,Sun, 22:00-06:00 or Mon-Fri 09:00-17:00; or a one-off period
+// between two dates and times, as 2024-06-01T22:00/2024-06-02T02:00. Times
+// without a zone are in loc.
+func parseTimeWindow(s string, loc *time.Location) (timeWindow, error) {
+	var w timeWindow
+	if from, until, ok := strings.Cut(s, "/"); ok {
+		var err error
+		if w.from, err = parseWindowTime(from, loc); err != nil {
+			return w, err
+		}
+		if w.until, err = parseWindowTime(until, loc); err != nil {
+			return w, err
+		}
+		if !w.until.After(w.from) {
+			return w, fmt.Errorf("time window %q ends before it starts", s)
+		}
+		return w, nil
+	}
+
+	days, times := "", ""
+	switch f := strings.Fields(s); {
+	case len(f) == 2:
+		days, times = f[0], f[1]
+	case len(f) == 1 && strings.Contains(f[0], ":"):
+		times = f[0]
+	case len(f) == 1:
+		days = f[0]
+	default:
+		return w, fmt.Errorf("invalid time window %q", s)
+	}
+	if days == "" {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, d := range strings.Split(days, ",") {
+		if d == "" {
+			continue
+		}
+		first, last, _ := strings.Cut(d, "-")
+		if last == "" {
+			last = first
+		}
+		from, ok1 := weekdays[strings.ToLower(first)[:min(3, len(first))]]
+		to, ok2 := weekdays[strings.ToLower(last)[:min(3, len(last))]]
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("invalid days %q in time window %q", d, s)
+		}
+		// Ranges may wrap around the end of the week, as Fri-Mon:
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	w.start, w.end = 0, 24*60
+	if times > "" {
+		start, end, ok := strings.Cut(times, "-")
+		var err1, err2 error
+		w.start, err1 = parseClock(start)
+		w.end, err2 = parseClock(end)
+		if !ok || err1 != nil || err2 != nil {
+			return w, fmt.Errorf("invalid times %q in time window %q", times, s)
+		}
+	}
+	return w, nil
+}
+
+// parseWindowTime parses a date and time, with or without seconds or a
+// zone.
+func parseWindowTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date and time %q", s)
+}
+
+// parseClock parses a time of day, such as 09:00 or 24:00, as minutes since
+// midnight.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, errors.New("out of range")
+	}
+	return h*60 + m, nil
+}
+
+// Contains reports whether t is within the window.
+func (w timeWindow) Contains(t time.Time) bool {
+	if !w.from.IsZero() {
+		return !t.Before(w.from) && t.Before(w.until)
+	}
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && m >= w.start && m < w.end
+	}
+	// Spanning midnight, it belongs to the day it starts on:
+	return w.days[day] && m >= w.start || w.days[(day+6)%7] && m < w.end
+}
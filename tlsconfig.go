@@ -0,0 +1,75 @@
+package main
+
+// TLS settings, for tightening the library defaults.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var versionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curveNames = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// TLSSettings are applied to the TLS config of every connection.
+type TLSSettings struct {
+	MinVersion       uint16
+	CipherSuites     []uint16      // nil for the library defaults
+	CurvePreferences []tls.CurveID // nil for the library defaults
+}
+
+// ParseTLSSettings parses a minimum version such as 1.2, and comma-separated
+// lists of cipher suite names, as listed by tls.CipherSuites, and curve
+// names, such as X25519 or P-256. Empty lists leave the library defaults.
+// Cipher suites only apply to TLS 1.2 and earlier.
+func ParseTLSSettings(minVersion, ciphers, curves string) (TLSSettings, error) {
+	var t TLSSettings
+	var ok bool
+	if t.MinVersion, ok = versionNames[minVersion]; !ok {
+		return t, fmt.Errorf("-tls-min-version: unknown version %q", minVersion)
+	}
+
+	suites := make(map[string]*tls.CipherSuite)
+	for _, c := range tls.CipherSuites() {
+		suites[c.Name] = c
+	}
+	for _, name := range splitList(ciphers) {
+		c, ok := suites[name]
+		if !ok {
+			return t, fmt.Errorf("-tls-ciphers: unknown or insecure cipher suite %q", name)
+		}
+		// Go always uses its own choice of them:
+		if !slices.ContainsFunc(c.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return t, fmt.Errorf("-tls-ciphers: TLS 1.3 cipher suites, such as %s, can't be configured", name)
+		}
+		t.CipherSuites = append(t.CipherSuites, c.ID)
+	}
+
+	for _, name := range splitList(curves) {
+		id, ok := curveNames[strings.ReplaceAll(strings.ToLower(name), "-", "")]
+		if !ok {
+			return t, fmt.Errorf("-tls-curves: unknown curve %q", name)
+		}
+		t.CurvePreferences = append(t.CurvePreferences, id)
+	}
+	return t, nil
+}
+
+// Apply sets the settings on cfg.
+func (t TLSSettings) Apply(cfg *tls.Config) {
+	cfg.MinVersion = t.MinVersion
+	cfg.CipherSuites = t.CipherSuites
+	cfg.CurvePreferences = t.CurvePreferences
+}
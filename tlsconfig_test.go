@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+func TestParseTLSSettings(t *testing.T) {
+	s, err := ParseTLSSettings("1.2", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", "X25519,P-256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.MinVersion != tls.VersionTLS12 ||
+		!slices.Equal(s.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}) ||
+		!slices.Equal(s.CurvePreferences, []tls.CurveID{tls.X25519, tls.CurveP256}) {
+		t.Errorf("ParseTLSSettings = %+v", s)
+	}
+
+	if s, err := ParseTLSSettings("1.3", "", ""); err != nil || s.CipherSuites != nil || s.CurvePreferences != nil {
+		t.Errorf("defaults: %+v, %v", s, err)
+	}
+
+	for _, tt := range []struct{ what, minVersion, ciphers, curves string }{
+		{"unknown version", "1.4", "", ""},
+		{"unknown cipher suite", "1.2", "TLS_MADE_UP", ""},
+		{"insecure cipher suite", "1.2", "TLS_RSA_WITH_RC4_128_SHA", ""},
+		{"TLS 1.3 cipher suite", "1.2", "TLS_AES_128_GCM_SHA256", ""},
+		{"TLS 1.3 among others", "1.2", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,TLS_CHACHA20_POLY1305_SHA256", ""},
+		{"unknown curve", "1.2", "", "P-192"},
+	} {
+		if s, err := ParseTLSSettings(tt.minVersion, tt.ciphers, tt.curves); err == nil {
+			t.Errorf("%s: ParseTLSSettings = %+v", tt.what, s)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the test vectors in RFC 6238
+// appendix B, "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	totp, err := LoadTOTP(writeTempFile(t, "totp", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last six of the eight digits in RFC 6238:
+	for _, tt := range []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if got := totp.code(tt.time / 30); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestLoadTOTP(t *testing.T) {
+	for name, data := range map[string]string{
+		"base32":        rfc6238Secret + "\n",
+		"lower case":    "gezd gnbv gy3t qojq gezd gnbv gy3t qojq",
+		"padded":        "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ====",
+		"otpauth":       "otpauth://totp/askpass:root?secret=" + rfc6238Secret + "&issuer=askpass",
+		"with newlines": "\n" + rfc6238Secret + "\n\n",
+	} {
+		totp, err := LoadTOTP(writeTempFile(t, "totp", data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got := totp.code(1); got != "287082" {
+			t.Errorf("%s: code = %s, want 287082", name, got)
+		}
+	}
+	for name, data := range map[string]string{
+		"empty":            "",
+		"not base32":       "not base32!",
+		"otpauth, none":    "otpauth://totp/askpass:root?issuer=askpass",
+		"otpauth, invalid": "otpauth://totp/askpass:root?secret=1",
+	} {
+		if _, err := LoadTOTP(writeTempFile(t, "totp", data)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+	if _, err := LoadTOTP(t.TempDir() + "/missing"); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	totp, err := LoadTOTP(writeTempFile(t, "totp", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix() / 30
+
+	for _, code := range []string{"", "000000x", totp.code(now - 2), totp.code(now + 2), "12345"} {
+		if err := totp.Verify(code); !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("Verify(%q) = %v, want ErrInvalidCode", code, err)
+		}
+	}
+	// The previous period's code is accepted, for clock skew and slow
+	// typists:
+	if err := totp.Verify(" " + totp.code(now-1) + "\n"); err != nil {
+		t.Errorf("Verify(previous code) = %v", err)
+	}
+	if err := totp.Verify(totp.code(now)); err != nil {
+		t.Errorf("Verify(current code) = %v", err)
+	}
+	// Codes can't be replayed, nor earlier ones used once a later one has:
+	if err := totp.Verify(totp.code(now)); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Verify(replayed code) = %v, want ErrInvalidCode", err)
+	}
+	if err := totp.Verify(totp.code(now - 1)); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Verify(earlier code) = %v, want ErrInvalidCode", err)
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	useTestSite(t, &Site{})
+	r := httptest.NewRequest("POST", "/", nil)
+
+	if err := CheckTOTP(r, ""); err != nil {
+		t.Errorf("CheckTOTP without TOTP = %v", err)
+	}
+
+	totp, err := LoadTOTP(writeTempFile(t, "totp", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestSite(t, &Site{TOTP: totp})
+	if err := CheckTOTP(r, ""); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("CheckTOTP(\"\") = %v, want ErrInvalidCode", err)
+	}
+	if err := CheckTOTP(r, totp.code(time.Now().Unix()/30)); err != nil {
+		t.Errorf("CheckTOTP(current code) = %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+// Keys and secrets in the TPM.
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// openTPM opens -tpm-device.
+var openTPM = func() (io.ReadWriteCloser, error) {
+	return tpm2.OpenTPM(*tpmDevice)
+}
+
+// TPMKey is a signing key that has been made persistent in the TPM, such as
+// with tpm2_evictcontrol. It implements crypto.Signer.
+type TPMKey struct {
+	mu     sync.Mutex
+	rw     io.ReadWriteCloser
+	handle tpmutil.Handle
+	pub    crypto.PublicKey
+}
+
+// OpenTPMKey opens the key at a persistent handle, given as tpm:HANDLE,
+// using -tpm-device.
+func OpenTPMKey(uri string) (*TPMKey, error) {
+	h, err := strconv.ParseUint(strings.TrimPrefix(uri, "tpm:"), 0, 32)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := openTPM()
+	if err != nil {
+		return nil, err
+	}
+	k := &TPMKey{rw: rw, handle: tpmutil.Handle(h)}
+	pub, _, _, err := tpm2.ReadPublic(rw, k.handle)
+	if err == nil {
+		k.pub, err = pub.Key()
+	}
+	if err != nil {
+		rw.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *TPMKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *TPMKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := tpm2.HashToAlgorithm(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	scheme := &tpm2.SigScheme{Hash: hash}
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		scheme.Alg = tpm2.AlgECDSA
+	case *rsa.PublicKey:
+		scheme.Alg = tpm2.AlgRSASSA
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme.Alg = tpm2.AlgRSAPSS
+		}
+	default:
+		return nil, errors.New("tpm: unsupported key type")
+	}
+
+	k.mu.Lock()
+	sig, err := tpm2.Sign(k.rw, k.handle, "", digest, nil, scheme)
+	k.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if sig.ECC != nil {
+		return asn1.Marshal(struct{ R, S *big.Int }{sig.ECC.R, sig.ECC.S})
+	}
+	return sig.RSA.Signature, nil
+}
+
+// tpmSecret unseals a secret sealed to the TPM, such as with tpm2_create,
+// and made persistent with tpm2_evictcontrol, given as HANDLE, or
+// HANDLE?pcrs=0+7 if it's sealed with a policy on those PCRs, in the
+// sha256 bank unless bank=sha1 is also given. If the PCRs don't have the
+// values it was sealed with, such as after booting something else,
+// unsealing fails.
+func tpmSecret(_ context.Context, ref string, _ Prompt) ([]byte, error) {
+	handle, query, _ := strings.Cut(ref, "?")
+	h, err := strconv.ParseUint(handle, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: %w", err)
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: %w", err)
+	}
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256}
+	switch bank := q.Get("bank"); bank {
+	case "", "sha256":
+	case "sha1":
+		sel.Hash = tpm2.AlgSHA1
+	default:
+		return nil, fmt.Errorf("tpm: unsupported PCR bank %q", bank)
+	}
+	if pcrs := q.Get("pcrs"); pcrs > "" {
+		// ParseQuery has already turned + into a space:
+		for _, s := range strings.FieldsFunc(pcrs, func(r rune) bool { return r == ' ' || r == ',' }) {
+			pcr, err := strconv.Atoi(s)
+			if err != nil || pcr < 0 || pcr > 23 {
+				return nil, fmt.Errorf("tpm: invalid PCR %q", s)
+			}
+			sel.PCRs = append(sel.PCRs, pcr)
+		}
+	}
+
+	rw, err := openTPM()
+	if err != nil {
+		return nil, fmt.Errorf("tpm: %w", err)
+	}
+	defer rw.Close()
+	if len(sel.PCRs) == 0 {
+		b, err := tpm2.Unseal(rw, tpmutil.Handle(h), "")
+		if err != nil {
+			return nil, fmt.Errorf("tpm: unsealing %s: %w", handle, err)
+		}
+		return b, nil
+	}
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull,
+		make([]byte, 16), nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: %w", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+	if err := tpm2.PolicyPCR(rw, session, nil, sel); err != nil {
+		return nil, fmt.Errorf("tpm: %w", err)
+	}
+	b, err := tpm2.UnsealWithSession(rw, session, tpmutil.Handle(h), "")
+	if err != nil {
+		return nil, fmt.Errorf("tpm: unsealing %s: %w", handle, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,210 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// useTestTPM points openTPM at a simulator, which is reset afterwards.
+func useTestTPM(t *testing.T) io.ReadWriter {
+	t.Helper()
+	sim, err := simulator.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := openTPM
+	openTPM = func() (io.ReadWriteCloser, error) {
+		return struct {
+			io.ReadWriter
+			io.Closer
+		}{sim, io.NopCloser(nil)}, nil
+	}
+	t.Cleanup(func() {
+		openTPM = old
+		sim.Close()
+	})
+	return sim
+}
+
+// persist makes the loaded object persistent at the handle, as
+// tpm2_evictcontrol does.
+func persist(t *testing.T, rw io.ReadWriter, object, handle tpmutil.Handle) {
+	t.Helper()
+	if err := tpm2.EvictControl(rw, "", tpm2.HandleOwner, object, handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpm2.FlushContext(rw, object); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seal seals the secret, as tpm2_create does, with the policy if given,
+// and makes it persistent at the handle.
+func seal(t *testing.T, rw io.ReadWriter, handle tpmutil.Handle, secret []byte, policy []byte) {
+	t.Helper()
+	srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", tpm2.Public{
+		Type:    tpm2.AlgECC,
+		NameAlg: tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+			tpm2.FlagUserWithAuth | tpm2.FlagRestricted | tpm2.FlagDecrypt | tpm2.FlagNoDA,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			CurveID:   tpm2.CurveNISTP256,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm2.FlushContext(rw, srk)
+	attrs := tpm2.FlagFixedTPM | tpm2.FlagFixedParent
+	if policy == nil {
+		attrs |= tpm2.FlagUserWithAuth
+	}
+	private, public, _, _, _, err := tpm2.CreateKeyWithSensitive(rw, srk, tpm2.PCRSelection{}, "", "", tpm2.Public{
+		Type:                tpm2.AlgKeyedHash,
+		NameAlg:             tpm2.AlgSHA256,
+		Attributes:          attrs,
+		AuthPolicy:          policy,
+		KeyedHashParameters: &tpm2.KeyedHashParams{Alg: tpm2.AlgNull},
+	}, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, _, err := tpm2.Load(rw, srk, "", public, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	persist(t, rw, object, handle)
+}
+
+// pcrPolicy returns the digest of a policy on the PCRs' current values.
+func pcrPolicy(t *testing.T, rw io.ReadWriter, sel tpm2.PCRSelection) []byte {
+	t.Helper()
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull,
+		make([]byte, 16), nil, tpm2.SessionTrial, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm2.FlushContext(rw, session)
+	if err := tpm2.PolicyPCR(rw, session, nil, sel); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := tpm2.PolicyGetDigest(rw, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestTPMSecret(t *testing.T) {
+	rw := useTestTPM(t)
+	seal(t, rw, 0x81000001, []byte("hunter2"), nil)
+	seal(t, rw, 0x81000002, []byte("correct horse"), pcrPolicy(t, rw, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{0, 7}}))
+	seal(t, rw, 0x81000003, []byte("battery staple"), pcrPolicy(t, rw, tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: []int{7}}))
+
+	for ref, want := range map[string]string{
+		"0x81000001":                      "hunter2",
+		"0x81000002?pcrs=0+7":             "correct horse",
+		"0x81000002?pcrs=0,7&bank=sha256": "correct horse",
+		"0x81000003?pcrs=7&bank=sha1":     "battery staple",
+		"2164260865":                      "hunter2",
+	} {
+		got, err := tpmSecret(context.Background(), ref, Prompt{})
+		if err != nil {
+			t.Errorf("%s: %v", ref, err)
+		} else if string(got) != want {
+			t.Errorf("%s = %q, want %q", ref, got, want)
+		}
+	}
+
+	for _, ref := range []string{
+		"0x81000002",             // without the policy
+		"0x81000002?pcrs=7",      // with the wrong one
+		"0x81000009",             // nothing there
+		"0x81000001?bank=sha512", // unsupported
+		"0x81000001?pcrs=24",
+		"handle",
+	} {
+		if got, err := tpmSecret(context.Background(), ref, Prompt{}); err == nil {
+			t.Errorf("%s = %q, want an error", ref, got)
+		}
+	}
+
+	// After booting something else:
+	if err := tpm2.PCRExtend(rw, 7, tpm2.AlgSHA256, make([]byte, sha256.Size), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tpmSecret(context.Background(), "0x81000002?pcrs=0+7", Prompt{}); err == nil {
+		t.Errorf("unsealed %q after PCR 7 changed", got)
+	}
+}
+
+func TestTPMKey(t *testing.T) {
+	rw := useTestTPM(t)
+	attrs := tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagSign
+	for handle, template := range map[tpmutil.Handle]tpm2.Public{
+		0x81000010: {
+			Type: tpm2.AlgECC, NameAlg: tpm2.AlgSHA256, Attributes: attrs,
+			ECCParameters: &tpm2.ECCParams{CurveID: tpm2.CurveNISTP256},
+		},
+		0x81000011: {
+			Type: tpm2.AlgRSA, NameAlg: tpm2.AlgSHA256, Attributes: attrs,
+			RSAParameters: &tpm2.RSAParams{KeyBits: 2048},
+		},
+	} {
+		object, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		persist(t, rw, object, handle)
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	ec, err := OpenTPMKey("tpm:0x81000010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ec.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := ec.Public().(*ecdsa.PublicKey); !ok || !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Errorf("ECDSA signature doesn't verify with %T", ec.Public())
+	}
+
+	r, err := OpenTPMKey("tpm:0x81000011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, ok := r.Public().(*rsa.PublicKey)
+	if !ok {
+		t.Fatalf("public key is %T", r.Public())
+	}
+	if sig, err := r.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Error(err)
+	} else if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("PKCS #1 v1.5: %v", err)
+	}
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}
+	if sig, err := r.Sign(rand.Reader, digest[:], pss); err != nil {
+		t.Error(err)
+	} else if err := rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, pss); err != nil {
+		t.Errorf("PSS: %v", err)
+	}
+
+	if _, err := OpenTPMKey("tpm:0x81000019"); err == nil {
+		t.Error("opened a key that isn't there")
+	}
+}
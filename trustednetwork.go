@@ -0,0 +1,49 @@
+package main
+
+// Whether this machine is on a trusted network, such as the office's, so
+// that rules can answer prompts there, and leave them for someone elsewhere.
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+// beaconTimeout is how long to wait to reach a rule's beacon.
+const beaconTimeout = 3 * time.Second
+
+// onNetwork reports whether this machine has an address in one of the
+// prefixes.
+func onNetwork(prefixes []netip.Prefix) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok {
+			continue
+		}
+		for _, p := range prefixes {
+			if p.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reachable reports whether a TCP connection can be made to the beacon, a
+// host and port, within beaconTimeout.
+func reachable(beacon string) bool {
+	conn, err := net.DialTimeout("tcp", beacon, beaconTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+// Outbound tunnels to a relay, for when nothing can connect in to the
+// machine being unlocked, such as behind NAT or a firewall we don't control.
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+// tunnelAddr is the address of a tunnel: the URL of its relay.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// TunnelListener accepts connections through a WebSocket to a relay. The
+// WebSocket carries a yamux session, on which the relay opens a stream for
+// each connection it receives.
+//
+// The relay is dialled on the first Accept, and redialled whenever the
+// WebSocket is lost, so that the network may come up after we start.
+type TunnelListener struct {
+	url   string
+	token string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	sess   *yamux.Session
+}
+
+// NewTunnelListener returns a listener for the relay at a ws:// or wss://
+// URL. If -tunnel-token-file is set, its contents are sent to the relay as a
+// bearer token.
+func NewTunnelListener(url string) (*TunnelListener, error) {
+	l := &TunnelListener{url: url}
+	if *tunnelTokenFile > "" {
+		b, err := os.ReadFile(*tunnelTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		l.token = strings.TrimSpace(string(b))
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l, nil
+}
+
+func (l *TunnelListener) Addr() net.Addr { return tunnelAddr(l.url) }
+
+func (l *TunnelListener) Close() error {
+	l.cancel()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sess != nil {
+		return l.sess.Close()
+	}
+	return nil
+}
+
+func (l *TunnelListener) Accept() (net.Conn, error) {
+	backoff := time.Second
+	for {
+		sess, err := l.session()
+		if err == nil {
+			var conn net.Conn
+			if conn, err = sess.Accept(); err == nil {
+				return tunnelConn{conn, tunnelAddr(l.url)}, nil
+			}
+			l.mu.Lock()
+			if l.sess == sess {
+				l.sess = nil
+			}
+			l.mu.Unlock()
+		}
+		if l.ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+		slog.Warn("Tunnel disconnected, retrying", "url", l.url, "err", err, "after", backoff)
+		select {
+		case <-l.ctx.Done():
+			return nil, net.ErrClosed
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// session returns the current yamux session, dialling the relay if there
+// isn't one.
+func (l *TunnelListener) session() (*yamux.Session, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sess != nil && !l.sess.IsClosed() {
+		return l.sess, nil
+	}
+	opts := &websocket.DialOptions{HTTPHeader: make(http.Header)}
+	if l.token > "" {
+		opts.HTTPHeader.Set("Authorization", "Bearer "+l.token)
+	}
+	ctx, cancel := context.WithTimeout(l.ctx, 30*time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, l.url, opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = io.Discard
+	sess, err := yamux.Server(websocket.NetConn(l.ctx, ws, websocket.MessageBinary), cfg)
+	if err != nil {
+		ws.CloseNow()
+		return nil, err
+	}
+	slog.Info("Tunnel connected", "url", l.url)
+	l.sess = sess
+	return sess, nil
+}
+
+// tunnelConn is a stream from the relay. Its remote address is the relay's
+// URL, until the PROXY protocol header the relay begins it with is read (see
+// -listen proxy=on).
+type tunnelConn struct {
+	net.Conn
+	addr tunnelAddr
+}
+
+func (c tunnelConn) RemoteAddr() net.Addr { return c.addr }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestTunnelRequiresProxy(t *testing.T) {
+	useTestSite(t, &Site{})
+	if _, err := OpenListeners([]string{"wss://relay.example.com/askpass"}); err == nil {
+		t.Error("opened a tunnel without proxy=on")
+	}
+	lsns, err := OpenListeners([]string{"wss://relay.example.com/askpass?proxy=on"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsns[0].Close()
+
+	// Every stream must say whose it is, and only the relay can:
+	for upstream, want := range map[net.Addr]proxyproto.Policy{
+		lsns[0].Addr():                           proxyproto.REQUIRE,
+		&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}: proxyproto.REJECT,
+	} {
+		if got, err := ProxyProtocolPolicy(upstream); err != nil || got != want {
+			t.Errorf("ProxyProtocolPolicy(%s) = %v, %v; want %v", upstream, got, err, want)
+		}
+	}
+}
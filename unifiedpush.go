@@ -0,0 +1,59 @@
+package main
+
+// UnifiedPush (https://unifiedpush.org), for phones without Google's push
+// service. The distributor on the phone, such as ntfy, gives each app an
+// endpoint URL, which messages are POSTed to.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// UnifiedPush sends notifications to UnifiedPush endpoints.
+type UnifiedPush struct {
+	Endpoints []string
+}
+
+// NewUnifiedPush returns a UnifiedPush for the endpoints.
+func NewUnifiedPush(endpoints []string) (*UnifiedPush, error) {
+	for _, e := range endpoints {
+		if !strings.HasPrefix(e, "https://") && !strings.HasPrefix(e, "http://") {
+			return nil, fmt.Errorf("unifiedpush: %q is not an http:// or https:// URL", e)
+		}
+	}
+	return &UnifiedPush{Endpoints: endpoints}, nil
+}
+
+func (u *UnifiedPush) Notify(ctx context.Context, n Notification) error {
+	b, err := pushPayload(n) // the same as for Web Push
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range u.Endpoints {
+		if err := u.send(ctx, e, b); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (u *UnifiedPush) send(ctx context.Context, endpoint string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("TTL", "3600")
+	req.Header.Set("Urgency", "high")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return ResponseError(resp)
+}
@@ -0,0 +1,180 @@
+package main
+
+// Unix domain socket listeners, with authorization by peer credentials.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type peerCredKey struct{}
+
+// ListenUnix listens on a unix domain socket at path, replacing any stale
+// socket left behind, with the ownership and permissions given by the flags.
+func ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		os.Remove(path)
+	}
+	lsn, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupUnixSocket(path); err != nil {
+		lsn.Close()
+		return nil, err
+	}
+	return lsn, nil
+}
+
+func setupUnixSocket(path string) error {
+	mode, err := strconv.ParseUint(*unixMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("-unix-mode: %w", err)
+	}
+	uid, gid := -1, -1
+	if *unixOwner > "" {
+		if uid, err = lookupUID(*unixOwner); err != nil {
+			return fmt.Errorf("-unix-owner: %w", err)
+		}
+	}
+	if *unixGroup > "" {
+		if gid, err = lookupGID(*unixGroup); err != nil {
+			return fmt.Errorf("-unix-group: %w", err)
+		}
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, fs.FileMode(mode))
+}
+
+// lookupUID accepts either a user name or a numeric UID.
+func lookupUID(s string) (int, error) {
+	if uid, err := strconv.Atoi(s); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID accepts either a group name or a numeric GID.
+func lookupGID(s string) (int, error) {
+	if gid, err := strconv.Atoi(s); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// PeerCredContext is a http.Server ConnContext func that records the
+// credentials of the process at the other end of a unix domain socket.
+func PeerCredContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// PeerCred returns the credentials of the peer, or nil if the request didn't
+// arrive over a unix domain socket.
+func PeerCred(r *http.Request) *syscall.Ucred {
+	cred, _ := r.Context().Value(peerCredKey{}).(*syscall.Ucred)
+	return cred
+}
+
+// PeerCreds is an allowlist of UIDs and GIDs.
+type PeerCreds struct {
+	UIDs []uint32
+	GIDs []uint32
+}
+
+// ParsePeerCreds parses comma-separated lists of users and groups, which may
+// be names or numbers.
+func ParsePeerCreds(users, groups string) (*PeerCreds, error) {
+	var p PeerCreds
+	for _, s := range splitList(users) {
+		uid, err := lookupUID(s)
+		if err != nil {
+			return nil, err
+		}
+		p.UIDs = append(p.UIDs, uint32(uid))
+	}
+	for _, s := range splitList(groups) {
+		gid, err := lookupGID(s)
+		if err != nil {
+			return nil, err
+		}
+		p.GIDs = append(p.GIDs, uint32(gid))
+	}
+	return &p, nil
+}
+
+var ErrPeerNotAllowed = errors.New("peer not allowed")
+
+// Allow returns nil if the peer's UID or primary GID is in the allowlist.
+func (p *PeerCreds) Allow(cred *syscall.Ucred) error {
+	if slices.Contains(p.UIDs, cred.Uid) || slices.Contains(p.GIDs, cred.Gid) {
+		return nil
+	}
+	return fmt.Errorf("%w: uid %d, gid %d", ErrPeerNotAllowed, cred.Uid, cred.Gid)
+}
+
+// PeerCredAuth rejects requests over unix domain sockets from peers that
+// aren't in the allowlist. Other requests are passed through.
+func PeerCredAuth(p *PeerCreds, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred := PeerCred(r)
+		if cred == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = WithLogAttrs(r, "peer_uid", cred.Uid, "peer_pid", cred.Pid)
+		if err := p.Allow(cred); err != nil {
+			Audit(r, "auth-peercred", "", err)
+			Error(w, r, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
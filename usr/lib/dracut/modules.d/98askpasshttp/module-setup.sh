@@ -9,6 +9,11 @@ depends() {
     return 0
 }
 
+installkernel() {
+    # For -listen vsock:PORT in virtual machines.
+    instmods vmw_vsock_virtio_transport
+}
+
 install() {
     inst_multiple \
         /usr/bin/askpass-http \
@@ -16,6 +21,56 @@ install() {
         "${systemdsystemunitdir}/askpass-http.service" \
         "${systemdsystemunitdir}/askpass-http.socket"
 
+    if [[ -f /etc/askpass-http/config.toml ]]; then
+        inst_simple /etc/askpass-http/config.toml
+    fi
+
+    # The -rules file, but not the secrets it refers to, which are left to
+    # install_items.
+    if [[ -f /etc/askpass-http/rules.toml ]]; then
+        inst_simple /etc/askpass-http/rules.toml
+    fi
+
+    # The -age-secrets file, which is encrypted.
+    if [[ -f /etc/askpass-http/secrets.age ]]; then
+        inst_simple /etc/askpass-http/secrets.age
+    fi
+
+    # The -fido2-token, which has nothing secret.
+    if [[ -f /etc/askpass-http/fido2.json ]]; then
+        inst_simple /etc/askpass-http/fido2.json
+    fi
+
+    # Encrypted credentials, which are only decrypted by the service. Plain
+    # ones in /etc/credstore are left out, to keep secrets out of the image.
+    for f in /etc/credstore.encrypted/askpass-http.*; do
+        [[ -f $f ]] && inst_simple "$f"
+    done
+
+    # The -tls-selfsigned certificate, so that it has the same fingerprint.
+    if [[ -f /etc/askpass-http/selfsigned.crt ]]; then
+        inst_simple /etc/askpass-http/selfsigned.crt
+        inst_simple /etc/askpass-http/selfsigned.key
+    fi
+
+    # Certificates obtained with -acme-domain, as of when the initramfs was
+    # built. Regenerate it after renewals.
+    if [[ -d /var/lib/askpass-http/acme ]]; then
+        inst_dir /var/lib/askpass-http/acme
+        find /var/lib/askpass-http/acme -type f -print0 | while IFS= read -r -d '' f; do
+            inst_simple "$f"
+        done
+    fi
+
+    # The -webpush-dir key and subscriptions, as of when the initramfs was
+    # built. Regenerate it after subscribing a new browser.
+    if [[ -d /var/lib/askpass-http/webpush ]]; then
+        inst_dir /var/lib/askpass-http/webpush
+        for f in /var/lib/askpass-http/webpush/*; do
+            [[ -f $f ]] && inst_simple "$f"
+        done
+    fi
+
     ln_r "${systemdsystemunitdir}/askpass-http.path" \
          "${systemdsystemunitdir}/sysinit.target.wants/askpass-http.path"
 }
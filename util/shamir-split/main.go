@@ -0,0 +1,48 @@
+// Command shamir-split splits a passphrase read from standard input into
+// shares for askpass-http's -shamir-threshold, printing one per line, to
+// be handed to a different person each:
+//
+//	shamir-split -n 5 -k 3 < passphrase.txt
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"jeremy.visser.name/go/askpass-http/shamir"
+)
+
+var (
+	parts     = flag.Int("n", 5, "Number of shares")
+	threshold = flag.Int("k", 3, "Number of shares needed to recover the passphrase")
+)
+
+func main() {
+	flag.Parse()
+	if err := split(os.Stdin, os.Stdout, *parts, *threshold); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// split reads the passphrase from r, and writes its shares to w.
+func split(r io.Reader, w io.Writer, parts, threshold int) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	shares, err := shamir.Split(bytes.TrimRight(b, "\r\n"), parts, threshold)
+	if err != nil {
+		return err
+	}
+	for _, s := range shares {
+		if _, err := fmt.Fprintln(w, base64.StdEncoding.EncodeToString(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"jeremy.visser.name/go/askpass-http/shamir"
+)
+
+func TestSplit(t *testing.T) {
+	var out bytes.Buffer
+	if err := split(strings.NewReader("hunter2\n"), &out, 5, 3); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(out.String())
+	if len(lines) != 5 {
+		t.Fatalf("got %d shares, want 5", len(lines))
+	}
+	var shares [][]byte
+	for _, l := range lines {
+		b, err := base64.StdEncoding.DecodeString(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, b)
+	}
+	for _, tt := range []struct {
+		shares [][]byte
+		ok     bool
+	}{
+		{shares[:3], true},
+		{shares[2:], true},
+		{[][]byte{shares[4], shares[0], shares[2]}, true},
+		{shares[:2], false},
+	} {
+		got, err := shamir.Combine(tt.shares)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The trailing newline isn't part of the passphrase:
+		if ok := string(got) == "hunter2"; ok != tt.ok {
+			t.Errorf("%d shares: recovered %q", len(tt.shares), got)
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	if err := split(strings.NewReader("hunter2"), new(bytes.Buffer), 2, 3); err == nil {
+		t.Error("split with threshold above parts succeeded")
+	}
+}
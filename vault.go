@@ -0,0 +1,253 @@
+package main
+
+// Secrets kept in HashiCorp Vault, so that a fleet's passphrases can be
+// managed centrally, and pulled by each machine at boot.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vault is nil unless -vault-addr is specified.
+var vault *Vault
+
+// Vault logs in to a Vault server with AppRole or TLS certificate auth, and
+// reads secrets with the resulting token.
+type Vault struct {
+	Addr      string // e.g. https://vault.example.com:8200
+	Namespace string // or "" for the root namespace
+	AuthMount string // path of the auth method, e.g. approle
+
+	roleID, secretIDFile string // for AppRole, or "" for cert auth
+	client               *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewVault returns a Vault for the server at addr, verified with the CAs in
+// caFile, if given. It logs in with AppRole if roleID is given, reading the
+// secret ID from secretIDFile, or otherwise with the client certificate in
+// certFile and keyFile. authMount defaults to approle or cert accordingly.
+func NewVault(addr, caFile, namespace, authMount, roleID, secretIDFile, certFile, keyFile string) (*Vault, error) {
+	if !strings.HasPrefix(addr, "https://") && !strings.HasPrefix(addr, "http://") {
+		return nil, fmt.Errorf("vault: %q is not an http:// or https:// URL", addr)
+	}
+	v := &Vault{
+		Addr:         strings.TrimSuffix(addr, "/"),
+		Namespace:    strings.Trim(namespace, "/"),
+		AuthMount:    strings.Trim(authMount, "/"),
+		roleID:       roleID,
+		secretIDFile: secretIDFile,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{}
+	if caFile > "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	switch {
+	case roleID > "":
+		if secretIDFile == "" {
+			return nil, errors.New("vault: an AppRole secret ID is required")
+		}
+		if v.AuthMount == "" {
+			v.AuthMount = "approle"
+		}
+	case certFile > "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		if v.AuthMount == "" {
+			v.AuthMount = "cert"
+		}
+	default:
+		return nil, errors.New("vault: either an AppRole role ID or a client certificate is required")
+	}
+	v.client = &http.Client{Transport: transport}
+	return v, nil
+}
+
+// call calls the API with the token, if not "", decoding the response's
+// data into v.
+func (v *Vault) call(ctx context.Context, method, path, token string, body, data any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.Addr+"/v1/"+path, r)
+	if err != nil {
+		return err
+	}
+	if token > "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.Namespace > "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := ResponseError(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(data)
+}
+
+// login returns a token, logging in again if the last one has expired.
+func (v *Vault) login(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token > "" && (v.expires.IsZero() || time.Now().Before(v.expires)) {
+		return v.token, nil
+	}
+	body := map[string]string{}
+	if v.roleID > "" {
+		// Read each time, in case it has been replaced:
+		b, err := os.ReadFile(v.secretIDFile)
+		if err != nil {
+			return "", err
+		}
+		body["role_id"] = v.roleID
+		body["secret_id"] = strings.TrimSpace(string(b))
+	}
+	var res struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := v.call(ctx, http.MethodPost, "auth/"+v.AuthMount+"/login", "", body, &res); err != nil {
+		return "", fmt.Errorf("logging in: %w", err)
+	}
+	v.token = res.Auth.ClientToken
+	v.expires = time.Time{}
+	if d := time.Duration(res.Auth.LeaseDuration) * time.Second; d > 0 {
+		// Leaving time to use it:
+		v.expires = time.Now().Add(d * 9 / 10)
+	}
+	return v.token, nil
+}
+
+// authCall calls the API after logging in, and again after logging in
+// afresh if the token has been revoked.
+func (v *Vault) authCall(ctx context.Context, method, path string, body, data any) error {
+	for attempt := 1; ; attempt++ {
+		token, err := v.login(ctx)
+		if err != nil {
+			return err
+		}
+		err = v.call(ctx, method, path, token, body, data)
+		var herr *HTTPError
+		if attempt == 1 && errors.As(err, &herr) && herr.StatusCode == http.StatusForbidden {
+			v.mu.Lock()
+			v.token = ""
+			v.mu.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+// vaultRef splits a secret's reference into its path and query.
+func vaultRef(ref string) (string, url.Values, error) {
+	path, query, _ := strings.Cut(ref, "?")
+	q, err := url.ParseQuery(query)
+	return path, q, err
+}
+
+// vaultKVSecret reads a field of a secret from a KV version 2 secrets
+// engine, given as MOUNT/PATH?field=FIELD, such as
+// secret/disks/data?field=passphrase. The field may be left out if the
+// secret has only one.
+func vaultKVSecret(ctx context.Context, ref string, _ Prompt) ([]byte, error) {
+	if vault == nil {
+		return nil, errors.New("vault: -vault-addr is not set")
+	}
+	path, q, err := vaultRef(ref)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	mount, path, ok := strings.Cut(strings.Trim(path, "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("vault: %q has no mount", ref)
+	}
+	var res struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := vault.authCall(ctx, http.MethodGet, mount+"/data/"+path, nil, &res); err != nil {
+		return nil, fmt.Errorf("vault: %s: %w", path, err)
+	}
+	field := q.Get("field")
+	if field == "" && len(res.Data.Data) == 1 {
+		for k := range res.Data.Data {
+			field = k
+		}
+	}
+	s, ok := res.Data.Data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault: %s: no string field %q", path, field)
+	}
+	return []byte(s), nil
+}
+
+// vaultTransitSecret decrypts a file of ciphertext, as returned by Vault's
+// transit secrets engine, such as vault:v1:..., with a key, given as
+// PATH?key=MOUNT/KEY, such as
+// /etc/askpass-http/data.vault?key=transit/disks.
+func vaultTransitSecret(ctx context.Context, ref string, _ Prompt) ([]byte, error) {
+	if vault == nil {
+		return nil, errors.New("vault: -vault-addr is not set")
+	}
+	path, q, err := vaultRef(ref)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	mount, key, ok := strings.Cut(strings.Trim(q.Get("key"), "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("vault: %q has no key=MOUNT/KEY", ref)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	body := map[string]string{"ciphertext": strings.TrimSpace(string(b))}
+	if err := vault.authCall(ctx, http.MethodPost, mount+"/decrypt/"+key, body, &res); err != nil {
+		return nil, fmt.Errorf("vault: decrypting %s: %w", path, err)
+	}
+	return base64.StdEncoding.DecodeString(res.Data.Plaintext)
+}
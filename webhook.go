@@ -0,0 +1,120 @@
+package main
+
+// Outbound webhooks, so that other automation can react to prompts coming
+// and going.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// WebhookEvent is the JSON body POSTed to webhooks.
+type WebhookEvent struct {
+	Event  string    `json:"event"` // prompt-created, prompt-answered, prompt-cancelled, prompt-expired or prompt-removed
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	URL    string    `json:"url,omitempty"` // of the page to answer it on
+	Prompt Prompt    `json:"prompt"`
+}
+
+// Webhooks POSTs a WebhookEvent to each URL. If Secret is set, the body is
+// signed with HMAC-SHA256, in the X-Askpass-Signature header as
+// sha256=HEX, like GitHub's webhooks.
+type Webhooks struct {
+	URLs   []string
+	Secret []byte
+}
+
+// NewWebhooks returns Webhooks for the urls, with the secret read from
+// secretFile, if given.
+func NewWebhooks(urls []string, secretFile string) (*Webhooks, error) {
+	for _, url := range urls {
+		if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+			return nil, fmt.Errorf("webhook: %q is not an http:// or https:// URL", url)
+		}
+	}
+	w := &Webhooks{URLs: urls}
+	if secretFile > "" {
+		b, err := os.ReadFile(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		w.Secret = bytes.TrimSpace(b)
+	}
+	return w, nil
+}
+
+// WebhookEventName returns the name of the WebhookEvent for e, or "" if
+// there isn't one.
+func WebhookEventName(e Event) string {
+	switch {
+	case e.Type == EventAdded:
+		return "prompt-created"
+	case e.Type == EventRemoved && e.Reason > "":
+		return "prompt-" + e.Reason
+	case e.Type == EventRemoved:
+		return "prompt-removed"
+	}
+	return ""
+}
+
+// Run sends events about the hub's prompts, linking to the PublicURL of
+// lsns. It doesn't return.
+func (w *Webhooks) Run(h *Hub, lsns []Listener) {
+	host, _ := os.Hostname()
+	events, _ := h.SubscribeAll()
+	for e := range events {
+		name := WebhookEventName(e)
+		if name == "" {
+			continue
+		}
+		body, err := json.Marshal(WebhookEvent{
+			Event:  name,
+			Time:   time.Now(),
+			Host:   host,
+			URL:    PublicURL(lsns),
+			Prompt: e.Prompt,
+		})
+		if err != nil {
+			panic(err)
+		}
+		for _, url := range w.URLs {
+			go func(url, name, prompt string) {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				if err := w.send(ctx, url, body); err != nil {
+					slog.Warn("Sending webhook", "url", url, "event", name, "prompt", prompt, "err", err)
+				}
+			}(url, name, e.Prompt.Name)
+		}
+	}
+}
+
+func (w *Webhooks) send(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.Secret) > 0 {
+		mac := hmac.New(sha256.New, w.Secret)
+		mac.Write(body)
+		req.Header.Set("X-Askpass-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return ResponseError(resp)
+}
@@ -0,0 +1,420 @@
+package main
+
+// Web Push notifications (RFC 8030), so that browsers that have subscribed
+// are told about new prompts even when the page isn't open.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var webPush *WebPush
+
+// maxPushSubscriptions is how many browsers each user may subscribe. Beyond
+// that, their oldest subscription is replaced.
+const maxPushSubscriptions = 10
+
+var ErrNotSubscriber = errors.New("subscribed by another user")
+
+// PushSubscription is a browser's subscription, from PushManager.subscribe.
+type PushSubscription struct {
+	Endpoint string    `json:"endpoint"`
+	P256DH   string    `json:"p256dh"` // base64url
+	Auth     string    `json:"auth"`   // base64url
+	User     string    `json:"user,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+}
+
+// WebPush sends notifications to the browsers that have subscribed. Its
+// VAPID key (RFC 8292) and the subscriptions are kept in a directory, so
+// that they survive restarts, and can be copied into the initramfs.
+type WebPush struct {
+	Subject string // contact for the push services, a mailto: or https: URL
+
+	dir  string
+	key  *ecdsa.PrivateKey
+	mu   sync.Mutex
+	subs map[string]PushSubscription // by endpoint
+}
+
+// OpenWebPush loads the VAPID key and subscriptions from dir, generating the
+// key if there isn't one yet.
+func OpenWebPush(dir, subject string) (*WebPush, error) {
+	wp := &WebPush{Subject: subject, dir: dir, subs: make(map[string]PushSubscription)}
+	keyPath := filepath.Join(dir, "vapid.key")
+	b, err := os.ReadFile(keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		if wp.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(wp.key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(keyPath, b, 0o600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data found", keyPath)
+		}
+		if wp.key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %w", keyPath, err)
+		}
+	}
+
+	var subs []PushSubscription
+	b, err = os.ReadFile(filepath.Join(dir, "subscriptions.json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &subs); err != nil {
+			return nil, fmt.Errorf("subscriptions.json: %w", err)
+		}
+	}
+	for _, s := range subs {
+		wp.subs[s.Endpoint] = s
+	}
+	return wp, nil
+}
+
+// PublicKey returns the VAPID public key, for PushManager.subscribe.
+func (wp *WebPush) PublicKey() string {
+	pub, err := wp.key.PublicKey.ECDH()
+	if err != nil {
+		panic(err) // P-256 is always supported
+	}
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// Subscribe adds a subscription for s.User, or replaces one of theirs,
+// returning ErrNotSubscriber if another user subscribed the endpoint. If the
+// user has too many, their oldest is removed.
+func (wp *WebPush) Subscribe(s PushSubscription) error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if old, ok := wp.subs[s.Endpoint]; ok && old.User != s.User {
+		return ErrNotSubscriber
+	}
+	delete(wp.subs, s.Endpoint)
+	var theirs []PushSubscription
+	for _, sub := range wp.subs {
+		if sub.User == s.User {
+			theirs = append(theirs, sub)
+		}
+	}
+	slices.SortFunc(theirs, func(a, b PushSubscription) int { return a.Created.Compare(b.Created) })
+	for len(theirs) >= maxPushSubscriptions {
+		delete(wp.subs, theirs[0].Endpoint)
+		theirs = theirs[1:]
+	}
+	wp.subs[s.Endpoint] = s
+	return wp.save()
+}
+
+// Unsubscribe removes a subscription of the user's, returning
+// ErrNotSubscriber if another user subscribed the endpoint.
+func (wp *WebPush) Unsubscribe(endpoint, user string) error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	s, ok := wp.subs[endpoint]
+	if !ok {
+		return nil
+	}
+	if s.User != user {
+		return ErrNotSubscriber
+	}
+	delete(wp.subs, endpoint)
+	return wp.save()
+}
+
+// remove removes a subscription, whoever's it is.
+func (wp *WebPush) remove(endpoint string) error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if _, ok := wp.subs[endpoint]; !ok {
+		return nil
+	}
+	delete(wp.subs, endpoint)
+	return wp.save()
+}
+
+// save must be called with wp.mu held.
+func (wp *WebPush) save() error {
+	subs := make([]PushSubscription, 0, len(wp.subs))
+	for _, s := range wp.subs {
+		subs = append(subs, s)
+	}
+	b, err := json.MarshalIndent(subs, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(wp.dir, "subscriptions.json")
+	if err := os.WriteFile(path+".tmp", b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// errGone is returned by send when the subscription no longer exists.
+var errGone = errors.New("subscription has expired")
+
+// Notify sends the notification to every subscription. Subscriptions that
+// the push service says no longer exist are removed.
+func (wp *WebPush) Notify(ctx context.Context, n Notification) error {
+	payload, err := pushPayload(n)
+	if err != nil {
+		return err
+	}
+	wp.mu.Lock()
+	subs := make([]PushSubscription, 0, len(wp.subs))
+	for _, s := range wp.subs {
+		subs = append(subs, s)
+	}
+	wp.mu.Unlock()
+
+	var errs []error
+	for _, s := range subs {
+		err := wp.send(ctx, s, payload)
+		if errors.Is(err, errGone) {
+			err = wp.remove(s.Endpoint)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Endpoint, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pushPayload returns the JSON message for the notification, for the
+// service worker to show.
+func pushPayload(n Notification) ([]byte, error) {
+	return json.Marshal(struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+		URL   string `json:"url,omitempty"`
+		Tag   string `json:"tag"`
+	}{n.Title, n.Message, n.URL, n.Prompt.Name})
+}
+
+func (wp *WebPush) send(ctx context.Context, s PushSubscription, payload []byte) error {
+	body, err := encryptPush(s, payload)
+	if err != nil {
+		return err
+	}
+	token, err := wp.vapidToken(s.Endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, wp.PublicKey()))
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", "3600")
+	req.Header.Set("Urgency", "high")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return errGone
+	}
+	return ResponseError(resp)
+}
+
+// vapidToken returns a JWT identifying us to the push service (RFC 8292).
+func (wp *WebPush) vapidToken(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}{u.Scheme + "://" + u.Host, time.Now().Add(12 * time.Hour).Unix(), wp.Subject})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, wp.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return input + "." + enc.EncodeToString(sig), nil
+}
+
+// encryptPush encrypts the payload for the subscription, using the
+// aes128gcm content coding (RFC 8291 and RFC 8188) in a single record.
+func encryptPush(s PushSubscription, payload []byte) ([]byte, error) {
+	as, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptPushWith(s, payload, as, salt)
+}
+
+// encryptPushWith is encryptPush with the given ephemeral key and salt,
+// which must be random but for testing.
+func encryptPushWith(s PushSubscription, payload []byte, as *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaPublic, err := decodeBase64URL(s.P256DH)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	authSecret, err := decodeBase64URL(s.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	ua, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := as.ECDH(ua)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := as.PublicKey().Bytes()
+
+	info := append([]byte("WebPush: info\x00"), uaPublic...)
+	info = append(info, asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, authSecret, info), ikm); err != nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(slices.Clip(salt), 0, 0, 0, 0, byte(len(asPublic)))
+	binary.BigEndian.PutUint32(header[16:20], 4096) // record size
+	header = append(header, asPublic...)
+	record := append(slices.Clip(payload), 2) // padding delimiter of the last record
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// decodeBase64URL decodes base64url, with or without padding, as browsers
+// differ.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// mayWebPush reports whether the request may subscribe to notifications,
+// which tell of each prompt, and have the server make requests to the
+// endpoint it gives. Only logged in users who may answer can.
+func mayWebPush(r *http.Request) bool {
+	return webPush != nil && User(r) > "" && MayAnswer(r)
+}
+
+// ServeWebPush subscribes the browser to notifications, or unsubscribes it
+// if the action is "unsubscribe".
+func ServeWebPush(w http.ResponseWriter, r *http.Request) {
+	if webPush == nil {
+		Error(w, r, "Web Push is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !mayWebPush(r) {
+		Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := CheckCSRF(r); err != nil {
+		Error(w, r, err.Error(), StatusCode(err))
+		return
+	}
+	endpoint := r.PostFormValue("endpoint")
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" {
+		Error(w, r, "Invalid endpoint", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if r.PostFormValue("action") == "unsubscribe" {
+		err = webPush.Unsubscribe(endpoint, User(r))
+	} else {
+		s := PushSubscription{
+			Endpoint: endpoint,
+			P256DH:   r.PostFormValue("p256dh"),
+			Auth:     r.PostFormValue("auth"),
+			User:     User(r),
+			Created:  time.Now(),
+		}
+		if _, err := encryptPush(s, nil); err != nil {
+			Error(w, r, "Invalid subscription: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = webPush.Subscribe(s)
+	}
+	if errors.Is(err, ErrNotSubscriber) {
+		Error(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The example in RFC 8291 section 5.
+var (
+	rfc8291Plaintext = "When I grow up, I want to be a watermelon"
+	rfc8291ASPrivate = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfc8291UAPrivate = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291UAPublic  = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfc8291Salt      = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfc8291Auth      = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfc8291Body      = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func mustDecodeBase64URL(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncryptPushRFC8291(t *testing.T) {
+	as, err := ecdh.P256().NewPrivateKey(mustDecodeBase64URL(t, rfc8291ASPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := PushSubscription{Endpoint: "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV", P256DH: rfc8291UAPublic, Auth: rfc8291Auth}
+	got, err := encryptPushWith(s, []byte(rfc8291Plaintext), as, mustDecodeBase64URL(t, rfc8291Salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustDecodeBase64URL(t, rfc8291Body); !bytes.Equal(got, want) {
+		t.Errorf("encryptPushWith =\n%s\nwant\n%s", base64.RawURLEncoding.EncodeToString(got), rfc8291Body)
+	}
+}
+
+// decryptPush decrypts a message from encryptPush, as the user agent would.
+func decryptPush(t *testing.T, body []byte) []byte {
+	t.Helper()
+	ua, err := ecdh.P256().NewPrivateKey(mustDecodeBase64URL(t, rfc8291UAPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, rs, idlen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	if rs != 4096 {
+		t.Errorf("record size = %d", rs)
+	}
+	as, err := ecdh.P256().NewPublicKey(body[21 : 21+idlen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := ua.ECDH(as)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := append([]byte("WebPush: info\x00"), ua.PublicKey().Bytes()...)
+	info = append(info, as.Bytes()...)
+	ikm := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, mustDecodeBase64URL(t, rfc8291Auth), info), ikm)
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek, nonce := make([]byte, 16), make([]byte, 12)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, nonce, body[21+idlen:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record) == 0 || record[len(record)-1] != 2 {
+		t.Fatalf("record %x doesn't end in the last record's delimiter", record)
+	}
+	return record[:len(record)-1]
+}
+
+func TestEncryptPush(t *testing.T) {
+	s := PushSubscription{P256DH: rfc8291UAPublic, Auth: rfc8291Auth}
+	payload := []byte(`{"title":"Password prompt"}`)
+	a, err := encryptPush(s, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encryptPush(s, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, b) {
+		t.Error("two encryptions are the same")
+	}
+	for _, body := range [][]byte{a, b} {
+		if got := decryptPush(t, body); !bytes.Equal(got, payload) {
+			t.Errorf("decrypted %q, want %q", got, payload)
+		}
+	}
+}
+
+func TestEncryptPushInvalid(t *testing.T) {
+	for name, s := range map[string]PushSubscription{
+		"bad p256dh":     {P256DH: "not base64!", Auth: rfc8291Auth},
+		"bad auth":       {P256DH: rfc8291UAPublic, Auth: "not base64!"},
+		"not on curve":   {P256DH: base64.RawURLEncoding.EncodeToString(append([]byte{4}, make([]byte, 64)...)), Auth: rfc8291Auth},
+		"wrong key size": {P256DH: rfc8291Auth, Auth: rfc8291Auth},
+	} {
+		if _, err := encryptPush(s, nil); err == nil {
+			t.Errorf("%s: encryptPush succeeded", name)
+		}
+	}
+}
+
+func TestVAPIDToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp := &WebPush{Subject: "mailto:admin@example.com", key: key}
+	token, err := wp.vapidToken("https://push.example.net/push/abc?x=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q isn't a JWS", token)
+	}
+	var header struct{ Typ, Alg string }
+	if err := json.Unmarshal(mustDecodeBase64URL(t, parts[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Alg != "ES256" {
+		t.Errorf("alg = %q", header.Alg)
+	}
+	var claims struct {
+		Aud string
+		Exp int64
+		Sub string
+	}
+	if err := json.Unmarshal(mustDecodeBase64URL(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != "https://push.example.net" || claims.Sub != wp.Subject {
+		t.Errorf("claims = %+v", claims)
+	}
+	// RFC 8292 limits tokens to 24 hours:
+	if exp := time.Unix(claims.Exp, 0); exp.Before(time.Now()) || exp.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("exp = %v", exp)
+	}
+	sig := mustDecodeBase64URL(t, parts[2])
+	if len(sig) != 64 {
+		t.Fatalf("signature is %d bytes", len(sig))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("signature doesn't verify")
+	}
+	// The public key given to browsers is the uncompressed point:
+	if pub := mustDecodeBase64URL(t, wp.PublicKey()); len(pub) != 65 || pub[0] != 4 {
+		t.Errorf("PublicKey() = %x", pub)
+	}
+}
+
+func TestWebPushSubscriptions(t *testing.T) {
+	wp, err := OpenWebPush(t.TempDir(), "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := func(endpoint, user string, age time.Duration) PushSubscription {
+		return PushSubscription{Endpoint: endpoint, P256DH: rfc8291UAPublic, Auth: rfc8291Auth, User: user, Created: time.Now().Add(-age)}
+	}
+	if err := wp.Subscribe(sub("https://push.example.net/a", "alice", 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the user who subscribed an endpoint can replace or remove it:
+	if err := wp.Subscribe(sub("https://push.example.net/a", "mallory", 0)); !errors.Is(err, ErrNotSubscriber) {
+		t.Errorf("Subscribe(someone else's) = %v, want ErrNotSubscriber", err)
+	}
+	if err := wp.Unsubscribe("https://push.example.net/a", "mallory"); !errors.Is(err, ErrNotSubscriber) {
+		t.Errorf("Unsubscribe(someone else's) = %v, want ErrNotSubscriber", err)
+	}
+	if err := wp.Subscribe(sub("https://push.example.net/a", "alice", 0)); err != nil {
+		t.Errorf("Subscribe(again) = %v", err)
+	}
+	if got := wp.subs["https://push.example.net/a"].User; got != "alice" {
+		t.Errorf("subscribed by %q", got)
+	}
+
+	// Beyond the limit, the user's oldest is replaced, and no one else's:
+	if err := wp.Subscribe(sub("https://push.example.net/b", "bob", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < maxPushSubscriptions+2; i++ {
+		if err := wp.Subscribe(sub(fmt.Sprintf("https://push.example.net/a%d", i), "alice", time.Duration(-i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var alice int
+	for _, s := range wp.subs {
+		if s.User == "alice" {
+			alice++
+		}
+	}
+	if alice != maxPushSubscriptions {
+		t.Errorf("alice has %d subscriptions, want %d", alice, maxPushSubscriptions)
+	}
+	for _, endpoint := range []string{"https://push.example.net/a", "https://push.example.net/a1"} {
+		if _, ok := wp.subs[endpoint]; ok {
+			t.Errorf("%s wasn't replaced", endpoint)
+		}
+	}
+	if _, ok := wp.subs["https://push.example.net/b"]; !ok {
+		t.Error("bob's subscription was replaced")
+	}
+
+	// They survive restarts:
+	again, err := OpenWebPush(wp.dir, wp.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.subs) != len(wp.subs) || again.PublicKey() != wp.PublicKey() {
+		t.Errorf("reopened with %d subscriptions, want %d", len(again.subs), len(wp.subs))
+	}
+
+	if err := wp.Unsubscribe("https://push.example.net/b", "bob"); err != nil {
+		t.Errorf("Unsubscribe = %v", err)
+	}
+	if err := wp.Unsubscribe("https://push.example.net/b", "bob"); err != nil {
+		t.Errorf("Unsubscribe(again) = %v", err)
+	}
+}
+
+func TestServeWebPush(t *testing.T) {
+	useTestSite(t, &Site{})
+	old := webPush
+	t.Cleanup(func() { webPush = old })
+	var err error
+	if webPush, err = OpenWebPush(t.TempDir(), "mailto:admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	page := httptest.NewRecorder()
+	token := CSRFToken(page, httptest.NewRequest("GET", "/", nil))
+	form := url.Values{csrfField: {token}, "endpoint": {"https://push.example.net/a"}, "p256dh": {rfc8291UAPublic}, "auth": {rfc8291Auth}}
+
+	for _, tt := range []struct {
+		name     string
+		user     string
+		readOnly bool
+		form     url.Values
+		wantCode int
+	}{
+		{"not logged in", "", false, form, http.StatusForbidden},
+		{"read-only", "alice", true, form, http.StatusForbidden},
+		{"subscribe", "alice", false, form, http.StatusNoContent},
+		{"someone else's", "mallory", false, form, http.StatusForbidden},
+		{"unsubscribe someone else's", "mallory", false, withAction(form, "unsubscribe"), http.StatusForbidden},
+		{"not https", "alice", false, withEndpoint(form, "http://127.0.0.1:8080/"), http.StatusBadRequest},
+		{"unsubscribe", "alice", false, withAction(form, "unsubscribe"), http.StatusNoContent},
+	} {
+		r := postForm("/webpush", tt.form, page)
+		if tt.user > "" {
+			r = WithUser(r, tt.user)
+		}
+		if tt.readOnly {
+			r = WithReadOnly(r)
+		}
+		w := httptest.NewRecorder()
+		ServeWebPush(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+	}
+	if len(webPush.subs) != 0 {
+		t.Errorf("subscriptions left: %v", webPush.subs)
+	}
+}
+
+func withAction(form url.Values, action string) url.Values {
+	form = maps.Clone(form)
+	form.Set("action", action)
+	return form
+}
+
+func withEndpoint(form url.Values, endpoint string) url.Values {
+	form = maps.Clone(form)
+	form.Set("endpoint", endpoint)
+	return form
+}